@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// JSONLinesSink writes every event as a line of JSON
+type JSONLinesSink struct {
+	w io.Writer
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+// OpenJSONLinesFile appends the events to the file, it's created if needed.
+// Only the owner can read it.
+func OpenJSONLinesFile(filename string) (*JSONLinesSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{w: f}, nil
+}
+
+// Every batch is one write, so lines from other processes don't interleave
+func (s *JSONLinesSink) Write(events []*core.AuditEvent) error {
+	var lines []byte
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	_, err := s.w.Write(lines)
+	return err
+}
+
+func (s *JSONLinesSink) Close() error {
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
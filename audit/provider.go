@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"net/http"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Provider records the outcomes of the wrapped provider's Check and Register.
+// Failed checks are recorded only for submissions, not for requests
+// that only display the login form.
+type Provider struct {
+	core.Provider
+
+	// Event's Source, e.g. "form"
+	Name    string
+	Auditor core.Auditor
+
+	// Optional. Providers don't return the user of a failed login,
+	// the attempted username is taken from this form field, e.g. "username".
+	UsernameField string
+
+	// Optional. Tells which requests are login attempts, core.IsSubmission by default.
+	Submission func(r *http.Request) bool
+}
+
+func (p *Provider) isSubmission(r *http.Request) bool {
+	if p.Submission != nil {
+		return p.Submission(r)
+	}
+	return core.IsSubmission(r)
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	user, err = p.Provider.Check(r)
+	if err != nil {
+		if !p.isSubmission(r) {
+			return
+		}
+
+		attempted := user
+		if attempted == "" && p.UsernameField != "" {
+			attempted = r.FormValue(p.UsernameField)
+		}
+		core.Audit(p.Auditor, core.NewAuditEvent(r, core.AuditLoginFailed, p.Name, attempted, err))
+	} else {
+		core.Audit(p.Auditor, core.NewAuditEvent(r, core.AuditLoginSucceeded, p.Name, user, nil))
+	}
+	return
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	user, err = p.Provider.Register(r)
+	if err != nil {
+		core.Audit(p.Auditor, core.NewAuditEvent(r, core.AuditRegistrationFailed, p.Name, user, err))
+	} else {
+		core.Audit(p.Auditor, core.NewAuditEvent(r, core.AuditUserRegistered, p.Name, user, nil))
+	}
+	return
+}
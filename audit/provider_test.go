@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/fail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &testSink{}
+	s, err := NewStream(Config{Sink: sink})
+	assert.Nil(err)
+
+	scripted := fail.NewScripted(fail.Result{User: "joe"}, fail.Result{Err: core.ErrorAuthenticationFailure}, fail.Result{Err: core.ErrorAuthenticationFailure})
+	scripted.QueueRegister(fail.Result{User: "ann"})
+
+	p := &Provider{Provider: scripted, Name: "form", Auditor: s, UsernameField: "username"}
+	var provider core.Provider = p
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(logging.WithRequestID(r.Context(), "req-1"))
+	user, err := provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	// Displaying the form isn't recorded
+	_, err = provider.Check(httptest.NewRequest("GET", "/?username=ann", nil))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	form := url.Values{"username": {"bob"}, "password": {"secret"}}
+	r = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	_, err = provider.Register(httptest.NewRequest("POST", "/register", nil))
+	assert.Nil(err)
+
+	assert.Nil(s.Close())
+	events := sink.events()
+	assert.Len(events, 3)
+
+	assert.Equal(core.AuditLoginSucceeded, events[0].Type)
+	assert.Equal("joe", events[0].User)
+	assert.Equal("form", events[0].Source)
+	assert.Equal("req-1", events[0].RequestID)
+
+	assert.Equal(core.AuditLoginFailed, events[1].Type)
+	assert.Equal("bob", events[1].User)
+	assert.Equal(core.ErrorAuthenticationFailure.Error(), events[1].Error)
+
+	assert.Equal(core.AuditUserRegistered, events[2].Type)
+	assert.Equal("ann", events[2].User)
+}
@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_audit_test.db3"
+	testLogName  = "/tmp/idp_audit_test.jsonl"
+)
+
+func consent() *core.AuditEvent {
+	e := core.NewAuditEvent(httptest.NewRequest("POST", "/consent", nil), core.AuditConsentGranted, "consent", "joe", nil)
+	e.Client = "app"
+	e.Scopes = []string{"openid", "offline"}
+	return e
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testLogName)
+
+	sink, err := OpenJSONLinesFile(testLogName)
+	assert.Nil(err)
+
+	failed := core.NewAuditEvent(nil, core.AuditLoginFailed, "form", "ann", core.ErrorAuthenticationFailure)
+	assert.Nil(sink.Write([]*core.AuditEvent{consent(), failed}))
+	assert.Nil(sink.Close())
+
+	// Appends
+	sink, err = OpenJSONLinesFile(testLogName)
+	assert.Nil(err)
+	assert.Nil(sink.Write([]*core.AuditEvent{consent()}))
+	assert.Nil(sink.Close())
+
+	info, err := os.Stat(testLogName)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	data, err := ioutil.ReadFile(testLogName)
+	assert.Nil(err)
+
+	var events []*core.AuditEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e core.AuditEvent
+		assert.Nil(json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, &e)
+	}
+
+	assert.Len(events, 3)
+	assert.Equal(core.AuditConsentGranted, events[0].Type)
+	assert.Equal([]string{"openid", "offline"}, events[0].Scopes)
+	assert.Equal("192.0.2.1:1234", events[0].RemoteAddr)
+	assert.Equal("authentication failure", events[1].Error)
+	assert.NotContains(string(data), `"client":""`)
+}
+
+func TestSQLSink(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	sink, err := NewSQLSink("sqlite3", testFileName)
+	assert.Nil(err)
+
+	assert.Nil(sink.Write([]*core.AuditEvent{consent(), consent()}))
+	assert.Nil(sink.Close())
+
+	db, err := sql.Open("sqlite3", testFileName)
+	assert.Nil(err)
+	defer db.Close()
+
+	var count int
+	var eventType, user, scopes string
+	err = db.QueryRow("SELECT COUNT(*), type, user, scopes FROM "+dbTablename).Scan(&count, &eventType, &user, &scopes)
+	assert.Nil(err)
+	assert.Equal(2, count)
+	assert.Equal("consent.granted", eventType)
+	assert.Equal("joe", user)
+	assert.Equal("openid offline", scopes)
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewWebhookSink(WebhookConfig{URL: "/audit"})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	status := http.StatusNoContent
+	var received []*core.AuditEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(Sign("secret", body), r.Header.Get(SignatureHeader))
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		assert.Nil(json.Unmarshal(body, &received))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(WebhookConfig{URL: server.URL, Secret: "secret"})
+	assert.Nil(err)
+
+	assert.Nil(sink.Write([]*core.AuditEvent{consent()}))
+	assert.Len(received, 1)
+	assert.Equal("app", received[0].Client)
+
+	status = http.StatusInternalServerError
+	assert.NotNil(sink.Write([]*core.AuditEvent{consent()}))
+}
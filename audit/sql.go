@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	dbTablename = "auditevents"
+)
+
+// SQLSink inserts the events into a table, a batch in one transaction
+type SQLSink struct {
+	db     *sql.DB
+	table  string
+	insert string
+}
+
+func NewSQLSink(driverName, databaseSourceName string) (*SQLSink, error) {
+	return NewSQLSinkWithTable(driverName, databaseSourceName, dbTablename)
+}
+
+func NewSQLSinkWithTable(driverName, databaseSourceName, table string) (*SQLSink, error) {
+	var s = new(SQLSink)
+	s.table = table
+
+	var err error
+	s.db, err = sql.Open(driverName, databaseSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStmt := `
+		CREATE TABLE IF NOT EXISTS %s (time        DATETIME NOT NULL,
+		                               type        VARCHAR(64) NOT NULL,
+		                               user        TEXT,
+		                               source      TEXT,
+		                               client      TEXT,
+		                               scopes      TEXT,
+		                               remote_addr TEXT,
+		                               request_id  TEXT,
+		                               error       TEXT);`
+
+	_, err = s.db.Exec(fmt.Sprintf(sqlStmt, s.table))
+	if err != nil {
+		return nil, err
+	}
+
+	s.insert = fmt.Sprintf("INSERT INTO %s (time, type, user, source, client, scopes, remote_addr, request_id, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", s.table)
+	return s, nil
+}
+
+func (s *SQLSink) Write(events []*core.AuditEvent) (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		_, err = stmt.Exec(e.Time, string(e.Type), e.User, e.Source, e.Client,
+			strings.Join(e.Scopes, " "), e.RemoteAddr, e.RequestID, e.Error)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,185 @@
+// Package audit delivers core.AuditEvents to sinks: JSON lines files, SQL tables and webhooks.
+package audit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+)
+
+const (
+	defaultBufferSize    = 1024
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+)
+
+// Sink stores the events. Write gets them in the order they happened.
+type Sink interface {
+	Write(events []*core.AuditEvent) error
+}
+
+// MultiSink writes to all sinks, even if some of them fail
+type MultiSink []Sink
+
+func (m MultiSink) Write(events []*core.AuditEvent) error {
+	var first error
+	for _, sink := range m {
+		err := sink.Write(events)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type Config struct {
+	Sink Sink
+
+	// Events waiting for the sink. When it's full new events are dropped,
+	// logins never wait for the sink.
+	BufferSize int
+
+	// Maximal number of events passed to one Sink.Write
+	BatchSize int
+
+	// Events are written at least this often
+	FlushInterval time.Duration
+
+	// Optional, gets the sink's errors
+	Logger logging.Logger
+}
+
+// Stream is a core.Auditor that buffers the events and writes them to the sink
+// in a background goroutine. Batches the sink failed to write are dropped.
+type Stream struct {
+	Config
+
+	events chan *core.AuditEvent
+	done   chan struct{}
+
+	// Guards closing the events channel
+	mutex  sync.RWMutex
+	closed bool
+
+	dropped uint64
+}
+
+func NewStream(c Config) (*Stream, error) {
+	if c.Sink == nil ||
+		c.BufferSize < 0 ||
+		c.BatchSize < 0 ||
+		c.FlushInterval < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.BufferSize == 0 {
+		c.BufferSize = defaultBufferSize
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+
+	s := &Stream{
+		Config: c,
+		events: make(chan *core.AuditEvent, c.BufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// Audit never blocks, the event is dropped if the buffer is full or the Stream is closed
+func (s *Stream) Audit(e *core.AuditEvent) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events that didn't reach the sink
+func (s *Stream) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*core.AuditEvent, 0, s.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := s.Sink.Write(batch)
+		if err != nil {
+			atomic.AddUint64(&s.dropped, uint64(len(batch)))
+			logging.Error(context.Background(), s.Logger, "writing audit events failed", logging.Fields{
+				"events": len(batch),
+				"error":  err,
+			})
+		}
+
+		// Sinks may keep the slice
+		batch = make([]*core.AuditEvent, 0, s.BatchSize)
+	}
+
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) >= s.BatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close writes the buffered events and closes the sink if it's an io.Closer
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.events)
+	s.mutex.Unlock()
+
+	<-s.done
+
+	if closer, ok := s.Sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Remembers the batches, blocks while locked
+type testSink struct {
+	sync.Mutex
+	batches [][]*core.AuditEvent
+	err     error
+}
+
+func (s *testSink) Write(events []*core.AuditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	s.batches = append(s.batches, events)
+	return s.err
+}
+
+func (s *testSink) events() []*core.AuditEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	var all []*core.AuditEvent
+	for _, batch := range s.batches {
+		all = append(all, batch...)
+	}
+	return all
+}
+
+func event(user string) *core.AuditEvent {
+	return core.NewAuditEvent(nil, core.AuditLoginSucceeded, "test", user, nil)
+}
+
+func TestNewStream(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewStream(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewStream(Config{Sink: &testSink{}, BufferSize: -1})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	s, err := NewStream(Config{Sink: &testSink{}})
+	assert.Nil(err)
+	assert.Equal(defaultBufferSize, s.BufferSize)
+	assert.Equal(defaultBatchSize, s.BatchSize)
+	assert.Equal(defaultFlushInterval, s.FlushInterval)
+	assert.Nil(s.Close())
+}
+
+func TestStream(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &testSink{}
+	s, err := NewStream(Config{Sink: sink, BatchSize: 2, FlushInterval: 10 * time.Millisecond})
+	assert.Nil(err)
+
+	s.Audit(event("joe"))
+	s.Audit(event("ann"))
+	s.Audit(event("bob"))
+
+	// Last one is flushed by the ticker
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(sink.batches, 2)
+	assert.Len(sink.batches[0], 2)
+
+	s.Audit(event("eve"))
+	assert.Nil(s.Close())
+	assert.Nil(s.Close())
+
+	events := sink.events()
+	assert.Len(events, 4)
+	for i, user := range []string{"joe", "ann", "bob", "eve"} {
+		assert.Equal(user, events[i].User)
+	}
+
+	// Closed
+	s.Audit(event("joe"))
+	assert.Equal(uint64(1), s.Dropped())
+}
+
+func TestStreamDoesntBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &testSink{}
+	sink.Lock()
+
+	s, err := NewStream(Config{Sink: sink, BufferSize: 2, BatchSize: 1})
+	assert.Nil(err)
+
+	// First one is taken by the stuck sink, two wait in the buffer
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			s.Audit(event("joe"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Audit blocked")
+	}
+
+	sink.Unlock()
+	assert.Nil(s.Close())
+	assert.Equal(uint64(10), uint64(len(sink.events()))+s.Dropped())
+	assert.True(s.Dropped() >= 7)
+}
+
+func TestStreamSinkFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &testSink{err: errors.New("disk full")}
+	s, err := NewStream(Config{Sink: MultiSink{sink, &testSink{}}})
+	assert.Nil(err)
+
+	s.Audit(event("joe"))
+	s.Audit(event("ann"))
+	assert.Nil(s.Close())
+
+	assert.Len(sink.events(), 2)
+	assert.Equal(uint64(2), s.Dropped())
+}
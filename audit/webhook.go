@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	SignatureHeader = "X-Audit-Signature"
+
+	defaultWebhookTimeout = 10 * time.Second
+)
+
+type WebhookConfig struct {
+	// Batches are POSTed here as a JSON array
+	URL string
+
+	// Optional. The body's HMAC-SHA256 is sent in the X-Audit-Signature header
+	// as "sha256=<hex>", so the receiver can tell the events are genuine.
+	Secret string
+
+	// Defaults to a client with Timeout
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+// WebhookSink sends the events to an HTTP endpoint.
+// Responses other than 2xx are errors.
+type WebhookSink struct {
+	WebhookConfig
+}
+
+func NewWebhookSink(c WebhookConfig) (*WebhookSink, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || !u.IsAbs() || c.Timeout < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultWebhookTimeout
+	}
+
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: c.Timeout}
+	}
+
+	return &WebhookSink{WebhookConfig: c}, nil
+}
+
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *WebhookSink) Write(events []*core.AuditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		r.Header.Set(SignatureHeader, Sign(s.Secret, body))
+	}
+
+	response, err := s.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// Lets the connection be reused
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook responded with %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/janekolszak/idp/config"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/htpasswd"
+	"github.com/janekolszak/idp/userdb/memory"
+)
+
+const connectTimeout = 10 * time.Second
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// Reads the files the configuration points to, nothing is written
+func checkFiles(conf *config.Config) error {
+	err := conf.ParseTemplates()
+	if err != nil {
+		return err
+	}
+
+	if conf.Users.Type == config.UsersHtpasswd {
+		var h htpasswd.Htpasswd
+		err = h.Load(conf.Users.Htpasswd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// OIDC discovers the upstream provider and magic links need the stores,
+	// they're built only by serve
+	switch conf.Provider.Type {
+	case config.ProviderOIDC, config.ProviderMagicLink:
+		return nil
+	}
+
+	// Providers read their files, e.g. the credentials of basic authentication
+	// or the SAML metadata. An empty store stands in for the users.
+	scratch, err := memory.NewMemStore()
+	if err != nil {
+		return err
+	}
+
+	_, err = conf.NewProvider(config.Components{Users: scratch})
+	return err
+}
+
+// Connects to Hydra and the stores
+func (c *cli) connect(conf *config.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	idp := core.NewIDP(conf.IDPConfig())
+	defer idp.Close()
+
+	err := idp.ConnectContext(ctx)
+	if err != nil {
+		return fmt.Errorf("hydra: %s", err)
+	}
+	fmt.Fprintln(c.stdout, "hydra: ok")
+
+	users, err := conf.NewUserStore()
+	if err != nil {
+		return fmt.Errorf("users: %s", err)
+	}
+	defer closeStore(users)
+
+	if p, ok := users.(pinger); ok {
+		err = p.PingContext(ctx)
+		if err != nil {
+			return fmt.Errorf("users: %s", err)
+		}
+	}
+	fmt.Fprintln(c.stdout, "users: ok")
+
+	cookies, err := conf.NewCookieStore()
+	if err != nil {
+		return fmt.Errorf("cookies: %s", err)
+	}
+	defer closeStore(cookies)
+
+	if p, ok := cookies.(pinger); ok {
+		err = p.PingContext(ctx)
+		if err != nil {
+			return fmt.Errorf("cookies: %s", err)
+		}
+	}
+	fmt.Fprintln(c.stdout, "cookies: ok")
+
+	return nil
+}
+
+func checkConfig(c *cli, args []string) error {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	connect := flags.Bool("connect", false, "connect to Hydra and the stores")
+
+	_, err := parse(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	conf, err := c.config()
+	if err != nil {
+		return err
+	}
+
+	err = checkFiles(conf)
+	if err != nil {
+		return err
+	}
+
+	if *connect {
+		err = c.connect(conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(c.stdout, "%s is valid\n", c.configPath)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Login with a remember me cookie or the provider, then the consent
+type handler struct {
+	idp            *core.IDP
+	provider       core.Provider
+	cookieProvider *cookie.CookieAuth
+	consent        *template.Template
+	logger         logging.Logger
+}
+
+func newHandler(idp *core.IDP, provider core.Provider, cookieProvider *cookie.CookieAuth, consent string, logger logging.Logger) (*handler, error) {
+	t, err := template.New("consent").Parse(consent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler{
+		idp:            idp,
+		provider:       provider,
+		cookieProvider: cookieProvider,
+		consent:        t,
+		logger:         logger,
+	}, nil
+}
+
+func (h *handler) attach(router *httprouter.Router) {
+	router.GET("/", h.challenge)
+	router.POST("/", h.challenge)
+	router.GET("/consent", h.consentGET)
+	router.POST("/consent", h.consentPOST)
+}
+
+func (h *handler) challenge(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	selector, user, err := h.cookieProvider.Check(r)
+	if err == nil {
+		err = h.cookieProvider.UpdateCookie(w, r, selector, user)
+		if err != nil {
+			logging.Error(r.Context(), h.logger, "renewing the remember me cookie failed", logging.Fields{"error": err})
+			h.provider.WriteError(w, r, err)
+			return
+		}
+	} else {
+		// No valid remember me cookie, for GET the form provider writes the form
+		user, err = h.provider.Check(r)
+		if err != nil {
+			h.provider.WriteError(w, r, err)
+			return
+		}
+
+		// Failure isn't fatal, the user logs in again next time
+		err = h.cookieProvider.SetCookie(w, r, user)
+		if err != nil {
+			logging.Warn(r.Context(), h.logger, "setting the remember me cookie failed", logging.Fields{"error": err})
+		}
+	}
+
+	challenge, err := h.idp.NewChallenge(r, user)
+	if err != nil {
+		logging.Info(r.Context(), h.logger, "bad challenge", logging.Fields{"error": err})
+		h.provider.WriteError(w, r, err)
+		return
+	}
+
+	err = challenge.Save(w, r)
+	if err != nil {
+		logging.Error(r.Context(), h.logger, "saving the challenge failed", logging.Fields{"error": err})
+		h.provider.WriteError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/consent", http.StatusFound)
+}
+
+func (h *handler) consentGET(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge, err := h.idp.GetChallenge(r)
+	if err != nil {
+		h.provider.WriteError(w, r, err)
+		return
+	}
+
+	err = h.consent.Execute(w, challenge)
+	if err != nil {
+		logging.Error(r.Context(), h.logger, "writing the consent page failed", logging.Fields{"error": err})
+	}
+}
+
+func (h *handler) consentPOST(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge, err := h.idp.GetChallenge(r)
+	if err != nil {
+		h.provider.WriteError(w, r, err)
+		return
+	}
+
+	if r.FormValue("answer") != "y" {
+		err = challenge.RefuseAccess(w, r)
+	} else {
+		err = challenge.GrantAccessToAll(w, r)
+	}
+
+	if err != nil {
+		logging.Error(r.Context(), h.logger, "answering the challenge failed", logging.Fields{"error": err})
+		h.provider.WriteError(w, r, err)
+	}
+}
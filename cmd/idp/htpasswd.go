@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/hasher"
+	"github.com/janekolszak/idp/userdb/htpasswd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Doesn't need the configuration, the entries can be added to the file by hand
+func htpasswdEntry(c *cli, args []string) error {
+	flags := flag.NewFlagSet("htpasswd", flag.ContinueOnError)
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+
+	args, err := parse(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	username := args[0]
+	if !htpasswd.ValidUser(username) {
+		return fmt.Errorf("%q can't be written to htpasswd: %s", username, core.ErrorBadRequest)
+	}
+
+	if *cost < bcrypt.MinCost || *cost > bcrypt.MaxCost {
+		return fmt.Errorf("cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	password, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+
+	hash, err := (&hasher.Bcrypt{Cost: *cost}).Hash(password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "%s:%s\n", username, hash)
+	return nil
+}
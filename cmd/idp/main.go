@@ -0,0 +1,180 @@
+// Command idp runs the identity provider for Hydra and manages its users.
+//
+// The IdP is configured with a YAML or JSON file and IDP_ environment variables,
+// see the config package. Run "idp help" for the commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/janekolszak/idp/config"
+)
+
+const defaultConfigPath = "/etc/idp/idp.yml"
+
+// Returned by commands called with wrong arguments
+var errUsage = errors.New("usage")
+
+// Streams and options shared by the commands, replaced in tests
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	configPath string
+}
+
+type command struct {
+	args string
+	help string
+	run  func(c *cli, args []string) error
+}
+
+var commands = map[string]*command{
+	"serve": {
+		help: "run the IdP",
+		run:  serve,
+	},
+	"check-config": {
+		args: "[-connect]",
+		help: "validate the configuration, -connect also pings the stores",
+		run:  checkConfig,
+	},
+	"useradd": {
+		args: "<username>",
+		help: "add a user to the configured store, the password is read from the terminal or stdin",
+		run:  userAdd,
+	},
+	"userdel": {
+		args: "<username>",
+		help: "delete a user and revoke the remember me cookies",
+		run:  userDel,
+	},
+	"passwd": {
+		args: "<username>",
+		help: "set the user's password, read from the terminal or stdin",
+		run:  passwd,
+	},
+	"htpasswd": {
+		args: "[-cost n] <username>",
+		help: "print an htpasswd entry with a bcrypt hash of the password",
+		run:  htpasswdEntry,
+	},
+	"sessions": {
+		args: "revoke <username>",
+		help: "delete the user's remember me cookies, the user has to log in again",
+		run:  sessions,
+	},
+}
+
+func (c *cli) usage() {
+	fmt.Fprintf(c.stderr, "Usage: idp [-config file] <command> [arguments]\n\n")
+	fmt.Fprintf(c.stderr, "The configuration defaults to $IDP_CONFIG or %s.\n\nCommands:\n", defaultConfigPath)
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(c.stderr, "  %s %s\n    \t%s\n", name, cmd.args, cmd.help)
+	}
+}
+
+// Loads the configuration, every command needs it
+func (c *cli) config() (*config.Config, error) {
+	return config.Load(c.configPath)
+}
+
+func (c *cli) printError(name string, err error) {
+	errs, ok := err.(config.Errors)
+	if !ok {
+		fmt.Fprintf(c.stderr, "idp %s: %s\n", name, err)
+		return
+	}
+
+	fmt.Fprintf(c.stderr, "idp %s: invalid configuration %s\n", name, c.configPath)
+	for _, e := range errs {
+		fmt.Fprintf(c.stderr, "  %s\n", e)
+	}
+}
+
+// Returns the exit code: 0 on success, 1 on errors and 2 on wrong arguments
+func (c *cli) run(args []string) int {
+	flags := flag.NewFlagSet("idp", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = c.usage
+
+	configPath := os.Getenv("IDP_CONFIG")
+	if configPath == "" {
+		configPath = defaultConfigPath
+	}
+	flags.StringVar(&c.configPath, "config", configPath, "configuration file")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	args = flags.Args()
+	if len(args) == 0 || args[0] == "help" {
+		c.usage()
+		return 2
+	}
+
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(c.stderr, "idp: unknown command %q\n", name)
+		c.usage()
+		return 2
+	}
+
+	err = cmd.run(c, args[1:])
+	switch err {
+	case nil:
+		return 0
+
+	case errUsage:
+		fmt.Fprintf(c.stderr, "Usage: idp %s %s\n", name, cmd.args)
+		return 2
+
+	default:
+		c.printError(name, err)
+		return 1
+	}
+}
+
+// Parses the command's flags and checks the number of the remaining arguments
+func parse(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != count {
+		return nil, errUsage
+	}
+
+	for _, arg := range flags.Args() {
+		if strings.HasPrefix(arg, "-") {
+			return nil, errUsage
+		}
+	}
+	return flags.Args(), nil
+}
+
+func main() {
+	c := &cli{
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	os.Exit(c.run(os.Args[1:]))
+}
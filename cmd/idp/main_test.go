@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/userdb/htpasswd"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testConfig   = "/tmp/idp_cmd_test.yml"
+	testHtpasswd = "/tmp/idp_cmd_test.htpasswd"
+	testCookieDB = "/tmp/idp_cmd_test.db3"
+)
+
+func setup(t *testing.T) {
+	os.Remove(testHtpasswd)
+	os.Remove(testCookieDB)
+
+	err := ioutil.WriteFile(testHtpasswd, nil, 0600)
+	assert.Nil(t, err)
+
+	err = ioutil.WriteFile(testConfig, []byte(`
+hydra:
+  client_id: idp
+  client_secret: secret
+challenge:
+  secret: 0123456789abcdef0123456789abcdef
+users:
+  htpasswd: `+testHtpasswd+`
+cookies:
+  dsn: `+testCookieDB+`
+provider:
+  form:
+    password:
+      min_length: 8
+      max_length: 100
+`), 0600)
+	assert.Nil(t, err)
+}
+
+// Runs the command with the input and returns the exit code, stdout and stderr
+func run(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	c := &cli{
+		stdin:  strings.NewReader(stdin),
+		stdout: &stdout,
+		stderr: &stderr,
+	}
+
+	code := c.run(append([]string{"-config", testConfig}, args...))
+	return code, stdout.String(), stderr.String()
+}
+
+func check(t *testing.T, username, password string) error {
+	var h htpasswd.Htpasswd
+	err := h.Load(testHtpasswd)
+	assert.Nil(t, err)
+	return h.Check(username, password)
+}
+
+func TestUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	code, _, stderr := run("")
+	assert.Equal(2, code)
+	assert.Contains(stderr, "Usage: idp")
+	assert.Contains(stderr, "sessions revoke <username>")
+
+	code, _, stderr = run("", "unknown")
+	assert.Equal(2, code)
+	assert.Contains(stderr, `unknown command "unknown"`)
+
+	code, _, stderr = run("", "useradd")
+	assert.Equal(2, code)
+	assert.Equal("Usage: idp useradd <username>\n", stderr)
+
+	code, _, _ = run("", "sessions", "list", "joe")
+	assert.Equal(2, code)
+}
+
+func TestHtpasswd(t *testing.T) {
+	assert := assert.New(t)
+
+	code, stdout, _ := run("password\n", "htpasswd", "-cost", "4", "joe")
+	assert.Equal(0, code)
+	assert.True(strings.HasPrefix(stdout, "joe:$2a$04$"))
+	assert.Nil(htpasswd.Compare(strings.TrimSpace(strings.TrimPrefix(stdout, "joe:")), "password"))
+
+	code, _, stderr := run("password\n", "htpasswd", "jo:e")
+	assert.Equal(1, code)
+	assert.Contains(stderr, "can't be written to htpasswd")
+
+	code, _, stderr = run("", "htpasswd", "joe")
+	assert.Equal(1, code)
+	assert.Equal("idp htpasswd: password is empty\n", stderr)
+}
+
+func TestUsers(t *testing.T) {
+	assert := assert.New(t)
+	setup(t)
+
+	code, stdout, _ := run("password\n", "useradd", "joe")
+	assert.Equal(0, code)
+	assert.Equal("added joe\n", stdout)
+	assert.Nil(check(t, "joe", "password"))
+
+	code, _, stderr := run("password\n", "useradd", "joe")
+	assert.Equal(1, code)
+	assert.Equal("idp useradd: user already exists\n", stderr)
+
+	// Form requires 8 characters
+	code, _, stderr = run("short\n", "passwd", "joe")
+	assert.Equal(1, code)
+	assert.Contains(stderr, "provider.form.password")
+
+	code, _, _ = run("new password\n", "passwd", "joe")
+	assert.Equal(0, code)
+	assert.Nil(check(t, "joe", "new password"))
+
+	code, _, stderr = run("password\n", "passwd", "ann")
+	assert.Equal(1, code)
+	assert.Equal("idp passwd: no such user\n", stderr)
+
+	// Deleting revokes the cookies
+	store, err := cookie.NewDBStore("sqlite3", testCookieDB)
+	assert.Nil(err)
+	defer store.Close()
+
+	selector, err := store.Insert("joe", "hash", time.Now().Add(time.Hour))
+	assert.Nil(err)
+
+	code, stdout, _ = run("", "userdel", "joe")
+	assert.Equal(0, code)
+	assert.Equal("deleted joe\n", stdout)
+	assert.NotNil(check(t, "joe", "new password"))
+
+	_, _, _, err = store.GetContext(context.Background(), selector)
+	assert.NotNil(err)
+
+	code, _, _ = run("", "userdel", "joe")
+	assert.Equal(1, code)
+}
+
+func TestSessions(t *testing.T) {
+	assert := assert.New(t)
+	setup(t)
+
+	store, err := cookie.NewDBStore("sqlite3", testCookieDB)
+	assert.Nil(err)
+	defer store.Close()
+
+	joe, err := store.Insert("joe", "hash", time.Now().Add(time.Hour))
+	assert.Nil(err)
+	ann, err := store.Insert("ann", "hash", time.Now().Add(time.Hour))
+	assert.Nil(err)
+
+	code, stdout, _ := run("", "sessions", "revoke", "joe")
+	assert.Equal(0, code)
+	assert.Equal("revoked the remember me cookies of joe\n", stdout)
+
+	_, _, _, err = store.GetContext(context.Background(), joe)
+	assert.NotNil(err)
+
+	user, _, _, err := store.GetContext(context.Background(), ann)
+	assert.Nil(err)
+	assert.Equal("ann", user)
+}
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+	setup(t)
+
+	code, stdout, _ := run("", "check-config")
+	assert.Equal(0, code)
+	assert.Equal(testConfig+" is valid\n", stdout)
+
+	// Every problem is listed
+	os.Setenv("IDP_CHALLENGE_SECRET", "short")
+	os.Setenv("IDP_USERS_TYPE", "mysql")
+	code, _, stderr := run("", "check-config")
+	os.Unsetenv("IDP_CHALLENGE_SECRET")
+	os.Unsetenv("IDP_USERS_TYPE")
+
+	assert.Equal(1, code)
+	assert.Equal("idp check-config: invalid configuration "+testConfig+"\n"+
+		"  challenge.secret: should have at least 32 bytes\n"+
+		"  users.type: \"mysql\" isn't one of htpasswd, rethinkdb, ldap\n", stderr)
+
+	os.Remove(testHtpasswd)
+	code, _, stderr = run("", "check-config")
+	assert.Equal(1, code)
+	assert.Contains(stderr, testHtpasswd)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/janekolszak/idp/audit"
+	"github.com/janekolszak/idp/config"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/health"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/metrics"
+	"github.com/janekolszak/idp/providers/basic"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/digest"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/janekolszak/idp/providers/magiclink"
+	"github.com/janekolszak/idp/providers/mtls"
+	"github.com/janekolszak/idp/providers/oidc"
+	"github.com/janekolszak/idp/providers/saml"
+	"github.com/janekolszak/idp/providers/totp"
+	"github.com/janekolszak/idp/providers/webauthn"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/ldap"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/janekolszak/idp/userdb/rethinkdb"
+	"github.com/janekolszak/idp/userdb/verifier"
+	"github.com/julienschmidt/httprouter"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	shutdownTimeout = 30 * time.Second
+
+	// The identity provider reads the service provider's keys here
+	samlMetadataPath = "/saml/metadata"
+)
+
+// Serves the verification page at the path of its URL and the resend form below it
+func attachVerifier(router *httprouter.Router, v *verifier.Verifier, verificationURL string) error {
+	u, err := url.Parse(verificationURL)
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	if path == "" {
+		return fmt.Errorf("verification: url needs a path, / is the login page")
+	}
+
+	router.HandlerFunc("GET", path, v.VerifyHandler)
+	router.HandlerFunc("POST", path+"/resend", v.ResendHandler)
+	return nil
+}
+
+// Reloads the htpasswd and htdigest files, e.g. after useradd
+func reload(conf *config.Config, users userdb.Store, provider core.Provider) error {
+	if store, ok := users.(*memory.Store); ok {
+		err := store.LoadHtpasswd(conf.Users.Htpasswd)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch p := provider.(type) {
+	case *basic.BasicAuth:
+		return p.Htpasswd.Load(conf.Users.Htpasswd)
+	case *digest.DigestAuth:
+		return p.Htdigest.Load(conf.Provider.Htdigest)
+	case *totp.Provider:
+		return reload(conf, nil, p.First)
+	case *webauthn.Provider:
+		if p.First != nil {
+			return reload(conf, nil, p.First)
+		}
+	}
+	return nil
+}
+
+// Passes the logger to the components that take one
+func setLogger(logger logging.Logger, components ...interface{}) {
+	for _, component := range components {
+		switch c := component.(type) {
+		case *form.FormAuth:
+			c.Logger = logger
+		case *basic.BasicAuth:
+			c.Logger = logger
+			c.Htpasswd.Logger = logger
+		case *digest.DigestAuth:
+			c.Logger = logger
+			c.Htdigest.Logger = logger
+		case *cookie.DBStore:
+			c.Logger = logger
+		case *cookie.RethinkDBStore:
+			c.Logger = logger
+		case *rethinkdb.Store:
+			c.Logger = logger
+		case *ldap.Store:
+			c.Logger = logger
+		case *oidc.Provider:
+			c.Logger = logger
+		case *saml.Provider:
+			c.Logger = logger
+		case *mtls.Provider:
+			c.Logger = logger
+		case *magiclink.Provider:
+			c.Logger = logger
+		case *totp.Provider:
+			c.Logger = logger
+			setLogger(logger, c.First)
+		case *webauthn.Provider:
+			c.Logger = logger
+			if c.First != nil {
+				setLogger(logger, c.First)
+			}
+		}
+	}
+}
+
+func serve(c *cli, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	levelName := flags.String("log-level", "info", "debug, info, warn or error")
+
+	_, err := parse(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	level, ok := logging.ParseLevel(*levelName)
+	if !ok {
+		return errUsage
+	}
+	logger := logging.NewJSONLogger(c.stderr, level)
+
+	conf, err := c.config()
+	if err != nil {
+		return err
+	}
+
+	m, err := metrics.New(metrics.Config{})
+	if err != nil {
+		return err
+	}
+
+	users, err := conf.NewUserStore()
+	if err != nil {
+		return fmt.Errorf("users: %s", err)
+	}
+	defer closeStore(users)
+
+	cookies, err := conf.NewCookieStore()
+	if err != nil {
+		return fmt.Errorf("cookies: %s", err)
+	}
+	defer closeStore(cookies)
+	setLogger(logger, users, cookies)
+
+	limiter, err := conf.NewLimiter()
+	if err != nil {
+		return fmt.Errorf("throttle: %s", err)
+	}
+	if limiter != nil {
+		defer closeStore(limiter.Users.Store)
+	}
+
+	mailer, err := conf.NewMailer()
+	if err != nil {
+		return fmt.Errorf("mail: %s", err)
+	}
+
+	auditConfig, err := conf.AuditConfig()
+	if err != nil {
+		return fmt.Errorf("audit: %s", err)
+	}
+
+	// Nil interface if the audit is disabled
+	var auditor core.Auditor
+	if auditConfig != nil {
+		auditConfig.Logger = logger
+
+		stream, err := audit.NewStream(*auditConfig)
+		if err != nil {
+			return fmt.Errorf("audit: %s", err)
+		}
+		// Closed after the verifier and the IdP stop, their last events are written
+		defer stream.Close()
+		auditor = stream
+	}
+
+	verifierConfig, err := conf.VerifierConfig(users, mailer)
+	if err != nil {
+		return fmt.Errorf("verification: %s", err)
+	}
+
+	var v *verifier.Verifier
+	if verifierConfig != nil {
+		defer closeStore(verifierConfig.Queue)
+		verifierConfig.Queue = &metrics.Queue{Queue: verifierConfig.Queue, Name: "verifications", Metrics: m}
+		verifierConfig.Logger = logger
+		verifierConfig.Auditor = auditor
+
+		v, err = verifier.NewVerifier(*verifierConfig)
+		if err != nil {
+			return fmt.Errorf("verification: %s", err)
+		}
+		v.Start()
+		defer v.Stop()
+	}
+
+	var tokens cookie.Store
+	if conf.Provider.Type == config.ProviderMagicLink {
+		tokens, err = conf.NewTokenStore()
+		if err != nil {
+			return fmt.Errorf("magic links: %s", err)
+		}
+		defer closeStore(tokens)
+		setLogger(logger, tokens)
+		tokens = &metrics.CookieStore{Store: tokens, Name: "magic_links", Metrics: m}
+	}
+
+	provider, err := conf.NewProvider(config.Components{
+		Users:    &metrics.UserStore{Store: users, Name: "users", Metrics: m},
+		Store:    users,
+		Limiter:  limiter,
+		Mailer:   mailer,
+		Tokens:   tokens,
+		Verifier: v,
+	})
+	if err != nil {
+		return fmt.Errorf("provider: %s", err)
+	}
+
+	setLogger(logger, provider)
+
+	consent, err := conf.ConsentTemplate()
+	if err != nil {
+		return err
+	}
+
+	idpConfig := conf.IDPConfig()
+	idpConfig.Logger = logger
+	idpConfig.Observer = m
+	idpConfig.Auditor = auditor
+
+	idp := core.NewIDP(idpConfig)
+	defer idp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	err = idp.ConnectContext(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("hydra: %s", err)
+	}
+
+	// provider stays unwrapped for reload and the type switches
+	observed := provider
+	if auditor != nil {
+		audited := &audit.Provider{Provider: provider, Name: conf.Provider.Type, Auditor: auditor}
+		if conf.Provider.Type == config.ProviderForm {
+			audited.UsernameField = conf.Provider.Form.UsernameField
+		}
+		observed = audited
+	}
+
+	cookieAuth := conf.NewCookieAuth(&metrics.CookieStore{Store: cookies, Name: "remember_me", Metrics: m})
+	cookieAuth.Auditor = auditor
+
+	h, err := newHandler(idp,
+		&metrics.Provider{Provider: observed, Name: conf.Provider.Type, Metrics: m},
+		cookieAuth, consent, logger)
+	if err != nil {
+		return err
+	}
+
+	checks := map[string]health.Check{"hydra": idp.Ready}
+	if p, ok := users.(pinger); ok {
+		checks["users"] = p.PingContext
+	}
+	if p, ok := cookies.(pinger); ok {
+		checks["cookies"] = p.PingContext
+	}
+	if v != nil {
+		checks["verifier"] = v.Ready
+	}
+
+	// Errors of the checks aren't shown on the public address
+	probes, err := health.New(health.Config{Checks: checks, HideErrors: conf.MetricsListen == ""})
+	if err != nil {
+		return err
+	}
+
+	router := httprouter.New()
+	h.attach(router)
+	router.HandlerFunc("GET", "/healthz", probes.Liveness)
+	if conf.MetricsListen == "" {
+		router.HandlerFunc("GET", "/readyz", probes.Readiness)
+	}
+	if v != nil {
+		err = attachVerifier(router, v, conf.Verification.URL)
+		if err != nil {
+			return err
+		}
+	}
+	if p, ok := provider.(*saml.Provider); ok {
+		router.HandlerFunc("GET", samlMetadataPath, p.ServeMetadata)
+	}
+	if conf.StaticFiles != "" {
+		router.ServeFiles("/static/*filepath", http.Dir(conf.StaticFiles))
+	}
+
+	// Metrics and the readiness of the dependencies aren't for the users,
+	// they're served on another address
+	if conf.MetricsListen != "" {
+		listener, err := net.Listen("tcp", conf.MetricsListen)
+		if err != nil {
+			return fmt.Errorf("metrics: %s", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		mux.HandleFunc("/readyz", probes.Readiness)
+		metricsServer := &http.Server{Handler: mux}
+		defer metricsServer.Close()
+
+		go metricsServer.Serve(listener)
+		logging.Info(context.Background(), logger, "serving metrics", logging.Fields{"address": conf.MetricsListen})
+	}
+
+	server := &http.Server{
+		Addr:    conf.Listen,
+		Handler: logging.RequestIDHandler(router),
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() {
+		for s := range signals {
+			if s == syscall.SIGHUP {
+				err := reload(conf, users, provider)
+				if err != nil {
+					logging.Error(context.Background(), logger, "reloading the users failed", logging.Fields{"error": err})
+				} else {
+					logging.Info(context.Background(), logger, "users reloaded", nil)
+				}
+				continue
+			}
+
+			// Requests in progress are finished
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			done <- server.Shutdown(ctx)
+			cancel()
+			return
+		}
+	}()
+
+	logging.Info(context.Background(), logger, "listening", logging.Fields{"address": conf.Listen})
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	return <-done
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func sessions(c *cli, args []string) error {
+	args, err := parse(flag.NewFlagSet("sessions", flag.ContinueOnError), args, 2)
+	if err != nil || args[0] != "revoke" {
+		return errUsage
+	}
+
+	conf, err := c.config()
+	if err != nil {
+		return err
+	}
+
+	username := args[1]
+	err = revoke(conf, username)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "revoked the remember me cookies of %s\n", username)
+	return nil
+}
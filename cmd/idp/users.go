@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/janekolszak/idp/config"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/hasher"
+	"github.com/janekolszak/idp/userdb/htpasswd"
+	"github.com/janekolszak/idp/userdb/rethinkdb"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	errEmptyPassword = errors.New("password is empty")
+	errLDAPUsers     = errors.New("LDAP users are managed in the directory")
+)
+
+// Users changed by the commands
+type userManager interface {
+	add(username, password string) error
+	setPassword(username, password string) error
+	delete(username string) error
+}
+
+// Edits the file, serve reloads it on SIGHUP
+type htpasswdUsers struct {
+	filename string
+	hasher   userdb.PasswordHasher
+}
+
+func (u *htpasswdUsers) add(username, password string) error {
+	return htpasswd.Edit(u.filename, username, func(hash string) (string, error) {
+		if hash != "" {
+			return "", core.ErrorUserAlreadyExists
+		}
+		return u.hasher.Hash(password)
+	})
+}
+
+func (u *htpasswdUsers) setPassword(username, password string) error {
+	return htpasswd.Edit(u.filename, username, func(hash string) (string, error) {
+		if hash == "" {
+			return "", core.ErrorNoSuchUser
+		}
+		return u.hasher.Hash(password)
+	})
+}
+
+func (u *htpasswdUsers) delete(username string) error {
+	return htpasswd.Edit(u.filename, username, func(hash string) (string, error) {
+		if hash == "" {
+			return "", core.ErrorNoSuchUser
+		}
+		return "", nil
+	})
+}
+
+type rethinkDBUsers struct {
+	store *rethinkdb.Store
+}
+
+func (u *rethinkDBUsers) add(username, password string) error {
+	return u.store.Add(username, password)
+}
+
+func (u *rethinkDBUsers) setPassword(username, password string) error {
+	return u.store.SetPassword(username, password)
+}
+
+func (u *rethinkDBUsers) delete(username string) error {
+	user, err := u.store.GetWithUsername(username)
+	if err != nil {
+		return err
+	}
+	return u.store.DeleteWithID(user.ID)
+}
+
+func users(conf *config.Config) (userManager, error) {
+	switch conf.Users.Type {
+	case config.UsersHtpasswd:
+		return &htpasswdUsers{filename: conf.Users.Htpasswd, hasher: hasher.NewDefault()}, nil
+
+	case config.UsersRethinkDB:
+		store, err := conf.NewUserStore()
+		if err != nil {
+			return nil, err
+		}
+		return &rethinkDBUsers{store: store.(*rethinkdb.Store)}, nil
+	}
+
+	return nil, errLDAPUsers
+}
+
+// Reads the password twice from the terminal, otherwise the first line of stdin
+func (c *cli) readPassword() (string, error) {
+	if f, ok := c.stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(c.stderr, "Password: ")
+		password, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.stderr)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprint(c.stderr, "Retype password: ")
+		confirm, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if string(password) != string(confirm) {
+			return "", core.ErrorPasswordMismatch
+		}
+		if len(password) == 0 {
+			return "", errEmptyPassword
+		}
+		return string(password), nil
+	}
+
+	line, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errEmptyPassword
+	}
+	return password, nil
+}
+
+// Users logging in with the form have to meet its requirements
+func checkComplexity(conf *config.Config, username, password string) error {
+	if conf.Provider.Type != config.ProviderForm {
+		return nil
+	}
+
+	f := conf.Provider.Form
+	usernameComplexity := form.Complexity{MinLength: f.Username.MinLength, MaxLength: f.Username.MaxLength, Patterns: f.Username.Patterns}
+	passwordComplexity := form.Complexity{MinLength: f.Password.MinLength, MaxLength: f.Password.MaxLength, Patterns: f.Password.Patterns}
+
+	if !usernameComplexity.Validate(username) {
+		return fmt.Errorf("username doesn't meet provider.form.username: %s", core.ErrorComplexityFailed)
+	}
+
+	if !passwordComplexity.Validate(password) {
+		return fmt.Errorf("password doesn't meet provider.form.password: %s", core.ErrorComplexityFailed)
+	}
+	return nil
+}
+
+// Parses the username argument and loads the configuration and the users
+func (c *cli) userCommand(name string, args []string) (*config.Config, userManager, string, error) {
+	args, err := parse(flag.NewFlagSet(name, flag.ContinueOnError), args, 1)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	conf, err := c.config()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	manager, err := users(conf)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return conf, manager, args[0], nil
+}
+
+func userAdd(c *cli, args []string) error {
+	conf, manager, username, err := c.userCommand("useradd", args)
+	if err != nil {
+		return err
+	}
+
+	password, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+
+	err = checkComplexity(conf, username, password)
+	if err != nil {
+		return err
+	}
+
+	err = manager.add(username, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "added %s\n", username)
+	return nil
+}
+
+func passwd(c *cli, args []string) error {
+	conf, manager, username, err := c.userCommand("passwd", args)
+	if err != nil {
+		return err
+	}
+
+	password, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+
+	err = checkComplexity(conf, username, password)
+	if err != nil {
+		return err
+	}
+
+	err = manager.setPassword(username, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "changed the password of %s\n", username)
+	return nil
+}
+
+func userDel(c *cli, args []string) error {
+	conf, manager, username, err := c.userCommand("userdel", args)
+	if err != nil {
+		return err
+	}
+
+	err = manager.delete(username)
+	if err != nil {
+		return err
+	}
+
+	// Cookies would still log the user in
+	err = revoke(conf, username)
+	if err != nil {
+		return fmt.Errorf("deleted %s, but revoking the remember me cookies failed: %s", username, err)
+	}
+
+	fmt.Fprintf(c.stdout, "deleted %s\n", username)
+	return nil
+}
+
+// Deletes the user's remember me cookies
+func revoke(conf *config.Config, username string) error {
+	store, err := conf.NewCookieStore()
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+
+	return store.DeleteUser(username)
+}
+
+func closeStore(store interface{}) {
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+}
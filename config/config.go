@@ -0,0 +1,529 @@
+// Package config defines the whole IdP in one schema loaded from a YAML or JSON file
+// and overridden with environment variables.
+//
+// Every field can be set with a variable named after its path, prefixed with IDP_,
+// e.g. IDP_HYDRA_CLIENT_SECRET sets hydra.client_secret. Durations are written like "10m",
+// lists are comma separated or YAML's flow sequences, e.g. ["^.{3,}$"].
+//
+// Factories, e.g. Config.IDPConfig and Config.NewProvider, build the library's types from the schema.
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/janekolszak/idp/helpers"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the names of variables overriding the fields
+const EnvPrefix = "IDP"
+
+// Types of the stores, providers and mailers
+const (
+	UsersHtpasswd  = "htpasswd"
+	UsersRethinkDB = "rethinkdb"
+	UsersLDAP      = "ldap"
+
+	CookiesSQL       = "sql"
+	CookiesRethinkDB = "rethinkdb"
+
+	ProviderForm      = "form"
+	ProviderBasic     = "basic"
+	ProviderDigest    = "digest"
+	ProviderOIDC      = "oidc"
+	ProviderSAML      = "saml"
+	ProviderMTLS      = "mtls"
+	ProviderMagicLink = "magiclink"
+	ProviderWebAuthn  = "webauthn"
+
+	FactorTOTP     = "totp"
+	FactorWebAuthn = "webauthn"
+
+	BindingRedirect = "redirect"
+	BindingPOST     = "post"
+
+	ThrottleMemory = "memory"
+	ThrottleSQL    = "sql"
+
+	QueueMemory    = "memory"
+	QueueSQL       = "sql"
+	QueueRethinkDB = "rethinkdb"
+
+	MailSMTP = "smtp"
+	MailFile = "file"
+	MailLog  = "log"
+
+	AuditJSONLines = "jsonlines"
+	AuditSQL       = "sql"
+	AuditWebhook   = "webhook"
+)
+
+type Hydra struct {
+	URL          string `yaml:"url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// Optional. Hydra's .hydra.yml with the credentials of the IdP,
+	// used when client_id and client_secret aren't set.
+	ConfigFile string `yaml:"config_file"`
+
+	KeyCacheExpiration    time.Duration `yaml:"key_cache_expiration"`
+	ClientCacheExpiration time.Duration `yaml:"client_cache_expiration"`
+	CacheCleanupInterval  time.Duration `yaml:"cache_cleanup_interval"`
+}
+
+// LoadConfigFile sets the credentials that aren't set from ConfigFile
+func (h *Hydra) LoadConfigFile() error {
+	if h.ConfigFile == "" || (h.ClientID != "" && h.ClientSecret != "") {
+		return nil
+	}
+
+	hydraConfig, err := helpers.LoadHydraConfig(h.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if h.ClientID == "" {
+		h.ClientID = hydraConfig.ClientID
+	}
+
+	if h.ClientSecret == "" {
+		h.ClientSecret = hydraConfig.ClientSecret
+	}
+
+	return nil
+}
+
+// Challenge cookies, kept between the login and the consent
+type Challenge struct {
+	// Authenticates the cookies, at least 32 bytes
+	Secret string `yaml:"secret"`
+
+	// Optional, encrypts the cookies. 16, 24 or 32 bytes.
+	EncryptionKey string `yaml:"encryption_key"`
+}
+
+type RethinkDB struct {
+	Address  string `yaml:"address"`
+	Database string `yaml:"database"`
+}
+
+type LDAP struct {
+	Address      string        `yaml:"address"`
+	UseTLS       bool          `yaml:"use_tls"`
+	StartTLS     bool          `yaml:"start_tls"`
+	BindDN       string        `yaml:"bind_dn"`
+	BindPassword string        `yaml:"bind_password"`
+	BaseDN       string        `yaml:"base_dn"`
+	UserFilter   string        `yaml:"user_filter"`
+	PoolSize     int           `yaml:"pool_size"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+type Users struct {
+	// htpasswd, rethinkdb or ldap
+	Type string `yaml:"type"`
+
+	// Credentials of the htpasswd store
+	Htpasswd string `yaml:"htpasswd"`
+
+	RethinkDB RethinkDB `yaml:"rethinkdb"`
+	LDAP      LDAP      `yaml:"ldap"`
+}
+
+// Remember me cookies
+type Cookies struct {
+	// sql or rethinkdb
+	Type string `yaml:"type"`
+
+	// database/sql driver and data source name of the sql store
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+
+	RethinkDB RethinkDB `yaml:"rethinkdb"`
+
+	// Optional, defaults to the store's table
+	Table string `yaml:"table"`
+
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type Complexity struct {
+	MinLength int      `yaml:"min_length"`
+	MaxLength int      `yaml:"max_length"`
+	Patterns  []string `yaml:"patterns"`
+}
+
+type Form struct {
+	UsernameField string `yaml:"username_field"`
+	PasswordField string `yaml:"password_field"`
+
+	Username Complexity `yaml:"username"`
+	Password Complexity `yaml:"password"`
+}
+
+type TOTP struct {
+	// Shown in authenticator apps next to the username
+	Issuer string `yaml:"issuer"`
+
+	Skew          int `yaml:"skew"`
+	RecoveryCodes int `yaml:"recovery_codes"`
+
+	// Time to enter the code after the first factor
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type WebAuthn struct {
+	// Relying party, the domain of the IdP
+	RPID   string `yaml:"rp_id"`
+	RPName string `yaml:"rp_name"`
+
+	// Origins of the login pages, e.g. https://login.example.com
+	Origins []string `yaml:"origins"`
+
+	// Required for the passwordless logins of the webauthn provider
+	RequireUserVerification bool `yaml:"require_user_verification"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Upstream OpenID Connect provider
+type OIDC struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// Callback registered at the upstream provider, the login page's URL
+	RedirectURL string   `yaml:"redirect_url"`
+	Scopes      []string `yaml:"scopes"`
+
+	// Create users logging in for the first time, otherwise only linked ones can
+	Provision bool `yaml:"provision"`
+
+	MaxAge    time.Duration `yaml:"max_age"`
+	ClockSkew time.Duration `yaml:"clock_skew"`
+}
+
+// SAML identity provider, the IdP is its service provider
+type SAML struct {
+	EntityID string `yaml:"entity_id"`
+
+	// Assertion consumer service, the login page's URL
+	ACSURL string `yaml:"acs_url"`
+
+	// File with the identity provider's metadata
+	IDPMetadata string `yaml:"idp_metadata"`
+
+	// redirect or post, sends the AuthnRequests
+	Binding string `yaml:"binding"`
+
+	// Optional. PEM files signing the AuthnRequests.
+	KeyFile         string `yaml:"key_file"`
+	CertificateFile string `yaml:"certificate_file"`
+
+	NameIDFormat string `yaml:"name_id_format"`
+
+	// Create users logging in for the first time, otherwise only linked ones can
+	Provision bool `yaml:"provision"`
+
+	MaxAge    time.Duration `yaml:"max_age"`
+	ClockSkew time.Duration `yaml:"clock_skew"`
+}
+
+// Client certificates, forwarded by the TLS terminating proxy
+type MTLS struct {
+	// Header with the certificate, e.g. X-SSL-Client-Cert
+	ProxyHeader    string   `yaml:"proxy_header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// PEM file with the CAs issuing the certificates
+	CAFile string `yaml:"ca_file"`
+
+	// Optional. Revocation lists of the CAs.
+	CRLFiles   []string `yaml:"crl_files"`
+	RequireCRL bool     `yaml:"require_crl"`
+
+	// Usernames by the certificate's subject DN, email address or fingerprint.
+	// Can't be set with the environment.
+	Subjects     map[string]string `yaml:"subjects"`
+	Emails       map[string]string `yaml:"emails"`
+	Fingerprints map[string]string `yaml:"fingerprints"`
+}
+
+// Login links sent by email, users are found by the address
+type MagicLink struct {
+	// Login page's URL
+	URL        string `yaml:"url"`
+	EmailField string `yaml:"email_field"`
+
+	// Email's subject and the file with the text/template of the body,
+	// the built in ones are used if empty
+	Subject  string `yaml:"subject"`
+	Template string `yaml:"template"`
+
+	MaxAge           time.Duration `yaml:"max_age"`
+	MaxPendingEmails int           `yaml:"max_pending_emails"`
+
+	// Table of the links in the cookies' database
+	Table string `yaml:"table"`
+}
+
+type Provider struct {
+	// form, basic, digest, oidc, saml, mtls, magiclink or webauthn
+	Type string `yaml:"type"`
+
+	// Optional. totp or webauthn, checked after the provider.
+	SecondFactor string `yaml:"second_factor"`
+
+	Form Form `yaml:"form"`
+
+	// Realm of the basic and digest authentication
+	Realm string `yaml:"realm"`
+
+	// Credentials of the digest authentication
+	Htdigest    string        `yaml:"htdigest"`
+	NonceMaxAge time.Duration `yaml:"nonce_max_age"`
+
+	// Optional, instances of the digest authentication sharing it accept each other's nonces
+	NonceSecret string `yaml:"nonce_secret"`
+
+	TOTP      TOTP      `yaml:"totp"`
+	WebAuthn  WebAuthn  `yaml:"webauthn"`
+	OIDC      OIDC      `yaml:"oidc"`
+	SAML      SAML      `yaml:"saml"`
+	MTLS      MTLS      `yaml:"mtls"`
+	MagicLink MagicLink `yaml:"magiclink"`
+}
+
+// Backoff of one throttle, the throttle's defaults are used for zeros
+type Backoff struct {
+	FreeFailures    int           `yaml:"free_failures"`
+	BaseDelay       time.Duration `yaml:"base_delay"`
+	MaxDelay        time.Duration `yaml:"max_delay"`
+	LockoutFailures int           `yaml:"lockout_failures"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	ResetAfter      time.Duration `yaml:"reset_after"`
+}
+
+// Throttles password guessing by username and by client IP
+type Throttle struct {
+	// memory or sql. Empty disables throttling.
+	Type string `yaml:"type"`
+
+	// database/sql driver and data source name of the sql store, shared by the replicas
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+
+	Users Backoff `yaml:"users"`
+	IPs   Backoff `yaml:"ips"`
+}
+
+// Email verification, needs mail
+type Verification struct {
+	// Queue of the verifications, memory, sql or rethinkdb. Empty disables verification.
+	Type string `yaml:"type"`
+
+	Driver    string    `yaml:"driver"`
+	DSN       string    `yaml:"dsn"`
+	RethinkDB RethinkDB `yaml:"rethinkdb"`
+
+	// Verification page, the links from the emails. The IdP serves it
+	// and its /resend subpath, which sends the email again.
+	URL string `yaml:"url"`
+
+	// Email's subject and the file with the text/template of the body,
+	// the built in ones are used if empty
+	Subject  string `yaml:"subject"`
+	Template string `yaml:"template"`
+
+	ResendInterval time.Duration `yaml:"resend_interval"`
+	MaxSendCount   int           `yaml:"max_send_count"`
+	TTL            time.Duration `yaml:"ttl"`
+	SweepInterval  time.Duration `yaml:"sweep_interval"`
+
+	// Unverified users can't log in after the grace period, needs users.type rethinkdb
+	RequireVerified bool          `yaml:"require_verified"`
+	GracePeriod     time.Duration `yaml:"grace_period"`
+}
+
+// Audit trail of logins, registrations, consents and remember me cookies
+type Audit struct {
+	// jsonlines, sql or webhook. Empty disables the audit.
+	Type string `yaml:"type"`
+
+	// Events are appended to this file by jsonlines
+	File string `yaml:"file"`
+
+	// database/sql driver, data source name and table of sql, the table defaults to auditevents
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+	Table  string `yaml:"table"`
+
+	// Batches are POSTed to the webhook's URL, signed with the secret if it's set
+	URL     string        `yaml:"url"`
+	Secret  string        `yaml:"secret"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Events are buffered and written in batches, logins don't wait for the sink
+	BufferSize    int           `yaml:"buffer_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// Paths to html/templates, the built in ones are used if empty
+type Templates struct {
+	// Gets form.LoginFormContext
+	Login string `yaml:"login"`
+
+	// Gets the core.Challenge
+	Consent string `yaml:"consent"`
+
+	// Gets totp.CodeFormContext
+	TOTP string `yaml:"totp"`
+
+	// Get webauthn.FormContext, required by webauthn
+	WebAuthnLogin    string `yaml:"webauthn_login"`
+	WebAuthnRegister string `yaml:"webauthn_register"`
+
+	// Gets magiclink.PageContext
+	MagicLink string `yaml:"magiclink"`
+}
+
+type SMTP struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type Mail struct {
+	// smtp, file or log. Empty disables emails.
+	Type string `yaml:"type"`
+
+	// Sender's address
+	From string `yaml:"from"`
+
+	SMTP SMTP `yaml:"smtp"`
+
+	// Emails are appended to this file by the file mailer
+	File string `yaml:"file"`
+}
+
+type Config struct {
+	// Address the IdP listens on
+	Listen string `yaml:"listen"`
+
+	// Optional. Address serving /metrics, e.g. 127.0.0.1:9100, apart from the public login pages.
+	// Metrics aren't exposed if it's empty.
+	MetricsListen string `yaml:"metrics_listen"`
+
+	// Optional, directory served as /static
+	StaticFiles string `yaml:"static_files"`
+
+	Hydra        Hydra        `yaml:"hydra"`
+	Challenge    Challenge    `yaml:"challenge"`
+	Users        Users        `yaml:"users"`
+	Cookies      Cookies      `yaml:"cookies"`
+	Provider     Provider     `yaml:"provider"`
+	Throttle     Throttle     `yaml:"throttle"`
+	Verification Verification `yaml:"verification"`
+	Audit        Audit        `yaml:"audit"`
+	Templates    Templates    `yaml:"templates"`
+	Mail         Mail         `yaml:"mail"`
+}
+
+// Default is the configuration of the examples, without the secrets
+func Default() *Config {
+	return &Config{
+		Listen: ":3000",
+		Hydra: Hydra{
+			URL:                   "https://hydra:4444",
+			KeyCacheExpiration:    10 * time.Minute,
+			ClientCacheExpiration: 10 * time.Minute,
+			CacheCleanupInterval:  30 * time.Second,
+		},
+		Users: Users{
+			Type:     UsersHtpasswd,
+			Htpasswd: "/etc/idp/htpasswd",
+		},
+		Cookies: Cookies{
+			Type:   CookiesSQL,
+			Driver: "sqlite3",
+			DSN:    "/etc/idp/remember.db3",
+			MaxAge: 30 * 24 * time.Hour,
+		},
+		Provider: Provider{
+			Type: ProviderForm,
+			Form: Form{
+				UsernameField: "username",
+				PasswordField: "password",
+				Username:      Complexity{MinLength: 1, MaxLength: 100},
+				Password:      Complexity{MinLength: 1, MaxLength: 100},
+			},
+			Realm:       "IdP",
+			NonceMaxAge: 5 * time.Minute,
+		},
+	}
+}
+
+// Decode overrides the fields set in the document. JSON is converted to YAML,
+// so durations are written the same way in both. Unknown fields are errors.
+func (c *Config) Decode(data []byte, isJSON bool) error {
+	if isJSON {
+		var document interface{}
+		err := json.Unmarshal(data, &document)
+		if err != nil {
+			return err
+		}
+
+		data, err = yaml.Marshal(document)
+		if err != nil {
+			return err
+		}
+	}
+
+	return yaml.UnmarshalStrict(data, c)
+}
+
+// DecodeFile decodes files with the .json extension as JSON, others as YAML
+func (c *Config) DecodeFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return c.Decode(data, strings.ToLower(filepath.Ext(path)) == ".json")
+}
+
+// Load reads the defaults overridden with the file, if path isn't empty,
+// and then with the environment. The result is validated.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		err := c.DecodeFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.LoadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Hydra.LoadConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
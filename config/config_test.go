@@ -0,0 +1,544 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/audit"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/janekolszak/idp/providers/mtls"
+	"github.com/janekolszak/idp/providers/saml"
+	"github.com/janekolszak/idp/providers/totp"
+	"github.com/janekolszak/idp/providers/webauthn"
+	"github.com/janekolszak/idp/userdb/verifier"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testSecret   = "0123456789abcdef0123456789abcdef"
+	testHtpasswd = "/tmp/idp_config_test.htpasswd"
+	testCookieDB = "/tmp/idp_config_test.db3"
+	testHydra    = "/tmp/idp_config_test.hydra.yml"
+	testAudit    = "/tmp/idp_config_test.audit.jsonl"
+
+	// Password "password"
+	testEntry = "joe:$2y$05$oHxU0ruGKexixZrm6uDFMOtSFKQIpesi.iW/K6CY/2fcwwZ7F13TK\n"
+)
+
+func writeFile(t *testing.T, path, content string) string {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	assert.Nil(t, err)
+	return path
+}
+
+func env(variables map[string]string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+func valid() *Config {
+	c := Default()
+	c.Hydra.ClientID = "idp"
+	c.Hydra.ClientSecret = "secret"
+	c.Challenge.Secret = testSecret
+	c.Users.Htpasswd = testHtpasswd
+	c.Cookies.DSN = testCookieDB
+	return c
+}
+
+func TestDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Default()
+	err := c.Decode([]byte(`
+hydra:
+  url: https://hydra.example.com
+  key_cache_expiration: 1m
+provider:
+  form:
+    username:
+      patterns: ["^[a-z]+$"]
+`), false)
+	assert.Nil(err)
+	assert.Equal("https://hydra.example.com", c.Hydra.URL)
+	assert.Equal(time.Minute, c.Hydra.KeyCacheExpiration)
+	assert.Equal([]string{"^[a-z]+$"}, c.Provider.Form.Username.Patterns)
+
+	// Not in the document
+	assert.Equal(10*time.Minute, c.Hydra.ClientCacheExpiration)
+	assert.Equal(100, c.Provider.Form.Username.MaxLength)
+
+	err = c.Decode([]byte(`{"hydra": {"client_cache_expiration": "2m"}, "cookies": {"max_age": "1h"}}`), true)
+	assert.Nil(err)
+	assert.Equal(2*time.Minute, c.Hydra.ClientCacheExpiration)
+	assert.Equal(time.Hour, c.Cookies.MaxAge)
+
+	// Typos aren't ignored
+	err = c.Decode([]byte("hydra:\n  clientid: idp\n"), false)
+	assert.NotNil(err)
+
+	err = c.Decode([]byte(`{"hydra": {"clientid": "idp"}}`), true)
+	assert.NotNil(err)
+}
+
+func TestEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Default()
+	err := c.loadEnv(env(map[string]string{
+		"IDP_HYDRA_CLIENT_SECRET":             "secret",
+		"IDP_HYDRA_KEY_CACHE_EXPIRATION":      "1m",
+		"IDP_USERS_LDAP_START_TLS":            "true",
+		"IDP_USERS_LDAP_POOL_SIZE":            "3",
+		"IDP_PROVIDER_FORM_USERNAME_PATTERNS": "^[a-z]+$, ^[^@]+$",
+		"IDP_PROVIDER_FORM_PASSWORD_PATTERNS": `["^.{3,}$", "[0-9]"]`,
+	}))
+	assert.Nil(err)
+	assert.Equal("secret", c.Hydra.ClientSecret)
+	assert.Equal(time.Minute, c.Hydra.KeyCacheExpiration)
+	assert.True(c.Users.LDAP.StartTLS)
+	assert.Equal(3, c.Users.LDAP.PoolSize)
+	assert.Equal([]string{"^[a-z]+$", "^[^@]+$"}, c.Provider.Form.Username.Patterns)
+	assert.Equal([]string{"^.{3,}$", "[0-9]"}, c.Provider.Form.Password.Patterns)
+
+	err = c.loadEnv(env(map[string]string{"IDP_COOKIES_MAX_AGE": "forever"}))
+	assert.NotNil(err)
+	assert.True(strings.HasPrefix(err.Error(), "IDP_COOKIES_MAX_AGE: "))
+}
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	writeFile(t, testHydra, "client_id: idp\nclient_secret: hydra-secret\n")
+	path := writeFile(t, "/tmp/idp_config_test.yml", `
+hydra:
+  config_file: `+testHydra+`
+  client_secret: file-secret
+challenge:
+  secret: `+testSecret+`
+`)
+
+	os.Setenv("IDP_HYDRA_CLIENT_SECRET", "env-secret")
+	c, err := Load(path)
+	os.Unsetenv("IDP_HYDRA_CLIENT_SECRET")
+	assert.Nil(err)
+	assert.Equal("idp", c.Hydra.ClientID)
+	assert.Equal("env-secret", c.Hydra.ClientSecret)
+
+	_, err = Load("/tmp/idp_config_test_missing.yml")
+	assert.NotNil(err)
+
+	// Secrets aren't set
+	_, err = Load("")
+	errs, ok := err.(Errors)
+	assert.True(ok)
+	assert.Contains(err.Error(), "hydra.client_id: required")
+	assert.Contains(err.Error(), "challenge.secret: ")
+	assert.Equal(3, len(errs))
+}
+
+func TestExample(t *testing.T) {
+	assert := assert.New(t)
+
+	c := Default()
+	assert.Nil(c.DecodeFile("idp.example.yml"))
+
+	// Only the secrets are missing
+	assert.Nil(c.loadEnv(env(map[string]string{
+		"IDP_HYDRA_CLIENT_ID":     "idp",
+		"IDP_HYDRA_CLIENT_SECRET": "secret",
+		"IDP_CHALLENGE_SECRET":    testSecret,
+	})))
+	assert.Nil(c.Validate())
+
+	// Defaults are documented
+	example := *c
+	c = Default()
+	c.Hydra = example.Hydra
+	c.Challenge = example.Challenge
+	c.Users.RethinkDB = example.Users.RethinkDB
+	c.Users.LDAP = example.Users.LDAP
+	c.Cookies.RethinkDB = example.Cookies.RethinkDB
+	c.Provider.Htdigest = example.Provider.Htdigest
+	c.Provider.TOTP = example.Provider.TOTP
+	c.Provider.WebAuthn = example.Provider.WebAuthn
+	c.Provider.OIDC = example.Provider.OIDC
+	c.Provider.SAML = example.Provider.SAML
+	c.Provider.MTLS = example.Provider.MTLS
+	c.Provider.MagicLink = example.Provider.MagicLink
+	c.Throttle = example.Throttle
+	c.Verification = example.Verification
+	c.Audit = example.Audit
+	c.Mail = example.Mail
+	assert.Equal(*c, example)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(valid().Validate())
+
+	check := func(modify func(c *Config), problems ...string) {
+		c := valid()
+		modify(c)
+
+		err := c.Validate()
+		errs, ok := err.(Errors)
+		if !assert.True(ok, "%v", problems) {
+			return
+		}
+
+		var messages []string
+		for _, e := range errs {
+			messages = append(messages, e.Error())
+		}
+		assert.Equal(problems, messages)
+	}
+
+	check(func(c *Config) { c.Listen = "3000" },
+		"listen: should be host:port, address 3000: missing port in address")
+
+	check(func(c *Config) { c.MetricsListen = c.Listen },
+		"metrics_listen: is the same as listen")
+
+	check(func(c *Config) { c.Hydra.URL = "hydra:4444"; c.Hydra.CacheCleanupInterval = 0 },
+		"hydra.url: should be an absolute URL, e.g. https://hydra:4444",
+		"hydra.cache_cleanup_interval: should be positive")
+
+	check(func(c *Config) { c.Challenge.Secret = "short"; c.Challenge.EncryptionKey = "short" },
+		"challenge.secret: should have at least 32 bytes",
+		"challenge.encryption_key: should have 16, 24 or 32 bytes")
+
+	check(func(c *Config) { c.Users.Type = "mysql" },
+		`users.type: "mysql" isn't one of htpasswd, rethinkdb, ldap`)
+
+	check(func(c *Config) {
+		c.Users.Type = UsersLDAP
+		c.Users.LDAP = LDAP{Address: "ldap:389", UseTLS: true, StartTLS: true, UserFilter: "(uid=joe)"}
+	},
+		"users.ldap.base_dn: required",
+		"users.ldap.start_tls: can't be used with use_tls",
+		"users.ldap.user_filter: should have one %s, e.g. (uid=%s)")
+
+	check(func(c *Config) { c.Cookies.Type = CookiesRethinkDB; c.Cookies.MaxAge = 0 },
+		"cookies.max_age: should be positive",
+		"cookies.rethinkdb.address: required",
+		"cookies.rethinkdb.database: required")
+
+	check(func(c *Config) {
+		c.Provider.Form.PasswordField = "username"
+		c.Provider.Form.Password = Complexity{MinLength: 8, MaxLength: 4, Patterns: []string{"("}}
+	},
+		"provider.form.password_field: is the same as username_field",
+		"provider.form.password.max_length: is less than min_length",
+		"provider.form.password.patterns[0]: error parsing regexp: missing closing ): `(`")
+
+	check(func(c *Config) {
+		c.Provider.Type = ProviderBasic
+		c.Users.Type = UsersRethinkDB
+		c.Users.RethinkDB = RethinkDB{"db:28015", "idp"}
+	},
+		"provider.type: basic authentication reads users.htpasswd, users.type should be htpasswd")
+
+	check(func(c *Config) { c.Provider.Type = ProviderDigest; c.Provider.Realm = "" },
+		"provider.realm: required",
+		"provider.htdigest: required")
+
+	check(func(c *Config) {
+		c.Provider.SecondFactor = FactorTOTP
+		c.Users.Type = UsersLDAP
+		c.Users.LDAP = LDAP{Address: "ldap:389", BaseDN: "dc=example,dc=com"}
+	},
+		"provider.totp.issuer: required",
+		"provider.second_factor: totp needs users.type htpasswd or rethinkdb")
+
+	check(func(c *Config) {
+		c.Provider.Type = ProviderWebAuthn
+		c.Provider.WebAuthn = WebAuthn{RPID: "example.com", Origins: []string{"example.com"}}
+	},
+		"provider.webauthn.require_user_verification: required by passwordless logins",
+		"provider.webauthn.origins[0]: should be an absolute URL",
+		"templates.webauthn_login: required")
+
+	check(func(c *Config) { c.Provider.Type = ProviderMTLS; c.Provider.MTLS.TrustedProxies = []string{"10.0.0.1"} },
+		"provider.mtls.proxy_header: required",
+		"provider.mtls.ca_file: required",
+		"provider.mtls.trusted_proxies[0]: invalid CIDR address: 10.0.0.1",
+		"provider.mtls: subjects, emails or fingerprints should map certificates to users")
+
+	check(func(c *Config) { c.Provider.Type = ProviderMagicLink },
+		"provider.magiclink.url: should be an absolute URL",
+		"mail.type: required by the magiclink provider",
+		"provider.type: magic links find users by the email address, users.type should be rethinkdb")
+
+	check(func(c *Config) { c.Throttle = Throttle{Type: ThrottleSQL, Users: Backoff{FreeFailures: -1}} },
+		"throttle.driver: required",
+		"throttle.dsn: required",
+		"throttle.users.free_failures: can't be negative")
+
+	check(func(c *Config) { c.Verification = Verification{Type: QueueMemory, RequireVerified: true} },
+		"verification.url: should be an absolute URL",
+		"mail.type: required by the verification",
+		"verification.require_verified: users.type should be rethinkdb")
+
+	check(func(c *Config) { c.Audit = Audit{Type: AuditSQL, BatchSize: -1} },
+		"audit.driver: required",
+		"audit.dsn: required",
+		"audit.batch_size: can't be negative")
+
+	check(func(c *Config) { c.Audit = Audit{Type: AuditWebhook, URL: "/events"} },
+		"audit.url: should be an absolute URL")
+
+	check(func(c *Config) { c.Mail.Type = MailSMTP; c.Mail.SMTP.Password = "secret" },
+		"mail.smtp.address: required",
+		"mail.from: required",
+		"mail.smtp.username: required with the password")
+}
+
+func TestFactories(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testCookieDB)
+	writeFile(t, testHtpasswd, testEntry)
+
+	c := valid()
+
+	idpConfig := c.IDPConfig()
+	assert.Equal("https://hydra:4444", idpConfig.ClusterURL)
+	assert.Equal("secret", idpConfig.ClientSecret)
+	assert.NotNil(idpConfig.ChallengeStore)
+
+	users, err := c.NewUserStore()
+	assert.Nil(err)
+	assert.Nil(users.Check("joe", "password"))
+
+	store, err := c.NewCookieStore()
+	assert.Nil(err)
+	defer store.(*cookie.DBStore).Close()
+	assert.Equal(c.Cookies.MaxAge, c.NewCookieAuth(store).MaxAge)
+
+	provider, err := c.NewProvider(Components{Users: users})
+	assert.Nil(err)
+	assert.Equal("username", provider.(*form.FormAuth).LoginUsernameField)
+	assert.Contains(provider.(*form.FormAuth).LoginForm, `name="password"`)
+
+	form := url.Values{"username": {"joe"}, "password": {"password"}}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	user, err := provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	c.Provider.Type = ProviderBasic
+	_, err = c.NewProvider(Components{})
+	assert.Nil(err)
+
+	c.Users.Htpasswd = "/tmp/idp_config_test_missing"
+	_, err = c.NewUserStore()
+	assert.NotNil(err)
+
+	c.Users.Type = "mysql"
+	_, err = c.NewUserStore()
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	mailer, err := c.NewMailer()
+	assert.Nil(err)
+	assert.Nil(mailer)
+
+	c.Mail = Mail{Type: MailSMTP, From: "idp@example.com", SMTP: SMTP{Address: "smtp.example.com:587", Username: "idp"}}
+	mailer, err = c.NewMailer()
+	assert.Nil(err)
+	assert.Equal("smtp.example.com:587", mailer.(*mail.SMTPMailer).Address)
+	assert.NotNil(mailer.(*mail.SMTPMailer).Auth)
+}
+
+// Self-signed CA in a PEM file
+func writeCA(t *testing.T, path string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	writeFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	return certificate
+}
+
+func TestProviderFactories(t *testing.T) {
+	assert := assert.New(t)
+	writeFile(t, testHtpasswd, testEntry)
+
+	c := valid()
+	users, err := c.NewUserStore()
+	assert.Nil(err)
+
+	// Throttle is disabled
+	limiter, err := c.NewLimiter()
+	assert.Nil(err)
+	assert.Nil(limiter)
+
+	c.Throttle.Type = ThrottleMemory
+	c.Throttle.IPs.FreeFailures = 20
+	limiter, err = c.NewLimiter()
+	assert.Nil(err)
+	assert.Equal(20, limiter.IPs.FreeFailures)
+
+	c.Provider.SecondFactor = FactorTOTP
+	c.Provider.TOTP.Issuer = "Example"
+	provider, err := c.NewProvider(Components{Users: users, Limiter: limiter})
+	assert.Nil(err)
+	second := provider.(*totp.Provider)
+	assert.Equal(limiter, second.Limiter)
+	assert.Equal(limiter, second.First.(*form.FormAuth).Limiter)
+	assert.Contains(second.CodeForm, "{{.CodeField}}")
+
+	// LDAP store can't keep the factors
+	_, err = c.NewProvider(Components{Users: users, Store: "ldap"})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	c.Provider.SecondFactor = FactorWebAuthn
+	c.Provider.WebAuthn = WebAuthn{RPID: "login.example.com", Origins: []string{"https://login.example.com"}}
+	_, err = c.NewProvider(Components{Users: users})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	c.Templates.WebAuthnLogin = writeFile(t, "/tmp/idp_config_test_webauthn.html", "{{.Options}}")
+	provider, err = c.NewProvider(Components{Users: users})
+	assert.Nil(err)
+	assert.NotNil(provider.(*webauthn.Provider).First)
+
+	c.Provider.SecondFactor = ""
+	c.Provider.Type = ProviderMTLS
+	ca := writeCA(t, "/tmp/idp_config_test_ca.pem")
+	c.Provider.MTLS = MTLS{
+		ProxyHeader:    "X-SSL-Client-Cert",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		CAFile:         "/tmp/idp_config_test_ca.pem",
+		Emails:         map[string]string{"Joe@Example.com": "joe"},
+	}
+	provider, err = c.NewProvider(Components{})
+	assert.Nil(err)
+	assert.Equal(mtls.Mappers{mtls.EmailMapper{"joe@example.com": "joe"}}, provider.(*mtls.Provider).Mapper)
+
+	c.Provider.Type = ProviderSAML
+	c.Provider.SAML = SAML{
+		EntityID: "https://login.example.com/saml/metadata",
+		ACSURL:   "https://login.example.com/",
+		Binding:  BindingPOST,
+		IDPMetadata: writeFile(t, "/tmp/idp_config_test_saml.xml", `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>`+
+			base64.StdEncoding.EncodeToString(ca.Raw)+`</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`),
+		Provision: true,
+	}
+	provider, err = c.NewProvider(Components{Users: users})
+	assert.Nil(err)
+	assert.Equal(saml.POSTBinding, provider.(*saml.Provider).Binding)
+	assert.NotNil(provider.(*saml.Provider).Provisioner)
+
+	// Users aren't found by the email address in the memory store
+	c.Provider.Type = ProviderMagicLink
+	c.Provider.MagicLink.URL = "https://login.example.com/"
+	_, err = c.NewProvider(Components{Users: users, Mailer: &mail.LogMailer{}})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	assert.Nil(c.ParseTemplates())
+	c.Templates.MagicLink = writeFile(t, "/tmp/idp_config_test_magiclink.html", "{{.Msg")
+	assert.NotNil(c.ParseTemplates())
+}
+
+func TestVerifierConfig(t *testing.T) {
+	assert := assert.New(t)
+	writeFile(t, testHtpasswd, testEntry)
+
+	c := valid()
+	users, err := c.NewUserStore()
+	assert.Nil(err)
+
+	config, err := c.VerifierConfig(users, &mail.LogMailer{})
+	assert.Nil(err)
+	assert.Nil(config)
+
+	c.Verification.Type = QueueMemory
+	c.Verification.URL = "https://login.example.com/verify"
+	c.Verification.MaxSendCount = 2
+	config, err = c.VerifierConfig(users, &mail.LogMailer{})
+	assert.Nil(err)
+	assert.Equal(2, config.MaxSendCount)
+
+	v, err := verifier.NewVerifier(*config)
+	assert.Nil(err)
+
+	// Form offers users another email
+	provider, err := c.NewProvider(Components{Users: users, Verifier: v})
+	assert.Nil(err)
+	assert.Equal(v, provider.(*form.FormAuth).Resender)
+
+	_, err = c.VerifierConfig(users, nil)
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestAuditConfig(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testAudit)
+
+	c := valid()
+	config, err := c.AuditConfig()
+	assert.Nil(err)
+	assert.Nil(config)
+
+	c.Audit = Audit{Type: AuditWebhook, URL: "https://audit.example.com/events", Secret: "secret"}
+	config, err = c.AuditConfig()
+	assert.Nil(err)
+	assert.Equal("secret", config.Sink.(*audit.WebhookSink).Secret)
+
+	c.Audit = Audit{Type: AuditJSONLines, File: testAudit, BatchSize: 10}
+	config, err = c.AuditConfig()
+	assert.Nil(err)
+	assert.Equal(10, config.BatchSize)
+
+	stream, err := audit.NewStream(*config)
+	assert.Nil(err)
+	stream.Audit(core.NewAuditEvent(httptest.NewRequest("POST", "/", nil), core.AuditLoginSucceeded, "form", "joe", nil))
+	assert.Nil(stream.Close())
+
+	events, err := ioutil.ReadFile(testAudit)
+	assert.Nil(err)
+	assert.Contains(string(events), `"joe"`)
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadEnv overrides the fields with the set IDP_ variables
+func (c *Config) LoadEnv() error {
+	return c.loadEnv(os.LookupEnv)
+}
+
+func (c *Config) loadEnv(lookup func(name string) (string, bool)) error {
+	return setFromEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup)
+}
+
+// Variable names follow the yaml tags, e.g. hydra.client_id is IDP_HYDRA_CLIENT_ID
+func setFromEnv(v reflect.Value, prefix string, lookup func(name string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			err := setFromEnv(field, name, lookup)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		err := set(field, value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func set(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+
+	case reflect.Slice:
+		// Items with commas, e.g. patterns
+		if strings.HasPrefix(value, "[") {
+			var items []string
+			err := yaml.Unmarshal([]byte(value), &items)
+			if err != nil {
+				return err
+			}
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,811 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/audit"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/basic"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/digest"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/janekolszak/idp/providers/magiclink"
+	"github.com/janekolszak/idp/providers/mtls"
+	"github.com/janekolszak/idp/providers/oidc"
+	"github.com/janekolszak/idp/providers/saml"
+	"github.com/janekolszak/idp/providers/throttle"
+	"github.com/janekolszak/idp/providers/totp"
+	"github.com/janekolszak/idp/providers/webauthn"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/ldap"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/janekolszak/idp/userdb/rethinkdb"
+	"github.com/janekolszak/idp/userdb/verifier"
+
+	r "gopkg.in/gorethink/gorethink.v3"
+)
+
+const defaultMagicLinkTable = "magiclink"
+
+// Components are shared by the providers, they're built by the other factories.
+// The ones the configuration doesn't need can be nil.
+type Components struct {
+	// Checks the passwords, can be wrapped, e.g. by metrics.UserStore
+	Users userdb.Store
+
+	// Store returned by NewUserStore, keeps the second factors and linked identities.
+	// Users is used if it's nil.
+	Store interface{}
+
+	// From NewLimiter
+	Limiter *throttle.Limiter
+
+	// From NewMailer, sends the magic links
+	Mailer mail.Mailer
+
+	// From NewTokenStore, keeps the magic links
+	Tokens cookie.Store
+
+	// Built from VerifierConfig, offered in the login form to unverified users
+	Verifier *verifier.Verifier
+}
+
+func (d *Components) store() interface{} {
+	if d.Store != nil {
+		return d.Store
+	}
+	return d.Users
+}
+
+func (c *Config) cookieKeys() [][]byte {
+	keys := [][]byte{[]byte(c.Challenge.Secret)}
+	if c.Challenge.EncryptionKey != "" {
+		keys = append(keys, []byte(c.Challenge.EncryptionKey))
+	}
+	return keys
+}
+
+// NewSessionStore keeps the state of the providers between the requests
+// in cookies, protected like the challenges
+func (c *Config) NewSessionStore() sessions.Store {
+	return sessions.NewCookieStore(c.cookieKeys()...)
+}
+
+// IDPConfig builds core.IDP's configuration with cookies keeping the challenges.
+// Optional fields, e.g. Logger, can be set on the result.
+func (c *Config) IDPConfig() *core.IDPConfig {
+	return &core.IDPConfig{
+		ClusterURL:            c.Hydra.URL,
+		ClientID:              c.Hydra.ClientID,
+		ClientSecret:          c.Hydra.ClientSecret,
+		KeyCacheExpiration:    c.Hydra.KeyCacheExpiration,
+		ClientCacheExpiration: c.Hydra.ClientCacheExpiration,
+		CacheCleanupInterval:  c.Hydra.CacheCleanupInterval,
+		ChallengeStore:        sessions.NewCookieStore(c.cookieKeys()...),
+	}
+}
+
+// NewUserStore opens the users.type store, close it if it's an io.Closer.
+// The htpasswd file is loaded into a memory.Store.
+func (c *Config) NewUserStore() (userdb.Store, error) {
+	switch c.Users.Type {
+	case UsersHtpasswd:
+		store, err := memory.NewMemStore()
+		if err != nil {
+			return nil, err
+		}
+
+		err = store.LoadHtpasswd(c.Users.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+
+	case UsersRethinkDB:
+		session, err := r.Connect(r.ConnectOpts{
+			Address:  c.Users.RethinkDB.Address,
+			Database: c.Users.RethinkDB.Database,
+		})
+		if err != nil {
+			return nil, err
+		}
+		store, err := rethinkdb.NewStore(session)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Verification.RequireVerified {
+			store.Policy = &userdb.RequireVerified{GracePeriod: c.Verification.GracePeriod}
+		}
+		return store, nil
+
+	case UsersLDAP:
+		l := c.Users.LDAP
+		store, err := ldap.NewStore(ldap.Config{
+			Address:      l.Address,
+			UseTLS:       l.UseTLS,
+			StartTLS:     l.StartTLS,
+			BindDN:       l.BindDN,
+			BindPassword: l.BindPassword,
+			BaseDN:       l.BaseDN,
+			UserFilter:   l.UserFilter,
+			PoolSize:     l.PoolSize,
+			Timeout:      l.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, core.ErrorInvalidConfig
+}
+
+// NewCookieStore opens the cookies.type store of the remember me cookies
+func (c *Config) NewCookieStore() (cookie.Store, error) {
+	return c.newCookieStore(c.Cookies.Table)
+}
+
+// NewTokenStore opens the store of the magic links, in a separate table of the cookies' database
+func (c *Config) NewTokenStore() (cookie.Store, error) {
+	table := c.Provider.MagicLink.Table
+	if table == "" {
+		table = defaultMagicLinkTable
+	}
+	return c.newCookieStore(table)
+}
+
+// Store's default table is used if table is empty
+func (c *Config) newCookieStore(table string) (cookie.Store, error) {
+	var store cookie.Store
+	var err error
+
+	switch c.Cookies.Type {
+	case CookiesSQL:
+		if table != "" {
+			store, err = cookie.NewDBStoreWithTable(c.Cookies.Driver, c.Cookies.DSN, table)
+		} else {
+			store, err = cookie.NewDBStore(c.Cookies.Driver, c.Cookies.DSN)
+		}
+
+	case CookiesRethinkDB:
+		address, database := c.Cookies.RethinkDB.Address, c.Cookies.RethinkDB.Database
+		if table != "" {
+			store, err = cookie.NewRethinkDBStoreWithTable(address, database, table)
+		} else {
+			store, err = cookie.NewRethinkDBStore(address, database)
+		}
+
+	default:
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewCookieAuth checks and issues remember me cookies kept in the store
+func (c *Config) NewCookieAuth(store cookie.Store) *cookie.CookieAuth {
+	return &cookie.CookieAuth{
+		Store:  store,
+		MaxAge: c.Cookies.MaxAge,
+	}
+}
+
+// NewProvider builds the provider.type provider, checked before the provider.second_factor if it's set.
+// The form provider checks users in the store, basic and digest authentication read their files.
+func (c *Config) NewProvider(d Components) (core.Provider, error) {
+	first, err := c.newFirstFactor(d)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Provider.SecondFactor {
+	case "":
+		return first, nil
+
+	case FactorTOTP:
+		return c.newTOTP(first, d)
+
+	case FactorWebAuthn:
+		return c.newWebAuthn(first, d)
+	}
+
+	return nil, core.ErrorInvalidConfig
+}
+
+func (c *Config) newFirstFactor(d Components) (core.Provider, error) {
+	p := c.Provider
+	switch p.Type {
+	case ProviderForm:
+		page, err := c.LoginTemplate()
+		if err != nil {
+			return nil, err
+		}
+
+		config := form.Config{
+			LoginForm:          page,
+			LoginUsernameField: p.Form.UsernameField,
+			LoginPasswordField: p.Form.PasswordField,
+			UserStore:          d.Users,
+			Username: form.Complexity{
+				MinLength: p.Form.Username.MinLength,
+				MaxLength: p.Form.Username.MaxLength,
+				Patterns:  p.Form.Username.Patterns,
+			},
+			Password: form.Complexity{
+				MinLength: p.Form.Password.MinLength,
+				MaxLength: p.Form.Password.MaxLength,
+				Patterns:  p.Form.Password.Patterns,
+			},
+			Limiter: d.Limiter,
+		}
+
+		if d.Verifier != nil {
+			config.Resender = d.Verifier
+		}
+
+		provider, err := form.NewFormAuth(config)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+
+	case ProviderBasic:
+		provider, err := basic.NewBasicAuth(c.Users.Htpasswd, p.Realm)
+		if err != nil {
+			return nil, err
+		}
+		provider.Limiter = d.Limiter
+		return provider, nil
+
+	case ProviderDigest:
+		var secret []byte
+		if p.NonceSecret != "" {
+			secret = []byte(p.NonceSecret)
+		}
+
+		provider, err := digest.NewDigestAuth(digest.Config{
+			HtdigestFileName: p.Htdigest,
+			Realm:            p.Realm,
+			NonceMaxAge:      p.NonceMaxAge,
+			Secret:           secret,
+			Limiter:          d.Limiter,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+
+	case ProviderOIDC:
+		return c.newOIDC(d)
+
+	case ProviderSAML:
+		return c.newSAML(d)
+
+	case ProviderMTLS:
+		return c.newMTLS()
+
+	case ProviderMagicLink:
+		return c.newMagicLink(d)
+
+	case ProviderWebAuthn:
+		// Passwordless
+		return c.newWebAuthn(nil, d)
+	}
+
+	return nil, core.ErrorInvalidConfig
+}
+
+func (c *Config) newTOTP(first core.Provider, d Components) (core.Provider, error) {
+	factors, ok := d.store().(userdb.FactorStore)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	t := c.Provider.TOTP
+	factor, err := totp.NewTOTP(totp.Config{
+		Factors:       factors,
+		Issuer:        t.Issuer,
+		Skew:          t.Skew,
+		RecoveryCodes: t.RecoveryCodes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := c.TOTPTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := totp.NewProvider(totp.ProviderConfig{
+		First:    first,
+		TOTP:     factor,
+		Sessions: c.NewSessionStore(),
+		CodeForm: page,
+		MaxAge:   t.MaxAge,
+		Limiter:  d.Limiter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Passwordless if first is nil
+func (c *Config) newWebAuthn(first core.Provider, d Components) (core.Provider, error) {
+	credentials, ok := d.store().(userdb.CredentialStore)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	w := c.Provider.WebAuthn
+	authenticators, err := webauthn.NewWebAuthn(webauthn.Config{
+		Credentials:             credentials,
+		RPID:                    w.RPID,
+		RPName:                  w.RPName,
+		Origins:                 w.Origins,
+		RequireUserVerification: w.RequireUserVerification,
+		Timeout:                 w.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	login, register, err := c.WebAuthnTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := webauthn.NewProvider(webauthn.ProviderConfig{
+		First:        first,
+		WebAuthn:     authenticators,
+		Sessions:     c.NewSessionStore(),
+		LoginForm:    login,
+		RegisterForm: register,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Discovers the upstream provider's endpoints
+func (c *Config) newOIDC(d Components) (core.Provider, error) {
+	identities, ok := d.store().(userdb.IdentityStore)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	o := c.Provider.OIDC
+	config := oidc.Config{
+		Issuer:       o.Issuer,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       o.Scopes,
+		Identities:   identities,
+		Sessions:     c.NewSessionStore(),
+		MaxAge:       o.MaxAge,
+		ClockSkew:    o.ClockSkew,
+	}
+
+	if o.Provision {
+		config.Provisioner = &oidc.StoreProvisioner{Users: d.Users}
+	}
+
+	provider, err := oidc.NewProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (c *Config) newSAML(d Components) (core.Provider, error) {
+	identities, ok := d.store().(userdb.IdentityStore)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	s := c.Provider.SAML
+	data, err := ioutil.ReadFile(s.IDPMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := saml.ParseIDPMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config := saml.Config{
+		EntityID:     s.EntityID,
+		ACSURL:       s.ACSURL,
+		IDP:          metadata,
+		Binding:      saml.RedirectBinding,
+		NameIDFormat: s.NameIDFormat,
+		Identities:   identities,
+		Sessions:     c.NewSessionStore(),
+		MaxAge:       s.MaxAge,
+		ClockSkew:    s.ClockSkew,
+	}
+
+	if s.Binding == BindingPOST {
+		config.Binding = saml.POSTBinding
+	}
+
+	if s.KeyFile != "" {
+		config.Key, config.Certificate, err = readKeyPair(s.CertificateFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Provision {
+		config.Provisioner = &saml.StoreProvisioner{Users: d.Users}
+	}
+
+	provider, err := saml.NewProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Reads the PEM files, the key has to be RSA
+func readKeyPair(certFile, keyFile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, core.ErrorInvalidConfig
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certificate, nil
+}
+
+// Reads all certificates from the PEM file
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+	return certificates, nil
+}
+
+func (c *Config) newMTLS() (core.Provider, error) {
+	m := c.Provider.MTLS
+	cas, err := readCertificates(m.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+
+	var mappers mtls.Mappers
+	if len(m.Subjects) != 0 {
+		mappers = append(mappers, mtls.SubjectMapper(m.Subjects))
+	}
+
+	if len(m.Emails) != 0 {
+		emails := make(mtls.EmailMapper)
+		for email, user := range m.Emails {
+			emails[strings.ToLower(email)] = user
+		}
+		mappers = append(mappers, emails)
+	}
+
+	if len(m.Fingerprints) != 0 {
+		mappers = append(mappers, mtls.FingerprintMapper(m.Fingerprints))
+	}
+
+	config := mtls.Config{
+		Mapper:         mappers,
+		Roots:          roots,
+		ProxyHeader:    m.ProxyHeader,
+		TrustedProxies: m.TrustedProxies,
+	}
+
+	if len(m.CRLFiles) != 0 || m.RequireCRL {
+		crls := &mtls.CRLs{RequireCRL: m.RequireCRL}
+		for _, path := range m.CRLFiles {
+			err = loadCRL(crls, path, cas)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.Revocation = crls
+	}
+
+	provider, err := mtls.NewProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// The list's issuer is the CA that signed it
+func loadCRL(crls *mtls.CRLs, path string, cas []*x509.Certificate) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return err
+	}
+
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			return crls.Add(crl, ca)
+		}
+	}
+	return core.ErrorInvalidConfig
+}
+
+// Links get their own throttles, not the Limiter of the password logins
+func (c *Config) newMagicLink(d Components) (core.Provider, error) {
+	users, ok := d.store().(magiclink.UserStore)
+	if !ok || d.Mailer == nil || d.Tokens == nil {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	page, err := c.MagicLinkTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	l := c.Provider.MagicLink
+	email, err := readTemplate(l.Template, "")
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := magiclink.NewProvider(magiclink.Config{
+		Tokens:           d.Tokens,
+		Users:            users,
+		Mailer:           d.Mailer,
+		Page:             page,
+		EmailField:       l.EmailField,
+		URL:              l.URL,
+		Subject:          l.Subject,
+		Template:         email,
+		MaxAge:           l.MaxAge,
+		MaxPendingEmails: l.MaxPendingEmails,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+func (b *Backoff) config(store throttle.Store) throttle.Config {
+	return throttle.Config{
+		Store:           store,
+		FreeFailures:    b.FreeFailures,
+		BaseDelay:       b.BaseDelay,
+		MaxDelay:        b.MaxDelay,
+		LockoutFailures: b.LockoutFailures,
+		LockoutDuration: b.LockoutDuration,
+		ResetAfter:      b.ResetAfter,
+	}
+}
+
+// NewLimiter returns nil if throttling is disabled. Both throttles share the store,
+// close it if it's an io.Closer.
+func (c *Config) NewLimiter() (*throttle.Limiter, error) {
+	var store throttle.Store
+	var err error
+
+	switch c.Throttle.Type {
+	case "":
+		return nil, nil
+
+	case ThrottleMemory:
+		store, err = throttle.NewMemoryStore()
+
+	case ThrottleSQL:
+		store, err = throttle.NewDBStore(c.Throttle.Driver, c.Throttle.DSN)
+
+	default:
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := throttle.NewThrottle(c.Throttle.Users.config(store))
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := throttle.NewThrottle(c.Throttle.IPs.config(store))
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle.Limiter{Users: users, IPs: ips}, nil
+}
+
+// VerifierConfig builds verifier.Verifier's configuration, nil if the verification is disabled.
+// Users is the store from NewUserStore. Optional fields, e.g. Logger, can be set on the result.
+// Close the Queue if it's an io.Closer.
+func (c *Config) VerifierConfig(users interface{}, mailer mail.Mailer) (*verifier.Config, error) {
+	v := c.Verification
+	if v.Type == "" {
+		return nil, nil
+	}
+
+	store, ok := users.(verifier.UserStore)
+	if !ok || mailer == nil {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	email, err := readTemplate(v.Template, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var queue verifier.Queue
+	switch v.Type {
+	case QueueMemory:
+		queue, err = verifier.NewMemoryQueue()
+
+	case QueueSQL:
+		queue, err = verifier.NewDBQueue(v.Driver, v.DSN)
+
+	case QueueRethinkDB:
+		var session *r.Session
+		session, err = r.Connect(r.ConnectOpts{
+			Address:  v.RethinkDB.Address,
+			Database: v.RethinkDB.Database,
+		})
+		if err != nil {
+			return nil, err
+		}
+		queue, err = verifier.NewRethinkDBQueue(session)
+
+	default:
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifier.Config{
+		Queue:          queue,
+		Users:          store,
+		Mailer:         mailer,
+		URL:            v.URL,
+		Subject:        v.Subject,
+		Template:       email,
+		ResendInterval: v.ResendInterval,
+		MaxSendCount:   v.MaxSendCount,
+		TTL:            v.TTL,
+		SweepInterval:  v.SweepInterval,
+	}, nil
+}
+
+// AuditConfig builds audit.Stream's configuration, nil if the audit is disabled.
+// Optional fields, e.g. Logger, can be set on the result. Closing the Stream closes the sink.
+func (c *Config) AuditConfig() (*audit.Config, error) {
+	a := c.Audit
+
+	var sink audit.Sink
+	var err error
+	switch a.Type {
+	case "":
+		return nil, nil
+
+	case AuditJSONLines:
+		sink, err = audit.OpenJSONLinesFile(a.File)
+
+	case AuditSQL:
+		if a.Table == "" {
+			sink, err = audit.NewSQLSink(a.Driver, a.DSN)
+		} else {
+			sink, err = audit.NewSQLSinkWithTable(a.Driver, a.DSN, a.Table)
+		}
+
+	case AuditWebhook:
+		sink, err = audit.NewWebhookSink(audit.WebhookConfig{
+			URL:     a.URL,
+			Secret:  a.Secret,
+			Timeout: a.Timeout,
+		})
+
+	default:
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &audit.Config{
+		Sink:          sink,
+		BufferSize:    a.BufferSize,
+		BatchSize:     a.BatchSize,
+		FlushInterval: a.FlushInterval,
+	}, nil
+}
+
+// NewMailer returns nil if emails are disabled
+func (c *Config) NewMailer() (mail.Mailer, error) {
+	m := c.Mail
+	switch m.Type {
+	case "":
+		return nil, nil
+
+	case MailSMTP:
+		mailer := &mail.SMTPMailer{
+			Address: m.SMTP.Address,
+			From:    m.From,
+		}
+
+		if m.SMTP.Username != "" {
+			host, _, err := net.SplitHostPort(m.SMTP.Address)
+			if err != nil {
+				return nil, err
+			}
+			mailer.Auth = smtp.PlainAuth("", m.SMTP.Username, m.SMTP.Password, host)
+		}
+		return mailer, nil
+
+	case MailFile:
+		return &mail.FileMailer{Filename: m.File, From: m.From}, nil
+
+	case MailLog:
+		return &mail.LogMailer{}, nil
+	}
+
+	return nil, core.ErrorInvalidConfig
+}
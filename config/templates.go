@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	defaultConsentTemplate = `<html>
+<head></head>
+<body>
+<p>User:        {{.User}} </p>
+<p>Client Name: {{.Client.Name}} </p>
+<p>Scopes:      {{range .Scopes}} {{.}} {{end}} </p>
+<p>Do you agree to grant access to those scopes? </p>
+<p><form method="post">
+	<input type="submit" name="answer" value="y">
+	<input type="submit" name="answer" value="n">
+</form></p>
+</body></html>
+`
+
+	// Gets the names of the fields
+	defaultLoginTemplate = `<html>
+<head></head>
+<body>
+<form method="post">
+	<p>username <input type="text" name="%s"></p>
+	<p>password <input type="password" name="%s" autocomplete="off"></p>
+	<input type="submit">
+</form>
+<hr>
+{{.Msg}}
+</body>
+</html>
+`
+)
+
+const (
+	defaultTOTPTemplate = `<html>
+<head></head>
+<body>
+<form method="post">
+	<p>code <input type="text" name="{{.CodeField}}" autocomplete="one-time-code"></p>
+	<input type="submit">
+</form>
+<hr>
+{{.Msg}}
+</body>
+</html>
+`
+
+	defaultMagicLinkTemplate = `<html>
+<head></head>
+<body>
+{{if .Sent}}
+<p>Check your inbox, the login link was sent</p>
+{{else if .Confirm}}
+<form method="post">
+	<input type="submit" value="log in">
+</form>
+{{else}}
+<form method="post">
+	<p>email <input type="email" name="{{.EmailField}}"></p>
+	<input type="submit">
+</form>
+{{end}}
+<hr>
+{{.Msg}}
+</body>
+</html>
+`
+)
+
+func readTemplate(path, fallback string) (string, error) {
+	if path == "" {
+		return fallback, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ConsentTemplate returns the consent page's template
+func (c *Config) ConsentTemplate() (string, error) {
+	return readTemplate(c.Templates.Consent, defaultConsentTemplate)
+}
+
+// LoginTemplate returns the form's template
+func (c *Config) LoginTemplate() (string, error) {
+	fallback := fmt.Sprintf(defaultLoginTemplate,
+		template.HTMLEscapeString(c.Provider.Form.UsernameField),
+		template.HTMLEscapeString(c.Provider.Form.PasswordField))
+
+	return readTemplate(c.Templates.Login, fallback)
+}
+
+// TOTPTemplate returns the template of the form asking for the code
+func (c *Config) TOTPTemplate() (string, error) {
+	return readTemplate(c.Templates.TOTP, defaultTOTPTemplate)
+}
+
+// WebAuthnTemplates returns the login and registration pages.
+// There's no built in login page, it needs a script calling the WebAuthn API.
+func (c *Config) WebAuthnTemplates() (login, register string, err error) {
+	if c.Templates.WebAuthnLogin == "" {
+		return "", "", core.ErrorInvalidConfig
+	}
+
+	login, err = readTemplate(c.Templates.WebAuthnLogin, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	register, err = readTemplate(c.Templates.WebAuthnRegister, "")
+	if err != nil {
+		return "", "", err
+	}
+	return login, register, nil
+}
+
+// MagicLinkTemplate returns the page requesting and confirming the links
+func (c *Config) MagicLinkTemplate() (string, error) {
+	return readTemplate(c.Templates.MagicLink, defaultMagicLinkTemplate)
+}
+
+// ParseTemplates parses the configured pages,
+// so broken files are found before the IdP starts
+func (c *Config) ParseTemplates() error {
+	pages := []func() (string, error){c.ConsentTemplate}
+
+	switch c.Provider.Type {
+	case ProviderForm:
+		pages = append(pages, c.LoginTemplate)
+	case ProviderMagicLink:
+		pages = append(pages, c.MagicLinkTemplate)
+	}
+
+	if c.Provider.SecondFactor == FactorTOTP {
+		pages = append(pages, c.TOTPTemplate)
+	}
+
+	if c.Provider.Type == ProviderWebAuthn || c.Provider.SecondFactor == FactorWebAuthn {
+		login, register, err := c.WebAuthnTemplates()
+		if err != nil {
+			return err
+		}
+		pages = append(pages,
+			func() (string, error) { return login, nil },
+			func() (string, error) { return register, nil })
+	}
+
+	for _, page := range pages {
+		text, err := page()
+		if err != nil {
+			return err
+		}
+
+		_, err = template.New("page").Parse(text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,484 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FieldError is a problem with the field at Path, e.g. "hydra.url"
+type FieldError struct {
+	Path    string
+	Problem string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Problem
+}
+
+// Errors lists all invalid fields, not just the first one
+type Errors []*FieldError
+
+func (e Errors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+func (e *Errors) add(path, format string, args ...interface{}) {
+	*e = append(*e, &FieldError{Path: path, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (e *Errors) required(path, value string) {
+	if value == "" {
+		e.add(path, "required")
+	}
+}
+
+func (e *Errors) oneOf(path, value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	e.add(path, "%q isn't one of %s", value, strings.Join(allowed, ", "))
+	return false
+}
+
+func (e *Errors) address(path, value string) {
+	if value == "" {
+		e.add(path, "required")
+		return
+	}
+
+	_, _, err := net.SplitHostPort(value)
+	if err != nil {
+		e.add(path, "should be host:port, %s", err)
+	}
+}
+
+func (e *Errors) complexity(path string, c *Complexity) {
+	if c.MinLength < 0 {
+		e.add(path+".min_length", "can't be negative")
+	}
+
+	if c.MaxLength < c.MinLength {
+		e.add(path+".max_length", "is less than min_length")
+	}
+
+	for i, pattern := range c.Patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			e.add(fmt.Sprintf("%s.patterns[%d]", path, i), "%s", err)
+		}
+	}
+}
+
+// Validate returns Errors with every invalid field.
+// Files the fields point to aren't checked, the factories fail if they can't read them.
+func (c *Config) Validate() error {
+	var errs Errors
+
+	errs.address("listen", c.Listen)
+	if c.MetricsListen != "" {
+		errs.address("metrics_listen", c.MetricsListen)
+		if c.MetricsListen == c.Listen {
+			errs.add("metrics_listen", "is the same as listen")
+		}
+	}
+	c.validateHydra(&errs)
+	c.validateChallenge(&errs)
+	c.validateUsers(&errs)
+	c.validateCookies(&errs)
+	c.validateProvider(&errs)
+	c.validateThrottle(&errs)
+	c.validateVerification(&errs)
+	c.validateAudit(&errs)
+	c.validateMail(&errs)
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validateHydra(errs *Errors) {
+	u, err := url.Parse(c.Hydra.URL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		errs.add("hydra.url", "should be an absolute URL, e.g. https://hydra:4444")
+	}
+
+	if c.Hydra.ClientID == "" {
+		errs.add("hydra.client_id", "required, or set hydra.config_file")
+	}
+
+	if c.Hydra.ClientSecret == "" {
+		errs.add("hydra.client_secret", "required, or set hydra.config_file")
+	}
+
+	if c.Hydra.KeyCacheExpiration <= 0 {
+		errs.add("hydra.key_cache_expiration", "should be positive")
+	}
+
+	if c.Hydra.ClientCacheExpiration <= 0 {
+		errs.add("hydra.client_cache_expiration", "should be positive")
+	}
+
+	if c.Hydra.CacheCleanupInterval <= 0 {
+		errs.add("hydra.cache_cleanup_interval", "should be positive")
+	}
+}
+
+func (c *Config) validateChallenge(errs *Errors) {
+	if len(c.Challenge.Secret) < 32 {
+		errs.add("challenge.secret", "should have at least 32 bytes")
+	}
+
+	switch len(c.Challenge.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		errs.add("challenge.encryption_key", "should have 16, 24 or 32 bytes")
+	}
+}
+
+func (c *Config) validateUsers(errs *Errors) {
+	if !errs.oneOf("users.type", c.Users.Type, UsersHtpasswd, UsersRethinkDB, UsersLDAP) {
+		return
+	}
+
+	switch c.Users.Type {
+	case UsersHtpasswd:
+		errs.required("users.htpasswd", c.Users.Htpasswd)
+
+	case UsersRethinkDB:
+		errs.required("users.rethinkdb.address", c.Users.RethinkDB.Address)
+		errs.required("users.rethinkdb.database", c.Users.RethinkDB.Database)
+
+	case UsersLDAP:
+		l := &c.Users.LDAP
+		errs.address("users.ldap.address", l.Address)
+		errs.required("users.ldap.base_dn", l.BaseDN)
+
+		if l.UseTLS && l.StartTLS {
+			errs.add("users.ldap.start_tls", "can't be used with use_tls")
+		}
+
+		if l.UserFilter != "" && strings.Count(l.UserFilter, "%s") != 1 {
+			errs.add("users.ldap.user_filter", "should have one %%s, e.g. (uid=%%s)")
+		}
+
+		if l.PoolSize < 0 {
+			errs.add("users.ldap.pool_size", "can't be negative")
+		}
+
+		if l.Timeout < 0 {
+			errs.add("users.ldap.timeout", "can't be negative")
+		}
+	}
+}
+
+func (c *Config) validateCookies(errs *Errors) {
+	if c.Cookies.MaxAge <= 0 {
+		errs.add("cookies.max_age", "should be positive")
+	}
+
+	if !errs.oneOf("cookies.type", c.Cookies.Type, CookiesSQL, CookiesRethinkDB) {
+		return
+	}
+
+	switch c.Cookies.Type {
+	case CookiesSQL:
+		errs.required("cookies.driver", c.Cookies.Driver)
+		errs.required("cookies.dsn", c.Cookies.DSN)
+
+	case CookiesRethinkDB:
+		errs.required("cookies.rethinkdb.address", c.Cookies.RethinkDB.Address)
+		errs.required("cookies.rethinkdb.database", c.Cookies.RethinkDB.Database)
+	}
+}
+
+func (e *Errors) absoluteURL(path, value string) {
+	u, err := url.Parse(value)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		e.add(path, "should be an absolute URL")
+	}
+}
+
+func (e *Errors) notNegative(path string, value time.Duration) {
+	if value < 0 {
+		e.add(path, "can't be negative")
+	}
+}
+
+func (e *Errors) backoff(path string, b *Backoff) {
+	if b.FreeFailures < 0 {
+		e.add(path+".free_failures", "can't be negative")
+	}
+
+	if b.LockoutFailures < 0 {
+		e.add(path+".lockout_failures", "can't be negative")
+	}
+}
+
+func (c *Config) validateProvider(errs *Errors) {
+	p := &c.Provider
+	if p.SecondFactor != "" {
+		errs.oneOf("provider.second_factor", p.SecondFactor, FactorTOTP, FactorWebAuthn)
+	}
+
+	switch p.SecondFactor {
+	case FactorTOTP:
+		c.validateTOTP(errs)
+
+	case FactorWebAuthn:
+		if p.Type == ProviderWebAuthn {
+			errs.add("provider.second_factor", "can't be the provider.type")
+		}
+		c.validateWebAuthn(errs, "provider.second_factor")
+	}
+
+	if !errs.oneOf("provider.type", p.Type, ProviderForm, ProviderBasic, ProviderDigest,
+		ProviderOIDC, ProviderSAML, ProviderMTLS, ProviderMagicLink, ProviderWebAuthn) {
+		return
+	}
+
+	switch p.Type {
+	case ProviderForm:
+		errs.required("provider.form.username_field", p.Form.UsernameField)
+		errs.required("provider.form.password_field", p.Form.PasswordField)
+		if p.Form.UsernameField != "" && p.Form.UsernameField == p.Form.PasswordField {
+			errs.add("provider.form.password_field", "is the same as username_field")
+		}
+
+		errs.complexity("provider.form.username", &p.Form.Username)
+		errs.complexity("provider.form.password", &p.Form.Password)
+
+	case ProviderBasic:
+		errs.required("provider.realm", p.Realm)
+		if c.Users.Type != UsersHtpasswd {
+			errs.add("provider.type", "basic authentication reads users.htpasswd, users.type should be htpasswd")
+		}
+
+	case ProviderDigest:
+		errs.required("provider.realm", p.Realm)
+		errs.required("provider.htdigest", p.Htdigest)
+		if p.NonceMaxAge < 0 {
+			errs.add("provider.nonce_max_age", "can't be negative")
+		}
+
+	case ProviderOIDC:
+		o := &p.OIDC
+		errs.absoluteURL("provider.oidc.issuer", o.Issuer)
+		errs.required("provider.oidc.client_id", o.ClientID)
+		errs.absoluteURL("provider.oidc.redirect_url", o.RedirectURL)
+		errs.notNegative("provider.oidc.max_age", o.MaxAge)
+		errs.notNegative("provider.oidc.clock_skew", o.ClockSkew)
+		c.requireAccounts(errs, "provider.type", "oidc")
+
+	case ProviderSAML:
+		s := &p.SAML
+		errs.required("provider.saml.entity_id", s.EntityID)
+		errs.absoluteURL("provider.saml.acs_url", s.ACSURL)
+		errs.required("provider.saml.idp_metadata", s.IDPMetadata)
+		if s.Binding != "" {
+			errs.oneOf("provider.saml.binding", s.Binding, BindingRedirect, BindingPOST)
+		}
+		if (s.KeyFile == "") != (s.CertificateFile == "") {
+			errs.add("provider.saml.certificate_file", "should be set with key_file")
+		}
+		errs.notNegative("provider.saml.max_age", s.MaxAge)
+		errs.notNegative("provider.saml.clock_skew", s.ClockSkew)
+		c.requireAccounts(errs, "provider.type", "saml")
+
+	case ProviderMTLS:
+		m := &p.MTLS
+
+		// The IdP doesn't terminate TLS
+		errs.required("provider.mtls.proxy_header", m.ProxyHeader)
+		errs.required("provider.mtls.ca_file", m.CAFile)
+		if len(m.TrustedProxies) == 0 {
+			errs.add("provider.mtls.trusted_proxies", "required")
+		}
+		for i, cidr := range m.TrustedProxies {
+			_, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errs.add(fmt.Sprintf("provider.mtls.trusted_proxies[%d]", i), "%s", err)
+			}
+		}
+		if len(m.Subjects) == 0 && len(m.Emails) == 0 && len(m.Fingerprints) == 0 {
+			errs.add("provider.mtls", "subjects, emails or fingerprints should map certificates to users")
+		}
+
+	case ProviderMagicLink:
+		l := &p.MagicLink
+		errs.absoluteURL("provider.magiclink.url", l.URL)
+		errs.notNegative("provider.magiclink.max_age", l.MaxAge)
+		if l.MaxPendingEmails < 0 {
+			errs.add("provider.magiclink.max_pending_emails", "can't be negative")
+		}
+		if c.Mail.Type == "" {
+			errs.add("mail.type", "required by the magiclink provider")
+		}
+		if c.Users.Type != UsersRethinkDB {
+			errs.add("provider.type", "magic links find users by the email address, users.type should be rethinkdb")
+		}
+
+	case ProviderWebAuthn:
+		if !p.WebAuthn.RequireUserVerification {
+			errs.add("provider.webauthn.require_user_verification", "required by passwordless logins")
+		}
+		c.validateWebAuthn(errs, "provider.type")
+	}
+}
+
+// Second factors and linked identities are kept by the memory and rethinkdb stores
+func (c *Config) requireAccounts(errs *Errors, path, name string) {
+	if c.Users.Type == UsersLDAP {
+		errs.add(path, "%s needs users.type htpasswd or rethinkdb", name)
+	}
+}
+
+func (c *Config) validateTOTP(errs *Errors) {
+	t := &c.Provider.TOTP
+	errs.required("provider.totp.issuer", t.Issuer)
+	if t.Skew < 0 {
+		errs.add("provider.totp.skew", "can't be negative")
+	}
+	if t.RecoveryCodes < 0 {
+		errs.add("provider.totp.recovery_codes", "can't be negative")
+	}
+	errs.notNegative("provider.totp.max_age", t.MaxAge)
+	c.requireAccounts(errs, "provider.second_factor", "totp")
+}
+
+func (c *Config) validateWebAuthn(errs *Errors, path string) {
+	w := &c.Provider.WebAuthn
+	errs.required("provider.webauthn.rp_id", w.RPID)
+	if len(w.Origins) == 0 {
+		errs.add("provider.webauthn.origins", "required")
+	}
+	for i, origin := range w.Origins {
+		errs.absoluteURL(fmt.Sprintf("provider.webauthn.origins[%d]", i), origin)
+	}
+	errs.notNegative("provider.webauthn.timeout", w.Timeout)
+	errs.required("templates.webauthn_login", c.Templates.WebAuthnLogin)
+	c.requireAccounts(errs, path, "webauthn")
+}
+
+func (c *Config) validateThrottle(errs *Errors) {
+	t := &c.Throttle
+	if t.Type == "" {
+		return
+	}
+
+	if !errs.oneOf("throttle.type", t.Type, ThrottleMemory, ThrottleSQL) {
+		return
+	}
+
+	if t.Type == ThrottleSQL {
+		errs.required("throttle.driver", t.Driver)
+		errs.required("throttle.dsn", t.DSN)
+	}
+
+	errs.backoff("throttle.users", &t.Users)
+	errs.backoff("throttle.ips", &t.IPs)
+}
+
+func (c *Config) validateVerification(errs *Errors) {
+	v := &c.Verification
+	if v.Type == "" {
+		if v.RequireVerified {
+			errs.add("verification.require_verified", "needs verification.type")
+		}
+		return
+	}
+
+	if !errs.oneOf("verification.type", v.Type, QueueMemory, QueueSQL, QueueRethinkDB) {
+		return
+	}
+
+	switch v.Type {
+	case QueueSQL:
+		errs.required("verification.driver", v.Driver)
+		errs.required("verification.dsn", v.DSN)
+
+	case QueueRethinkDB:
+		errs.required("verification.rethinkdb.address", v.RethinkDB.Address)
+		errs.required("verification.rethinkdb.database", v.RethinkDB.Database)
+	}
+
+	errs.absoluteURL("verification.url", v.URL)
+	errs.notNegative("verification.grace_period", v.GracePeriod)
+
+	if c.Mail.Type == "" {
+		errs.add("mail.type", "required by the verification")
+	}
+
+	if c.Users.Type == UsersLDAP {
+		errs.add("verification.type", "users.type should be htpasswd or rethinkdb")
+	}
+
+	if v.RequireVerified && c.Users.Type != UsersRethinkDB {
+		errs.add("verification.require_verified", "users.type should be rethinkdb")
+	}
+}
+
+func (c *Config) validateAudit(errs *Errors) {
+	a := &c.Audit
+	if a.Type == "" {
+		return
+	}
+
+	if !errs.oneOf("audit.type", a.Type, AuditJSONLines, AuditSQL, AuditWebhook) {
+		return
+	}
+
+	switch a.Type {
+	case AuditJSONLines:
+		errs.required("audit.file", a.File)
+
+	case AuditSQL:
+		errs.required("audit.driver", a.Driver)
+		errs.required("audit.dsn", a.DSN)
+
+	case AuditWebhook:
+		errs.absoluteURL("audit.url", a.URL)
+		errs.notNegative("audit.timeout", a.Timeout)
+	}
+
+	if a.BufferSize < 0 {
+		errs.add("audit.buffer_size", "can't be negative")
+	}
+	if a.BatchSize < 0 {
+		errs.add("audit.batch_size", "can't be negative")
+	}
+	errs.notNegative("audit.flush_interval", a.FlushInterval)
+}
+
+func (c *Config) validateMail(errs *Errors) {
+	m := &c.Mail
+	if m.Type == "" {
+		return
+	}
+
+	if !errs.oneOf("mail.type", m.Type, MailSMTP, MailFile, MailLog) {
+		return
+	}
+
+	switch m.Type {
+	case MailSMTP:
+		errs.address("mail.smtp.address", m.SMTP.Address)
+		errs.required("mail.from", m.From)
+		if m.SMTP.Password != "" && m.SMTP.Username == "" {
+			errs.add("mail.smtp.username", "required with the password")
+		}
+
+	case MailFile:
+		errs.required("mail.file", m.File)
+	}
+}
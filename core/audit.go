@@ -0,0 +1,79 @@
+package core
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/janekolszak/idp/logging"
+)
+
+type AuditEventType string
+
+const (
+	AuditLoginSucceeded     AuditEventType = "login.succeeded"
+	AuditLoginFailed        AuditEventType = "login.failed"
+	AuditConsentGranted     AuditEventType = "consent.granted"
+	AuditConsentRefused     AuditEventType = "consent.refused"
+	AuditCookieIssued       AuditEventType = "cookie.issued"
+	AuditCookieRenewed      AuditEventType = "cookie.renewed"
+	AuditUserRegistered     AuditEventType = "user.registered"
+	AuditRegistrationFailed AuditEventType = "registration.failed"
+	AuditEmailVerified      AuditEventType = "email.verified"
+	AuditVerificationFailed AuditEventType = "verification.failed"
+)
+
+// AuditEvent is a record of a security relevant action.
+// Fields that don't apply to the type are empty.
+type AuditEvent struct {
+	Time time.Time      `json:"time"`
+	Type AuditEventType `json:"type"`
+
+	// Username, or the user's ID where only it's known
+	User string `json:"user,omitempty"`
+
+	// Provider or component that emitted the event, e.g. "form"
+	Source string `json:"source,omitempty"`
+
+	// Consent
+	Client string   `json:"client,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+
+	// Why the action failed
+	Error string `json:"error,omitempty"`
+}
+
+// Auditor receives the events. Audit is called during requests, so it shouldn't block.
+type Auditor interface {
+	Audit(e *AuditEvent)
+}
+
+// NewAuditEvent describes an action done in the request, r can be nil
+func NewAuditEvent(r *http.Request, t AuditEventType, source, user string, err error) *AuditEvent {
+	e := &AuditEvent{
+		Time:   time.Now().UTC(),
+		Type:   t,
+		User:   user,
+		Source: source,
+	}
+
+	if r != nil {
+		e.RemoteAddr = r.RemoteAddr
+		e.RequestID = logging.RequestID(r.Context())
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	return e
+}
+
+// Audit passes the event to a, nil a is ignored
+func Audit(a Auditor, e *AuditEvent) {
+	if a != nil {
+		a.Audit(e)
+	}
+}
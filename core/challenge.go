@@ -2,8 +2,8 @@ package core
 
 import (
 	"encoding/gob"
-	"fmt"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/janekolszak/idp/logging"
 	// "github.com/gorilla/sessions"
 	hclient "github.com/ory-am/hydra/client"
 	"net/http"
@@ -41,9 +41,11 @@ func (c *Challenge) Save(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	fmt.Println("MaxAge", session.Options.MaxAge)
 	session.Options = c.idp.createChallengeCookieOptions
-	fmt.Println("MaxAge", session.Options.MaxAge)
+	logging.Debug(r.Context(), c.idp.config.Logger, "challenge saved", logging.Fields{
+		"user":    c.User,
+		"max_age": session.Options.MaxAge,
+	})
 
 	session.Values[SessionCookieName] = c
 	return c.idp.config.ChallengeStore.Save(r, w, session)
@@ -59,18 +61,42 @@ func (c *Challenge) Delete(w http.ResponseWriter, r *http.Request) error {
 	return c.idp.config.ChallengeStore.Save(r, w, session)
 }
 
-func (c *Challenge) RefuseAccess(w http.ResponseWriter, r *http.Request) error {
-	err := c.Delete(w, r)
+func (c *Challenge) audit(r *http.Request, t AuditEventType) {
+	e := NewAuditEvent(r, t, "consent", c.User, nil)
+	if c.Client != nil {
+		e.Client = c.Client.GetID()
+	}
+	e.Scopes = c.Scopes
+	Audit(c.idp.config.Auditor, e)
+}
+
+func (c *Challenge) observeConsent(granted bool, err error) {
+	if c.idp.config.Observer != nil {
+		c.idp.config.Observer.ObserveConsent(granted, err)
+	}
+}
+
+func (c *Challenge) RefuseAccess(w http.ResponseWriter, r *http.Request) (err error) {
+	defer func() {
+		c.observeConsent(false, err)
+	}()
+
+	err = c.Delete(w, r)
 	if err != nil {
 		return err
 	}
 
+	c.audit(r, AuditConsentRefused)
 	http.Redirect(w, r, c.Redirect+"&consent=false", http.StatusFound)
 
 	return nil
 }
 
-func (c *Challenge) GrantAccessToAll(w http.ResponseWriter, r *http.Request) error {
+func (c *Challenge) GrantAccessToAll(w http.ResponseWriter, r *http.Request) (err error) {
+	defer func() {
+		c.observeConsent(true, err)
+	}()
+
 	now := time.Now()
 
 	// TODO: Validate Challenge before using the data
@@ -107,6 +133,7 @@ func (c *Challenge) GrantAccessToAll(w http.ResponseWriter, r *http.Request) err
 		return ErrorChallengeExpired
 	}
 
+	c.audit(r, AuditConsentGranted)
 	http.Redirect(w, r, c.Redirect+"&consent="+tokenString, http.StatusFound)
 
 	return nil
@@ -2,6 +2,8 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -25,4 +27,32 @@ var (
 	ErrorPasswordMismatch      = errors.New("passwords don't match")
 	ErrorComplexityFailed      = errors.New("complexity failed")
 	ErrorNotImplemented        = errors.New("not implemented")
+	ErrorUnknownHashFormat     = errors.New("unknown password hash format")
+	ErrorTokenExpired          = errors.New("token expired")
+	ErrorBadEmailMessage       = errors.New("bad email message")
+	ErrorTooManyRequests       = errors.New("too many requests")
+	ErrorNotVerified           = errors.New("email address isn't verified")
+	ErrorVerificationResent    = errors.New("verification email was sent again")
+	ErrorAccountLocked         = errors.New("account is temporarily locked")
+	ErrorSecondFactorRequired  = errors.New("second factor is required")
+	ErrorBadSecondFactor       = errors.New("bad second factor code")
+	ErrorSecondFactorEnabled   = errors.New("second factor is already enabled")
+	ErrorCertificateRevoked    = errors.New("certificate is revoked")
+	ErrorOutdatedCRL           = errors.New("certificate revocation list is outdated")
+	ErrorNotRunning            = errors.New("not running")
 )
+
+// ErrorRetryLater is returned when a request is rate limited, but can be repeated after some time
+type ErrorRetryLater struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrorRetryLater) Error() string {
+	// Rounded up, so the user won't be rejected again
+	minutes := int((e.RetryAfter + time.Minute - 1) / time.Minute)
+	if minutes <= 1 {
+		return "too many requests, try again in 1 minute"
+	}
+
+	return fmt.Sprintf("too many requests, try again in %d minutes", minutes)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"crypto/rsa"
 	"fmt"
 	"net/http"
@@ -8,13 +9,21 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/logging"
 	hclient "github.com/ory-am/hydra/client"
 	hjwk "github.com/ory-am/hydra/jwk"
 	hoauth2 "github.com/ory-am/hydra/oauth2"
 	hydra "github.com/ory-am/hydra/sdk"
 	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// TracerName is the name of the tracers of the library
+const TracerName = "github.com/janekolszak/idp"
+
 const (
 	VerifyPublicKey   = "VerifyPublic"
 	ConsentPrivateKey = "ConsentPrivate"
@@ -31,6 +40,18 @@ type IDPConfig struct {
 	ClientCacheExpiration time.Duration `yaml:"client_cache_expiration"`
 	CacheCleanupInterval  time.Duration `yaml:"cache_cleanup_interval"`
 	ChallengeStore        sessions.Store
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger `yaml:"-"`
+
+	// Optional, gets consent grants and refusals
+	Auditor Auditor `yaml:"-"`
+
+	// Optional, e.g. for metrics
+	Observer Observer `yaml:"-"`
+
+	// Optional, defaults to OpenTelemetry's global provider
+	TracerProvider trace.TracerProvider `yaml:"-"`
 }
 
 type IDP struct {
@@ -51,6 +72,14 @@ type IDP struct {
 	deleteChallengeCookieOptions *sessions.Options
 }
 
+func (idp *IDP) tracer() trace.Tracer {
+	tp := idp.config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(TracerName)
+}
+
 func NewIDP(config *IDPConfig) *IDP {
 	var idp = new(IDP)
 	idp.config = config
@@ -74,44 +103,117 @@ func NewIDP(config *IDPConfig) *IDP {
 	return idp
 }
 
+func (idp *IDP) observeCache(key string, hit bool) {
+	if idp.config.Observer != nil {
+		idp.config.Observer.ObserveCache(key, hit)
+	}
+}
+
+func (idp *IDP) observeRefresh(key string, err error) {
+	if idp.config.Observer != nil {
+		idp.config.Observer.ObserveCacheRefresh(key, err)
+	}
+}
+
 // Called when any key expires
 func (idp *IDP) refreshCache(key string) {
+	ctx, span := idp.tracer().Start(context.Background(), "idp.RefreshCache",
+		trace.WithAttributes(attribute.String("idp.cache.key", key)))
+	defer span.End()
+
+	err := idp.refresh(ctx, key)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logging.Warn(ctx, idp.config.Logger, "refreshing cached data from hydra failed", logging.Fields{
+			"key":   key,
+			"error": err,
+		})
+	}
+	idp.observeRefresh(key, err)
+}
+
+func (idp *IDP) refresh(ctx context.Context, key string) error {
 	switch key {
 	case VerifyPublicKey:
-		verifyKey, err := idp.getVerificationKey()
-		if err != nil {
+		var verifyKey *rsa.PublicKey
+		err := idp.callHydra(ctx, "GetVerificationKey", func(ctx context.Context) (err error) {
+			verifyKey, err = idp.getVerificationKey(ctx)
 			return
+		})
+		if err != nil {
+			return err
 		}
 		idp.cache.Set(VerifyPublicKey, verifyKey, cache.DefaultExpiration)
-		return
 
 	case ConsentPrivateKey:
-		consentKey, err := idp.getConsentKey()
-		if err != nil {
+		var consentKey *rsa.PrivateKey
+		err := idp.callHydra(ctx, "GetConsentKey", func(ctx context.Context) (err error) {
+			consentKey, err = idp.getConsentKey(ctx)
 			return
+		})
+		if err != nil {
+			return err
 		}
 		idp.cache.Set(ConsentPrivateKey, consentKey, cache.DefaultExpiration)
-		return
 
 	case ClientInfo:
-
-		clients, err := idp.hc.Client.GetClients()
-		if err != nil {
+		var clients map[string]*hclient.Client
+		err := idp.callHydra(ctx, "GetClients", func(ctx context.Context) (err error) {
+			clients, err = idp.getClients(ctx)
 			return
+		})
+		if err != nil {
+			return err
 		}
 		idp.cache.Set(ClientInfo, clients, idp.config.ClientCacheExpiration)
+	}
 
-		return
+	return nil
+}
 
-	default:
-		return
+// Hydra's managers take no context. The copy sends its requests with ctx,
+// so they're canceled with it.
+func (idp *IDP) jwkManager(ctx context.Context) *hjwk.HTTPManager {
+	m := *idp.hc.JWK
+	m.Client = clientWithContext(ctx, m.Client)
+	return &m
+}
+
+func (idp *IDP) clientManager(ctx context.Context) *hclient.HTTPManager {
+	m := *idp.hc.Client
+	m.Client = clientWithContext(ctx, m.Client)
+	return &m
+}
+
+// Returns a copy of the client whose requests are sent with ctx
+func clientWithContext(ctx context.Context, client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
 	}
+
+	c := *client
+	c.Transport = &contextTransport{ctx: ctx, base: base}
+	return &c
 }
 
-// Downloads the hydra's public key
-func (idp *IDP) getVerificationKey() (*rsa.PublicKey, error) {
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(r.WithContext(t.ctx))
+}
 
-	jwk, err := idp.hc.JWK.GetKey(hoauth2.ConsentChallengeKey, "public")
+// Downloads the hydra's public key
+func (idp *IDP) getVerificationKey(ctx context.Context) (*rsa.PublicKey, error) {
+	jwk, err := idp.jwkManager(ctx).GetKey(hoauth2.ConsentChallengeKey, "public")
 	if err != nil {
 		return nil, err
 	}
@@ -125,8 +227,8 @@ func (idp *IDP) getVerificationKey() (*rsa.PublicKey, error) {
 }
 
 // Downloads the private key used for signing the consent
-func (idp *IDP) getConsentKey() (*rsa.PrivateKey, error) {
-	jwk, err := idp.hc.JWK.GetKey(hoauth2.ConsentEndpointKey, "private")
+func (idp *IDP) getConsentKey(ctx context.Context) (*rsa.PrivateKey, error) {
+	jwk, err := idp.jwkManager(ctx).GetKey(hoauth2.ConsentEndpointKey, "private")
 	if err != nil {
 		return nil, err
 	}
@@ -139,8 +241,38 @@ func (idp *IDP) getConsentKey() (*rsa.PrivateKey, error) {
 	return rsaKey, nil
 }
 
+func (idp *IDP) getClients(ctx context.Context) (map[string]*hclient.Client, error) {
+	return idp.clientManager(ctx).GetClients()
+}
+
+// Hydra's call in a span. The call gets the span's context.
+func (idp *IDP) callHydra(ctx context.Context, name string, call func(ctx context.Context) error) error {
+	ctx, span := idp.tracer().Start(ctx, "hydra."+name, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	err := call(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
 func (idp *IDP) Connect() error {
-	var err error
+	return idp.ConnectContext(context.Background())
+}
+
+// ConnectContext cancels the requests to Hydra when the context is done
+func (idp *IDP) ConnectContext(ctx context.Context) (err error) {
+	ctx, span := idp.tracer().Start(ctx, "idp.Connect")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	idp.hc, err = hydra.Connect(
 		hydra.ClientID(idp.config.ClientID),
 		hydra.ClientSecret(idp.config.ClientSecret),
@@ -152,17 +284,29 @@ func (idp *IDP) Connect() error {
 		return err
 	}
 
-	verifyKey, err := idp.getVerificationKey()
+	var verifyKey *rsa.PublicKey
+	err = idp.callHydra(ctx, "GetVerificationKey", func(ctx context.Context) (err error) {
+		verifyKey, err = idp.getVerificationKey(ctx)
+		return
+	})
 	if err != nil {
 		return err
 	}
 
-	consentKey, err := idp.getConsentKey()
+	var consentKey *rsa.PrivateKey
+	err = idp.callHydra(ctx, "GetConsentKey", func(ctx context.Context) (err error) {
+		consentKey, err = idp.getConsentKey(ctx)
+		return
+	})
 	if err != nil {
 		return err
 	}
 
-	clients, err := idp.hc.Client.GetClients()
+	var clients map[string]*hclient.Client
+	err = idp.callHydra(ctx, "GetClients", func(ctx context.Context) (err error) {
+		clients, err = idp.getClients(ctx)
+		return
+	})
 	if err != nil {
 		return err
 	}
@@ -171,6 +315,10 @@ func (idp *IDP) Connect() error {
 	idp.cache.Set(ConsentPrivateKey, consentKey, cache.DefaultExpiration)
 	idp.cache.Set(ClientInfo, clients, idp.config.ClientCacheExpiration)
 
+	logging.Info(ctx, idp.config.Logger, "connected to hydra", logging.Fields{
+		"cluster_url": idp.config.ClusterURL,
+		"clients":     len(clients),
+	})
 	return err
 }
 
@@ -196,8 +344,27 @@ func (idp *IDP) getChallengeToken(challengeString string) (*jwt.Token, error) {
 	return token, nil
 }
 
+// Ready checks that the keys and clients from Hydra are cached,
+// e.g. for the readiness probe. Doesn't contact Hydra.
+func (idp *IDP) Ready(ctx context.Context) error {
+	if _, ok := idp.cache.Get(VerifyPublicKey); !ok {
+		return ErrorNotInCache
+	}
+
+	if _, ok := idp.cache.Get(ConsentPrivateKey); !ok {
+		return ErrorNotInCache
+	}
+
+	if _, ok := idp.cache.Get(ClientInfo); !ok {
+		return ErrorNotInCache
+	}
+
+	return nil
+}
+
 func (idp *IDP) GetConsentKey() (*rsa.PrivateKey, error) {
 	data, ok := idp.cache.Get(ConsentPrivateKey)
+	idp.observeCache(ConsentPrivateKey, ok)
 	if !ok {
 		return nil, ErrorNotInCache
 	}
@@ -212,6 +379,7 @@ func (idp *IDP) GetConsentKey() (*rsa.PrivateKey, error) {
 
 func (idp *IDP) GetVerificationKey() (*rsa.PublicKey, error) {
 	data, ok := idp.cache.Get(VerifyPublicKey)
+	idp.observeCache(VerifyPublicKey, ok)
 	if !ok {
 		return nil, ErrorNotInCache
 	}
@@ -226,6 +394,7 @@ func (idp *IDP) GetVerificationKey() (*rsa.PublicKey, error) {
 
 func (idp *IDP) GetClient(clientID string) (*hclient.Client, error) {
 	data, ok := idp.cache.Get(ClientInfo)
+	idp.observeCache(ClientInfo, ok)
 	if !ok {
 		return nil, ErrorNotInCache
 	}
@@ -243,7 +412,21 @@ func (idp *IDP) GetClient(clientID string) (*hclient.Client, error) {
 	return client, nil
 }
 
+// NewChallenge verifies the challenge from Hydra with the cached keys, the request's context is used for tracing
 func (idp *IDP) NewChallenge(r *http.Request, user string) (challenge *Challenge, err error) {
+	_, span := idp.tracer().Start(r.Context(), "idp.NewChallenge")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		if idp.config.Observer != nil {
+			idp.config.Observer.ObserveChallenge(err)
+		}
+	}()
+
 	tokenStr := r.FormValue("challenge")
 	if tokenStr == "" {
 		// No challenge token
@@ -286,7 +469,17 @@ func (idp *IDP) NewChallenge(r *http.Request, user string) (challenge *Challenge
 	return
 }
 
-func (idp *IDP) GetChallenge(r *http.Request) (*Challenge, error) {
+// GetChallenge reads the challenge saved in the cookie, the request's context is used for tracing
+func (idp *IDP) GetChallenge(r *http.Request) (challenge *Challenge, err error) {
+	_, span := idp.tracer().Start(r.Context(), "idp.GetChallenge")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	session, err := idp.config.ChallengeStore.Get(r, SessionCookieName)
 	if err != nil {
 		return nil, err
@@ -307,7 +500,7 @@ func (idp *IDP) GetChallenge(r *http.Request) (*Challenge, error) {
 }
 
 func (idp *IDP) Close() {
-	fmt.Println("IDP closed")
+	logging.Info(context.Background(), idp.config.Logger, "IDP closed", nil)
 	idp.client = nil
 
 	// Removes all keys from the cache
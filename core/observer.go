@@ -0,0 +1,15 @@
+package core
+
+// Observer is notified about the challenge flow and the cache of Hydra's data,
+// e.g. metrics.Metrics. Methods are called during requests, so they shouldn't block.
+type Observer interface {
+	// NewChallenge finished
+	ObserveChallenge(err error)
+
+	// GrantAccessToAll or RefuseAccess finished
+	ObserveConsent(granted bool, err error)
+
+	// Key is VerifyPublicKey, ConsentPrivateKey or ClientInfo
+	ObserveCache(key string, hit bool)
+	ObserveCacheRefresh(key string, err error)
+}
@@ -16,3 +16,10 @@ type Provider interface {
 	Write(w http.ResponseWriter, r *http.Request) error
 	WriteError(w http.ResponseWriter, r *http.Request, err error) error
 }
+
+// IsSubmission tells whether the request carries credentials, i.e. it's a POST
+// or has the Authorization header. Check fails for other requests too,
+// e.g. the ones displaying the login form, but they aren't failed logins.
+func IsSubmission(r *http.Request) bool {
+	return r.Method == http.MethodPost || r.Header.Get("Authorization") != ""
+}
@@ -151,11 +151,13 @@ func main() {
 	hydraConfig := helpers.NewHydraConfig(*configPath)
 
 	// Setup the providers
-	var err error
-	provider, err = basic.NewBasicAuth(*htpasswdPath, "localhost")
+	basicAuth, err := basic.NewBasicAuth(*htpasswdPath, "localhost")
 	if err != nil {
 		panic(err)
 	}
+	basicAuth.Htpasswd.Watch(5 * time.Second)
+	defer basicAuth.Htpasswd.Close()
+	provider = basicAuth
 
 	dbCookieStore, err := cookie.NewDBStore("sqlite3", *cookieDBPath)
 	if err != nil {
@@ -4,11 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/health"
 	"github.com/janekolszak/idp/helpers"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/metrics"
 	"github.com/janekolszak/idp/providers/cookie"
 	"github.com/janekolszak/idp/providers/form"
 	"github.com/janekolszak/idp/userdb/memory"
@@ -76,13 +80,21 @@ func main() {
 		panic(err)
 	}
 
+	logger := logging.NewJSONLogger(os.Stderr, logging.LevelInfo)
+
+	m, err := metrics.New(metrics.Config{})
+	if err != nil {
+		panic(err)
+	}
+
 	provider, err := form.NewFormAuth(form.Config{
+		Logger:             logger,
 		LoginForm:          loginform,
 		LoginUsernameField: "username",
 		LoginPasswordField: "password",
 
 		// Store for
-		UserStore: userdb,
+		UserStore: &metrics.UserStore{Store: userdb, Name: "users", Metrics: m},
 
 		// Validation options:
 		Username: form.Complexity{
@@ -106,7 +118,7 @@ func main() {
 	}
 
 	cookieProvider := &cookie.CookieAuth{
-		Store:  dbCookieStore,
+		Store:  &metrics.CookieStore{Store: dbCookieStore, Name: "remember_me", Metrics: m},
 		MaxAge: time.Minute * 1,
 	}
 
@@ -120,6 +132,8 @@ func main() {
 
 		// TODO: [IMPORTANT] Don't use CookieStore here
 		ChallengeStore: sessions.NewCookieStore([]byte("something-very-secret")),
+		Logger:         logger,
+		Observer:       m,
 	})
 
 	// Connect with Hydra
@@ -130,15 +144,27 @@ func main() {
 
 	handler, err := CreateHandler(HandlerConfig{
 		IDP:            idp,
-		Provider:       provider,
+		Provider:       &metrics.Provider{Provider: provider, Name: "form", Metrics: m},
 		CookieProvider: cookieProvider,
 		ConsentForm:    consent,
 		StaticFiles:    *staticFiles,
 	})
 
+	// Probes don't require a challenge
+	probes, err := health.New(health.Config{Checks: map[string]health.Check{
+		"hydra":   idp.Ready,
+		"cookies": dbCookieStore.PingContext,
+	}})
+	if err != nil {
+		panic(err)
+	}
+
 	router := httprouter.New()
 	handler.Attach(router)
-	http.ListenAndServe(":3000", router)
+	router.Handler("GET", "/metrics", m.Handler())
+	router.HandlerFunc("GET", "/healthz", probes.Liveness)
+	router.HandlerFunc("GET", "/readyz", probes.Readiness)
+	http.ListenAndServe(":3000", logging.RequestIDHandler(router))
 
 	idp.Close()
 }
@@ -0,0 +1,151 @@
+// Package health serves liveness and readiness probes.
+//
+// Readiness runs named checks of the dependencies, e.g. IDP.Ready, stores' PingContext
+// and Verifier.Ready, and reports the result of each one as JSON.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Check returns nil if the dependency works
+type Check func(ctx context.Context) error
+
+type Config struct {
+	// Dependencies checked by the readiness probe, by name
+	Checks map[string]Check
+
+	// Limits every check, defaults to 5s
+	Timeout time.Duration
+
+	// Leaves the errors out of the report, they can reveal e.g. the addresses
+	// of the databases. Set it if anyone can reach the probes.
+	HideErrors bool
+}
+
+// Result of one check
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+type Health struct {
+	Config
+}
+
+func New(c Config) (*Health, error) {
+	if c.Timeout < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	for _, check := range c.Checks {
+		if check == nil {
+			return nil, core.ErrorInvalidConfig
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	return &Health{Config: c}, nil
+}
+
+// Checks don't have to respect the context, hanging ones fail after the Timeout
+func (h *Health) run(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check runs all checks concurrently
+func (h *Health) Check(ctx context.Context) *Report {
+	report := &Report{
+		Status: StatusOK,
+		Checks: make(map[string]Result, len(h.Checks)),
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.Checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := h.run(ctx, check)
+			result := Result{
+				Status:   StatusOK,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				result.Status = StatusError
+				if !h.HideErrors {
+					result.Error = err.Error()
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Checks[name] = result
+			if err != nil {
+				report.Status = StatusError
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func write(w http.ResponseWriter, report *Report) {
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Liveness reports that the process serves requests, it doesn't check dependencies
+func (h *Health) Liveness(w http.ResponseWriter, r *http.Request) {
+	write(w, &Report{Status: StatusOK})
+}
+
+// Readiness responds with 503 Service Unavailable if any check fails
+func (h *Health) Readiness(w http.ResponseWriter, r *http.Request) {
+	write(w, h.Check(r.Context()))
+}
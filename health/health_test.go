@@ -0,0 +1,124 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testFileName = "/tmp/idp_health_test.db3"
+
+func get(handler http.HandlerFunc) (*httptest.ResponseRecorder, *Report) {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	report := &Report{}
+	json.Unmarshal(w.Body.Bytes(), report)
+	return w, report
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New(Config{Timeout: -time.Second})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = New(Config{Checks: map[string]Check{"store": nil}})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	h, err := New(Config{})
+	assert.Nil(err)
+	assert.Equal(defaultTimeout, h.Timeout)
+
+	w, report := get(h.Readiness)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(StatusOK, report.Status)
+}
+
+func TestReadiness(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := New(Config{
+		Checks: map[string]Check{
+			"ok":     func(ctx context.Context) error { return nil },
+			"failed": func(ctx context.Context) error { return errors.New("connection refused") },
+			"hanging": func(ctx context.Context) error {
+				time.Sleep(time.Minute)
+				return nil
+			},
+		},
+		Timeout: 50 * time.Millisecond,
+	})
+	assert.Nil(err)
+
+	start := time.Now()
+	w, report := get(h.Readiness)
+	assert.True(time.Since(start) < time.Second)
+
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal("no-store", w.Header().Get("Cache-Control"))
+
+	assert.Equal(StatusError, report.Status)
+	assert.Equal(StatusOK, report.Checks["ok"].Status)
+	assert.Equal("", report.Checks["ok"].Error)
+	assert.Equal(StatusError, report.Checks["failed"].Status)
+	assert.Equal("connection refused", report.Checks["failed"].Error)
+	assert.Equal(context.DeadlineExceeded.Error(), report.Checks["hanging"].Error)
+
+	// Dependencies aren't checked
+	w, report = get(h.Liveness)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(StatusOK, report.Status)
+	assert.Empty(report.Checks)
+}
+
+func TestHideErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := New(Config{
+		Checks: map[string]Check{
+			"failed": func(ctx context.Context) error { return errors.New("dial tcp 10.0.0.5:5432: connection refused") },
+		},
+		HideErrors: true,
+	})
+	assert.Nil(err)
+
+	w, report := get(h.Readiness)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(StatusError, report.Checks["failed"].Status)
+	assert.Equal("", report.Checks["failed"].Error)
+	assert.NotContains(w.Body.String(), "10.0.0.5")
+}
+
+func TestDependencies(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	store, err := cookie.NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+
+	idp := core.NewIDP(&core.IDPConfig{})
+
+	h, err := New(Config{Checks: map[string]Check{
+		"hydra":   idp.Ready,
+		"cookies": store.PingContext,
+	}})
+	assert.Nil(err)
+
+	w, report := get(h.Readiness)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(StatusOK, report.Checks["cookies"].Status)
+	assert.Equal(core.ErrorNotInCache.Error(), report.Checks["hydra"].Error)
+}
@@ -16,14 +16,24 @@ type HydraConfig struct {
 }
 
 // IdP has its credentials preconfigured by Hydra.
-// This function parses the yaml file with that information
-func NewHydraConfig(path string) *HydraConfig {
-	config := new(HydraConfig)
+// LoadHydraConfig parses the yaml file with that information.
+func LoadHydraConfig(path string) (*HydraConfig, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
+	config := new(HydraConfig)
 	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// NewHydraConfig is LoadHydraConfig that panics on errors
+func NewHydraConfig(path string) *HydraConfig {
+	config, err := LoadHydraConfig(path)
 	if err != nil {
 		panic(err)
 	}
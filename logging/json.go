@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLogger writes every entry as a line of JSON, e.g.
+//
+//	{"time":"2017-06-01T12:00:00Z","level":"error","msg":"sending failed","error":"timeout"}
+type JSONLogger struct {
+	// Entries below it are skipped
+	Level Level
+
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewJSONLogger(w io.Writer, level Level) *JSONLogger {
+	return &JSONLogger{Level: level, w: w}
+}
+
+func (l *JSONLogger) Log(level Level, msg string, fields Fields) {
+	if level < l.Level {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for name, value := range fields {
+		switch v := value.(type) {
+		case error:
+			// Most errors encode as {}
+			entry[name] = v.Error()
+		case fmt.Stringer:
+			entry[name] = v.String()
+		default:
+			entry[name] = v
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": LevelError.String(),
+			"msg":   "can't encode the log entry: " + err.Error(),
+		})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(append(line, '\n'))
+}
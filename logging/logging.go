@@ -0,0 +1,100 @@
+// Package logging is a small leveled, structured logger used across the library.
+//
+// Components take an optional Logger in their config. Without one nothing is logged.
+// Values of sensitive fields, like passwords and tokens, never reach the Logger.
+package logging
+
+import (
+	"context"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel accepts the names returned by Level.String
+func ParseLevel(name string) (Level, bool) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, true
+		}
+	}
+	return LevelInfo, false
+}
+
+// Fields describe the logged event, e.g. {"user": "joe", "error": err}
+type Fields map[string]interface{}
+
+// Logger is implemented by adapters of logging libraries
+type Logger interface {
+	Log(level Level, msg string, fields Fields)
+}
+
+// LoggerFunc adapts a function to the Logger interface
+type LoggerFunc func(level Level, msg string, fields Fields)
+
+func (f LoggerFunc) Log(level Level, msg string, fields Fields) {
+	f(level, msg, fields)
+}
+
+// Nop discards everything
+type Nop struct{}
+
+func (Nop) Log(level Level, msg string, fields Fields) {}
+
+// Log passes the entry to l with the request ID from the context and
+// sensitive fields redacted. Nil l is silent.
+func Log(ctx context.Context, l Logger, level Level, msg string, fields Fields) {
+	if l == nil {
+		return
+	}
+
+	out := redact(fields)
+	if ctx != nil {
+		if id := RequestID(ctx); id != "" {
+			if out == nil {
+				out = Fields{}
+			}
+			out[RequestIDField] = id
+		}
+	}
+
+	l.Log(level, msg, out)
+}
+
+func Debug(ctx context.Context, l Logger, msg string, fields Fields) {
+	Log(ctx, l, LevelDebug, msg, fields)
+}
+
+func Info(ctx context.Context, l Logger, msg string, fields Fields) {
+	Log(ctx, l, LevelInfo, msg, fields)
+}
+
+func Warn(ctx context.Context, l Logger, msg string, fields Fields) {
+	Log(ctx, l, LevelWarn, msg, fields)
+}
+
+func Error(ctx context.Context, l Logger, msg string, fields Fields) {
+	Log(ctx, l, LevelError, msg, fields)
+}
@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type entry struct {
+	level  Level
+	msg    string
+	fields Fields
+}
+
+type testLogger struct {
+	entries []entry
+}
+
+func (l *testLogger) Log(level Level, msg string, fields Fields) {
+	l.entries = append(l.entries, entry{level, msg, fields})
+}
+
+func TestLog(t *testing.T) {
+	assert := assert.New(t)
+
+	// Default is silent
+	Error(context.Background(), nil, "failed", Fields{"error": errors.New("x")})
+
+	l := &testLogger{}
+	fields := Fields{
+		"user":          "joe",
+		"password":      "secret1",
+		"new_Password":  "secret2",
+		"validator":     "abc",
+		"access_token":  "def",
+		"Authorization": "Basic am9lOnNlY3JldA==",
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	Warn(ctx, l, "login failed", fields)
+	Debug(context.Background(), l, "closed", nil)
+
+	assert.Len(l.entries, 2)
+	assert.Equal(LevelWarn, l.entries[0].level)
+	assert.Equal("login failed", l.entries[0].msg)
+	assert.Equal(Fields{
+		"user":          "joe",
+		"password":      Redacted,
+		"new_Password":  Redacted,
+		"validator":     Redacted,
+		"access_token":  Redacted,
+		"Authorization": Redacted,
+		RequestIDField:  "req-1",
+	}, l.entries[0].fields)
+
+	// Caller's fields aren't modified
+	assert.Equal("secret1", fields["password"])
+
+	assert.Equal(LevelDebug, l.entries[1].level)
+	assert.Nil(l.entries[1].fields)
+}
+
+func TestJSONLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var b bytes.Buffer
+	l := NewJSONLogger(&b, LevelInfo)
+
+	Debug(context.Background(), l, "skipped", nil)
+	Error(context.Background(), l, "sending failed", Fields{"error": errors.New("timeout"), "token": "abc"})
+	Info(context.Background(), l, "closed", nil)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Len(lines, 2)
+
+	var decoded map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(lines[0]), &decoded))
+	assert.Equal("error", decoded["level"])
+	assert.Equal("sending failed", decoded["msg"])
+	assert.Equal("timeout", decoded["error"])
+	assert.Equal(Redacted, decoded["token"])
+	assert.NotEmpty(decoded["time"])
+
+	assert.Contains(lines[1], `"msg":"closed"`)
+}
+
+func TestParseLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	level, ok := ParseLevel("WARN")
+	assert.True(ok)
+	assert.Equal(LevelWarn, level)
+
+	_, ok = ParseLevel("verbose")
+	assert.False(ok)
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	var id string
+	h := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = RequestID(r.Context())
+	}))
+
+	// From the proxy
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal("abc-123", id)
+	assert.Equal("abc-123", w.Header().Get(RequestIDHeader))
+
+	for _, header := range []string{"", "a b", "x\"}", strings.Repeat("a", 129)} {
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(RequestIDHeader, header)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Len(id, 36, header)
+		assert.Equal(id, w.Header().Get(RequestIDHeader))
+	}
+
+	assert.Equal("", RequestID(context.Background()))
+}
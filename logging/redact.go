@@ -0,0 +1,44 @@
+package logging
+
+import "strings"
+
+const Redacted = "[REDACTED]"
+
+// Fields with any of these in the lowercased name are redacted,
+// e.g. "password", "new_password", "validator" or "access_token"
+var SensitiveFields = []string{
+	"password",
+	"passwd",
+	"secret",
+	"validator",
+	"token",
+	"hash",
+	"cookie",
+	"authorization",
+}
+
+func IsSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range SensitiveFields {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy, callers may reuse the fields
+func redact(fields Fields) Fields {
+	if fields == nil {
+		return nil
+	}
+
+	out := make(Fields, len(fields))
+	for name, value := range fields {
+		if IsSensitive(name) {
+			value = Redacted
+		}
+		out[name] = value
+	}
+	return out
+}
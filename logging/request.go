@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	RequestIDHeader = "X-Request-Id"
+	RequestIDField  = "request_id"
+
+	// Longer IDs from the client are replaced
+	maxRequestIDLen = 128
+)
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns "" if the context has no ID
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// IDs from proxies end up in the logs, they can't contain anything else
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' ||
+			c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDHandler puts an ID into the context of every request,
+// so all entries logged for the request can be found.
+// The ID is taken from the X-Request-Id header set by a proxy, or generated.
+// It's returned in the same response header.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewV4().String()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
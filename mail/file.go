@@ -0,0 +1,61 @@
+package mail
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// FileMailer appends emails to a file instead of sending them.
+// Useful in tests and development.
+type FileMailer struct {
+	Filename string
+	From     string
+
+	mtx sync.Mutex
+}
+
+func (m *FileMailer) Send(message *Message) error {
+	err := message.validate()
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	f, err := os.OpenFile(m.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(message.bytes(m.From), "\r\n\r\n"...))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LogMailer prints emails with the logger instead of sending them.
+// Useful in development.
+type LogMailer struct {
+	// Defaults to the standard logger
+	Logger *log.Logger
+}
+
+func (m *LogMailer) Send(message *Message) error {
+	err := message.validate()
+	if err != nil {
+		return err
+	}
+
+	logger := m.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	logger.Printf("Email to %s\nSubject: %s\n\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
@@ -0,0 +1,53 @@
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mailTestFileName = "/tmp/idp_mail_test"
+)
+
+func TestFileMailer(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(mailTestFileName)
+
+	m := FileMailer{Filename: mailTestFileName, From: "idp@example.com"}
+
+	err := m.Send(&Message{To: "joe@example.com", Subject: "First", Body: "Body 1"})
+	assert.Nil(err)
+
+	err = m.Send(&Message{To: "bob@example.com", Subject: "Second", Body: "Body 2"})
+	assert.Nil(err)
+
+	err = m.Send(&Message{To: "", Subject: "Third", Body: "Body 3"})
+	assert.Equal(core.ErrorBadEmailMessage, err)
+
+	data, err := ioutil.ReadFile(mailTestFileName)
+	assert.Nil(err)
+	assert.Contains(string(data), "To: joe@example.com\r\nSubject: First\r\n")
+	assert.Contains(string(data), "Body 1")
+	assert.Contains(string(data), "To: bob@example.com\r\nSubject: Second\r\n")
+	assert.Contains(string(data), "Body 2")
+	assert.NotContains(string(data), "Body 3")
+}
+
+func TestLogMailer(t *testing.T) {
+	assert := assert.New(t)
+
+	var b bytes.Buffer
+	m := LogMailer{Logger: log.New(&b, "", 0)}
+
+	err := m.Send(&Message{To: "joe@example.com", Subject: "Hello", Body: "Body"})
+	assert.Nil(err)
+	assert.Contains(b.String(), "joe@example.com")
+	assert.Contains(b.String(), "Subject: Hello")
+	assert.Contains(b.String(), "Body")
+}
@@ -0,0 +1,51 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users, e.g. password reset links
+type Mailer interface {
+	Send(message *Message) error
+}
+
+// Formats the message according to RFC 5322
+func (m *Message) bytes(from string) []byte {
+	var b bytes.Buffer
+
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+
+	// Normalize line endings
+	body := strings.Replace(m.Body, "\r\n", "\n", -1)
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return b.Bytes()
+}
+
+// Header fields can't contain line breaks, otherwise headers could be injected
+func (m *Message) validate() error {
+	if m.To == "" || strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return core.ErrorBadEmailMessage
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	m := Message{
+		To:      "joe@example.com",
+		Subject: "Hello",
+		Body:    "Line 1\nLine 2\r\n",
+	}
+
+	b := string(m.bytes("idp@example.com"))
+	assert.True(strings.HasPrefix(b, "From: idp@example.com\r\nTo: joe@example.com\r\nSubject: Hello\r\n"))
+	assert.True(strings.HasSuffix(b, "\r\n\r\nLine 1\r\nLine 2\r\n"))
+}
+
+func TestMessageValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	m := Message{To: "joe@example.com", Subject: "Hello"}
+	assert.Nil(m.validate())
+
+	m = Message{To: "", Subject: "Hello"}
+	assert.Equal(core.ErrorBadEmailMessage, m.validate())
+
+	m = Message{To: "joe@example.com\r\nBcc: bob@example.com", Subject: "Hello"}
+	assert.Equal(core.ErrorBadEmailMessage, m.validate())
+
+	m = Message{To: "joe@example.com", Subject: "Hello\nBcc: bob@example.com"}
+	assert.Equal(core.ErrorBadEmailMessage, m.validate())
+}
@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"crypto/tls"
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends emails through an SMTP server.
+// STARTTLS is used when the server supports it.
+type SMTPMailer struct {
+	// host:port of the server
+	Address string
+
+	// Optional, e.g. smtp.PlainAuth
+	Auth smtp.Auth
+
+	// Sender's address
+	From string
+
+	// Used for STARTTLS, defaults to verifying the server's host name
+	TLSConfig *tls.Config
+}
+
+func (m *SMTPMailer) Send(message *Message) error {
+	err := message.validate()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.Address)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.Dial(m.Address)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := m.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+
+		err = c.StartTLS(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Auth != nil {
+		err = c.Auth(m.Auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(m.From)
+	if err != nil {
+		return err
+	}
+
+	err = c.Rcpt(message.To)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(message.bytes(m.From))
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
@@ -0,0 +1,124 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Minimal SMTP server, records the envelope and the data of one session
+type testSMTPServer struct {
+	listener net.Listener
+	auth     string
+	from     string
+	to       string
+	data     string
+	done     chan bool
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSMTPServer{listener: l, done: make(chan bool)}
+	go s.serve()
+	return s
+}
+
+func (s *testSMTPServer) serve() {
+	defer close(s.done)
+
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = line
+			reply("235 Authentication successful")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.to = line
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data = append(data, l)
+			}
+			s.data = strings.Join(data, "")
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestSMTPServer(t)
+	defer s.listener.Close()
+
+	m := SMTPMailer{
+		Address: s.listener.Addr().String(),
+		Auth:    smtp.PlainAuth("", "user", "password", "127.0.0.1"),
+		From:    "idp@example.com",
+	}
+
+	err := m.Send(&Message{To: "joe@example.com", Subject: "Hello", Body: "Body"})
+	assert.Nil(err)
+	<-s.done
+
+	assert.True(strings.HasPrefix(s.auth, "AUTH PLAIN"))
+	assert.Equal("MAIL FROM:<idp@example.com>", s.from)
+	assert.Equal("RCPT TO:<joe@example.com>", s.to)
+	assert.Contains(s.data, "To: joe@example.com\r\n")
+	assert.Contains(s.data, "Subject: Hello\r\n")
+	assert.Contains(s.data, "\r\n\r\nBody")
+}
+
+func TestSMTPMailerBadMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	m := SMTPMailer{Address: "127.0.0.1:1", From: "idp@example.com"}
+	err := m.Send(&Message{To: "joe@example.com\nBcc: bob@example.com", Subject: "Hello"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Error classes used as label values. Errors are grouped, so the labels
+// have few values and messages with user data don't end up in the metrics.
+var errorClasses = map[error]string{
+	core.ErrorAuthenticationFailure: "authentication_failure",
+	core.ErrorBadRequest:            "bad_request",
+	core.ErrorNoSuchUser:            "no_such_user",
+	core.ErrorUserAlreadyExists:     "user_exists",
+	core.ErrorNotVerified:           "not_verified",
+	core.ErrorAccountLocked:         "locked",
+	core.ErrorTooManyRequests:       "rate_limited",
+	core.ErrorSessionExpired:        "expired",
+	core.ErrorChallengeExpired:      "expired",
+	core.ErrorTokenExpired:          "expired",
+	core.ErrorPasswordMismatch:      "bad_request",
+	core.ErrorComplexityFailed:      "bad_request",
+	core.ErrorSecondFactorRequired:  "second_factor_required",
+	core.ErrorBadSecondFactor:       "authentication_failure",
+	core.ErrorCertificateRevoked:    "revoked",
+	core.ErrorNotInCache:            "not_in_cache",
+	core.ErrorNoSuchClient:          "no_such_client",
+	core.ErrorNotImplemented:        "not_implemented",
+	context.Canceled:                "canceled",
+	context.DeadlineExceeded:        "timeout",
+	sql.ErrNoRows:                   "not_found",
+}
+
+// ErrorClass returns "" for nil and "other" for errors it doesn't know
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	if class, ok := errorClasses[err]; ok {
+		return class
+	}
+
+	if _, ok := err.(*core.ErrorRetryLater); ok {
+		return "rate_limited"
+	}
+
+	return "other"
+}
@@ -0,0 +1,179 @@
+// Package metrics exposes Prometheus metrics of the IdP.
+//
+// Metrics implements core.Observer for the challenge flow and Hydra's cache.
+// Providers and stores are instrumented by wrapping them, e.g. with Provider and CookieStore.
+// Labels never contain usernames, only names of the providers and stores, outcomes and error classes.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultNamespace = "idp"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+type Config struct {
+	// Prefix of the metric names, defaults to "idp"
+	Namespace string
+
+	// Defaults to a new registry with the Go runtime metrics
+	Registry *prometheus.Registry
+
+	// Histogram buckets in seconds, defaults to prometheus.DefBuckets
+	Buckets []float64
+}
+
+type Metrics struct {
+	Config
+
+	logins        *prometheus.CounterVec
+	loginDuration *prometheus.HistogramVec
+	registrations *prometheus.CounterVec
+	challenges    *prometheus.CounterVec
+	consents      *prometheus.CounterVec
+	cache         *prometheus.CounterVec
+	refreshes     *prometheus.CounterVec
+	storeDuration *prometheus.HistogramVec
+}
+
+func New(c Config) (*Metrics, error) {
+	if c.Namespace == "" {
+		c.Namespace = defaultNamespace
+	}
+
+	if c.Registry == nil {
+		c.Registry = prometheus.NewRegistry()
+		c.Registry.MustRegister(prometheus.NewGoCollector())
+	}
+
+	if len(c.Buckets) == 0 {
+		c.Buckets = prometheus.DefBuckets
+	}
+
+	m := &Metrics{Config: c}
+
+	m.logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts checked by the providers.",
+	}, []string{"provider", "outcome", "error"})
+
+	m.loginDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: c.Namespace,
+		Name:      "login_duration_seconds",
+		Help:      "Time the providers took to check the login attempts.",
+		Buckets:   c.Buckets,
+	}, []string{"provider", "outcome"})
+
+	m.registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "registrations_total",
+		Help:      "Users registered by the providers.",
+	}, []string{"provider", "outcome", "error"})
+
+	m.challenges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "challenges_total",
+		Help:      "Hydra's challenges received after the user was authenticated.",
+	}, []string{"outcome", "error"})
+
+	m.consents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "consents_total",
+		Help:      "Answers to the consent requests.",
+	}, []string{"decision", "outcome", "error"})
+
+	m.cache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "cache_requests_total",
+		Help:      "Lookups of the keys and clients cached from Hydra.",
+	}, []string{"key", "result"})
+
+	m.refreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: c.Namespace,
+		Name:      "cache_refreshes_total",
+		Help:      "Downloads of expired keys and clients from Hydra.",
+	}, []string{"key", "outcome", "error"})
+
+	m.storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: c.Namespace,
+		Name:      "store_duration_seconds",
+		Help:      "Time of the calls to the cookie, user and verification stores.",
+		Buckets:   c.Buckets,
+	}, []string{"store", "operation", "outcome", "error"})
+
+	for _, collector := range []prometheus.Collector{
+		m.logins,
+		m.loginDuration,
+		m.registrations,
+		m.challenges,
+		m.consents,
+		m.cache,
+		m.refreshes,
+		m.storeDuration,
+	} {
+		err := c.Registry.Register(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Handler serves the metrics, e.g. on /metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+func (m *Metrics) ObserveLogin(provider string, err error, duration time.Duration) {
+	m.logins.WithLabelValues(provider, outcome(err), ErrorClass(err)).Inc()
+	m.loginDuration.WithLabelValues(provider, outcome(err)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveRegistration(provider string, err error) {
+	m.registrations.WithLabelValues(provider, outcome(err), ErrorClass(err)).Inc()
+}
+
+func (m *Metrics) ObserveStore(store, operation string, err error, duration time.Duration) {
+	m.storeDuration.WithLabelValues(store, operation, outcome(err), ErrorClass(err)).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveChallenge(err error) {
+	m.challenges.WithLabelValues(outcome(err), ErrorClass(err)).Inc()
+}
+
+func (m *Metrics) ObserveConsent(granted bool, err error) {
+	decision := "refused"
+	if granted {
+		decision = "granted"
+	}
+	m.consents.WithLabelValues(decision, outcome(err), ErrorClass(err)).Inc()
+}
+
+func (m *Metrics) ObserveCache(key string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cache.WithLabelValues(key, result).Inc()
+}
+
+func (m *Metrics) ObserveCacheRefresh(key string, err error) {
+	m.refreshes.WithLabelValues(key, outcome(err), ErrorClass(err)).Inc()
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/fail"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_metrics_test.db3"
+)
+
+func scrape(m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := New(Config{})
+	assert.Nil(err)
+	assert.Equal("idp", m.Namespace)
+	assert.Contains(scrape(m), "go_goroutines")
+
+	// Metrics are already registered
+	registry := prometheus.NewRegistry()
+	_, err = New(Config{Registry: registry})
+	assert.Nil(err)
+	_, err = New(Config{Registry: registry})
+	assert.NotNil(err)
+
+	_, err = New(Config{Registry: registry, Namespace: "other"})
+	assert.Nil(err)
+}
+
+func TestProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := New(Config{})
+	assert.Nil(err)
+
+	failure := fail.Result{User: "joe", Err: core.ErrorAuthenticationFailure}
+	scripted := fail.NewScripted(fail.Result{User: "joe"}, failure, failure)
+	scripted.QueueRegister(fail.Result{Err: errors.New("joe can't be registered")})
+
+	var p core.Provider = &Provider{Provider: scripted, Name: "form", Metrics: m}
+	p.Check(httptest.NewRequest("GET", "/", nil))
+
+	// Displaying the form isn't a failed login
+	p.Check(httptest.NewRequest("GET", "/", nil))
+	p.Check(httptest.NewRequest("POST", "/", nil))
+	p.Register(httptest.NewRequest("POST", "/", nil))
+
+	body := scrape(m)
+	assert.Contains(body, `idp_logins_total{error="",outcome="success",provider="form"} 1`)
+	assert.Contains(body, `idp_logins_total{error="authentication_failure",outcome="failure",provider="form"} 1`)
+	assert.Contains(body, `idp_login_duration_seconds_count{outcome="success",provider="form"} 1`)
+	assert.Contains(body, `idp_registrations_total{error="other",outcome="failure",provider="form"} 1`)
+	assert.NotContains(body, "joe")
+}
+
+func TestObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := New(Config{})
+	assert.Nil(err)
+
+	var observer core.Observer = m
+	observer.ObserveChallenge(core.ErrorChallengeExpired)
+	observer.ObserveConsent(true, nil)
+	observer.ObserveConsent(false, nil)
+	observer.ObserveCache(core.ClientInfo, true)
+	observer.ObserveCache(core.ClientInfo, false)
+	observer.ObserveCacheRefresh(core.VerifyPublicKey, context.DeadlineExceeded)
+
+	body := scrape(m)
+	assert.Contains(body, `idp_challenges_total{error="expired",outcome="failure"} 1`)
+	assert.Contains(body, `idp_consents_total{decision="granted",error="",outcome="success"} 1`)
+	assert.Contains(body, `idp_consents_total{decision="refused",error="",outcome="success"} 1`)
+	assert.Contains(body, `idp_cache_requests_total{key="ClientInfo",result="hit"} 1`)
+	assert.Contains(body, `idp_cache_requests_total{key="ClientInfo",result="miss"} 1`)
+	assert.Contains(body, `idp_cache_refreshes_total{error="timeout",key="VerifyPublic",outcome="failure"} 1`)
+}
+
+func TestCookieStore(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	m, err := New(Config{})
+	assert.Nil(err)
+
+	db, err := cookie.NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer db.Close()
+
+	var store cookie.ContextStore = &CookieStore{Store: db, Name: "remember_me", Metrics: m}
+	selector, err := store.InsertContext(context.Background(), "joe", "hash", time.Now().Add(time.Minute))
+	assert.Nil(err)
+
+	_, _, _, err = store.GetContext(context.Background(), selector)
+	assert.Nil(err)
+
+	_, _, _, err = store.GetContext(context.Background(), "unknown")
+	assert.NotNil(err)
+
+	body := scrape(m)
+	assert.Contains(body, `idp_store_duration_seconds_count{error="",operation="insert",outcome="success",store="remember_me"} 1`)
+	assert.Contains(body, `idp_store_duration_seconds_count{error="",operation="get",outcome="success",store="remember_me"} 1`)
+	assert.Contains(body, `idp_store_duration_seconds_count{error="not_found",operation="get",outcome="failure",store="remember_me"} 1`)
+}
+
+func TestErrorClass(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", ErrorClass(nil))
+	assert.Equal("rate_limited", ErrorClass(&core.ErrorRetryLater{RetryAfter: time.Minute}))
+	assert.Equal("canceled", ErrorClass(context.Canceled))
+	assert.Equal("other", ErrorClass(errors.New("user joe is broken")))
+}
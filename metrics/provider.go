@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Provider counts the outcomes of the wrapped provider's Check and Register
+// and measures how long Check takes. Failed checks are counted only for submissions,
+// not for requests that only display the login form.
+type Provider struct {
+	core.Provider
+
+	// Label value, e.g. "form"
+	Name    string
+	Metrics *Metrics
+
+	// Optional. Tells which requests are login attempts, core.IsSubmission by default.
+	Submission func(r *http.Request) bool
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	start := time.Now()
+	user, err = p.Provider.Check(r)
+	if err != nil && !p.isSubmission(r) {
+		return
+	}
+
+	p.Metrics.ObserveLogin(p.Name, err, time.Since(start))
+	return
+}
+
+func (p *Provider) isSubmission(r *http.Request) bool {
+	if p.Submission != nil {
+		return p.Submission(r)
+	}
+	return core.IsSubmission(r)
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	user, err = p.Provider.Register(r)
+	p.Metrics.ObserveRegistration(p.Name, err)
+	return
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/verifier"
+)
+
+// CookieStore measures the calls to the wrapped store
+type CookieStore struct {
+	cookie.Store
+
+	// Label value, e.g. "remember_me"
+	Name    string
+	Metrics *Metrics
+}
+
+func (s *CookieStore) Get(selector string) (user string, hash string, expiration time.Time, err error) {
+	return s.GetContext(context.Background(), selector)
+}
+
+func (s *CookieStore) Insert(user, hash string, expiration time.Time) (selector string, err error) {
+	return s.InsertContext(context.Background(), user, hash, expiration)
+}
+
+func (s *CookieStore) Update(selector, user, hash string, expiration time.Time) (err error) {
+	return s.UpdateContext(context.Background(), selector, user, hash, expiration)
+}
+
+func (s *CookieStore) DeleteSelector(selector string) (err error) {
+	return s.DeleteSelectorContext(context.Background(), selector)
+}
+
+func (s *CookieStore) DeleteUser(user string) (err error) {
+	return s.DeleteUserContext(context.Background(), user)
+}
+
+func (s *CookieStore) GetContext(ctx context.Context, selector string) (user string, hash string, expiration time.Time, err error) {
+	start := time.Now()
+	user, hash, expiration, err = cookie.WithContext(s.Store).GetContext(ctx, selector)
+	s.Metrics.ObserveStore(s.Name, "get", err, time.Since(start))
+	return
+}
+
+func (s *CookieStore) InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error) {
+	start := time.Now()
+	selector, err = cookie.WithContext(s.Store).InsertContext(ctx, user, hash, expiration)
+	s.Metrics.ObserveStore(s.Name, "insert", err, time.Since(start))
+	return
+}
+
+func (s *CookieStore) UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error) {
+	start := time.Now()
+	err = cookie.WithContext(s.Store).UpdateContext(ctx, selector, user, hash, expiration)
+	s.Metrics.ObserveStore(s.Name, "update", err, time.Since(start))
+	return
+}
+
+func (s *CookieStore) DeleteSelectorContext(ctx context.Context, selector string) (err error) {
+	start := time.Now()
+	err = cookie.WithContext(s.Store).DeleteSelectorContext(ctx, selector)
+	s.Metrics.ObserveStore(s.Name, "delete_selector", err, time.Since(start))
+	return
+}
+
+// ConsumeSelectorContext fails with core.ErrorNotImplemented if the wrapped store isn't a cookie.Consumer
+func (s *CookieStore) ConsumeSelectorContext(ctx context.Context, selector string) (err error) {
+	consumer, ok := s.Store.(cookie.Consumer)
+	if !ok {
+		return core.ErrorNotImplemented
+	}
+
+	start := time.Now()
+	err = consumer.ConsumeSelectorContext(ctx, selector)
+	s.Metrics.ObserveStore(s.Name, "consume_selector", err, time.Since(start))
+	return
+}
+
+func (s *CookieStore) DeleteUserContext(ctx context.Context, user string) (err error) {
+	start := time.Now()
+	err = cookie.WithContext(s.Store).DeleteUserContext(ctx, user)
+	s.Metrics.ObserveStore(s.Name, "delete_user", err, time.Since(start))
+	return
+}
+
+// UserStore measures the calls to the wrapped store
+type UserStore struct {
+	userdb.Store
+
+	// Label value, e.g. "users"
+	Name    string
+	Metrics *Metrics
+}
+
+func (s *UserStore) Check(username, password string) error {
+	return s.CheckContext(context.Background(), username, password)
+}
+
+func (s *UserStore) Add(username, password string) error {
+	return s.AddContext(context.Background(), username, password)
+}
+
+func (s *UserStore) CheckContext(ctx context.Context, username, password string) (err error) {
+	start := time.Now()
+	err = userdb.WithContext(s.Store).CheckContext(ctx, username, password)
+	s.Metrics.ObserveStore(s.Name, "check", err, time.Since(start))
+	return
+}
+
+func (s *UserStore) AddContext(ctx context.Context, username, password string) (err error) {
+	start := time.Now()
+	err = userdb.WithContext(s.Store).AddContext(ctx, username, password)
+	s.Metrics.ObserveStore(s.Name, "add", err, time.Since(start))
+	return
+}
+
+// Queue measures the calls to the wrapped verification queue, except Pending
+type Queue struct {
+	verifier.Queue
+
+	// Label value, e.g. "verifications"
+	Name    string
+	Metrics *Metrics
+}
+
+func (q *Queue) PushContext(ctx context.Context, v *verifier.Verification) (code string, err error) {
+	start := time.Now()
+	code, err = q.Queue.PushContext(ctx, v)
+	q.Metrics.ObserveStore(q.Name, "push", err, time.Since(start))
+	return
+}
+
+func (q *Queue) GetWithUserIDContext(ctx context.Context, userID string) (v *verifier.Verification, err error) {
+	start := time.Now()
+	v, err = q.Queue.GetWithUserIDContext(ctx, userID)
+	q.Metrics.ObserveStore(q.Name, "get", err, time.Since(start))
+	return
+}
+
+func (q *Queue) TakeContext(ctx context.Context, code string) (v *verifier.Verification, err error) {
+	start := time.Now()
+	v, err = q.Queue.TakeContext(ctx, code)
+	q.Metrics.ObserveStore(q.Name, "take", err, time.Since(start))
+	return
+}
+
+func (q *Queue) MarkSentContext(ctx context.Context, code string, sentCount int) (ok bool, err error) {
+	start := time.Now()
+	ok, err = q.Queue.MarkSentContext(ctx, code, sentCount)
+	q.Metrics.ObserveStore(q.Name, "mark_sent", err, time.Since(start))
+	return
+}
+
+func (q *Queue) DeleteExpiredContext(ctx context.Context, deadline time.Time) (err error) {
+	start := time.Now()
+	err = q.Queue.DeleteExpiredContext(ctx, deadline)
+	q.Metrics.ObserveStore(q.Name, "delete_expired", err, time.Since(start))
+	return
+}
+
+func (q *Queue) CountContext(ctx context.Context) (count uint, err error) {
+	start := time.Now()
+	count, err = q.Queue.CountContext(ctx)
+	q.Metrics.ObserveStore(q.Name, "count", err, time.Since(start))
+	return
+}
@@ -3,16 +3,25 @@ package basic
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/janekolszak/idp/core"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
+	"github.com/janekolszak/idp/userdb/htpasswd"
 )
 
 // Basic Authentication checker.
-// Expects Storage to return plain text passwords
+// Credentials are read from an htpasswd file, call Htpasswd.Watch to reload it on changes.
 type BasicAuth struct {
-	Htpasswd Htpasswd
+	Htpasswd htpasswd.Htpasswd
 	Realm    string
+
+	// Optional. Throttles password guessing.
+	Limiter *throttle.Limiter
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
 }
 
 func NewBasicAuth(htpasswdFileName string, realm string) (*BasicAuth, error) {
@@ -39,17 +48,29 @@ func (c *BasicAuth) Check(r *http.Request) (user string, err error) {
 		return
 	}
 
-	hash, err := c.Htpasswd.Get(user)
-	if err != nil {
-		// Prevent timing attack
-		bcrypt.CompareHashAndPassword([]byte{}, []byte(pass))
-		user = ""
-		err = core.ErrorAuthenticationFailure
-		return
+	if c.Limiter != nil {
+		err = c.Limiter.Reserve(r, user)
+		if err != nil {
+			user = ""
+			return
+		}
+	}
+
+	err = c.Htpasswd.Check(user, pass)
+
+	if c.Limiter != nil {
+		// Failed attempts stay reserved, failure to release one isn't fatal
+		if err == nil {
+			c.Limiter.Succeed(r, user)
+		}
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
 	if err != nil {
+		// Users see only that the login failed
+		logging.Info(r.Context(), c.Logger, "login failed", logging.Fields{
+			"user":  user,
+			"error": err,
+		})
 		user = ""
 		err = core.ErrorAuthenticationFailure
 	}
@@ -62,7 +83,18 @@ func (c *BasicAuth) Register(r *http.Request) (user string, err error) {
 	return
 }
 
-func (c *BasicAuth) WriteError(w http.ResponseWriter, r *http.Request, _ error) error {
+func (c *BasicAuth) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	if retry, ok := err.(*core.ErrorRetryLater); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.RetryAfter.Seconds()+1)))
+		http.Error(w, retry.Error(), http.StatusTooManyRequests)
+		return nil
+	}
+
+	if err == core.ErrorAccountLocked {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil
+	}
+
 	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, c.Realm))
 	http.Error(w, "authorization failed", http.StatusUnauthorized)
 	return nil
@@ -6,6 +6,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,6 +50,34 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestCheckLogged(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(testFileName, []byte(htpasswdFile), 0644)
+	assert.Nil(err)
+
+	provider, err := NewBasicAuth(testFileName, "example.com")
+	assert.Nil(err)
+
+	var logged []logging.Fields
+	provider.Logger = logging.LoggerFunc(func(level logging.Level, msg string, fields logging.Fields) {
+		logged = append(logged, fields)
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.Nil(err)
+	r.SetBasicAuth("user1", "badpassword")
+
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// The user and the store's error, never the password
+	assert.Len(logged, 1)
+	assert.Equal("user1", logged[0]["user"])
+	assert.NotNil(logged[0]["error"])
+	assert.NotContains(logged[0], "password")
+}
+
 func TestNoHeader(t *testing.T) {
 	assert := assert.New(t)
 
@@ -83,3 +114,49 @@ func TestRespond(t *testing.T) {
 	assert.Equal(w.HeaderMap["Www-Authenticate"], []string{`Basic realm="example.com"`}, "Bad header")
 	assert.Equal(w.HeaderMap["Content-Type"], []string{`text/plain; charset=utf-8`}, "Bad header")
 }
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(testFileName, []byte(htpasswdFile), 0644)
+	assert.Nil(err)
+
+	provider, err := NewBasicAuth(testFileName, "example.com")
+	assert.Nil(err)
+
+	store, err := throttle.NewMemoryStore()
+	assert.Nil(err)
+	users, err := throttle.NewThrottle(throttle.Config{Store: store, FreeFailures: 1, LockoutFailures: 2})
+	assert.Nil(err)
+	provider.Limiter = &throttle.Limiter{Users: users}
+
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.Nil(err)
+
+	r.SetBasicAuth("user1", "badpassword")
+	for i := 0; i < 2; i++ {
+		_, err = provider.Check(r)
+		assert.Equal(core.ErrorAuthenticationFailure, err)
+	}
+
+	// Good password doesn't help
+	r.SetBasicAuth("user1", "password")
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAccountLocked, err)
+
+	w := httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, err))
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+
+	// Other users can log in
+	r.SetBasicAuth("user2", "password")
+	u, err := provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("user2", u)
+
+	assert.Nil(provider.Limiter.Unlock("user1"))
+	r.SetBasicAuth("user1", "password")
+	u, err = provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("user1", u)
+}
@@ -12,23 +12,39 @@ const (
 	rememberMeCookieName = "remember"
 )
 
+const auditSource = "cookie"
+
 type CookieAuth struct {
 	Store  Store
 	MaxAge time.Duration
+
+	// Optional, gets logins with the cookies and issued cookies
+	Auditor core.Auditor
 }
 
 func (c *CookieAuth) Check(r *http.Request) (selector, user string, err error) {
-	var now = time.Now()
-
 	l, err := helpers.GetLoginCookie(r, rememberMeCookieName)
 	if err != nil {
+		// No cookie, not a login attempt
 		return
 	}
 
+	selector, user, err = c.check(r, l)
+	if err != nil {
+		core.Audit(c.Auditor, core.NewAuditEvent(r, core.AuditLoginFailed, auditSource, user, err))
+	} else {
+		core.Audit(c.Auditor, core.NewAuditEvent(r, core.AuditLoginSucceeded, auditSource, user, nil))
+	}
+	return
+}
+
+func (c *CookieAuth) check(r *http.Request, l *helpers.LoginCookie) (selector, user string, err error) {
+	var now = time.Now()
+
 	// TODO: Validate selector, shouldn't be too long etc.
 
 	var hash string
-	user, hash, expires, err := c.Store.Get(l.Selector)
+	user, hash, expires, err := WithContext(c.Store).GetContext(r.Context(), l.Selector)
 	if err != nil {
 		return
 	}
@@ -59,13 +75,16 @@ func (c *CookieAuth) SetCookie(w http.ResponseWriter, r *http.Request, user stri
 	}
 
 	// First save to the database
-	l.Selector, err = c.Store.Insert(user, hash, time.Now().Add(c.MaxAge))
+	l.Selector, err = WithContext(c.Store).InsertContext(r.Context(), user, hash, time.Now().Add(c.MaxAge))
 	if err != nil {
 		return
 	}
 
 	// Then save to the cookie
 	err = l.Save(w, r)
+	if err == nil {
+		core.Audit(c.Auditor, core.NewAuditEvent(r, core.AuditCookieIssued, auditSource, user, nil))
+	}
 	return
 }
 
@@ -82,13 +101,16 @@ func (c *CookieAuth) UpdateCookie(w http.ResponseWriter, r *http.Request, select
 	}
 
 	// First save to the database
-	err = c.Store.Update(selector, user, hash, time.Now().Add(c.MaxAge))
+	err = WithContext(c.Store).UpdateContext(r.Context(), selector, user, hash, time.Now().Add(c.MaxAge))
 	if err != nil {
 		return
 	}
 
 	// Then save to the cookie
 	err = l.Save(w, r)
+	if err == nil {
+		core.Audit(c.Auditor, core.NewAuditEvent(r, core.AuditCookieRenewed, auditSource, user, nil))
+	}
 	return
 }
 
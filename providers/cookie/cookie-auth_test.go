@@ -1,6 +1,7 @@
 package cookie
 
 import (
+	"github.com/janekolszak/idp/core"
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"net/http/httptest"
@@ -18,6 +19,12 @@ var (
 	users = []string{"user1", "user2", "user3", "user4"}
 )
 
+type testAuditor []*core.AuditEvent
+
+func (a *testAuditor) Audit(e *core.AuditEvent) {
+	*a = append(*a, e)
+}
+
 func TestSetUpdateCookie(t *testing.T) {
 	assert := assert.New(t)
 
@@ -25,9 +32,11 @@ func TestSetUpdateCookie(t *testing.T) {
 	assert.Nil(err)
 	defer store.Close()
 
+	auditor := &testAuditor{}
 	c := CookieAuth{
-		Store:  store,
-		MaxAge: time.Minute * 1,
+		Store:   store,
+		MaxAge:  time.Minute * 1,
+		Auditor: auditor,
 	}
 
 	for _, user := range users {
@@ -47,4 +56,51 @@ func TestSetUpdateCookie(t *testing.T) {
 		err = c.UpdateCookie(w2, r, selector, user)
 		assert.Nil(err)
 	}
+
+	assert.Len(*auditor, 3*len(users))
+	for i, user := range users {
+		events := (*auditor)[3*i : 3*i+3]
+		assert.Equal(core.AuditCookieIssued, events[0].Type)
+		assert.Equal(core.AuditLoginSucceeded, events[1].Type)
+		assert.Equal(core.AuditCookieRenewed, events[2].Type)
+		for _, e := range events {
+			assert.Equal(user, e.User)
+			assert.Equal("cookie", e.Source)
+		}
+	}
+
+	// Requests without the cookie aren't login attempts
+	_, _, err = c.Check(httptest.NewRequest("GET", "/", nil))
+	assert.NotNil(err)
+	assert.Len(*auditor, 3*len(users))
+}
+
+// Hides the context methods of the wrapped store
+type oldStore struct {
+	Store
+}
+
+func TestOldStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer store.Close()
+
+	c := CookieAuth{
+		Store:  oldStore{store},
+		MaxAge: time.Minute,
+	}
+
+	w := httptest.NewRecorder()
+	assert.Nil(c.SetCookie(w, httptest.NewRequest("GET", "/", nil), "user1"))
+
+	r := &http.Request{Header: http.Header{"Cookie": w.HeaderMap["Set-Cookie"]}}
+	selector, user, err := c.Check(r)
+	assert.Nil(err)
+	assert.Equal("user1", user)
+
+	assert.Nil(WithContext(c.Store).DeleteSelectorContext(r.Context(), selector))
+	_, _, err = c.Check(r)
+	assert.NotNil(err)
 }
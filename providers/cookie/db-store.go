@@ -1,18 +1,37 @@
 package cookie
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
 	"github.com/satori/go.uuid"
 	"time"
 )
 
+const (
+	dbTablename = "cookieauth"
+)
+
 type DBStore struct {
+	// Optional, gets the database errors
+	Logger logging.Logger
+
 	db      *sql.DB
+	table   string
 	getStmt *sql.Stmt
 }
 
 func NewDBStore(driverName, databaseSourceName string) (*DBStore, error) {
+	return NewDBStoreWithTable(driverName, databaseSourceName, dbTablename)
+}
+
+// NewDBStoreWithTable keeps the data in the given table,
+// so the store can hold other selector/validator tokens than remember me cookies.
+func NewDBStoreWithTable(driverName, databaseSourceName, table string) (*DBStore, error) {
 	var s = new(DBStore)
+	s.table = table
 
 	var err error
 	s.db, err = sql.Open(driverName, databaseSourceName)
@@ -26,18 +45,18 @@ func NewDBStore(driverName, databaseSourceName string) (*DBStore, error) {
 	}
 
 	sqlStmt := `
-		CREATE TABLE  IF NOT EXISTS cookieauth (selector   VARCHAR(20) NOT NULL PRIMARY KEY,
-					                            validator  TEXT NOT NULL,
-					                            user       TEXT NOT NULL,
-					                            expiration DATETIME);`
+		CREATE TABLE  IF NOT EXISTS %s (selector   VARCHAR(20) NOT NULL PRIMARY KEY,
+					                    validator  TEXT NOT NULL,
+					                    user       TEXT NOT NULL,
+					                    expiration DATETIME);`
 
-	_, err = s.db.Exec(sqlStmt)
+	_, err = s.db.Exec(fmt.Sprintf(sqlStmt, s.table))
 	if err != nil {
 		return nil, err
 	}
 
 	// Prepare statements
-	s.getStmt, err = s.db.Prepare("SELECT validator, user, expiration FROM cookieauth WHERE selector = ?")
+	s.getStmt, err = s.db.Prepare(fmt.Sprintf("SELECT validator, user, expiration FROM %s WHERE selector = ?", s.table))
 	if err != nil {
 		return nil, err
 	}
@@ -45,13 +64,23 @@ func NewDBStore(driverName, databaseSourceName string) (*DBStore, error) {
 	return s, nil
 }
 
+// PingContext checks the connection to the database
+func (s *DBStore) PingContext(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 func (s *DBStore) Insert(user, hash string, expiration time.Time) (selector string, err error) {
+	return s.InsertContext(context.Background(), user, hash, expiration)
+}
+
+func (s *DBStore) InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error) {
+	defer func() { s.logError(ctx, "inserting the cookie failed", err) }()
 
 	// TODO: Database should generate the selector, but is can't be sequential
 	uniqueID := uuid.NewV1()
 	selector = uniqueID.String()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -63,13 +92,13 @@ func (s *DBStore) Insert(user, hash string, expiration time.Time) (selector stri
 		err = tx.Commit()
 	}()
 
-	stmt, err := tx.Prepare("INSERT INTO cookieauth(selector, validator, user, expiration) values(?, ?, ?, ?)")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s(selector, validator, user, expiration) values(?, ?, ?, ?)", s.table))
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(selector, hash, user, expiration)
+	_, err = stmt.ExecContext(ctx, selector, hash, user, expiration)
 	if err != nil {
 		return
 	}
@@ -78,7 +107,12 @@ func (s *DBStore) Insert(user, hash string, expiration time.Time) (selector stri
 }
 
 func (s *DBStore) Update(selector, user, hash string, expiration time.Time) (err error) {
-	tx, err := s.db.Begin()
+	return s.UpdateContext(context.Background(), selector, user, hash, expiration)
+}
+
+func (s *DBStore) UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error) {
+	defer func() { s.logError(ctx, "updating the cookie failed", err) }()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -90,24 +124,34 @@ func (s *DBStore) Update(selector, user, hash string, expiration time.Time) (err
 		err = tx.Commit()
 	}()
 
-	stmt, err := tx.Prepare("UPDATE cookieauth SET validator=?, expiration =? WHERE selector=?")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET validator=?, expiration =? WHERE selector=?", s.table))
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(hash, expiration, selector)
+	_, err = stmt.ExecContext(ctx, hash, expiration, selector)
 
 	return
 }
 
 func (s *DBStore) Get(selector string) (user, hash string, expiration time.Time, err error) {
-	err = s.getStmt.QueryRow(selector).Scan(&hash, &user, &expiration)
+	return s.GetContext(context.Background(), selector)
+}
+
+func (s *DBStore) GetContext(ctx context.Context, selector string) (user, hash string, expiration time.Time, err error) {
+	defer func() { s.logError(ctx, "getting the cookie failed", err) }()
+	err = s.getStmt.QueryRowContext(ctx, selector).Scan(&hash, &user, &expiration)
 	return
 }
 
 func (s *DBStore) DeleteSelector(selector string) (err error) {
-	tx, err := s.db.Begin()
+	return s.DeleteSelectorContext(context.Background(), selector)
+}
+
+func (s *DBStore) DeleteSelectorContext(ctx context.Context, selector string) (err error) {
+	defer func() { s.logError(ctx, "deleting the cookie failed", err) }()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -119,19 +163,44 @@ func (s *DBStore) DeleteSelector(selector string) (err error) {
 		err = tx.Commit()
 	}()
 
-	stmt, err := tx.Prepare("DELETE FROM cookieauth WHERE selector=?")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE selector=?", s.table))
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(selector)
+	_, err = stmt.ExecContext(ctx, selector)
+
+	return
+}
+
+// ConsumeSelectorContext deletes the selector, it fails if the row was already deleted
+func (s *DBStore) ConsumeSelectorContext(ctx context.Context, selector string) (err error) {
+	defer func() { s.logError(ctx, "consuming the token failed", err) }()
+	result, err := s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE selector=?", s.table), selector)
+	if err != nil {
+		return
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if deleted == 0 {
+		err = core.ErrorTokenExpired
+	}
 
 	return
 }
 
 func (s *DBStore) DeleteUser(user string) (err error) {
-	tx, err := s.db.Begin()
+	return s.DeleteUserContext(context.Background(), user)
+}
+
+func (s *DBStore) DeleteUserContext(ctx context.Context, user string) (err error) {
+	defer func() { s.logError(ctx, "deleting the user's cookies failed", err) }()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
@@ -143,17 +212,26 @@ func (s *DBStore) DeleteUser(user string) (err error) {
 		err = tx.Commit()
 	}()
 
-	stmt, err := tx.Prepare("DELETE FROM cookieauth WHERE user=?")
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE user=?", s.table))
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(user)
+	_, err = stmt.ExecContext(ctx, user)
 
 	return
 }
 
+// Logs failures of the database, missing rows aren't failures
+func (s *DBStore) logError(ctx context.Context, msg string, err error) {
+	if err == nil || err == sql.ErrNoRows || err == core.ErrorTokenExpired {
+		return
+	}
+
+	logging.Error(ctx, s.Logger, msg, logging.Fields{"table": s.table, "error": err})
+}
+
 func (s *DBStore) Close() error {
 	s.getStmt.Close()
 	return s.db.Close()
@@ -2,9 +2,12 @@ package cookie
 
 import (
 	// "github.com/satori/go.uuid"
-	"fmt"
-	r "gopkg.in/dancannon/gorethink.v2"
+	"context"
 	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	r "gopkg.in/gorethink/gorethink.v3"
 )
 
 const (
@@ -12,8 +15,12 @@ const (
 )
 
 type RethinkDBStore struct {
+	// Optional, errors are returned either way
+	Logger logging.Logger
+
 	session *r.Session
 	db      string
+	table   string
 }
 
 type data struct {
@@ -24,13 +31,19 @@ type data struct {
 }
 
 func NewRethinkDBStore(address, database string) (store *RethinkDBStore, err error) {
+	return NewRethinkDBStoreWithTable(address, database, tablename)
+}
+
+// NewRethinkDBStoreWithTable keeps the data in the given table,
+// so the store can hold other selector/validator tokens than remember me cookies.
+func NewRethinkDBStoreWithTable(address, database, table string) (store *RethinkDBStore, err error) {
 	store = new(RethinkDBStore)
+	store.table = table
 	store.session, err = r.Connect(r.ConnectOpts{
 		Address:  address,
 		Database: database,
 	})
 	if err != nil {
-		fmt.Println(err)
 		return
 	}
 
@@ -38,33 +51,50 @@ func NewRethinkDBStore(address, database string) (store *RethinkDBStore, err err
 
 	// Discard error (database exists)
 	_, _ = r.DBCreate(database).RunWrite(store.session)
-	_, _ = r.DB(database).TableCreate(tablename).RunWrite(store.session)
+	_, _ = r.DB(database).TableCreate(store.table).RunWrite(store.session)
 
 	return
 }
 
+// PingContext checks the connection and that the table exists
+func (s *RethinkDBStore) PingContext(ctx context.Context) error {
+	return r.Table(s.table).Info().Exec(s.session, r.ExecOpts{Context: ctx})
+}
+
 func (s *RethinkDBStore) Insert(user, hash string, expiration time.Time) (selector string, err error) {
+	return s.InsertContext(context.Background(), user, hash, expiration)
+}
+
+func (s *RethinkDBStore) InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error) {
 	d := data{
 		User:       user,
 		Hash:       hash,
 		Expiration: expiration,
 	}
 
-	result, err := r.Table(tablename).Insert(d).RunWrite(s.session)
+	result, err := r.Table(s.table).Insert(d).RunWrite(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		logging.Error(ctx, s.Logger, "inserting the cookie failed", logging.Fields{"table": s.table, "error": err})
+		return
+	}
 
 	selector = result.GeneratedKeys[0]
 	return
 }
 
 func (s *RethinkDBStore) Update(selector, user, hash string, expiration time.Time) (err error) {
+	return s.UpdateContext(context.Background(), selector, user, hash, expiration)
+}
+
+func (s *RethinkDBStore) UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error) {
 	d := data{
 		Hash:       hash,
 		Expiration: expiration,
 	}
 
-	_, err = r.Table(tablename).Get(selector).Update(d).RunWrite(s.session)
+	_, err = r.Table(s.table).Get(selector).Update(d).RunWrite(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
-		fmt.Println(err)
+		logging.Error(ctx, s.Logger, "updating the cookie failed", logging.Fields{"table": s.table, "error": err})
 		return
 	}
 
@@ -72,9 +102,13 @@ func (s *RethinkDBStore) Update(selector, user, hash string, expiration time.Tim
 }
 
 func (s *RethinkDBStore) Get(selector string) (user, hash string, expiration time.Time, err error) {
-	cursor, err := r.Table(tablename).Get(selector).Run(s.session)
+	return s.GetContext(context.Background(), selector)
+}
+
+func (s *RethinkDBStore) GetContext(ctx context.Context, selector string) (user, hash string, expiration time.Time, err error) {
+	cursor, err := r.Table(s.table).Get(selector).Run(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
-		fmt.Println(err)
+		logging.Error(ctx, s.Logger, "getting the cookie failed", logging.Fields{"table": s.table, "error": err})
 		return
 	}
 	defer cursor.Close()
@@ -92,29 +126,51 @@ func (s *RethinkDBStore) Get(selector string) (user, hash string, expiration tim
 }
 
 func (s *RethinkDBStore) DeleteSelector(selector string) (err error) {
-	_, err = r.Table(tablename).Get(selector).Delete().Run(s.session)
+	return s.DeleteSelectorContext(context.Background(), selector)
+}
+
+func (s *RethinkDBStore) DeleteSelectorContext(ctx context.Context, selector string) (err error) {
+	_, err = r.Table(s.table).Get(selector).Delete().RunWrite(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
-		fmt.Println(err)
+		logging.Error(ctx, s.Logger, "deleting the cookie failed", logging.Fields{"table": s.table, "error": err})
 		return
 	}
 	return
 }
 
+// ConsumeSelectorContext deletes the selector, it fails if the document was already deleted
+func (s *RethinkDBStore) ConsumeSelectorContext(ctx context.Context, selector string) (err error) {
+	result, err := r.Table(s.table).Get(selector).Delete().RunWrite(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		logging.Error(ctx, s.Logger, "consuming the token failed", logging.Fields{"table": s.table, "error": err})
+		return
+	}
+
+	if result.Deleted == 0 {
+		err = core.ErrorTokenExpired
+	}
+	return
+}
+
 func (s *RethinkDBStore) DeleteUser(user string) (err error) {
-	_, err = r.Table(tablename).Filter(map[string]interface{}{
+	return s.DeleteUserContext(context.Background(), user)
+}
+
+func (s *RethinkDBStore) DeleteUserContext(ctx context.Context, user string) (err error) {
+	_, err = r.Table(s.table).Filter(map[string]interface{}{
 		"user": user,
-	}).Delete().Run(s.session)
+	}).Delete().RunWrite(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
-		fmt.Println(err)
+		logging.Error(ctx, s.Logger, "deleting the user's cookies failed", logging.Fields{"table": s.table, "error": err})
 		return
 	}
 	return
 }
 
 func (s *RethinkDBStore) DeleteAll() (err error) {
-	_, err = r.Table(tablename).Delete().Run(s.session)
+	_, err = r.Table(s.table).Delete().Run(s.session)
 	if err != nil {
-		fmt.Println(err)
+		logging.Error(context.Background(), s.Logger, "deleting all cookies failed", logging.Fields{"table": s.table, "error": err})
 		return
 	}
 	return
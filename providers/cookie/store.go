@@ -1,6 +1,9 @@
 package cookie
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type Store interface {
 	Get(selector string) (user string, hash string, expiration time.Time, err error)
@@ -9,3 +12,52 @@ type Store interface {
 	DeleteSelector(selector string) (err error)
 	DeleteUser(user string) (err error)
 }
+
+// ContextStore is a Store whose database calls are canceled with the context,
+// e.g. when the browser disconnects. Implemented by DBStore and RethinkDBStore.
+type ContextStore interface {
+	GetContext(ctx context.Context, selector string) (user string, hash string, expiration time.Time, err error)
+	InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error)
+	UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error)
+	DeleteSelectorContext(ctx context.Context, selector string) (err error)
+	DeleteUserContext(ctx context.Context, user string) (err error)
+}
+
+// WithContext returns the store itself if it's a ContextStore.
+// Other stores are adapted, they ignore the context.
+func WithContext(s Store) ContextStore {
+	if cs, ok := s.(ContextStore); ok {
+		return cs
+	}
+	return contextAdapter{s}
+}
+
+type contextAdapter struct {
+	Store
+}
+
+func (a contextAdapter) GetContext(ctx context.Context, selector string) (user string, hash string, expiration time.Time, err error) {
+	return a.Get(selector)
+}
+
+func (a contextAdapter) InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error) {
+	return a.Insert(user, hash, expiration)
+}
+
+func (a contextAdapter) UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error) {
+	return a.Update(selector, user, hash, expiration)
+}
+
+func (a contextAdapter) DeleteSelectorContext(ctx context.Context, selector string) (err error) {
+	return a.DeleteSelector(selector)
+}
+
+func (a contextAdapter) DeleteUserContext(ctx context.Context, user string) (err error) {
+	return a.DeleteUser(user)
+}
+
+// Consumer deletes single use tokens. Of concurrent calls with the same selector
+// only one succeeds, the others get core.ErrorTokenExpired.
+type Consumer interface {
+	ConsumeSelectorContext(ctx context.Context, selector string) (err error)
+}
@@ -0,0 +1,298 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
+	"github.com/janekolszak/idp/userdb/htdigest"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	defaultNonceMaxAge = 5 * time.Minute
+
+	// Only "auth", the body isn't protected
+	qop = "auth"
+
+	// Nonce is the time it was issued, random bytes and their MAC
+	nonceRandomSize = 16
+	nonceMACSize    = 16
+	nonceSize       = 8 + nonceRandomSize + nonceMACSize
+)
+
+var defaultAlgorithms = []string{htdigest.SHA256, htdigest.MD5}
+
+type Config struct {
+	// Credentials, call DigestAuth.Htdigest.Watch to reload the file on changes
+	HtdigestFileName string
+
+	Realm string
+
+	// Offered to clients in this order, SHA-256 and MD5 by default
+	Algorithms []string
+
+	// Time a nonce can be used, afterwards the client is asked to retry with a new one
+	NonceMaxAge time.Duration
+
+	// Optional. Signs nonces, instances sharing it accept each other's nonces.
+	// Nonce counts are tracked by each instance. Random by default.
+	Secret []byte
+
+	// Optional. Throttles password guessing.
+	Limiter *throttle.Limiter
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Digest Access Authentication checker, RFC 7616.
+// Only the "auth" quality of protection is supported and a nonce count
+// has to grow with every request using the nonce, so requests can't be replayed.
+type DigestAuth struct {
+	Config
+
+	Htdigest htdigest.Htdigest
+
+	// Last nonce count of each nonce
+	counts *cache.Cache
+	mtx    sync.Mutex
+}
+
+func NewDigestAuth(c Config) (*DigestAuth, error) {
+	if c.HtdigestFileName == "" || c.Realm == "" || c.NonceMaxAge < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if len(c.Algorithms) == 0 {
+		c.Algorithms = defaultAlgorithms
+	}
+
+	for _, algorithm := range c.Algorithms {
+		if htdigest.NewHash(algorithm) == nil {
+			return nil, core.ErrorInvalidConfig
+		}
+	}
+
+	if c.NonceMaxAge == 0 {
+		c.NonceMaxAge = defaultNonceMaxAge
+	}
+
+	if len(c.Secret) == 0 {
+		c.Secret = make([]byte, 32)
+		_, err := rand.Read(c.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DigestAuth{Config: c}
+	err := d.Htdigest.Load(c.HtdigestFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Counts are kept until their nonces expire
+	d.counts = cache.New(c.NonceMaxAge, c.NonceMaxAge)
+	return d, nil
+}
+
+func (d *DigestAuth) mac(data []byte) []byte {
+	h := hmac.New(sha256.New, d.Secret)
+	h.Write(data)
+	return h.Sum(nil)[:nonceMACSize]
+}
+
+func (d *DigestAuth) newNonce() (string, error) {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(time.Now().UnixNano()))
+
+	_, err := rand.Read(nonce[8 : 8+nonceRandomSize])
+	if err != nil {
+		return "", err
+	}
+
+	copy(nonce[8+nonceRandomSize:], d.mac(nonce[:8+nonceRandomSize]))
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// Returns the time the nonce was issued, ok is false if it wasn't issued by the IdP
+func (d *DigestAuth) checkNonce(encoded string) (issued time.Time, ok bool) {
+	nonce, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(nonce) != nonceSize {
+		return time.Time{}, false
+	}
+
+	if !hmac.Equal(nonce[8+nonceRandomSize:], d.mac(nonce[:8+nonceRandomSize])) {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(nonce))), true
+}
+
+// Records the nonce count, fails if it isn't greater than the previous one
+func (d *DigestAuth) useCount(nonce string, count uint64) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	last, ok := d.counts.Get(nonce)
+	if ok && count <= last.(uint64) {
+		return false
+	}
+
+	d.counts.Set(nonce, count, cache.DefaultExpiration)
+	return true
+}
+
+func (d *DigestAuth) offers(algorithm string) bool {
+	for _, a := range d.Algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// Request-URI the client sent, compared with the uri parameter
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// Expected response parameter, RFC 7616 3.4.1
+func response(algorithm, ha1, nonce, nc, cnonce, method, uri string) string {
+	ha2 := htdigest.H(algorithm, method+":"+uri)
+	return htdigest.H(algorithm, strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+}
+
+func (d *DigestAuth) Check(r *http.Request) (user string, err error) {
+	params, ok := parseAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	user, ok = username(params)
+	if !ok {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	// MD5 if the client doesn't say
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = htdigest.MD5
+	}
+
+	if !d.offers(algorithm) || params["realm"] != d.Realm || params["qop"] != qop ||
+		params["uri"] != requestURI(r) || params["cnonce"] == "" || len(params["nc"]) != 8 {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	count, err := strconv.ParseUint(params["nc"], 16, 32)
+	if err != nil {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	nonce := params["nonce"]
+	issued, ok := d.checkNonce(nonce)
+	if !ok {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	if d.Limiter != nil {
+		err = d.Limiter.Reserve(r, user)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Unknown users are compared with an empty hash, so they take as long as the others
+	ha1, err := d.Htdigest.Get(user, d.Realm, algorithm)
+	expected := response(algorithm, ha1, nonce, params["nc"], params["cnonce"], r.Method, params["uri"])
+	valid := subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) == 1
+
+	if d.Limiter != nil {
+		// Failed attempts stay reserved, failure to release one isn't fatal
+		if err == nil && valid {
+			d.Limiter.Succeed(r, user)
+		}
+	}
+
+	if err != nil || !valid {
+		if err == nil {
+			err = core.ErrorAuthenticationFailure
+		}
+		logging.Info(r.Context(), d.Logger, "login failed", logging.Fields{
+			"user":  user,
+			"error": err,
+		})
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	// Password is right, the client retries with a new nonce without asking the user
+	if time.Since(issued) > d.NonceMaxAge {
+		return "", core.ErrorSessionExpired
+	}
+
+	if !d.useCount(nonce, count) {
+		// Replayed request
+		logging.Warn(r.Context(), d.Logger, "nonce count reused", logging.Fields{"user": user})
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	return user, nil
+}
+
+func (d *DigestAuth) Register(r *http.Request) (user string, err error) {
+	err = core.ErrorNotImplemented
+	return
+}
+
+func (d *DigestAuth) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	if retry, ok := err.(*core.ErrorRetryLater); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.RetryAfter.Seconds()+1)))
+		http.Error(w, retry.Error(), http.StatusTooManyRequests)
+		return nil
+	}
+
+	if err == core.ErrorAccountLocked {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil
+	}
+
+	nonce, nonceErr := d.newNonce()
+	if nonceErr != nil {
+		http.Error(w, "An error occurred", http.StatusInternalServerError)
+		return nonceErr
+	}
+
+	stale := ""
+	if err == core.ErrorSessionExpired {
+		stale = ", stale=true"
+	}
+
+	// One challenge for each algorithm, the client picks the first it supports
+	for _, algorithm := range d.Algorithms {
+		w.Header().Add("WWW-Authenticate", "Digest realm="+quote(d.Realm)+
+			`, qop="`+qop+`", algorithm=`+algorithm+", nonce="+quote(nonce)+", charset=UTF-8"+stale)
+	}
+
+	http.Error(w, "authorization failed", http.StatusUnauthorized)
+	return nil
+}
+
+func (d *DigestAuth) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,236 @@
+package digest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/htdigest"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testFileName = "/tmp/idp_digestauth_test"
+	testRealm    = "example.com"
+)
+
+var nonceParam = regexp.MustCompile(`nonce="([^"]*)"`)
+
+func newTestDigestAuth(assert *assert.Assertions, c Config) *DigestAuth {
+	contents := fmt.Sprintf("# Comment\nuser1:%s:%s\nuser1:%s:%s\nuser2:%s:%s\n",
+		testRealm, htdigest.HA1(htdigest.SHA256, "user1", testRealm, "password"),
+		testRealm, htdigest.HA1(htdigest.MD5, "user1", testRealm, "password"),
+		testRealm, htdigest.HA1(htdigest.MD5, "user2", testRealm, "password"))
+
+	err := ioutil.WriteFile(testFileName, []byte(contents), 0644)
+	assert.Nil(err)
+
+	c.HtdigestFileName = testFileName
+	c.Realm = testRealm
+	provider, err := NewDigestAuth(c)
+	assert.Nil(err)
+	return provider
+}
+
+// Returns a nonce from the provider's challenge
+func challenge(provider *DigestAuth) string {
+	recorder := httptest.NewRecorder()
+	provider.WriteError(recorder, httptest.NewRequest("GET", "/", nil), core.ErrorAuthenticationFailure)
+	return nonceParam.FindStringSubmatch(recorder.Header().Get("WWW-Authenticate"))[1]
+}
+
+// Answers the challenge like a browser
+func authorize(r *http.Request, user, password, algorithm, nonce string, nc int) {
+	ha1 := htdigest.HA1(algorithm, user, testRealm, password)
+	count := fmt.Sprintf("%08x", nc)
+	uri := r.URL.RequestURI()
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="%s", realm="%s", uri="%s", algorithm=%s, nonce="%s", nc=%s, cnonce="0a4f113b", qop=auth, response="%s"`,
+		user, testRealm, uri, algorithm, nonce, count, response(algorithm, ha1, nonce, count, "0a4f113b", r.Method, uri)))
+}
+
+func TestResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 7616, 3.9.1
+	for algorithm, expected := range map[string]string{
+		htdigest.SHA256: "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		htdigest.MD5:    "8ca523f5e9506fed4657c9700eebdbec",
+	} {
+		ha1 := htdigest.HA1(algorithm, "Mufasa", "http-auth@example.org", "Circle of Life")
+		assert.Equal(expected, response(algorithm, ha1, "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			"00000001", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", "GET", "/dir/index.html"))
+	}
+}
+
+func TestParseAuthorization(t *testing.T) {
+	assert := assert.New(t)
+
+	params, ok := parseAuthorization(`Digest username="Mufasa", realm="http-auth@example.org",
+		uri="/dir/index.html", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth,
+		response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+		opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+	assert.True(ok)
+	assert.Equal("Mufasa", params["username"])
+	assert.Equal("SHA-256", params["algorithm"])
+	assert.Equal("00000001", params["nc"])
+	assert.Equal("/dir/index.html", params["uri"])
+
+	params, ok = parseAuthorization(`digest Username="a\"b\\c",realm=""`)
+	assert.True(ok)
+	assert.Equal(`a"b\c`, params["username"])
+	assert.Equal("", params["realm"])
+
+	// RFC 7616, 3.9.2
+	params, ok = parseAuthorization(`Digest username*=UTF-8''J%C3%A4s%C3%B8n%20Doe, realm="api@example.org"`)
+	assert.True(ok)
+	user, ok := username(params)
+	assert.True(ok)
+	assert.Equal("Jäsøn Doe", user)
+
+	for _, header := range []string{
+		`Basic dXNlcjpwYXNz`,
+		`Digest username="unterminated`,
+		`Digest username="a" realm="b"`,
+		`Digest username="a", username="b"`,
+		`Digest =value`,
+	} {
+		_, ok = parseAuthorization(header)
+		assert.False(ok, header)
+	}
+
+	for _, params := range []map[string]string{
+		{},
+		{"username": ""},
+		{"username": "a", "username*": "UTF-8''b"},
+		{"username": "a", "userhash": "true"},
+		{"username*": "ISO-8859-1''b"},
+	} {
+		_, ok = username(params)
+		assert.False(ok)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	provider := newTestDigestAuth(assert, Config{})
+
+	for _, algorithm := range []string{htdigest.SHA256, htdigest.MD5} {
+		r := httptest.NewRequest("GET", "/login?challenge=abc", nil)
+		authorize(r, "user1", "password", algorithm, challenge(provider), 1)
+		user, err := provider.Check(r)
+		assert.Nil(err)
+		assert.Equal("user1", user)
+
+		r = httptest.NewRequest("GET", "/login?challenge=abc", nil)
+		authorize(r, "user1", "badpassword", algorithm, challenge(provider), 1)
+		user, err = provider.Check(r)
+		assert.Equal(core.ErrorAuthenticationFailure, err)
+		assert.Equal("", user)
+	}
+
+	// No SHA-256 hash in the file
+	r := httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user2", "password", htdigest.SHA256, challenge(provider), 1)
+	_, err := provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user3", "password", htdigest.MD5, challenge(provider), 1)
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Credentials for another URI
+	r = httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user1", "password", htdigest.MD5, challenge(provider), 1)
+	r.RequestURI = "/other"
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Nonce that wasn't issued by the provider
+	r = httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user1", "password", htdigest.MD5, "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", 1)
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Only offered algorithms are accepted
+	provider = newTestDigestAuth(assert, Config{Algorithms: []string{htdigest.SHA256}})
+	r = httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user1", "password", htdigest.MD5, challenge(provider), 1)
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	_, err = NewDigestAuth(Config{HtdigestFileName: testFileName, Realm: testRealm, Algorithms: []string{"SHA-512"}})
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestNonceCount(t *testing.T) {
+	assert := assert.New(t)
+	provider := newTestDigestAuth(assert, Config{})
+	nonce := challenge(provider)
+
+	for _, step := range []struct {
+		nc int
+		ok bool
+	}{{1, true}, {1, false}, {2, true}, {5, true}, {3, false}} {
+		r := httptest.NewRequest("GET", "/", nil)
+		authorize(r, "user1", "password", htdigest.SHA256, nonce, step.nc)
+		_, err := provider.Check(r)
+		assert.Equal(step.ok, err == nil, "nc %d", step.nc)
+	}
+}
+
+func TestStaleNonce(t *testing.T) {
+	assert := assert.New(t)
+	provider := newTestDigestAuth(assert, Config{NonceMaxAge: 10 * time.Millisecond})
+	nonce := challenge(provider)
+	time.Sleep(20 * time.Millisecond)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	authorize(r, "user1", "badpassword", htdigest.SHA256, nonce, 1)
+	_, err := provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Client can retry without asking the user
+	authorize(r, "user1", "password", htdigest.SHA256, nonce, 1)
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorSessionExpired, err)
+
+	recorder := httptest.NewRecorder()
+	assert.Nil(provider.WriteError(recorder, r, err))
+	assert.Contains(recorder.Header().Get("WWW-Authenticate"), "stale=true")
+
+	authorize(r, "user1", "password", htdigest.SHA256, challenge(provider), 1)
+	user, err := provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("user1", user)
+}
+
+func TestWriteError(t *testing.T) {
+	assert := assert.New(t)
+	provider := newTestDigestAuth(assert, Config{})
+
+	recorder := httptest.NewRecorder()
+	assert.Nil(provider.WriteError(recorder, httptest.NewRequest("GET", "/", nil), core.ErrorAuthenticationFailure))
+	assert.Equal(http.StatusUnauthorized, recorder.Code)
+
+	challenges := recorder.Header()["Www-Authenticate"]
+	if assert.Len(challenges, 2) {
+		assert.Regexp(`^Digest realm="example.com", qop="auth", algorithm=SHA-256, nonce="[\w-]+", charset=UTF-8$`, challenges[0])
+		assert.Regexp(`algorithm=MD5,`, challenges[1])
+		assert.NotContains(challenges[0], "stale")
+	}
+
+	assert.Equal(`"a\"b\\c"`, quote(`a"b\c`))
+}
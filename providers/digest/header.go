@@ -0,0 +1,108 @@
+package digest
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Parses the auth-params of Digest credentials, ok is false if the header is malformed
+func parseAuthorization(header string) (params map[string]string, ok bool) {
+	const scheme = "digest "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return nil, false
+	}
+
+	params = make(map[string]string)
+	s := header[len(scheme):]
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, true
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, false
+		}
+
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			value, s, ok = unquote(s)
+			if !ok {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexAny(s, ", \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		if _, duplicate := params[key]; duplicate {
+			return nil, false
+		}
+		params[key] = value
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, false
+		}
+	}
+}
+
+// Reads the quoted-string at the start of s, returns it and the rest of s
+func unquote(s string) (value, rest string, ok bool) {
+	var b []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", false
+			}
+			b = append(b, s[i])
+
+		case '"':
+			return string(b), s[i+1:], true
+
+		default:
+			b = append(b, s[i])
+		}
+	}
+	return "", "", false
+}
+
+// Quoted-string for the challenge
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Username from the username or the RFC 5987 encoded username* parameter
+func username(params map[string]string) (string, bool) {
+	plain, hasPlain := params["username"]
+	encoded, hasEncoded := params["username*"]
+
+	// Hashed usernames aren't supported
+	if params["userhash"] == "true" || hasPlain == hasEncoded {
+		return "", false
+	}
+
+	if hasPlain {
+		return plain, plain != ""
+	}
+
+	parts := strings.SplitN(encoded, "'", 3)
+	if len(parts) != 3 || !strings.EqualFold(parts[0], "UTF-8") {
+		return "", false
+	}
+
+	user, err := url.PathUnescape(parts[2])
+	if err != nil || user == "" {
+		return "", false
+	}
+	return user, true
+}
@@ -7,23 +7,49 @@ import (
 )
 
 // Well.. at least it's the fastest possible checker implementation..
+// Const authenticates and registers User when Answer is true,
+// otherwise it fails with core.ErrorAuthenticationFailure.
 type Const struct {
 	Answer bool
+	User   string
 }
 
-func (p Const) Check(*http.Request) error {
+func (p Const) result() (string, error) {
 	if p.Answer {
-		return nil
+		return p.User, nil
 	}
 
-	return core.ErrorAuthenticationFailure
+	return "", core.ErrorAuthenticationFailure
 }
 
-func (s Const) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
-	http.Error(w, "authorization failed", http.StatusUnauthorized)
+func (p Const) Check(*http.Request) (user string, err error) {
+	return p.result()
+}
+
+func (p Const) Register(*http.Request) (user string, err error) {
+	return p.result()
+}
+
+func (p Const) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	return writeError(w, err)
+}
+
+func (p Const) Write(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func (s Const) Write(w http.ResponseWriter, r *http.Request) error {
+// Error's message is written, so handler tests can tell the errors apart
+func writeError(w http.ResponseWriter, err error) error {
+	status := http.StatusInternalServerError
+	if err == core.ErrorAuthenticationFailure {
+		status = http.StatusUnauthorized
+	}
+
+	message := "authorization failed"
+	if err != nil {
+		message = err.Error()
+	}
+
+	http.Error(w, message, status)
 	return nil
 }
@@ -0,0 +1,132 @@
+package fail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Login handler like the ones in the examples
+func handler(provider core.Provider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := provider.Check(r)
+		if err != nil {
+			provider.WriteError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "user:%s", user)
+	})
+}
+
+func serve(provider core.Provider) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(provider).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	return w
+}
+
+func TestProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, provider := range []core.Provider{Const{}, NewScripted(), &Recording{}, Slow{}} {
+		w := serve(provider)
+		assert.Equal(http.StatusUnauthorized, w.Code)
+
+		_, err := provider.Register(httptest.NewRequest("POST", "/register", nil))
+		assert.Equal(core.ErrorAuthenticationFailure, err)
+	}
+}
+
+func TestConst(t *testing.T) {
+	assert := assert.New(t)
+
+	w := serve(Const{Answer: true, User: "joe"})
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("user:joe", w.Body.String())
+
+	user, err := Const{Answer: true, User: "joe"}.Register(nil)
+	assert.Nil(err)
+	assert.Equal("joe", user)
+}
+
+func TestScripted(t *testing.T) {
+	assert := assert.New(t)
+	errorDatabase := errors.New("database is down")
+
+	p := NewScripted(Result{User: "joe"}, Result{Err: errorDatabase})
+	p.QueueCheck(Result{User: "ann"})
+	p.QueueRegister(Result{Err: core.ErrorUserAlreadyExists})
+	assert.Equal(4, p.Pending())
+
+	w := serve(p)
+	assert.Equal("user:joe", w.Body.String())
+
+	w = serve(p)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Equal("database is down\n", w.Body.String())
+
+	w = serve(p)
+	assert.Equal("user:ann", w.Body.String())
+
+	_, err := p.Register(nil)
+	assert.Equal(core.ErrorUserAlreadyExists, err)
+	assert.Equal(0, p.Pending())
+
+	w = serve(p)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func TestRecording(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Recording{Provider: NewScripted(Result{User: "joe"})}
+	serve(p)
+	serve(p)
+
+	calls := p.Calls()
+	assert.Equal([]string{"Check", "Check", "WriteError"}, p.Methods())
+	assert.Equal("joe", calls[0].User)
+	assert.Nil(calls[0].Err)
+	assert.Equal("/", calls[0].Request.URL.Path)
+	assert.Equal(core.ErrorAuthenticationFailure, calls[1].Err)
+	assert.Equal(core.ErrorAuthenticationFailure, calls[2].Err)
+
+	p.Reset()
+	assert.Empty(p.Calls())
+}
+
+func TestSlow(t *testing.T) {
+	assert := assert.New(t)
+
+	p := Slow{Provider: Const{Answer: true, User: "joe"}, Delay: 50 * time.Millisecond}
+
+	start := time.Now()
+	user, err := p.Check(httptest.NewRequest("GET", "/", nil))
+	assert.Nil(err)
+	assert.Equal("joe", user)
+	assert.True(time.Since(start) >= p.Delay)
+
+	// Handler gave up waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	p.Delay = time.Minute
+	start = time.Now()
+	_, err = p.Check(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < time.Second)
+
+	server := httptest.NewServer(http.TimeoutHandler(handler(p), 10*time.Millisecond, "timeout"))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	assert.Nil(err)
+	response.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, response.StatusCode)
+}
@@ -0,0 +1,95 @@
+package fail
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Call is a call to the Recording's provider
+type Call struct {
+	// "Check", "Register", "Write" or "WriteError"
+	Method  string
+	Request *http.Request
+
+	// Returned by Check and Register
+	User string
+
+	// Returned by the provider, or passed to WriteError
+	Err error
+}
+
+// Recording passes the calls to Provider and records them.
+// Without a Provider it behaves like Const{}.
+type Recording struct {
+	Provider core.Provider
+
+	mtx   sync.Mutex
+	calls []Call
+}
+
+func (p *Recording) provider() core.Provider {
+	if p.Provider == nil {
+		return Const{}
+	}
+	return p.Provider
+}
+
+func (p *Recording) record(call Call) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.calls = append(p.calls, call)
+}
+
+// Calls returns the recorded calls in order
+func (p *Recording) Calls() []Call {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	calls := make([]Call, len(p.calls))
+	copy(calls, p.calls)
+	return calls
+}
+
+// Methods returns the names of the called methods in order
+func (p *Recording) Methods() []string {
+	calls := p.Calls()
+	methods := make([]string, len(calls))
+	for i, call := range calls {
+		methods[i] = call.Method
+	}
+	return methods
+}
+
+// Reset forgets the recorded calls
+func (p *Recording) Reset() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.calls = nil
+}
+
+func (p *Recording) Check(r *http.Request) (user string, err error) {
+	user, err = p.provider().Check(r)
+	p.record(Call{Method: "Check", Request: r, User: user, Err: err})
+	return
+}
+
+func (p *Recording) Register(r *http.Request) (user string, err error) {
+	user, err = p.provider().Register(r)
+	p.record(Call{Method: "Register", Request: r, User: user, Err: err})
+	return
+}
+
+func (p *Recording) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	p.record(Call{Method: "WriteError", Request: r, Err: err})
+	return p.provider().WriteError(w, r, err)
+}
+
+func (p *Recording) Write(w http.ResponseWriter, r *http.Request) error {
+	err := p.provider().Write(w, r)
+	p.record(Call{Method: "Write", Request: r, Err: err})
+	return err
+}
@@ -0,0 +1,81 @@
+package fail
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Result is returned by Scripted
+type Result struct {
+	User string
+	Err  error
+}
+
+// Scripted returns the queued results in order, one per call.
+// Check and Register have separate queues. When a queue is empty
+// the calls fail with core.ErrorAuthenticationFailure.
+type Scripted struct {
+	mtx           sync.Mutex
+	checks        []Result
+	registrations []Result
+}
+
+func NewScripted(checks ...Result) *Scripted {
+	return &Scripted{checks: checks}
+}
+
+// QueueCheck adds results returned by the next calls to Check
+func (p *Scripted) QueueCheck(results ...Result) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.checks = append(p.checks, results...)
+}
+
+// QueueRegister adds results returned by the next calls to Register
+func (p *Scripted) QueueRegister(results ...Result) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.registrations = append(p.registrations, results...)
+}
+
+// Pending returns the number of results that weren't used yet,
+// tests can check the handler called the provider as many times as expected
+func (p *Scripted) Pending() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return len(p.checks) + len(p.registrations)
+}
+
+func (p *Scripted) next(queue *[]Result) (string, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if len(*queue) == 0 {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	result := (*queue)[0]
+	*queue = (*queue)[1:]
+	return result.User, result.Err
+}
+
+func (p *Scripted) Check(*http.Request) (user string, err error) {
+	return p.next(&p.checks)
+}
+
+func (p *Scripted) Register(*http.Request) (user string, err error) {
+	return p.next(&p.registrations)
+}
+
+func (p *Scripted) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	return writeError(w, err)
+}
+
+func (p *Scripted) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
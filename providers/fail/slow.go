@@ -0,0 +1,60 @@
+package fail
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Slow waits Delay before passing Check and Register to Provider,
+// e.g. to test timeouts. Without a Provider it behaves like Const{}.
+// The wait ends early when the request's context is done,
+// the context's error is returned then.
+type Slow struct {
+	Provider core.Provider
+	Delay    time.Duration
+}
+
+func (p Slow) provider() core.Provider {
+	if p.Provider == nil {
+		return Const{}
+	}
+	return p.Provider
+}
+
+func (p Slow) wait(r *http.Request) error {
+	timer := time.NewTimer(p.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func (p Slow) Check(r *http.Request) (user string, err error) {
+	err = p.wait(r)
+	if err != nil {
+		return "", err
+	}
+	return p.provider().Check(r)
+}
+
+func (p Slow) Register(r *http.Request) (user string, err error) {
+	err = p.wait(r)
+	if err != nil {
+		return "", err
+	}
+	return p.provider().Register(r)
+}
+
+func (p Slow) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	return p.provider().WriteError(w, r, err)
+}
+
+func (p Slow) Write(w http.ResponseWriter, r *http.Request) error {
+	return p.provider().Write(w, r)
+}
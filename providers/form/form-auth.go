@@ -7,6 +7,8 @@ import (
 	"net/url"
 
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
 	"github.com/janekolszak/idp/userdb"
 )
 
@@ -14,6 +16,28 @@ type LoginFormContext struct {
 	Msg         string
 	SubmitURI   string
 	RegisterURI string
+
+	// Set when the user can ask for another verification email.
+	// The form should have a submit button named ResendField,
+	// the credentials are checked again before sending.
+	Resend      bool
+	ResendField string
+	Username    string
+}
+
+// Sends the verification email again, e.g. verifier.Verifier
+type VerificationResender interface {
+	ResendWithUsername(username string) error
+}
+
+// ResendError is returned by Check when the verification email wasn't sent again,
+// e.g. because of *core.ErrorRetryLater. The throttle's errors aren't wrapped.
+type ResendError struct {
+	Err error
+}
+
+func (e *ResendError) Error() string {
+	return e.Err.Error()
 }
 
 type Config struct {
@@ -28,6 +52,16 @@ type Config struct {
 	Username  Complexity
 	Password  Complexity
 	UserStore userdb.Store
+
+	// Optional. Offered to users rejected with core.ErrorNotVerified
+	Resender         VerificationResender
+	LoginResendField string
+
+	// Optional. Throttles password guessing.
+	Limiter *throttle.Limiter
+
+	// Optional. Logs failed logins with the store's error.
+	Logger logging.Logger
 }
 
 type FormAuth struct {
@@ -49,6 +83,10 @@ func NewFormAuth(c Config) (*FormAuth, error) {
 		c.Password.Patterns = []string{".*"}
 	}
 
+	if c.LoginResendField == "" {
+		c.LoginResendField = "resend"
+	}
+
 	auth := FormAuth{Config: c}
 	return &auth, nil
 }
@@ -68,8 +106,40 @@ func (f *FormAuth) Check(r *http.Request) (user string, err error) {
 		return
 	}
 
-	err = f.UserStore.Check(user, password)
-	if err != nil {
+	if f.Limiter != nil {
+		err = f.Limiter.Reserve(r, user)
+		if err != nil {
+			user = ""
+			return
+		}
+	}
+
+	err = userdb.WithContext(f.UserStore).CheckContext(r.Context(), user, password)
+
+	if f.Limiter != nil {
+		// Failed attempts stay reserved, failure to release one isn't fatal
+		if err == nil || err == core.ErrorNotVerified {
+			f.Limiter.Succeed(r, user)
+		}
+	}
+
+	if err == core.ErrorNotVerified {
+		// Credentials are correct, the user can ask for another email
+		if f.Resender != nil && r.FormValue(f.LoginResendField) != "" {
+			err = f.Resender.ResendWithUsername(user)
+			if err == nil {
+				err = core.ErrorVerificationResent
+			} else {
+				err = &ResendError{Err: err}
+			}
+		}
+		user = ""
+	} else if err != nil {
+		// Users see only that the login failed
+		logging.Info(r.Context(), f.Logger, "login failed", logging.Fields{
+			"user":  user,
+			"error": err,
+		})
 		user = ""
 		err = core.ErrorAuthenticationFailure
 	}
@@ -99,7 +169,7 @@ func (f *FormAuth) Register(r *http.Request) (user string, err error) {
 		return
 	}
 
-	err = f.UserStore.Add(user, password)
+	err = userdb.WithContext(f.UserStore).AddContext(r.Context(), user, password)
 	return
 }
 
@@ -116,14 +186,55 @@ func (f *FormAuth) WriteError(w http.ResponseWriter, r *http.Request, err error)
 		case core.ErrorAuthenticationFailure:
 			context.Msg = "Authentication failed"
 
+		case core.ErrorNotVerified:
+			context.Msg = "Your email address isn't verified"
+			context.Resend = f.Resender != nil
+
+		case core.ErrorVerificationResent:
+			context.Msg = "Verification email was sent, check your inbox"
+
+		case core.ErrorAccountLocked:
+			context.Msg = "Account is temporarily locked after too many failed logins"
+
 		default:
-			context.Msg = "An error occurred"
+			switch e := err.(type) {
+			case *ResendError:
+				context.Msg = resendMessage(e.Err)
+				if _, ok := e.Err.(*core.ErrorRetryLater); ok {
+					context.Resend = f.Resender != nil
+				}
+
+			case *core.ErrorRetryLater:
+				// Throttled login, says when to try again
+				context.Msg = e.Error()
+
+			default:
+				context.Msg = "An error occurred"
+			}
+		}
+
+		if context.Resend {
+			context.ResendField = f.LoginResendField
+			context.Username = r.FormValue(f.LoginUsernameField)
 		}
 	}
 	t := template.Must(template.New("tmpl").Parse(f.LoginForm))
 	return t.Execute(w, context)
 }
 
+func resendMessage(err error) string {
+	if err == core.ErrorTooManyRequests {
+		return "Too many verification emails were sent"
+	}
+
+	if _, ok := err.(*core.ErrorRetryLater); ok {
+		// Says when to try again
+		return err.Error()
+	}
+
+	return "An error occurred"
+}
+
 func (f *FormAuth) Write(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
@@ -1,12 +1,19 @@
 package form
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
 	"github.com/janekolszak/idp/userdb/memory"
 	"github.com/stretchr/testify/assert"
 )
@@ -159,12 +166,18 @@ func TestPostFail(t *testing.T) {
 	assert := assert.New(t)
 	userdb := createUsers(assert)
 
+	var logged []logging.Fields
+	logger := logging.LoggerFunc(func(level logging.Level, msg string, fields logging.Fields) {
+		logged = append(logged, fields)
+	})
+
 	// Create the provider
 	provider, err := NewFormAuth(Config{
 		LoginForm:          loginform,
 		LoginUsernameField: "username",
 		LoginPasswordField: "password",
 		UserStore:          userdb,
+		Logger:             logger,
 
 		// Validation options:
 		Username: Complexity{
@@ -187,4 +200,192 @@ func TestPostFail(t *testing.T) {
 
 	_, err = provider.Check(r)
 	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Store's error is logged, not the password
+	assert.Len(logged, 1)
+	assert.Equal("bob", logged[0]["user"])
+	assert.NotNil(logged[0]["error"])
+	assert.NotContains(logged[0], "password")
+}
+
+// Accepts any credentials of unverified users. Has no context methods, like stores outside this repository.
+type unverifiedStore struct{}
+
+func (s *unverifiedStore) Check(username, password string) error {
+	if password != "bob123" {
+		return core.ErrorAuthenticationFailure
+	}
+	return core.ErrorNotVerified
+}
+
+func (s *unverifiedStore) Add(username, password string) error {
+	return core.ErrorNotImplemented
+}
+
+type testResender struct {
+	usernames []string
+	err       error
+}
+
+func (r *testResender) ResendWithUsername(username string) error {
+	r.usernames = append(r.usernames, username)
+	return r.err
+}
+
+func postLogin(assert *assert.Assertions, data url.Values) *http.Request {
+	r, err := http.NewRequest("POST", "/?challenge=c", strings.NewReader(data.Encode()))
+	assert.Nil(err)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestPostNotVerified(t *testing.T) {
+	assert := assert.New(t)
+
+	resender := &testResender{}
+	provider, err := NewFormAuth(Config{
+		LoginForm:          `{{.Msg}}|{{if .Resend}}{{.ResendField}}:{{.Username}}{{end}}`,
+		LoginUsernameField: "username",
+		LoginPasswordField: "password",
+		UserStore:          &unverifiedStore{},
+		Resender:           resender,
+		Username:           Complexity{MinLength: 1, MaxLength: 100},
+		Password:           Complexity{MinLength: 1, MaxLength: 100},
+	})
+	assert.Nil(err)
+
+	// Rejected, resend offered
+	r := postLogin(assert, url.Values{"username": {"bob"}, "password": {"bob123"}})
+	user, err := provider.Check(r)
+	assert.Equal(core.ErrorNotVerified, err)
+	assert.Equal("", user)
+	assert.Len(resender.usernames, 0)
+
+	w := httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, err))
+	assert.Equal("Your email address isn&#39;t verified|resend:bob", w.Body.String())
+
+	// Resend needs the correct password
+	r = postLogin(assert, url.Values{"username": {"bob"}, "password": {"bad"}, "resend": {"1"}})
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.Len(resender.usernames, 0)
+
+	r = postLogin(assert, url.Values{"username": {"bob"}, "password": {"bob123"}, "resend": {"1"}})
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorVerificationResent, err)
+	assert.Equal([]string{"bob"}, resender.usernames)
+
+	// Rate limited
+	resender.err = &core.ErrorRetryLater{RetryAfter: 3 * time.Minute}
+	_, err = provider.Check(r)
+	assert.Equal(&ResendError{Err: resender.err}, err)
+
+	w = httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, err))
+	assert.Equal("too many requests, try again in 3 minutes|resend:bob", w.Body.String())
+
+	resender.err = core.ErrorTooManyRequests
+	_, err = provider.Check(r)
+
+	w = httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, err))
+	assert.Equal("Too many verification emails were sent|", w.Body.String())
+
+	// Throttled login doesn't offer the resend
+	w = httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, &core.ErrorRetryLater{RetryAfter: 3 * time.Minute}))
+	assert.Equal("too many requests, try again in 3 minutes|", w.Body.String())
+}
+
+func TestPostLocked(t *testing.T) {
+	assert := assert.New(t)
+	userdb := createUsers(assert)
+
+	store, err := throttle.NewMemoryStore()
+	assert.Nil(err)
+	users, err := throttle.NewThrottle(throttle.Config{Store: store, FreeFailures: 1, LockoutFailures: 2})
+	assert.Nil(err)
+
+	provider, err := NewFormAuth(Config{
+		LoginForm:          `{{.Msg}}`,
+		LoginUsernameField: "username",
+		LoginPasswordField: "password",
+		UserStore:          userdb,
+		Limiter:            &throttle.Limiter{Users: users},
+		Username:           Complexity{MinLength: 1, MaxLength: 100},
+		Password:           Complexity{MinLength: 1, MaxLength: 100},
+	})
+	assert.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = provider.Check(postLogin(assert, url.Values{"username": {"bob"}, "password": {"bad"}}))
+		assert.Equal(core.ErrorAuthenticationFailure, err)
+	}
+
+	r := postLogin(assert, url.Values{"username": {"bob"}, "password": {"bob123"}})
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAccountLocked, err)
+
+	w := httptest.NewRecorder()
+	assert.Nil(provider.WriteError(w, r, err))
+	assert.Equal("Account is temporarily locked after too many failed logins", w.Body.String())
+
+	assert.Nil(provider.Limiter.Unlock("bob"))
+	user, err := provider.Check(r)
+	assert.Nil(err)
+	assert.Equal("bob", user)
+}
+
+// Counts the passwords that reach the store
+type countingStore struct {
+	*memory.Store
+	checks int32
+}
+
+func (s *countingStore) Check(username, password string) error {
+	return s.CheckContext(context.Background(), username, password)
+}
+
+func (s *countingStore) CheckContext(ctx context.Context, username, password string) error {
+	atomic.AddInt32(&s.checks, 1)
+	return s.Store.CheckContext(ctx, username, password)
+}
+
+func TestLimiterParallel(t *testing.T) {
+	assert := assert.New(t)
+	userdb := &countingStore{Store: createUsers(assert)}
+
+	store, err := throttle.NewMemoryStore()
+	assert.Nil(err)
+	users, err := throttle.NewThrottle(throttle.Config{Store: store, FreeFailures: 2, LockoutFailures: 3, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	provider, err := NewFormAuth(Config{
+		LoginForm:          `{{.Msg}}`,
+		LoginUsernameField: "username",
+		LoginPasswordField: "password",
+		UserStore:          userdb,
+		Limiter:            &throttle.Limiter{Users: users},
+		Username:           Complexity{MinLength: 1, MaxLength: 100},
+		Password:           Complexity{MinLength: 1, MaxLength: 100},
+	})
+	assert.Nil(err)
+
+	// A burst of guesses can't pass the limiter before the failures are recorded
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		r := postLogin(assert, url.Values{"username": {"bob"}, "password": {"bad"}})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			provider.Check(r)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(3), atomic.LoadInt32(&userdb.checks))
+
+	_, err = provider.Check(postLogin(assert, url.Values{"username": {"bob"}, "password": {"bob123"}}))
+	assert.Equal(core.ErrorAccountLocked, err)
 }
@@ -0,0 +1,479 @@
+package magiclink
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/helpers"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/throttle"
+)
+
+const (
+	selectorParam  = "selector"
+	validatorParam = "validator"
+
+	defaultEmailField = "email"
+	defaultMaxAge     = 15 * time.Minute
+	defaultSubject    = "Your login link"
+	defaultTemplate   = `Hello {{.Username}},
+
+To log in open the link below:
+
+{{.URL}}
+
+The link expires in {{.MaxAge}} and works only once. If you didn't try to log in, ignore this email.
+`
+
+	// RFC 5321 limits the path to 256 characters, including the brackets
+	maxEmailLen = 254
+
+	defaultMaxPendingEmails = 100
+
+	// Default limiter, one client IP can request links for many addresses
+	defaultIPFreeFailures    = 30
+	defaultIPLockoutFailures = 100
+)
+
+// Users who log in with the links
+type UserStore interface {
+	// GetUsernameWithEmail returns core.ErrorNoSuchUser if no user has the address
+	GetUsernameWithEmail(email string) (string, error)
+}
+
+// PageContext is passed to the Page template
+type PageContext struct {
+	Msg string
+
+	// The form should be submitted here with the POST method
+	SubmitURI  string
+	EmailField string
+
+	// Link was requested, the page should tell the user to check the inbox
+	Sent bool
+
+	// Link was opened, the page should have a button submitting an empty form.
+	// Mail scanners opening the links won't log the user in.
+	Confirm bool
+}
+
+type Config struct {
+	// Keeps selectors and hashed validators of the links.
+	// Use a separate table from the remember me cookies and password resets.
+	// Has to be a cookie.Consumer, links are consumed atomically.
+	Tokens cookie.Store
+
+	Users UserStore
+
+	// Delivers the links
+	Mailer mail.Mailer
+
+	// html/template of the login page, gets PageContext
+	Page       string
+	EmailField string
+
+	// Absolute URL of the login page. Links get the query of the page where they
+	// were requested, e.g. Hydra's challenge, so the login continues after the link is opened.
+	URL string
+
+	// Email's subject and text/template of the body.
+	// Template gets .Username, .URL and .MaxAge
+	Subject  string
+	Template string
+
+	// How long the link is valid
+	MaxAge time.Duration
+
+	// Every requested link counts as a failure of the email address and the client IP.
+	// Use separate throttles from the password logins. Defaults to throttles
+	// of this process only, with more free failures of the IPs.
+	Limiter *throttle.Limiter
+
+	// Requests fail with core.ErrorTooManyRequests while this many emails
+	// are being sent in the background. Defaults to 100.
+	MaxPendingEmails int
+
+	// Optional, errors of the emails sent in the background end up only here
+	Logger logging.Logger
+}
+
+// Provider logs users in with single use links sent to their email addresses.
+// Tokens use the same selector/validator scheme as the remember me cookies,
+// only the hash of the validator is stored.
+//
+// Requesting a link looks the same whether the address belongs to a user or not,
+// the email is sent in the background.
+type Provider struct {
+	Config
+
+	page     *template.Template
+	template *texttemplate.Template
+
+	consumer cookie.Consumer
+
+	// Holds a value for each email being sent
+	pending chan bool
+}
+
+// Link was requested
+type sentError struct{}
+
+func (e *sentError) Error() string {
+	return "login link was sent"
+}
+
+// Link was opened, user has to confirm the login
+type confirmError struct{}
+
+func (e *confirmError) Error() string {
+	return "login has to be confirmed"
+}
+
+func NewProvider(c Config) (*Provider, error) {
+	if c.Tokens == nil ||
+		c.Users == nil ||
+		c.Mailer == nil ||
+		c.Page == "" ||
+		c.MaxAge < 0 ||
+		c.MaxPendingEmails < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || !u.IsAbs() {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.EmailField == "" {
+		c.EmailField = defaultEmailField
+	}
+
+	if c.Subject == "" {
+		c.Subject = defaultSubject
+	}
+
+	if c.Template == "" {
+		c.Template = defaultTemplate
+	}
+
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultMaxAge
+	}
+
+	if c.MaxPendingEmails == 0 {
+		c.MaxPendingEmails = defaultMaxPendingEmails
+	}
+
+	// Of concurrent logins with the same link only one may succeed
+	consumer, ok := c.Tokens.(cookie.Consumer)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Limiter == nil {
+		c.Limiter, err = defaultLimiter()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Provider{Config: c, consumer: consumer}
+
+	p.page, err = template.New("page").Parse(c.Page)
+	if err != nil {
+		return nil, err
+	}
+
+	p.template, err = texttemplate.New("email").Parse(c.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	p.pending = make(chan bool, c.MaxPendingEmails)
+	return p, nil
+}
+
+func defaultLimiter() (*throttle.Limiter, error) {
+	store, err := throttle.NewMemoryStore()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := throttle.NewThrottle(throttle.Config{Store: store})
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := throttle.NewThrottle(throttle.Config{
+		Store:           store,
+		FreeFailures:    defaultIPFreeFailures,
+		LockoutFailures: defaultIPLockoutFailures,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &throttle.Limiter{Users: users, IPs: ips}, nil
+}
+
+// Addresses are compared case insensitively by the limiter
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	if len(email) > maxEmailLen ||
+		strings.Count(email, "@") != 1 ||
+		strings.HasPrefix(email, "@") ||
+		strings.HasSuffix(email, "@") ||
+		strings.ContainsAny(email, " \t\r\n<>,") {
+		return "", false
+	}
+	return email, true
+}
+
+// Link to the login page with the query of the page where it was requested and the token
+func (p *Provider) link(page url.Values, selector, validator string) (string, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for key, values := range page {
+		query[key] = values
+	}
+	query.Set(selectorParam, selector)
+	query.Set(validatorParam, validator)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Sends the link if the address belongs to a user
+func (p *Provider) send(page url.Values, email string) error {
+	username, err := p.Users.GetUsernameWithEmail(email)
+	if err != nil {
+		return err
+	}
+
+	token := helpers.LoginCookie{}
+	hash, err := token.GenerateValidator()
+	if err != nil {
+		return err
+	}
+
+	// Request is done, the email is sent in the background
+	selector, err := cookie.WithContext(p.Tokens).InsertContext(context.Background(), username, hash, time.Now().Add(p.MaxAge))
+	if err != nil {
+		return err
+	}
+
+	uri, err := p.link(page, selector, token.Validator)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	err = p.template.Execute(&body, map[string]interface{}{
+		"Username": username,
+		"URL":      uri,
+		"MaxAge":   p.MaxAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.Mailer.Send(&mail.Message{
+		To:      email,
+		Subject: p.Subject,
+		Body:    body.String(),
+	})
+}
+
+func (p *Provider) request(r *http.Request) error {
+	email, ok := normalizeEmail(r.FormValue(p.EmailField))
+	if !ok {
+		return core.ErrorBadRequest
+	}
+
+	key := strings.ToLower(email)
+	// Every request counts, it's never released
+	err := p.Limiter.Reserve(r, key)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.pending <- true:
+	default:
+		// Mailer can't keep up
+		return core.ErrorTooManyRequests
+	}
+
+	// Errors, including unknown addresses, can't be shown without revealing
+	// which addresses have accounts. Timing would reveal it too, so the email
+	// is sent in the background.
+	ctx := logging.WithRequestID(context.Background(), logging.RequestID(r.Context()))
+	go func(page url.Values) {
+		defer func() { <-p.pending }()
+
+		err := p.send(page, email)
+		switch err {
+		case nil:
+			logging.Debug(ctx, p.Logger, "login link sent", nil)
+		case core.ErrorNoSuchUser:
+			logging.Debug(ctx, p.Logger, "login link requested for an unknown address", nil)
+		default:
+			logging.Error(ctx, p.Logger, "sending the login link failed", logging.Fields{"error": err})
+		}
+	}(r.URL.Query())
+
+	return &sentError{}
+}
+
+// Returns the user the token belongs to
+func (p *Provider) validate(ctx context.Context, selector, validator string) (string, error) {
+	if selector == "" || validator == "" {
+		return "", core.ErrorTokenExpired
+	}
+
+	// Stores report unknown selectors differently
+	username, hash, expiration, err := cookie.WithContext(p.Tokens).GetContext(ctx, selector)
+	if err != nil {
+		return "", core.ErrorTokenExpired
+	}
+
+	if expiration.Before(time.Now()) {
+		cookie.WithContext(p.Tokens).DeleteSelectorContext(ctx, selector)
+		return "", core.ErrorTokenExpired
+	}
+
+	token := helpers.LoginCookie{
+		Selector:  selector,
+		Validator: validator,
+	}
+
+	if !token.Check(hash) {
+		return "", core.ErrorTokenExpired
+	}
+
+	return username, nil
+}
+
+func (p *Provider) login(ctx context.Context, selector, validator string) (string, error) {
+	username, err := p.validate(ctx, selector, validator)
+	if err != nil {
+		return "", err
+	}
+
+	// Of concurrent logins with the same link only one gets past this,
+	// the others get core.ErrorTokenExpired
+	err = p.consumer.ConsumeSelectorContext(ctx, selector)
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+// Check returns the user after the opened link is confirmed.
+// Otherwise it requests a link for the submitted email address.
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	query := r.URL.Query()
+	selector := query.Get(selectorParam)
+	validator := query.Get(validatorParam)
+
+	if selector != "" || validator != "" {
+		if r.Method != "POST" {
+			_, err = p.validate(r.Context(), selector, validator)
+			if err != nil {
+				return "", err
+			}
+			return "", &confirmError{}
+		}
+
+		return p.login(r.Context(), selector, validator)
+	}
+
+	if r.Method != "POST" {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	return "", p.request(r)
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	// Users are registered elsewhere, e.g. with the form provider
+	return "", core.ErrorNotImplemented
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// Login page without the token, so the email form doesn't submit it again
+func submitURI(r *http.Request) string {
+	u := *r.URL
+	query := u.Query()
+	query.Del(selectorParam)
+	query.Del(validatorParam)
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	context := PageContext{
+		SubmitURI:  submitURI(r),
+		EmailField: p.EmailField,
+	}
+	status := http.StatusOK
+
+	switch e := err.(type) {
+	case *sentError:
+		context.Sent = true
+		context.Msg = "If an account uses this address, a login link was sent to it"
+
+	case *confirmError:
+		context.Confirm = true
+		context.SubmitURI = r.URL.RequestURI()
+
+	case *core.ErrorRetryLater:
+		context.Msg = e.Error()
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter.Seconds()+1)))
+		status = http.StatusTooManyRequests
+
+	default:
+		switch err {
+		case core.ErrorAuthenticationFailure:
+			// Just the form
+
+		case core.ErrorBadRequest:
+			context.Msg = "Enter a valid email address"
+			status = http.StatusBadRequest
+
+		case core.ErrorTokenExpired:
+			context.Msg = "Login link is invalid or expired, request a new one"
+			status = http.StatusBadRequest
+
+		case core.ErrorAccountLocked, core.ErrorTooManyRequests:
+			context.Msg = "Too many login links were requested, try again later"
+			status = http.StatusTooManyRequests
+
+		default:
+			context.Msg = "An error occurred"
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	return p.page.Execute(w, context)
+}
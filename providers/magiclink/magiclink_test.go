@@ -0,0 +1,302 @@
+package magiclink
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/throttle"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_magiclink_test.db3"
+	testUsername = "joe"
+	testEmail    = "joe@example.com"
+	testURL      = "https://idp.example.com/login?lang=en"
+	testPage     = `{{.Msg}}|{{.SubmitURI}}|{{.EmailField}}|{{.Sent}}|{{.Confirm}}`
+)
+
+var linkRegexp = regexp.MustCompile(`https://\S+`)
+
+type testUsers map[string]string
+
+func (u testUsers) GetUsernameWithEmail(email string) (string, error) {
+	username, ok := u[email]
+	if !ok {
+		return "", core.ErrorNoSuchUser
+	}
+	return username, nil
+}
+
+// Emails are sent in the background
+type testMailer chan *mail.Message
+
+func (m testMailer) Send(message *mail.Message) error {
+	m <- message
+	return nil
+}
+
+// Returns the link from the next email
+func (m testMailer) link(t *testing.T) *url.URL {
+	select {
+	case message := <-m:
+		u, err := url.Parse(linkRegexp.FindString(message.Body))
+		assert.Nil(t, err)
+		return u
+
+	case <-time.After(time.Second):
+		t.Fatal("no email")
+		return nil
+	}
+}
+
+func (m testMailer) assertEmpty(t *testing.T) {
+	select {
+	case message := <-m:
+		t.Fatal("unexpected email to", message.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func setup(t *testing.T, c Config) (*Provider, testMailer) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	tokens, err := cookie.NewDBStoreWithTable("sqlite3", testFileName, "magiclinks")
+	assert.Nil(err)
+
+	mailer := make(testMailer, 10)
+
+	c.Tokens = tokens
+	c.Users = testUsers{testEmail: testUsername}
+	c.Mailer = mailer
+	c.Page = testPage
+	c.URL = testURL
+
+	p, err := NewProvider(c)
+	assert.Nil(err)
+	return p, mailer
+}
+
+// Checks the request and writes the page like the login handler
+func do(p *Provider, method, uri string, form url.Values) (string, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(method, uri, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	w := httptest.NewRecorder()
+	user, err := p.Check(r)
+	if err != nil {
+		p.WriteError(w, r, err)
+	}
+	return user, w
+}
+
+func requestLink(p *Provider, email string) *httptest.ResponseRecorder {
+	_, w := do(p, "POST", "/login?challenge=abc", url.Values{"email": {email}})
+	return w
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	tokens, err := cookie.NewDBStoreWithTable("sqlite3", testFileName, "magiclinks")
+	assert.Nil(err)
+
+	c := Config{
+		Tokens: tokens,
+		Users:  testUsers{},
+		Mailer: make(testMailer),
+		Page:   testPage,
+		URL:    "/login",
+	}
+
+	// Links in emails have to be absolute
+	_, err = NewProvider(c)
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	c.URL = testURL
+	p, err := NewProvider(c)
+	assert.Nil(err)
+	assert.Equal(defaultMaxAge, p.MaxAge)
+	assert.Equal("email", p.EmailField)
+
+	// Links have to be consumed atomically
+	c.Tokens = struct{ cookie.Store }{tokens}
+	_, err = NewProvider(c)
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	p, mailer := setup(t, Config{})
+
+	// Email form
+	_, w := do(p, "GET", "/login?challenge=abc", nil)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("|/login?challenge=abc|email|false|false", w.Body.String())
+
+	w = requestLink(p, " "+testEmail+" ")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "|true|false")
+
+	link := mailer.link(t)
+	assert.Equal("idp.example.com", link.Host)
+	assert.Equal("abc", link.Query().Get("challenge"))
+	assert.Equal("en", link.Query().Get("lang"))
+
+	// Opening the link only asks for confirmation
+	user, w := do(p, "GET", link.RequestURI(), nil)
+	assert.Equal("", user)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("|"+html.EscapeString(link.RequestURI())+"|email|false|true", w.Body.String())
+
+	user, _ = do(p, "POST", link.RequestURI(), url.Values{})
+	assert.Equal(testUsername, user)
+
+	// Single use
+	user, w = do(p, "POST", link.RequestURI(), url.Values{})
+	assert.Equal("", user)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.True(strings.HasPrefix(w.Body.String(), "Login link is invalid or expired, request a new one|/login?challenge=abc&amp;lang=en|"))
+}
+
+func TestLoginConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	p, mailer := setup(t, Config{})
+
+	requestLink(p, testEmail)
+	link := mailer.link(t)
+
+	var wg sync.WaitGroup
+	var logins int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, _ := do(p, "POST", link.RequestURI(), url.Values{})
+			if user == testUsername {
+				atomic.AddInt32(&logins, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(1), logins)
+}
+
+func TestBadLinks(t *testing.T) {
+	assert := assert.New(t)
+	p, mailer := setup(t, Config{MaxAge: time.Second})
+
+	requestLink(p, testEmail)
+	link := mailer.link(t)
+
+	query := link.Query()
+	query.Set("validator", "bad")
+	_, w := do(p, "POST", "/login?"+query.Encode(), url.Values{})
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	query = link.Query()
+	query.Del("validator")
+	_, w = do(p, "GET", "/login?"+query.Encode(), nil)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	time.Sleep(1100 * time.Millisecond)
+	user, w := do(p, "POST", link.RequestURI(), url.Values{})
+	assert.Equal("", user)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestUnknownEmail(t *testing.T) {
+	assert := assert.New(t)
+	p, mailer := setup(t, Config{})
+
+	known := requestLink(p, testEmail)
+	mailer.link(t)
+
+	unknown := requestLink(p, "ann@example.com")
+	mailer.assertEmpty(t)
+
+	// Nothing tells the addresses apart
+	assert.Equal(known.Code, unknown.Code)
+	assert.Equal(known.Body.String(), unknown.Body.String())
+
+	for _, email := range []string{"", "joe", "@example.com", "joe@", "a@b@c", "joe@example.com\r\nBcc: ann@example.com"} {
+		w := requestLink(p, email)
+		assert.Equal(http.StatusBadRequest, w.Code, email)
+	}
+	mailer.assertEmpty(t)
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := throttle.NewMemoryStore()
+	assert.Nil(err)
+
+	users, err := throttle.NewThrottle(throttle.Config{Store: store, FreeFailures: 2, BaseDelay: time.Minute})
+	assert.Nil(err)
+
+	p, mailer := setup(t, Config{Limiter: &throttle.Limiter{Users: users}})
+
+	assert.Equal(http.StatusOK, requestLink(p, testEmail).Code)
+	mailer.link(t)
+
+	// Counted as the same address, but the store doesn't know it
+	assert.Equal(http.StatusOK, requestLink(p, "JOE@example.com").Code)
+	mailer.assertEmpty(t)
+
+	w := requestLink(p, testEmail)
+	assert.Equal(http.StatusOK, w.Code)
+	mailer.link(t)
+
+	w = requestLink(p, testEmail)
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(w.Header().Get("Retry-After"))
+	mailer.assertEmpty(t)
+
+	// Unknown addresses are limited the same way
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, requestLink(p, "ann@example.com").Code)
+	}
+	assert.Equal(http.StatusTooManyRequests, requestLink(p, "ann@example.com").Code)
+}
+
+func TestMaxPendingEmails(t *testing.T) {
+	assert := assert.New(t)
+
+	p, _ := setup(t, Config{MaxPendingEmails: 1})
+	assert.NotNil(p.Limiter)
+
+	// Sending blocks until the email is read
+	mailer := make(testMailer)
+	p.Mailer = mailer
+
+	assert.Equal(http.StatusOK, requestLink(p, testEmail).Code)
+
+	w := requestLink(p, "ann@example.com")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Contains(w.Body.String(), "Too many login links were requested")
+
+	mailer.link(t)
+}
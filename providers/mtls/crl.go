@@ -0,0 +1,93 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// RevocationChecker tells whether a certificate was revoked by its issuer.
+// An error rejects the certificate too.
+type RevocationChecker interface {
+	IsRevoked(certificate, issuer *x509.Certificate) (bool, error)
+}
+
+// CRLs checks certificates against the revocation lists of their issuers.
+// Lists are replaced by calling Add again, e.g. after the CA publishes a new one.
+type CRLs struct {
+	// Reject certificates of issuers without a list. Otherwise they are accepted.
+	RequireCRL bool
+
+	mtx sync.RWMutex
+
+	// Revoked serial numbers and the time of the next update by the issuer's raw subject
+	lists map[string]*revocationList
+}
+
+type revocationList struct {
+	revoked    map[string]bool
+	nextUpdate time.Time
+}
+
+// Add verifies the list is signed by the issuer and replaces its previous list
+func (c *CRLs) Add(crl *pkix.CertificateList, issuer *x509.Certificate) error {
+	err := issuer.CheckCRLSignature(crl)
+	if err != nil {
+		return err
+	}
+
+	list := &revocationList{
+		revoked:    make(map[string]bool),
+		nextUpdate: crl.TBSCertList.NextUpdate,
+	}
+
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		list.revoked[revoked.SerialNumber.String()] = true
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.lists == nil {
+		c.lists = make(map[string]*revocationList)
+	}
+	c.lists[string(issuer.RawSubject)] = list
+	return nil
+}
+
+// Load reads a PEM or DER encoded list from the file
+func (c *CRLs) Load(filename string, issuer *x509.Certificate) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return err
+	}
+
+	return c.Add(crl, issuer)
+}
+
+// IsRevoked fails if the issuer's list is outdated, revoked certificates
+// could be missing from it
+func (c *CRLs) IsRevoked(certificate, issuer *x509.Certificate) (bool, error) {
+	c.mtx.RLock()
+	list, ok := c.lists[string(issuer.RawSubject)]
+	c.mtx.RUnlock()
+
+	if !ok {
+		return c.RequireCRL, nil
+	}
+
+	if !list.nextUpdate.IsZero() && time.Now().After(list.nextUpdate) {
+		return false, core.ErrorOutdatedCRL
+	}
+
+	return list.revoked[certificate.SerialNumber.String()], nil
+}
@@ -0,0 +1,149 @@
+package mtls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Mapper returns the user a verified certificate belongs to,
+// core.ErrorNoSuchUser if it doesn't belong to anyone
+type Mapper interface {
+	Map(certificate *x509.Certificate) (username string, err error)
+}
+
+// MapperFunc is a function used as a Mapper
+type MapperFunc func(certificate *x509.Certificate) (string, error)
+
+func (f MapperFunc) Map(certificate *x509.Certificate) (string, error) {
+	return f(certificate)
+}
+
+// SubjectMapper maps subject DNs, formatted by SubjectDN, to usernames
+type SubjectMapper map[string]string
+
+func (m SubjectMapper) Map(certificate *x509.Certificate) (string, error) {
+	dn, err := SubjectDN(certificate)
+	if err != nil {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	username, ok := m[dn]
+	if !ok {
+		return "", core.ErrorNoSuchUser
+	}
+	return username, nil
+}
+
+// EmailMapper maps lowercase email addresses from the subject alternative names to usernames
+type EmailMapper map[string]string
+
+func (m EmailMapper) Map(certificate *x509.Certificate) (string, error) {
+	for _, email := range certificate.EmailAddresses {
+		username, ok := m[strings.ToLower(email)]
+		if ok {
+			return username, nil
+		}
+	}
+	return "", core.ErrorNoSuchUser
+}
+
+// FingerprintMapper maps certificate fingerprints, formatted by Fingerprint, to usernames.
+// Unlike the other mappers it pins the exact certificate, a renewed one has to be added again.
+type FingerprintMapper map[string]string
+
+func (m FingerprintMapper) Map(certificate *x509.Certificate) (string, error) {
+	username, ok := m[Fingerprint(certificate)]
+	if !ok {
+		return "", core.ErrorNoSuchUser
+	}
+	return username, nil
+}
+
+// Mappers tries the mappers in order, the first one that knows the certificate wins
+type Mappers []Mapper
+
+func (m Mappers) Map(certificate *x509.Certificate) (string, error) {
+	for _, mapper := range m {
+		username, err := mapper.Map(certificate)
+		if err != core.ErrorNoSuchUser {
+			return username, err
+		}
+	}
+	return "", core.ErrorNoSuchUser
+}
+
+// Fingerprint is the lowercase hex encoded SHA-256 of the certificate
+func Fingerprint(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Short names of the attribute types, RFC 4514 and the ones OpenSSL prints
+var attributeTypes = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "SERIALNUMBER",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.17":                   "POSTALCODE",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+}
+
+// SubjectDN formats the certificate's subject as in RFC 4514, e.g. "CN=joe,OU=Tools,O=Example".
+// The most significant RDN is last, as OpenSSL prints it with -nameopt RFC2253.
+func SubjectDN(certificate *x509.Certificate) (string, error) {
+	var rdns pkix.RDNSequence
+	_, err := asn1.Unmarshal(certificate.RawSubject, &rdns)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, len(rdns))
+	for i := len(rdns) - 1; i >= 0; i-- {
+		values := make([]string, 0, len(rdns[i]))
+		for _, attribute := range rdns[i] {
+			name, ok := attributeTypes[attribute.Type.String()]
+			if !ok {
+				name = attribute.Type.String()
+			}
+			values = append(values, name+"="+escapeDN(fmt.Sprint(attribute.Value)))
+		}
+		parts = append(parts, strings.Join(values, "+"))
+	}
+
+	return strings.Join(parts, ","), nil
+}
+
+// RFC 4514, 2.4
+func escapeDN(value string) string {
+	var b bytes.Buffer
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+
+		case c == 0:
+			b.WriteString(`\00`)
+
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
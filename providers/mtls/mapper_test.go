@@ -0,0 +1,71 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubjectDN(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+
+	certificate, _ := ca.client(pkix.Name{
+		CommonName:         "Doe, Joe",
+		OrganizationalUnit: []string{"Tools"},
+		Organization:       []string{"Example"},
+		Country:            []string{"PL"},
+	})
+
+	dn, err := SubjectDN(certificate)
+	assert.Nil(err)
+	assert.Equal(`CN=Doe\, Joe,OU=Tools,O=Example,C=PL`, dn)
+
+	certificate, _ = ca.client(pkix.Name{
+		CommonName: " #joe ",
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "joe"},
+			{Type: asn1.ObjectIdentifier{1, 2, 3}, Value: "x+y"},
+		},
+	})
+
+	dn, err = SubjectDN(certificate)
+	assert.Nil(err)
+	assert.Equal(`1.2.3=x\+y,UID=joe,CN=\ #joe\ `, dn)
+}
+
+func TestMappers(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+	certificate, _ := ca.client(pkix.Name{CommonName: "joe"}, "joe@example.org", "Joe@Example.com")
+
+	mappers := Mappers{
+		SubjectMapper{"CN=ann": "ann"},
+		EmailMapper{"joe@example.com": "joe"},
+		FingerprintMapper{Fingerprint(certificate): "fingerprint"},
+	}
+
+	user, err := mappers.Map(certificate)
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	user, err = mappers[2].Map(certificate)
+	assert.Nil(err)
+	assert.Equal("fingerprint", user)
+	assert.Len(Fingerprint(certificate), 64)
+
+	other, _ := ca.client(pkix.Name{CommonName: "other"})
+	_, err = mappers.Map(other)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// Errors other than an unknown certificate stop the search
+	failing := MapperFunc(func(*x509.Certificate) (string, error) {
+		return "", core.ErrorInternalError
+	})
+	_, err = Mappers{failing, mappers[1]}.Map(certificate)
+	assert.Equal(core.ErrorInternalError, err)
+}
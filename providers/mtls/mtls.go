@@ -0,0 +1,230 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+)
+
+type Config struct {
+	// Maps verified certificates to users
+	Mapper Mapper
+
+	// Optional. CAs issuing client certificates, verified again by the provider.
+	// Without it the certificates have to be verified by the TLS server,
+	// with tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert.
+	// Required with ProxyHeader.
+	Roots *x509.CertPool
+
+	// Optional. Intermediate CAs, besides the ones sent by the client.
+	Intermediates []*x509.Certificate
+
+	// Optional. Checks every certificate in the verified chain.
+	Revocation RevocationChecker
+
+	// Optional. Header with the client certificate, set by a TLS terminating proxy,
+	// e.g. "X-SSL-Client-Cert" filled with nginx's $ssl_client_escaped_cert.
+	// The URL encoded or plain PEM certificate is accepted.
+	ProxyHeader string
+
+	// Networks of the proxies, e.g. "10.0.0.0/8". ProxyHeader is ignored in requests
+	// from other addresses, they could set it to any certificate.
+	TrustedProxies []string
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Provider logs users in with TLS client certificates.
+// The user isn't asked for anything, the login page shows the user
+// mapped to the certificate or an error.
+type Provider struct {
+	Config
+
+	proxies []*net.IPNet
+}
+
+func NewProvider(c Config) (*Provider, error) {
+	if c.Mapper == nil {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	// Certificates from the proxy can't be verified without the CAs
+	if c.ProxyHeader != "" && (c.Roots == nil || len(c.TrustedProxies) == 0) {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	p := &Provider{Config: c}
+	for _, cidr := range c.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, core.ErrorInvalidConfig
+		}
+		p.proxies = append(p.proxies, network)
+	}
+
+	return p, nil
+}
+
+func (p *Provider) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the certificate forwarded by the proxy
+func parseHeader(value string) (*x509.Certificate, error) {
+	// Base64 has no '%', but has '+' that mustn't become a space
+	if strings.Contains(value, "%") {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		value = unescaped
+	}
+
+	block, _ := pem.Decode([]byte(value))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, core.ErrorBadRequest
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func (p *Provider) verify(leaf *x509.Certificate, intermediates []*x509.Certificate) ([]*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		pool.AddCert(intermediate)
+	}
+
+	for _, intermediate := range p.Intermediates {
+		pool.AddCert(intermediate)
+	}
+
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.Roots,
+		Intermediates: pool,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// Returns the verified chain of the client's certificate, from the leaf to the root
+func (p *Provider) chain(r *http.Request) ([]*x509.Certificate, error) {
+	if p.ProxyHeader != "" && p.fromTrustedProxy(r) {
+		value := r.Header.Get(p.ProxyHeader)
+		if value == "" {
+			return nil, core.ErrorAuthenticationFailure
+		}
+
+		leaf, err := parseHeader(value)
+		if err != nil {
+			return nil, core.ErrorAuthenticationFailure
+		}
+		return p.verify(leaf, nil)
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if p.Roots != nil {
+		return p.verify(r.TLS.PeerCertificates[0], r.TLS.PeerCertificates[1:])
+	}
+
+	// Server only requested the certificate without verifying it
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, core.ErrorAuthenticationFailure
+	}
+	return r.TLS.VerifiedChains[0], nil
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	chain, err := p.chain(r)
+	if err != nil {
+		logging.Info(r.Context(), p.Logger, "client certificate rejected", logging.Fields{"error": err})
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	subject := chain[0].Subject.String()
+	if p.Revocation != nil {
+		for i := 0; i+1 < len(chain); i++ {
+			revoked, err := p.Revocation.IsRevoked(chain[i], chain[i+1])
+			if err != nil {
+				logging.Error(r.Context(), p.Logger, "checking the certificate's revocation failed", logging.Fields{
+					"subject": subject,
+					"error":   err,
+				})
+				return "", err
+			}
+
+			if revoked {
+				logging.Warn(r.Context(), p.Logger, "revoked client certificate", logging.Fields{
+					"subject": chain[i].Subject.String(),
+					"serial":  chain[i].SerialNumber.String(),
+				})
+				return "", core.ErrorCertificateRevoked
+			}
+		}
+	}
+
+	user, err = p.Mapper.Map(chain[0])
+	if err != nil {
+		logging.Info(r.Context(), p.Logger, "certificate isn't mapped to a user", logging.Fields{
+			"subject": subject,
+			"error":   err,
+		})
+	}
+	return user, err
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	// Users are mapped from certificates issued elsewhere
+	return "", core.ErrorNotImplemented
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	switch err {
+	case core.ErrorAuthenticationFailure:
+		http.Error(w, "Valid client certificate is required", http.StatusUnauthorized)
+
+	case core.ErrorNoSuchUser:
+		http.Error(w, "Certificate doesn't belong to any user", http.StatusForbidden)
+
+	case core.ErrorCertificateRevoked:
+		http.Error(w, "Certificate is revoked", http.StatusForbidden)
+
+	default:
+		http.Error(w, "An error occurred", http.StatusInternalServerError)
+	}
+
+	return nil
+}
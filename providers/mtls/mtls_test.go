@@ -0,0 +1,304 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Certificate authority issuing test certificates
+type testCA struct {
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+	serial      int64
+}
+
+func newTestCA(name string) *testCA {
+	ca := &testCA{}
+
+	var err error
+	ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	ca.certificate = ca.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, &ca.key.PublicKey, ca.key, nil)
+	return ca
+}
+
+func (ca *testCA) issue(template *x509.Certificate, public interface{}, signer *ecdsa.PrivateKey, parent *x509.Certificate) *x509.Certificate {
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, public, signer)
+	if err != nil {
+		panic(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return certificate
+}
+
+// Client certificate and its key
+func (ca *testCA) client(subject pkix.Name, emails ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	certificate := ca.issue(&x509.Certificate{
+		Subject:        subject,
+		EmailAddresses: emails,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &key.PublicKey, ca.key, ca.certificate)
+	return certificate, key
+}
+
+func (ca *testCA) crl(nextUpdate time.Time, revoked ...*x509.Certificate) *pkix.CertificateList {
+	var list []pkix.RevokedCertificate
+	for _, certificate := range revoked {
+		list = append(list, pkix.RevokedCertificate{SerialNumber: certificate.SerialNumber, RevocationTime: time.Now()})
+	}
+
+	der, err := ca.certificate.CreateCRL(rand.Reader, ca.key, list, time.Now(), nextUpdate)
+	if err != nil {
+		panic(err)
+	}
+
+	crl, err := x509.ParseDERCRL(der)
+	if err != nil {
+		panic(err)
+	}
+	return crl
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+func encodePEM(certificate *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+
+	_, err := NewProvider(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewProvider(Config{Mapper: EmailMapper{}, ProxyHeader: "X-SSL-Client-Cert", TrustedProxies: []string{"10.0.0.0/8"}})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewProvider(Config{Mapper: EmailMapper{}, ProxyHeader: "X-SSL-Client-Cert", Roots: ca.pool(), TrustedProxies: []string{"10.0.0.1"}})
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestTLS(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+	certificate, key := ca.client(pkix.Name{CommonName: "joe"}, "Joe@example.com")
+	other, otherKey := newTestCA("other").client(pkix.Name{CommonName: "joe"}, "joe@example.com")
+
+	provider, err := NewProvider(Config{Mapper: EmailMapper{"joe@example.com": "joe"}})
+	assert.Nil(err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := provider.Check(r)
+		if err != nil {
+			provider.WriteError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "user:%s", user)
+	})
+
+	verifying := httptest.NewUnstartedServer(handler)
+	verifying.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: ca.pool()}
+	verifying.StartTLS()
+	defer verifying.Close()
+
+	requesting := httptest.NewUnstartedServer(handler)
+	requesting.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	requesting.StartTLS()
+	defer requesting.Close()
+
+	get := func(server *httptest.Server, certificates ...tls.Certificate) (int, string) {
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+
+		// New connection for every client certificate
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+
+		response, err := client.Get(server.URL)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer response.Body.Close()
+
+		body, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	valid := tls.Certificate{Certificate: [][]byte{certificate.Raw}, PrivateKey: key}
+	unknown := tls.Certificate{Certificate: [][]byte{other.Raw}, PrivateKey: otherKey}
+
+	status, body := get(verifying, valid)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe", body)
+
+	status, _ = get(verifying)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	// Not sent, the server asks for certificates of other CAs
+	status, _ = get(verifying, unknown)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	// Certificates only requested by the server aren't trusted...
+	status, _ = get(requesting, valid)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	// ...unless the provider verifies them
+	provider.Roots = ca.pool()
+	status, _ = get(requesting, unknown)
+	assert.Equal(http.StatusUnauthorized, status)
+
+	status, body = get(requesting, valid)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe", body)
+}
+
+func TestProxyHeader(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+	certificate, _ := ca.client(pkix.Name{CommonName: "joe"})
+	other, _ := newTestCA("other").client(pkix.Name{CommonName: "joe"})
+
+	provider, err := NewProvider(Config{
+		Mapper:         FingerprintMapper{Fingerprint(certificate): "joe", Fingerprint(other): "joe"},
+		Roots:          ca.pool(),
+		ProxyHeader:    "X-SSL-Client-Cert",
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+	assert.Nil(err)
+
+	request := func(remoteAddr, header string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-SSL-Client-Cert", header)
+		return r
+	}
+
+	// nginx's $ssl_client_escaped_cert, spaces as %20
+	escaped := strings.Replace(url.QueryEscape(encodePEM(certificate)), "+", "%20", -1)
+	user, err := provider.Check(request("10.1.2.3:4000", escaped))
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	user, err = provider.Check(request("10.1.2.3:4000", encodePEM(certificate)))
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	// Header values can't span lines
+	user, err = provider.Check(request("10.1.2.3:4000", strings.Replace(encodePEM(certificate), "\n", "%0A", -1)))
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	// Anyone could set the header
+	_, err = provider.Check(request("192.0.2.1:4000", encodePEM(certificate)))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Issued by an unknown CA
+	_, err = provider.Check(request("10.1.2.3:4000", encodePEM(other)))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	_, err = provider.Check(request("10.1.2.3:4000", ""))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	_, err = provider.Check(request("10.1.2.3:4000", "garbage"))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+}
+
+func TestRevocation(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA("ca")
+	certificate, _ := ca.client(pkix.Name{CommonName: "joe"})
+	revoked, _ := ca.client(pkix.Name{CommonName: "ann"})
+
+	crls := &CRLs{}
+	provider, err := NewProvider(Config{
+		Mapper:     SubjectMapper{"CN=joe": "joe", "CN=ann": "ann"},
+		Roots:      ca.pool(),
+		Revocation: crls,
+	})
+	assert.Nil(err)
+
+	check := func(certificate *x509.Certificate) (string, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+		return provider.Check(r)
+	}
+
+	// No list yet
+	user, err := check(revoked)
+	assert.Nil(err)
+	assert.Equal("ann", user)
+
+	crls.RequireCRL = true
+	_, err = check(revoked)
+	assert.Equal(core.ErrorCertificateRevoked, err)
+
+	// Signed by another CA
+	assert.NotNil(crls.Add(newTestCA("other").crl(time.Now().Add(time.Hour)), ca.certificate))
+
+	assert.Nil(crls.Add(ca.crl(time.Now().Add(time.Hour), revoked), ca.certificate))
+	_, err = check(revoked)
+	assert.Equal(core.ErrorCertificateRevoked, err)
+
+	user, err = check(certificate)
+	assert.Nil(err)
+	assert.Equal("joe", user)
+
+	// CA should have published a newer list
+	assert.Nil(crls.Add(ca.crl(time.Now().Add(-time.Minute)), ca.certificate))
+	_, err = check(certificate)
+	assert.Equal(core.ErrorOutdatedCRL, err)
+
+	recorder := httptest.NewRecorder()
+	provider.WriteError(recorder, nil, core.ErrorCertificateRevoked)
+	assert.Equal(http.StatusForbidden, recorder.Code)
+}
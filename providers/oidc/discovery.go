@@ -0,0 +1,49 @@
+package oidc
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// Metadata describes the upstream provider's endpoints
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover fetches the metadata of the issuer
+func Discover(client *http.Client, issuer string) (*Metadata, error) {
+	response, err := client.Get(strings.TrimSuffix(issuer, "/") + discoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	metadata := new(Metadata)
+	err = json.NewDecoder(response.Body).Decode(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prevents an attacker controlling one issuer from impersonating another
+	if metadata.Issuer != issuer {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	return metadata, nil
+}
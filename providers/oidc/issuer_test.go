@@ -0,0 +1,186 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testClientID     = "idp"
+	testClientSecret = "secret"
+	testKeyID        = "key1"
+)
+
+// Stand-in upstream provider, logs in the user it's told to
+type testIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mtx sync.Mutex
+
+	// Next user logging in
+	claims map[string]interface{}
+
+	// Issued authorization codes
+	codes map[string]testGrant
+
+	// Modifies the next ID token
+	tamper func(claims jwt.MapClaims)
+}
+
+type testGrant struct {
+	claims        jwt.MapClaims
+	redirectURI   string
+	codeChallenge string
+}
+
+func newTestIssuer() *testIssuer {
+	i := &testIssuer{codes: make(map[string]testGrant)}
+
+	var err error
+	i.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, i.discovery)
+	mux.HandleFunc("/keys", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	i.server = httptest.NewServer(mux)
+	return i
+}
+
+func (i *testIssuer) Close() {
+	i.server.Close()
+}
+
+func (i *testIssuer) URL() string {
+	return i.server.URL
+}
+
+func (i *testIssuer) login(subject string, claims map[string]interface{}) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.claims = map[string]interface{}{"sub": subject}
+	for key, value := range claims {
+		i.claims[key] = value
+	}
+}
+
+func (i *testIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(Metadata{
+		Issuer:                i.URL(),
+		AuthorizationEndpoint: i.URL() + "/authorize",
+		TokenEndpoint:         i.URL() + "/token",
+		JWKSURI:               i.URL() + "/keys",
+	})
+}
+
+func (i *testIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	encode := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []interface{}{
+			map[string]string{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"use": "sig",
+				"n":   encode(i.key.N),
+				"e":   encode(big.NewInt(int64(i.key.E))),
+			},
+		},
+	})
+}
+
+// Logs the user in without asking and redirects back
+func (i *testIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	i.mtx.Lock()
+	claims := jwt.MapClaims{
+		"iss":   i.URL(),
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for key, value := range i.claims {
+		claims[key] = value
+	}
+
+	code := base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes())
+	i.codes[code] = testGrant{
+		claims:        claims,
+		redirectURI:   query.Get("redirect_uri"),
+		codeChallenge: query.Get("code_challenge"),
+	}
+	i.mtx.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	callbackQuery := callback.Query()
+	callbackQuery.Set("code", code)
+	callbackQuery.Set("state", query.Get("state"))
+	callback.RawQuery = callbackQuery.Encode()
+
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (i *testIssuer) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != testClientID || secret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	i.mtx.Lock()
+	grant, ok := i.codes[r.FormValue("code")]
+	delete(i.codes, r.FormValue("code"))
+	tamper := i.tamper
+	i.tamper = nil
+	i.mtx.Unlock()
+
+	if !ok || grant.redirectURI != r.FormValue("redirect_uri") ||
+		codeChallenge(r.FormValue("code_verifier")) != grant.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	if tamper != nil {
+		tamper(grant.claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = testKeyID
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
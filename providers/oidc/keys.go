@@ -0,0 +1,164 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	// Unknown key IDs trigger a refresh, but not more often than this
+	minKeyRefreshInterval = time.Minute
+)
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, core.ErrorBadPublicKey
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, core.ErrorBadPublicKey
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, core.ErrorBadPublicKey
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, core.ErrorBadPublicKey
+		}
+		return key, nil
+	}
+
+	return nil, core.ErrorBadPublicKey
+}
+
+// Upstream's signing keys, fetched again when it rotates them
+type keySet struct {
+	url    string
+	client *http.Client
+
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	mtx     sync.Mutex
+}
+
+func (s *keySet) refresh() error {
+	response, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return core.ErrorNoKey
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			// Unsupported keys are skipped
+			continue
+		}
+		keys[k.KeyID] = key
+	}
+
+	s.keys = keys
+	s.fetched = time.Now()
+	return nil
+}
+
+// Returns the key with the ID, or the only key if the token doesn't name one
+func (s *keySet) get(keyID string) (crypto.PublicKey, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key, err := s.find(keyID)
+	if err == nil {
+		return key, nil
+	}
+
+	if time.Since(s.fetched) < minKeyRefreshInterval {
+		return nil, err
+	}
+
+	err = s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.find(keyID)
+}
+
+func (s *keySet) find(keyID string) (crypto.PublicKey, error) {
+	if keyID == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, nil
+		}
+	}
+
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, core.ErrorNoKey
+	}
+	return key, nil
+}
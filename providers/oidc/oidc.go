@@ -0,0 +1,433 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	pendingSessionName   = "oidc"
+	completedSessionName = "oidc-login"
+
+	defaultMaxAge    = 10 * time.Minute
+	defaultClockSkew = time.Minute
+	httpTimeout      = 10 * time.Second
+
+	// Time to follow the redirect back to the login page
+	completedMaxAge = time.Minute
+)
+
+var defaultScopes = []string{"openid", "email", "profile"}
+
+type Config struct {
+	// Upstream OpenID Connect provider, e.g. "https://accounts.google.com"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// Callback registered at the upstream provider.
+	// Should be served by the login handler, like the login page.
+	RedirectURL string
+
+	// "openid" is always requested
+	Scopes []string
+
+	// Optional. Discovered from the Issuer if nil.
+	Metadata *Metadata
+
+	// Optional. Used to call the upstream provider.
+	HTTPClient *http.Client
+
+	// Links upstream accounts to local users
+	Identities userdb.IdentityStore
+
+	// Optional. Creates users logging in for the first time,
+	// without it only linked accounts can log in.
+	Provisioner Provisioner
+
+	// Keeps the state between the redirects
+	Sessions sessions.Store
+
+	// Time to log in at the upstream provider
+	MaxAge time.Duration
+
+	// Allowed difference between the clocks of the upstream provider and the IdP
+	ClockSkew time.Duration
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Provider logs users in through an upstream OpenID Connect provider
+// with the authorization code flow and PKCE.
+//
+// The login page redirects to the upstream provider, which redirects back to
+// RedirectURL. After the callback is verified the browser is sent back to the
+// login page it started from, e.g. with Hydra's challenge, and Check returns the user.
+type Provider struct {
+	Config
+
+	keys *keySet
+
+	// States and logins can't be used twice
+	used *cache.Cache
+}
+
+// Browser should be redirected to the upstream provider
+type redirectError struct{}
+
+func (e *redirectError) Error() string {
+	return "redirect to the upstream provider"
+}
+
+// User logged in, browser should return to the page that started the login
+type completedError struct {
+	user      string
+	returnURI string
+}
+
+func (e *completedError) Error() string {
+	return "redirect to the login page"
+}
+
+func NewProvider(c Config) (*Provider, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" ||
+		c.Identities == nil || c.Sessions == nil || c.MaxAge < 0 || c.ClockSkew < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: httpTimeout}
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = defaultScopes
+	}
+
+	if !hasScope(c.Scopes, "openid") {
+		c.Scopes = append([]string{"openid"}, c.Scopes...)
+	}
+
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultMaxAge
+	}
+
+	if c.ClockSkew == 0 {
+		c.ClockSkew = defaultClockSkew
+	}
+
+	if c.Metadata == nil {
+		var err error
+		c.Metadata, err = Discover(c.HTTPClient, c.Issuer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Provider{Config: c}
+	p.keys = &keySet{url: c.Metadata.JWKSURI, client: c.HTTPClient}
+	p.used = cache.New(c.MaxAge, c.MaxAge)
+	return p, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// PKCE S256 code challenge, RFC 7636
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Marks the value as used, fails if it already was
+func (p *Provider) useOnce(value string) error {
+	err := p.used.Add(value, true, cache.DefaultExpiration)
+	if err != nil {
+		return core.ErrorSessionExpired
+	}
+	return nil
+}
+
+// Only paths on this host, so the login can't be redirected elsewhere
+func isLocal(uri string) bool {
+	return strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") && !strings.HasPrefix(uri, "/\\")
+}
+
+func (p *Provider) saveSession(w http.ResponseWriter, r *http.Request, name string, maxAge time.Duration, values map[interface{}]interface{}) error {
+	session, err := p.Sessions.New(r, name)
+	if err != nil && session == nil {
+		return err
+	}
+
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+
+	session.Values = values
+	session.Values["expires"] = time.Now().Add(maxAge).Unix()
+	return p.Sessions.Save(r, w, session)
+}
+
+func (p *Provider) getSession(r *http.Request, name string) (map[interface{}]interface{}, bool) {
+	session, err := p.Sessions.Get(r, name)
+	if err != nil {
+		return nil, false
+	}
+
+	expires, _ := session.Values["expires"].(int64)
+	if time.Now().Unix() > expires {
+		return nil, false
+	}
+
+	return session.Values, true
+}
+
+// Redirects to the upstream provider. The user is linked
+// to the upstream account if link isn't empty.
+func (p *Provider) redirect(w http.ResponseWriter, r *http.Request, link, returnURI string) error {
+	state, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	verifier, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	authorize, err := url.Parse(p.Metadata.AuthorizationEndpoint)
+	if err != nil {
+		return err
+	}
+
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+
+	err = p.saveSession(w, r, pendingSessionName, p.MaxAge, map[interface{}]interface{}{
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"link":     link,
+		"return":   returnURI,
+	})
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, authorize.String(), http.StatusFound)
+	return nil
+}
+
+// BeginLink redirects the user, who has to be authenticated by the caller,
+// to the upstream provider and links the upstream account when the user returns.
+// Afterwards the browser is sent to returnURI, a path on this host.
+func (p *Provider) BeginLink(w http.ResponseWriter, r *http.Request, username, returnURI string) error {
+	if username == "" || !isLocal(returnURI) {
+		return core.ErrorBadRequest
+	}
+
+	return p.redirect(w, r, username, returnURI)
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	// Back on the login page after the callback
+	completed, ok := p.getSession(r, completedSessionName)
+	if ok {
+		user, _ = completed["user"].(string)
+		id, _ := completed["id"].(string)
+		if user != "" && p.useOnce(id) == nil {
+			return user, nil
+		}
+	}
+
+	if r.URL.Query().Get("state") != "" {
+		user, err = p.callback(r)
+		if _, ok := err.(*completedError); err != nil && !ok {
+			logging.Info(r.Context(), p.Logger, "login at the upstream provider failed", logging.Fields{
+				"issuer": p.Issuer,
+				"error":  err,
+			})
+		}
+		return user, err
+	}
+
+	return "", &redirectError{}
+}
+
+func (p *Provider) callback(r *http.Request) (user string, err error) {
+	query := r.URL.Query()
+
+	pending, ok := p.getSession(r, pendingSessionName)
+	if !ok {
+		return "", core.ErrorSessionExpired
+	}
+
+	state, _ := pending["state"].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		return "", core.ErrorBadRequest
+	}
+
+	err = p.useOnce(state)
+	if err != nil {
+		return "", err
+	}
+
+	// User refused or the upstream provider failed
+	if query.Get("error") != "" {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		return "", core.ErrorBadRequest
+	}
+
+	verifier, _ := pending["verifier"].(string)
+	idToken, err := p.exchange(r.Context(), code, verifier)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, _ := pending["nonce"].(string)
+	claims, err := p.verifyIDToken(idToken, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	link, _ := pending["link"].(string)
+	user, err = p.localUser(r.Context(), claims, link)
+	if err != nil {
+		return "", err
+	}
+
+	returnURI, _ := pending["return"].(string)
+	return "", &completedError{user: user, returnURI: returnURI}
+}
+
+// Finds, links or provisions the local user
+func (p *Provider) localUser(ctx context.Context, claims *Claims, link string) (string, error) {
+	identities := userdb.IdentitiesWithContext(p.Identities)
+	if link != "" {
+		return link, identities.LinkIdentityContext(ctx, link, claims.Issuer, claims.Subject)
+	}
+
+	user, err := identities.GetUsernameWithIdentityContext(ctx, claims.Issuer, claims.Subject)
+	if err != core.ErrorNoSuchUser {
+		return user, err
+	}
+
+	if p.Provisioner == nil {
+		return "", core.ErrorNoSuchUser
+	}
+
+	if cp, ok := p.Provisioner.(ContextProvisioner); ok {
+		user, err = cp.ProvisionContext(ctx, claims)
+	} else {
+		user, err = p.Provisioner.Provision(claims)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return user, identities.LinkIdentityContext(ctx, user, claims.Issuer, claims.Subject)
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	// Users are provisioned during the login
+	return "", core.ErrorNotImplemented
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	switch e := err.(type) {
+	case *redirectError:
+		return p.redirect(w, r, "", r.URL.RequestURI())
+
+	case *completedError:
+		id, err := randomString()
+		if err != nil {
+			return err
+		}
+
+		err = p.saveSession(w, r, completedSessionName, completedMaxAge, map[interface{}]interface{}{
+			"user": e.user,
+			"id":   id,
+		})
+		if err != nil {
+			return err
+		}
+
+		returnURI := e.returnURI
+		if !isLocal(returnURI) {
+			returnURI = "/"
+		}
+		http.Redirect(w, r, returnURI, http.StatusFound)
+		return nil
+	}
+
+	switch err {
+	case core.ErrorAuthenticationFailure:
+		http.Error(w, "Authentication failed", http.StatusUnauthorized)
+
+	case core.ErrorNoSuchUser:
+		http.Error(w, "Account isn't registered", http.StatusForbidden)
+
+	case core.ErrorUserAlreadyExists:
+		http.Error(w, "Account already exists, log in and link it first", http.StatusConflict)
+
+	case core.ErrorBadRequest, core.ErrorSessionExpired:
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+
+	default:
+		http.Error(w, "An error occurred", http.StatusInternalServerError)
+	}
+
+	return nil
+}
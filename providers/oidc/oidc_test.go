@@ -0,0 +1,237 @@
+package oidc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEnv struct {
+	issuer   *testIssuer
+	idp      *httptest.Server
+	provider *Provider
+	users    *memory.Store
+}
+
+func (e *testEnv) Close() {
+	e.idp.Close()
+	e.issuer.Close()
+}
+
+// Starts the stand-in issuer and a login handler like the one in the examples
+func newTestEnv(assert *assert.Assertions, provision bool) *testEnv {
+	e := &testEnv{issuer: newTestIssuer()}
+
+	var err error
+	e.users, err = memory.NewMemStore()
+	assert.Nil(err)
+
+	e.idp = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := e.provider.Check(r)
+		if err != nil {
+			e.provider.WriteError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "user:%s challenge:%s", user, r.FormValue("challenge"))
+	}))
+
+	config := Config{
+		Issuer:       e.issuer.URL(),
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  e.idp.URL + "/",
+		Identities:   e.users,
+		Sessions:     sessions.NewCookieStore([]byte("testsecret")),
+	}
+
+	if provision {
+		config.Provisioner = &StoreProvisioner{Users: e.users}
+	}
+
+	e.provider, err = NewProvider(config)
+	assert.Nil(err)
+	return e
+}
+
+// Browser following redirects and keeping cookies
+func newBrowser() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+func get(assert *assert.Assertions, browser *http.Client, url string) (int, string) {
+	response, err := browser.Get(url)
+	if !assert.Nil(err) {
+		return 0, ""
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.Nil(err)
+	return response.StatusCode, string(body)
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	e := newTestEnv(assert, false)
+	defer e.Close()
+
+	assert.Equal(e.issuer.URL()+"/token", e.provider.Metadata.TokenEndpoint)
+	assert.Equal(defaultScopes, e.provider.Scopes)
+
+	// Issuer has to match the discovered one
+	_, err = NewProvider(Config{
+		Issuer:      e.issuer.URL() + "/",
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/",
+		Identities:  e.users,
+		Sessions:    sessions.NewCookieStore([]byte("testsecret")),
+	})
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestLinkedLogin(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, false)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	e.issuer.login("upstream-joe", nil)
+
+	// Not linked and not provisioned
+	status, _ := get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusForbidden, status)
+
+	assert.Nil(e.users.LinkIdentity("joe", e.issuer.URL(), "upstream-joe"))
+
+	browser := newBrowser()
+	status, body := get(assert, browser, e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+
+	// Login is used once, the next one goes through the upstream provider again
+	e.issuer.login("upstream-other", nil)
+	status, _ = get(assert, browser, e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusForbidden, status)
+}
+
+func TestProvisioning(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, true)
+	defer e.Close()
+
+	// Name isn't verified
+	e.issuer.login("1", map[string]interface{}{"email": "joe@example.com"})
+	status, _ := get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusBadRequest, status)
+
+	e.issuer.login("1", map[string]interface{}{"email": "joe@example.com", "email_verified": true})
+	status, body := get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe@example.com challenge:abc", body)
+
+	// Linked after provisioning
+	username, err := e.users.GetUsernameWithIdentity(e.issuer.URL(), "1")
+	assert.Nil(err)
+	assert.Equal("joe@example.com", username)
+
+	status, body = get(assert, newBrowser(), e.idp.URL+"/?challenge=def")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe@example.com challenge:def", body)
+
+	// Another upstream account with the same name isn't linked to the existing user
+	e.issuer.login("2", map[string]interface{}{"preferred_username": "joe@example.com"})
+	status, _ = get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusConflict, status)
+}
+
+func TestBeginLink(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, false)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	e.issuer.login("upstream-joe", nil)
+
+	// Settings page of a logged in user, on the IdP's host
+	browser := newBrowser()
+	request, _ := http.NewRequest("GET", e.idp.URL+"/", nil)
+	recorder := httptest.NewRecorder()
+	assert.Nil(e.provider.BeginLink(recorder, request, "joe", "/?challenge=linked"))
+	assert.Equal(http.StatusFound, recorder.Code)
+
+	browser.Jar.SetCookies(request.URL, (&http.Response{Header: recorder.Header()}).Cookies())
+	status, body := get(assert, browser, recorder.Header().Get("Location"))
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:linked", body)
+
+	username, err := e.users.GetUsernameWithIdentity(e.issuer.URL(), "upstream-joe")
+	assert.Nil(err)
+	assert.Equal("joe", username)
+
+	err = e.provider.BeginLink(recorder, request, "joe", "https://evil.com/")
+	assert.Equal(core.ErrorBadRequest, err)
+}
+
+func TestBadIDToken(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, false)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	assert.Nil(e.users.LinkIdentity("joe", e.issuer.URL(), "upstream-joe"))
+	e.issuer.login("upstream-joe", nil)
+
+	tampered := []func(claims jwt.MapClaims){
+		func(claims jwt.MapClaims) { claims["aud"] = "other" },
+		func(claims jwt.MapClaims) { claims["aud"] = []string{testClientID, "other"} },
+		func(claims jwt.MapClaims) { claims["iss"] = "https://evil.com" },
+		func(claims jwt.MapClaims) { claims["nonce"] = "replayed" },
+		func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		func(claims jwt.MapClaims) { claims["iat"] = time.Now().Add(time.Hour).Unix() },
+	}
+
+	for _, tamper := range tampered {
+		e.issuer.mtx.Lock()
+		e.issuer.tamper = tamper
+		e.issuer.mtx.Unlock()
+
+		status, _ := get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+		assert.Equal(http.StatusUnauthorized, status)
+	}
+
+	// Multiple audiences with the IdP as the authorized party
+	e.issuer.mtx.Lock()
+	e.issuer.tamper = func(claims jwt.MapClaims) {
+		claims["aud"] = []string{testClientID, "other"}
+		claims["azp"] = testClientID
+	}
+	e.issuer.mtx.Unlock()
+	status, body := get(assert, newBrowser(), e.idp.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+}
+
+func TestForgedCallback(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, false)
+	defer e.Close()
+
+	// No login was started in this browser
+	status, _ := get(assert, newBrowser(), e.idp.URL+"/?code=stolen&state=guessed")
+	assert.Equal(http.StatusBadRequest, status)
+}
@@ -0,0 +1,59 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+)
+
+// Provisioner returns the local user for an upstream identity that isn't linked yet.
+// It can create a new user or return an existing one, the identity is linked to it.
+type Provisioner interface {
+	Provision(claims *Claims) (username string, err error)
+}
+
+// ContextProvisioner is a Provisioner whose calls to the database are canceled with the context.
+// Used instead of Provision when the Provisioner implements it.
+type ContextProvisioner interface {
+	ProvisionContext(ctx context.Context, claims *Claims) (username string, err error)
+}
+
+// StoreProvisioner creates users named by the preferred_username claim,
+// or the email claim if the upstream provider verified it.
+// Users get a random password, so they log in through the upstream provider
+// until they set their own. Existing users aren't linked, the upstream account
+// could be registered by someone else with the same name.
+type StoreProvisioner struct {
+	Users userdb.Store
+}
+
+func (s *StoreProvisioner) Provision(claims *Claims) (string, error) {
+	return s.ProvisionContext(context.Background(), claims)
+}
+
+func (s *StoreProvisioner) ProvisionContext(ctx context.Context, claims *Claims) (string, error) {
+	username := claims.PreferredUsername
+	if username == "" && claims.EmailVerified {
+		username = claims.Email
+	}
+
+	if username == "" {
+		return "", core.ErrorBadRequest
+	}
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	err = userdb.WithContext(s.Users).AddContext(ctx, username, base64.RawURLEncoding.EncodeToString(random))
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/janekolszak/idp/core"
+)
+
+// Audience is a string or an array of strings in the token
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = Audience{s}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a Audience) contains(clientID string) bool {
+	for _, audience := range a {
+		if audience == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims of the upstream ID token
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	GivenName         string `json:"given_name"`
+	FamilyName        string `json:"family_name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Claims are validated in verifyIDToken, with the allowed clock skew
+func (c *Claims) Valid() error {
+	return nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	Error       string `json:"error"`
+}
+
+// Exchanges the authorization code for tokens, returns the ID token
+func (p *Provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientID},
+	}
+
+	request, err := http.NewRequest("POST", p.Metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	// RFC 6749, 2.3.1
+	request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	response, err := p.HTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var tokens tokenResponse
+	err = json.NewDecoder(response.Body).Decode(&tokens)
+	if err != nil || response.StatusCode != http.StatusOK || tokens.Error != "" || tokens.IDToken == "" {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	return tokens.IDToken, nil
+}
+
+// Checks the signature and claims of the ID token
+func (p *Provider) verifyIDToken(idToken, nonce string) (*Claims, error) {
+	parser := jwt.Parser{
+		ValidMethods:         []string{"RS256", "ES256"},
+		SkipClaimsValidation: true,
+	}
+
+	claims := new(Claims)
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		return p.keys.get(keyID)
+	})
+	if err != nil {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if claims.Issuer != p.Metadata.Issuer || claims.Subject == "" {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if !claims.Audience.contains(p.ClientID) {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	now := time.Now()
+	if now.Add(-p.ClockSkew).Unix() >= claims.Expires || now.Add(p.ClockSkew).Unix() < claims.IssuedAt {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	return claims, nil
+}
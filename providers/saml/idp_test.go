@@ -0,0 +1,293 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const testIDPEntityID = "https://idp.example.com/saml"
+
+func newTestCertificate(key *rsa.PrivateKey) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return certificate
+}
+
+// Stand-in identity provider, logs in the user it's told to.
+// Instead of an auto-submitted form it replies with the form values for the ACS.
+type testIDP struct {
+	server      *httptest.Server
+	key         *rsa.PrivateKey
+	certificate *x509.Certificate
+
+	mtx sync.Mutex
+
+	// Next user logging in
+	nameID     string
+	attributes map[string]string
+
+	// Verifies AuthnRequests if set
+	spCertificate *x509.Certificate
+
+	// Signing of the next response
+	signAssertion bool
+	signResponse  bool
+
+	// Modify the next response before and after it's signed
+	tamper func(response *etree.Element)
+	forge  func(response *etree.Element)
+}
+
+func newTestIDP() *testIDP {
+	i := &testIDP{signAssertion: true}
+
+	var err error
+	i.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	i.certificate = newTestCertificate(i.key)
+
+	i.server = httptest.NewServer(http.HandlerFunc(i.sso))
+	return i
+}
+
+func (i *testIDP) Close() {
+	i.server.Close()
+}
+
+func (i *testIDP) login(nameID string, attributes map[string]string) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.nameID = nameID
+	i.attributes = attributes
+}
+
+func (i *testIDP) metadata() []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="encryption">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>bm90IGEgY2VydGlmaWNhdGU=</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>
+        %s
+      </ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="%s/sso"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%s/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, testIDPEntityID, base64.StdEncoding.EncodeToString(i.certificate.Raw), i.server.URL, i.server.URL))
+}
+
+// Reads the AuthnRequest sent with either binding
+func (i *testIDP) readRequest(r *http.Request) (*etree.Element, error) {
+	doc := etree.NewDocument()
+
+	if r.Method == "GET" {
+		deflated, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		if err != nil {
+			return nil, err
+		}
+
+		if i.spCertificate != nil {
+			signed := r.URL.RawQuery[:strings.Index(r.URL.RawQuery, "&Signature=")]
+			signature, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("Signature"))
+			if err != nil {
+				return nil, err
+			}
+
+			sum := sha256.Sum256([]byte(signed))
+			err = rsa.VerifyPKCS1v15(i.spCertificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], signature)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = doc.ReadFromBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		return doc.Root(), nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(r.PostFormValue("SAMLRequest"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = doc.ReadFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.spCertificate != nil {
+		validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: []*x509.Certificate{i.spCertificate},
+		})
+		return validator.Validate(doc.Root())
+	}
+	return doc.Root(), nil
+}
+
+func (i *testIDP) sso(w http.ResponseWriter, r *http.Request) {
+	request, err := i.readRequest(r)
+	if err != nil || request.SelectAttrValue("Destination", "") != i.server.URL+"/sso" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	response, err := i.response(request.SelectAttrValue("ID", ""), request.SelectAttrValue("AssertionConsumerServiceURL", ""))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprint(w, url.Values{
+		"SAMLResponse": {response},
+		"RelayState":   {r.FormValue("RelayState")},
+	}.Encode())
+}
+
+func (i *testIDP) sign(el *etree.Element) (*etree.Element, error) {
+	ctx := dsig.NewDefaultSigningContext(&keyStore{key: i.key, certificate: i.certificate.Raw})
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		return nil, err
+	}
+
+	// After the Issuer
+	signature := signed.RemoveChildAt(len(signed.Child) - 1)
+	signed.InsertChildAt(1, signature)
+	return signed, nil
+}
+
+func (i *testIDP) response(requestID, acs string) (string, error) {
+	now := time.Now().UTC()
+	format := func(t time.Time) string {
+		return t.Format(timeFormat)
+	}
+
+	response := etree.NewElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", protocolNS)
+	response.CreateAttr("xmlns:saml", assertionNS)
+	response.CreateAttr("ID", "_response"+fmt.Sprint(now.UnixNano()))
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", format(now))
+	response.CreateAttr("Destination", acs)
+	response.CreateAttr("InResponseTo", requestID)
+	response.CreateElement("saml:Issuer").SetText(testIDPEntityID)
+	response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", successStatus)
+
+	assertion := response.CreateElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", assertionNS)
+	assertion.CreateAttr("ID", "_assertion"+fmt.Sprint(now.UnixNano()))
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", format(now))
+	assertion.CreateElement("saml:Issuer").SetText(testIDPEntityID)
+
+	subject := assertion.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText(i.nameID)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", bearerMethod)
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	confirmationData.CreateAttr("Recipient", acs)
+	confirmationData.CreateAttr("InResponseTo", requestID)
+	confirmationData.CreateAttr("NotOnOrAfter", format(now.Add(5*time.Minute)))
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", format(now.Add(-time.Minute)))
+	conditions.CreateAttr("NotOnOrAfter", format(now.Add(5*time.Minute)))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(testEntityID)
+
+	statement := assertion.CreateElement("saml:AuthnStatement")
+	statement.CreateAttr("AuthnInstant", format(now))
+	statement.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").
+		SetText("urn:oasis:names:tc:SAML:2.0:ac:classes:Password")
+
+	attributes := assertion.CreateElement("saml:AttributeStatement")
+	for name, value := range i.attributes {
+		attribute := attributes.CreateElement("saml:Attribute")
+		attribute.CreateAttr("Name", name)
+		attribute.CreateElement("saml:AttributeValue").SetText(value)
+	}
+
+	if i.tamper != nil {
+		i.tamper(response)
+		i.tamper = nil
+	}
+
+	var err error
+	if i.signAssertion {
+		signed, err := i.sign(assertion)
+		if err != nil {
+			return "", err
+		}
+		response.InsertChild(assertion, signed)
+		response.RemoveChild(assertion)
+	}
+
+	if i.signResponse {
+		response, err = i.sign(response)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if i.forge != nil {
+		i.forge(response)
+		i.forge = nil
+	}
+
+	data, err := serialize(response)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
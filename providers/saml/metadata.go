@@ -0,0 +1,133 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/janekolszak/idp/core"
+)
+
+// IDPMetadata describes the SAML identity provider
+type IDPMetadata struct {
+	EntityID string
+
+	// Locations of the single sign-on service by binding
+	SingleSignOnServices map[string]string
+
+	// Certificates the identity provider signs with
+	Certificates []*x509.Certificate
+}
+
+// ParseIDPMetadata reads the identity provider's EntityDescriptor
+func ParseIDPMetadata(data []byte) (*IDPMetadata, error) {
+	doc := etree.NewDocument()
+	err := doc.ReadFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root := doc.Root()
+	if root == nil || !is(root, metadataNS, "EntityDescriptor") {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	descriptor := child(root, metadataNS, "IDPSSODescriptor")
+	if descriptor == nil {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	metadata := &IDPMetadata{
+		EntityID:             root.SelectAttrValue("entityID", ""),
+		SingleSignOnServices: make(map[string]string),
+	}
+
+	for _, service := range children(descriptor, metadataNS, "SingleSignOnService") {
+		binding := service.SelectAttrValue("Binding", "")
+		if _, ok := metadata.SingleSignOnServices[binding]; !ok {
+			metadata.SingleSignOnServices[binding] = service.SelectAttrValue("Location", "")
+		}
+	}
+
+	for _, key := range children(descriptor, metadataNS, "KeyDescriptor") {
+		// Keys without use are for both signing and encryption
+		if use := key.SelectAttrValue("use", "signing"); use != "signing" {
+			continue
+		}
+
+		for _, data := range key.FindElements("./KeyInfo/X509Data/X509Certificate") {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data.Text()), ""))
+			if err != nil {
+				return nil, err
+			}
+
+			certificate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			metadata.Certificates = append(metadata.Certificates, certificate)
+		}
+	}
+
+	if metadata.EntityID == "" || len(metadata.Certificates) == 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	return metadata, nil
+}
+
+// Metadata returns the service provider's EntityDescriptor,
+// to be registered at the identity provider
+func (p *Provider) Metadata() ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+
+	root := doc.CreateElement("md:EntityDescriptor")
+	root.CreateAttr("xmlns:md", metadataNS)
+	root.CreateAttr("entityID", p.EntityID)
+
+	descriptor := root.CreateElement("md:SPSSODescriptor")
+	descriptor.CreateAttr("protocolSupportEnumeration", protocolNS)
+	if p.Key != nil {
+		descriptor.CreateAttr("AuthnRequestsSigned", "true")
+	} else {
+		descriptor.CreateAttr("AuthnRequestsSigned", "false")
+	}
+	descriptor.CreateAttr("WantAssertionsSigned", "true")
+
+	if p.Certificate != nil {
+		key := descriptor.CreateElement("md:KeyDescriptor")
+		key.CreateAttr("use", "signing")
+		info := key.CreateElement("ds:KeyInfo")
+		info.CreateAttr("xmlns:ds", dsigNS)
+		info.CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").
+			SetText(base64.StdEncoding.EncodeToString(p.Certificate.Raw))
+	}
+
+	if p.NameIDFormat != "" {
+		descriptor.CreateElement("md:NameIDFormat").SetText(p.NameIDFormat)
+	}
+
+	service := descriptor.CreateElement("md:AssertionConsumerService")
+	service.CreateAttr("Binding", POSTBinding)
+	service.CreateAttr("Location", p.ACSURL)
+	service.CreateAttr("index", "0")
+	service.CreateAttr("isDefault", "true")
+
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
+
+// ServeMetadata is a handler publishing the service provider's metadata
+func (p *Provider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := p.Metadata()
+	if err != nil {
+		http.Error(w, "An error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
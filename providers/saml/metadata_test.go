@@ -0,0 +1,78 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+
+	"github.com/beevik/etree"
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIDPMetadata(t *testing.T) {
+	assert := assert.New(t)
+	idp := newTestIDP()
+	defer idp.Close()
+
+	metadata, err := ParseIDPMetadata(idp.metadata())
+	assert.Nil(err)
+	assert.Equal(testIDPEntityID, metadata.EntityID)
+	assert.Equal(idp.server.URL+"/sso", metadata.SingleSignOnServices[RedirectBinding])
+	assert.Equal(idp.server.URL+"/sso", metadata.SingleSignOnServices[POSTBinding])
+
+	// Only the signing key
+	if assert.Len(metadata.Certificates, 1) {
+		assert.True(metadata.Certificates[0].Equal(idp.certificate))
+	}
+
+	_, err = ParseIDPMetadata([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`))
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = ParseIDPMetadata([]byte(`<EntityDescriptor entityID="x"><IDPSSODescriptor/></EntityDescriptor>`))
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	certificate := newTestCertificate(key)
+
+	e := newTestEnv(assert, func(c *Config) {
+		c.Key = key
+		c.Certificate = certificate
+		c.NameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	})
+	defer e.Close()
+
+	data, err := e.provider.Metadata()
+	assert.Nil(err)
+
+	doc := etree.NewDocument()
+	assert.Nil(doc.ReadFromBytes(data))
+
+	root := doc.Root()
+	assert.True(is(root, metadataNS, "EntityDescriptor"))
+	assert.Equal(testEntityID, root.SelectAttrValue("entityID", ""))
+
+	descriptor := child(root, metadataNS, "SPSSODescriptor")
+	if !assert.NotNil(descriptor) {
+		return
+	}
+	assert.Equal("true", descriptor.SelectAttrValue("AuthnRequestsSigned", ""))
+	assert.Equal("urn:oasis:names:tc:SAML:2.0:nameid-format:persistent", childText(descriptor, metadataNS, "NameIDFormat"))
+
+	service := child(descriptor, metadataNS, "AssertionConsumerService")
+	if assert.NotNil(service) {
+		assert.Equal(POSTBinding, service.SelectAttrValue("Binding", ""))
+		assert.Equal(e.provider.ACSURL, service.SelectAttrValue("Location", ""))
+	}
+
+	published := descriptor.FindElement("./md:KeyDescriptor/ds:KeyInfo/ds:X509Data/ds:X509Certificate")
+	if assert.NotNil(published) {
+		assert.Equal(base64.StdEncoding.EncodeToString(certificate.Raw), published.Text())
+	}
+}
@@ -0,0 +1,59 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+)
+
+// Provisioner returns the local user for a NameID that isn't linked yet.
+// It can create a new user or return an existing one, the NameID is linked to it.
+type Provisioner interface {
+	Provision(user *User) (username string, err error)
+}
+
+// ContextProvisioner is a Provisioner whose calls to the database are canceled with the context.
+// Used instead of Provision when the Provisioner implements it.
+type ContextProvisioner interface {
+	ProvisionContext(ctx context.Context, user *User) (username string, err error)
+}
+
+// StoreProvisioner creates users named by the username attribute,
+// or the email attribute if there's no username.
+// Users get a random password, so they log in through the identity provider
+// until they set their own. Existing users aren't linked, the identity provider
+// could have another user with the same name.
+type StoreProvisioner struct {
+	Users userdb.Store
+}
+
+func (s *StoreProvisioner) Provision(user *User) (string, error) {
+	return s.ProvisionContext(context.Background(), user)
+}
+
+func (s *StoreProvisioner) ProvisionContext(ctx context.Context, user *User) (string, error) {
+	username := user.GetUsername()
+	if username == "" {
+		username = user.GetEmail()
+	}
+
+	if username == "" {
+		return "", core.ErrorBadRequest
+	}
+
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	err = userdb.WithContext(s.Users).AddContext(ctx, username, base64.RawURLEncoding.EncodeToString(random))
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
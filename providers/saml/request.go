@@ -0,0 +1,161 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const signatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+
+var postTemplate = template.Must(template.New("post").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.URL}}">
+<input type="hidden" name="SAMLRequest" value="{{.Request}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// Signs with the service provider's key
+type keyStore struct {
+	key         *rsa.PrivateKey
+	certificate []byte
+}
+
+func (k *keyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return k.key, k.certificate, nil
+}
+
+// IDs have to start with a letter or an underscore
+func newID() (string, error) {
+	random := make([]byte, 20)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(random), nil
+}
+
+func (p *Provider) authnRequest(id, destination string) *etree.Element {
+	request := etree.NewElement("samlp:AuthnRequest")
+	request.CreateAttr("xmlns:samlp", protocolNS)
+	request.CreateAttr("xmlns:saml", assertionNS)
+	request.CreateAttr("ID", id)
+	request.CreateAttr("Version", "2.0")
+	request.CreateAttr("IssueInstant", time.Now().UTC().Format(timeFormat))
+	request.CreateAttr("Destination", destination)
+	request.CreateAttr("AssertionConsumerServiceURL", p.ACSURL)
+	request.CreateAttr("ProtocolBinding", POSTBinding)
+
+	request.CreateElement("saml:Issuer").SetText(p.EntityID)
+
+	policy := request.CreateElement("samlp:NameIDPolicy")
+	if p.NameIDFormat != "" {
+		policy.CreateAttr("Format", p.NameIDFormat)
+	}
+	policy.CreateAttr("AllowCreate", "true")
+	return request
+}
+
+func serialize(el *etree.Element) ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	return doc.WriteToBytes()
+}
+
+// Sends the AuthnRequest with the HTTP-Redirect binding.
+// The request is deflated and signed in the query string.
+func (p *Provider) redirectBinding(w http.ResponseWriter, r *http.Request, id, relayState string) error {
+	destination := p.IDP.SingleSignOnServices[RedirectBinding]
+
+	request, err := serialize(p.authnRequest(id, destination))
+	if err != nil {
+		return err
+	}
+
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	writer.Write(request)
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	// Signature covers the parameters in this order, as they are sent
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes())) +
+		"&RelayState=" + url.QueryEscape(relayState)
+
+	if p.Key != nil {
+		query += "&SigAlg=" + url.QueryEscape(signatureAlgorithm)
+
+		sum := sha256.Sum256([]byte(query))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, p.Key, crypto.SHA256, sum[:])
+		if err != nil {
+			return err
+		}
+		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	}
+
+	separator := "?"
+	if strings.Contains(destination, "?") {
+		separator = "&"
+	}
+
+	http.Redirect(w, r, destination+separator+query, http.StatusFound)
+	return nil
+}
+
+// Sends the AuthnRequest with the HTTP-POST binding,
+// the browser submits a form to the identity provider
+func (p *Provider) postBinding(w http.ResponseWriter, r *http.Request, id, relayState string) error {
+	destination := p.IDP.SingleSignOnServices[POSTBinding]
+	request := p.authnRequest(id, destination)
+
+	if p.Key != nil {
+		ctx := dsig.NewDefaultSigningContext(&keyStore{key: p.Key, certificate: p.Certificate.Raw})
+		ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+		signed, err := ctx.SignEnveloped(request)
+		if err != nil {
+			return err
+		}
+
+		// Schema requires the signature right after the Issuer
+		signature := signed.RemoveChildAt(len(signed.Child) - 1)
+		signed.InsertChildAt(1, signature)
+		request = signed
+	}
+
+	data, err := serialize(request)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	return postTemplate.Execute(w, map[string]string{
+		"URL":        destination,
+		"Request":    base64.StdEncoding.EncodeToString(data),
+		"RelayState": relayState,
+	})
+}
@@ -0,0 +1,226 @@
+package saml
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/janekolszak/idp/core"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Verifies the SAMLResponse sent to the assertion consumer service
+// in reply to the request and returns the user it describes
+func (p *Provider) parseResponse(encoded, requestID string) (*User, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, core.ErrorBadRequest
+	}
+
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(data)
+	if err != nil {
+		return nil, core.ErrorBadRequest
+	}
+
+	response := doc.Root()
+	if response == nil || !is(response, protocolNS, "Response") {
+		return nil, core.ErrorBadRequest
+	}
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: p.IDP.Certificates,
+	})
+
+	// Validate returns the signed content, only it is read afterwards.
+	// Elements wrapped around or next to it could be forged.
+	signed := false
+	if len(children(response, dsigNS, "Signature")) != 0 {
+		response, err = validator.Validate(response)
+		if err != nil {
+			return nil, core.ErrorAuthenticationFailure
+		}
+		signed = true
+	}
+
+	err = p.checkResponse(response, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Exactly one assertion, encrypted ones aren't supported
+	assertion := child(response, assertionNS, "Assertion")
+	if assertion == nil || len(children(response, assertionNS, "EncryptedAssertion")) != 0 {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	assertion = detach(assertion)
+	if len(children(assertion, dsigNS, "Signature")) != 0 {
+		assertion, err = validator.Validate(assertion)
+		if err != nil {
+			return nil, core.ErrorAuthenticationFailure
+		}
+	} else if !signed {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	return p.checkAssertion(assertion, requestID)
+}
+
+func (p *Provider) checkResponse(response *etree.Element, requestID string) error {
+	if response.SelectAttrValue("Version", "") != "2.0" {
+		return core.ErrorAuthenticationFailure
+	}
+
+	// Unsolicited responses aren't accepted
+	if response.SelectAttrValue("InResponseTo", "") != requestID {
+		return core.ErrorAuthenticationFailure
+	}
+
+	destination := response.SelectAttrValue("Destination", "")
+	if destination != "" && destination != p.ACSURL {
+		return core.ErrorAuthenticationFailure
+	}
+
+	issuer := child(response, assertionNS, "Issuer")
+	if issuer != nil && issuer.Text() != p.IDP.EntityID {
+		return core.ErrorAuthenticationFailure
+	}
+
+	// User refused or the identity provider failed
+	status := child(response, protocolNS, "Status")
+	if status == nil {
+		return core.ErrorAuthenticationFailure
+	}
+
+	code := child(status, protocolNS, "StatusCode")
+	if code == nil || code.SelectAttrValue("Value", "") != successStatus {
+		return core.ErrorAuthenticationFailure
+	}
+
+	return nil
+}
+
+func (p *Provider) checkAssertion(assertion *etree.Element, requestID string) (*User, error) {
+	now := time.Now()
+
+	id := assertion.SelectAttrValue("ID", "")
+	if id == "" || assertion.SelectAttrValue("Version", "") != "2.0" {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if childText(assertion, assertionNS, "Issuer") != p.IDP.EntityID {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	subject := child(assertion, assertionNS, "Subject")
+	if subject == nil {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	nameID := childText(subject, assertionNS, "NameID")
+	if nameID == "" {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	expires, ok := p.confirm(subject, requestID, now)
+	if !ok {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	if !p.checkConditions(child(assertion, assertionNS, "Conditions"), now) {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	statements := children(assertion, assertionNS, "AuthnStatement")
+	if len(statements) == 0 {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	authnInstant, _, ok := timeAttr(statements[0], "AuthnInstant")
+	if !ok {
+		return nil, core.ErrorAuthenticationFailure
+	}
+
+	// Assertion can't be used again while it's valid
+	err := p.used.Add(id, true, expires.Sub(now)+p.ClockSkew)
+	if err != nil {
+		return nil, core.ErrorSessionExpired
+	}
+
+	user := p.Attributes.user(nameID, assertion)
+	user.AuthnInstant = authnInstant
+	return user, nil
+}
+
+// Finds the bearer confirmation of the subject for this request,
+// returns the time it expires
+func (p *Provider) confirm(subject *etree.Element, requestID string, now time.Time) (time.Time, bool) {
+	for _, confirmation := range children(subject, assertionNS, "SubjectConfirmation") {
+		if confirmation.SelectAttrValue("Method", "") != bearerMethod {
+			continue
+		}
+
+		data := child(confirmation, assertionNS, "SubjectConfirmationData")
+		if data == nil {
+			continue
+		}
+
+		if data.SelectAttrValue("Recipient", "") != p.ACSURL ||
+			data.SelectAttrValue("InResponseTo", "") != requestID {
+			continue
+		}
+
+		notOnOrAfter, present, ok := timeAttr(data, "NotOnOrAfter")
+		if !present || !ok || !now.Add(-p.ClockSkew).Before(notOnOrAfter) {
+			continue
+		}
+
+		notBefore, present, ok := timeAttr(data, "NotBefore")
+		if !ok || (present && now.Add(p.ClockSkew).Before(notBefore)) {
+			continue
+		}
+
+		return notOnOrAfter, true
+	}
+
+	return time.Time{}, false
+}
+
+// Checks the validity period and that the service provider is in every audience restriction
+func (p *Provider) checkConditions(conditions *etree.Element, now time.Time) bool {
+	if conditions == nil {
+		return false
+	}
+
+	notBefore, present, ok := timeAttr(conditions, "NotBefore")
+	if !ok || (present && now.Add(p.ClockSkew).Before(notBefore)) {
+		return false
+	}
+
+	notOnOrAfter, present, ok := timeAttr(conditions, "NotOnOrAfter")
+	if !ok || (present && !now.Add(-p.ClockSkew).Before(notOnOrAfter)) {
+		return false
+	}
+
+	restrictions := children(conditions, assertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return false
+	}
+
+	for _, restriction := range restrictions {
+		found := false
+		for _, audience := range children(restriction, assertionNS, "Audience") {
+			if strings.TrimSpace(audience.Text()) == p.EntityID {
+				found = true
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
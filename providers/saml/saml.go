@@ -0,0 +1,385 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	pendingSessionName   = "saml"
+	completedSessionName = "saml-login"
+
+	defaultMaxAge    = 10 * time.Minute
+	defaultClockSkew = time.Minute
+
+	// Time to follow the redirect back to the login page
+	completedMaxAge = time.Minute
+)
+
+type Config struct {
+	// Service provider's name, usually the URL of its metadata
+	EntityID string
+
+	// Assertion consumer service, receives responses with the HTTP-POST binding.
+	// Should be served by the login handler, like the login page.
+	ACSURL string
+
+	// Identity provider users log in at, see ParseIDPMetadata
+	IDP *IDPMetadata
+
+	// Binding sending AuthnRequests to the identity provider, RedirectBinding or POSTBinding.
+	// RedirectBinding by default.
+	Binding string
+
+	// Optional. Signs AuthnRequests and is published in the metadata.
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+
+	// Optional. Format of the NameID requested from the identity provider,
+	// e.g. "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent".
+	NameIDFormat string
+
+	// Attributes copied into the User, DefaultAttributes by default
+	Attributes AttributeMap
+
+	// Links NameIDs to local users
+	Identities userdb.IdentityStore
+
+	// Optional. Creates users logging in for the first time,
+	// without it only linked users can log in.
+	Provisioner Provisioner
+
+	// Keeps the state between the redirects
+	Sessions sessions.Store
+
+	// Time to log in at the identity provider
+	MaxAge time.Duration
+
+	// Allowed difference between the clocks of the identity provider and the IdP
+	ClockSkew time.Duration
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Provider is a SAML 2.0 service provider logging users in at an identity provider.
+//
+// The login page sends an AuthnRequest to the identity provider, which posts
+// a signed assertion to ACSURL. After the assertion is verified the browser is
+// sent back to the login page it started from, e.g. with Hydra's challenge,
+// and Check returns the user.
+//
+// NameIDs are linked to local users, so the identity provider should use
+// persistent NameIDs rather than transient ones.
+type Provider struct {
+	Config
+
+	// Requests, assertions and logins can't be used twice
+	used *cache.Cache
+}
+
+// Browser should be sent to the identity provider
+type redirectError struct{}
+
+func (e *redirectError) Error() string {
+	return "redirect to the identity provider"
+}
+
+// User logged in, browser should return to the page that started the login
+type completedError struct {
+	user      string
+	returnURI string
+}
+
+func (e *completedError) Error() string {
+	return "redirect to the login page"
+}
+
+func NewProvider(c Config) (*Provider, error) {
+	if c.EntityID == "" || c.ACSURL == "" || c.IDP == nil || len(c.IDP.Certificates) == 0 ||
+		c.Identities == nil || c.Sessions == nil || c.MaxAge < 0 || c.ClockSkew < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Binding == "" {
+		c.Binding = RedirectBinding
+	}
+
+	if (c.Binding != RedirectBinding && c.Binding != POSTBinding) || c.IDP.SingleSignOnServices[c.Binding] == "" {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	// Key is published with the certificate
+	if (c.Key == nil) != (c.Certificate == nil) {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Attributes.Username == "" {
+		c.Attributes.Username = DefaultAttributes.Username
+	}
+
+	if c.Attributes.Email == "" {
+		c.Attributes.Email = DefaultAttributes.Email
+	}
+
+	if c.Attributes.FirstName == "" {
+		c.Attributes.FirstName = DefaultAttributes.FirstName
+	}
+
+	if c.Attributes.LastName == "" {
+		c.Attributes.LastName = DefaultAttributes.LastName
+	}
+
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultMaxAge
+	}
+
+	if c.ClockSkew == 0 {
+		c.ClockSkew = defaultClockSkew
+	}
+
+	p := &Provider{Config: c}
+	p.used = cache.New(c.MaxAge, c.MaxAge)
+	return p, nil
+}
+
+func randomString() (string, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// Marks the value as used, fails if it already was
+func (p *Provider) useOnce(value string) error {
+	err := p.used.Add(value, true, cache.DefaultExpiration)
+	if err != nil {
+		return core.ErrorSessionExpired
+	}
+	return nil
+}
+
+// Only paths on this host, so the login can't be redirected elsewhere
+func isLocal(uri string) bool {
+	return strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//") && !strings.HasPrefix(uri, "/\\")
+}
+
+func (p *Provider) saveSession(w http.ResponseWriter, r *http.Request, name string, maxAge time.Duration, values map[interface{}]interface{}) error {
+	session, err := p.Sessions.New(r, name)
+	if err != nil && session == nil {
+		return err
+	}
+
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+
+	// Identity provider posts the response from its site, browsers send only
+	// secure SameSite=None cookies with it
+	if name == pendingSessionName {
+		session.Options.SameSite = http.SameSiteNoneMode
+		session.Options.Secure = true
+	}
+
+	session.Values = values
+	session.Values["expires"] = time.Now().Add(maxAge).Unix()
+	return p.Sessions.Save(r, w, session)
+}
+
+func (p *Provider) getSession(r *http.Request, name string) (map[interface{}]interface{}, bool) {
+	session, err := p.Sessions.Get(r, name)
+	if err != nil {
+		return nil, false
+	}
+
+	expires, _ := session.Values["expires"].(int64)
+	if time.Now().Unix() > expires {
+		return nil, false
+	}
+
+	return session.Values, true
+}
+
+// Sends the AuthnRequest to the identity provider
+func (p *Provider) redirect(w http.ResponseWriter, r *http.Request, returnURI string) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+
+	relayState, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	err = p.saveSession(w, r, pendingSessionName, p.MaxAge, map[interface{}]interface{}{
+		"id":     id,
+		"relay":  relayState,
+		"return": returnURI,
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.Binding == POSTBinding {
+		return p.postBinding(w, r, id, relayState)
+	}
+	return p.redirectBinding(w, r, id, relayState)
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	// Back on the login page after the assertion was verified
+	completed, ok := p.getSession(r, completedSessionName)
+	if ok {
+		user, _ = completed["user"].(string)
+		id, _ := completed["id"].(string)
+		if user != "" && p.useOnce(id) == nil {
+			return user, nil
+		}
+	}
+
+	if r.Method == "POST" && r.PostFormValue("SAMLResponse") != "" {
+		user, err = p.consume(r)
+		if _, ok := err.(*completedError); err != nil && !ok {
+			logging.Info(r.Context(), p.Logger, "login at the identity provider failed", logging.Fields{
+				"idp":   p.IDP.EntityID,
+				"error": err,
+			})
+		}
+		return user, err
+	}
+
+	return "", &redirectError{}
+}
+
+// Assertion consumer service
+func (p *Provider) consume(r *http.Request) (user string, err error) {
+	pending, ok := p.getSession(r, pendingSessionName)
+	if !ok {
+		return "", core.ErrorSessionExpired
+	}
+
+	relayState, _ := pending["relay"].(string)
+	if relayState == "" || subtle.ConstantTimeCompare([]byte(relayState), []byte(r.PostFormValue("RelayState"))) != 1 {
+		return "", core.ErrorBadRequest
+	}
+
+	requestID, _ := pending["id"].(string)
+	err = p.useOnce(requestID)
+	if err != nil {
+		return "", err
+	}
+
+	assertion, err := p.parseResponse(r.PostFormValue("SAMLResponse"), requestID)
+	if err != nil {
+		return "", err
+	}
+
+	user, err = p.localUser(r.Context(), assertion)
+	if err != nil {
+		return "", err
+	}
+
+	returnURI, _ := pending["return"].(string)
+	return "", &completedError{user: user, returnURI: returnURI}
+}
+
+// Finds or provisions the local user
+func (p *Provider) localUser(ctx context.Context, assertion *User) (string, error) {
+	identities := userdb.IdentitiesWithContext(p.Identities)
+	user, err := identities.GetUsernameWithIdentityContext(ctx, p.IDP.EntityID, assertion.NameID)
+	if err != core.ErrorNoSuchUser {
+		return user, err
+	}
+
+	if p.Provisioner == nil {
+		return "", core.ErrorNoSuchUser
+	}
+
+	if cp, ok := p.Provisioner.(ContextProvisioner); ok {
+		user, err = cp.ProvisionContext(ctx, assertion)
+	} else {
+		user, err = p.Provisioner.Provision(assertion)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return user, identities.LinkIdentityContext(ctx, user, p.IDP.EntityID, assertion.NameID)
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	// Users are provisioned during the login
+	return "", core.ErrorNotImplemented
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	switch e := err.(type) {
+	case *redirectError:
+		return p.redirect(w, r, r.URL.RequestURI())
+
+	case *completedError:
+		id, err := randomString()
+		if err != nil {
+			return err
+		}
+
+		err = p.saveSession(w, r, completedSessionName, completedMaxAge, map[interface{}]interface{}{
+			"user": e.user,
+			"id":   id,
+		})
+		if err != nil {
+			return err
+		}
+
+		returnURI := e.returnURI
+		if !isLocal(returnURI) {
+			returnURI = "/"
+		}
+
+		// The browser posted to the assertion consumer service
+		http.Redirect(w, r, returnURI, http.StatusSeeOther)
+		return nil
+	}
+
+	switch err {
+	case core.ErrorAuthenticationFailure:
+		http.Error(w, "Authentication failed", http.StatusUnauthorized)
+
+	case core.ErrorNoSuchUser:
+		http.Error(w, "Account isn't registered", http.StatusForbidden)
+
+	case core.ErrorUserAlreadyExists:
+		http.Error(w, "Account already exists", http.StatusConflict)
+
+	case core.ErrorBadRequest, core.ErrorSessionExpired:
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+
+	default:
+		http.Error(w, "An error occurred", http.StatusInternalServerError)
+	}
+
+	return nil
+}
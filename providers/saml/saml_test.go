@@ -0,0 +1,469 @@
+package saml
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+const testEntityID = "https://sp.example.com/metadata"
+
+type testEnv struct {
+	idp      *testIDP
+	server   *httptest.Server
+	provider *Provider
+	users    *memory.Store
+}
+
+func (e *testEnv) Close() {
+	e.server.Close()
+	e.idp.Close()
+}
+
+// Records the users passed to the provisioner
+type testProvisioner struct {
+	StoreProvisioner
+	last *User
+}
+
+func (t *testProvisioner) ProvisionContext(ctx context.Context, user *User) (string, error) {
+	t.last = user
+	return t.StoreProvisioner.ProvisionContext(ctx, user)
+}
+
+// Starts the stand-in identity provider and a login handler like the one in the examples
+func newTestEnv(assert *assert.Assertions, configure func(c *Config)) *testEnv {
+	e := &testEnv{idp: newTestIDP()}
+
+	var err error
+	e.users, err = memory.NewMemStore()
+	assert.Nil(err)
+
+	// Pending logins are kept in secure cookies
+	e.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := e.provider.Check(r)
+		if err != nil {
+			e.provider.WriteError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "user:%s challenge:%s", user, r.FormValue("challenge"))
+	}))
+
+	metadata, err := ParseIDPMetadata(e.idp.metadata())
+	assert.Nil(err)
+
+	config := Config{
+		EntityID:   testEntityID,
+		ACSURL:     e.server.URL + "/",
+		IDP:        metadata,
+		Identities: e.users,
+		Sessions:   sessions.NewCookieStore([]byte("testsecret")),
+	}
+
+	if configure != nil {
+		configure(&config)
+	}
+
+	e.provider, err = NewProvider(config)
+	assert.Nil(err)
+	return e
+}
+
+// Browser following redirects and keeping cookies, it trusts the test servers
+func newBrowser() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	return &http.Client{Jar: jar, Transport: transport}
+}
+
+// Status and body of the response, 0 and the error if the request failed
+func read(response *http.Response, err error) (int, string) {
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err.Error()
+	}
+	return response.StatusCode, string(body)
+}
+
+var (
+	formAction = regexp.MustCompile(`action="([^"]*)"`)
+	formInput  = regexp.MustCompile(`name="(\w+)" value="([^"]*)"`)
+)
+
+// Goes to the identity provider, returns the form values it posts to the ACS
+func (e *testEnv) authenticate(browser *http.Client, uri string) (int, url.Values) {
+	status, body := read(browser.Get(uri))
+	if status != http.StatusOK {
+		return status, nil
+	}
+
+	// Auto-submitted form
+	if e.provider.Binding == POSTBinding {
+		form := url.Values{}
+		for _, input := range formInput.FindAllStringSubmatch(body, -1) {
+			form.Set(input[1], html.UnescapeString(input[2]))
+		}
+
+		action := formAction.FindStringSubmatch(body)
+		if action == nil {
+			return 0, nil
+		}
+
+		status, body = read(browser.PostForm(html.UnescapeString(action[1]), form))
+		if status != http.StatusOK {
+			return status, nil
+		}
+	}
+
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		return 0, nil
+	}
+	return status, form
+}
+
+// Logs in, returns the status and body of the page the ACS redirected to
+func (e *testEnv) login(browser *http.Client, uri string) (int, string) {
+	status, form := e.authenticate(browser, uri)
+	if status != http.StatusOK {
+		return status, ""
+	}
+	return read(browser.PostForm(e.provider.ACSURL, form))
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, nil)
+	defer e.Close()
+
+	_, err := NewProvider(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	assert.Equal(RedirectBinding, e.provider.Binding)
+	assert.Equal(DefaultAttributes, e.provider.Attributes)
+
+	config := e.provider.Config
+	config.Binding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+	_, err = NewProvider(config)
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+
+	config = e.provider.Config
+	config.Key = key
+	_, err = NewProvider(config)
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, nil)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	e.idp.login("idp-joe", nil)
+
+	// Not linked and not provisioned
+	status, _ := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusForbidden, status)
+
+	assert.Nil(e.users.LinkIdentity("joe", testIDPEntityID, "idp-joe"))
+
+	browser := newBrowser()
+	status, body := e.login(browser, e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+
+	// Login is used once, the next one goes through the identity provider again
+	e.idp.login("idp-other", nil)
+	status, _ = e.login(browser, e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusForbidden, status)
+}
+
+func TestPendingCookie(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, nil)
+	defer e.Close()
+
+	browser := newBrowser()
+	browser.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	response, err := browser.Get(e.server.URL + "/?challenge=abc")
+	assert.Nil(err)
+	response.Body.Close()
+
+	// Sent with the response the identity provider posts from its site
+	cookies := response.Cookies()
+	if assert.Len(cookies, 1) {
+		assert.Equal(pendingSessionName, cookies[0].Name)
+		assert.Equal(http.SameSiteNoneMode, cookies[0].SameSite)
+		assert.True(cookies[0].Secure)
+		assert.True(cookies[0].HttpOnly)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	certificate := newTestCertificate(key)
+
+	for _, binding := range []string{RedirectBinding, POSTBinding} {
+		e := newTestEnv(assert, func(c *Config) {
+			c.Binding = binding
+			c.Key = key
+			c.Certificate = certificate
+		})
+		e.idp.spCertificate = certificate
+
+		// Signed response wrapping a signed assertion
+		e.idp.signResponse = true
+
+		assert.Nil(e.users.Add("joe", "joe123"))
+		assert.Nil(e.users.LinkIdentity("joe", testIDPEntityID, "idp-joe"))
+		e.idp.login("idp-joe", nil)
+
+		status, body := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+		assert.Equal(http.StatusOK, status)
+		assert.Equal("user:joe challenge:abc", body)
+
+		// Only the response is signed
+		e.idp.signAssertion = false
+		status, body = e.login(newBrowser(), e.server.URL+"/?challenge=def")
+		assert.Equal(http.StatusOK, status)
+		assert.Equal("user:joe challenge:def", body)
+
+		// Request signed with another key
+		e.idp.spCertificate = e.idp.certificate
+		status, _ = e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+		assert.Equal(http.StatusBadRequest, status)
+
+		e.Close()
+	}
+}
+
+func TestProvisioning(t *testing.T) {
+	assert := assert.New(t)
+
+	provisioner := &testProvisioner{}
+	e := newTestEnv(assert, func(c *Config) {
+		provisioner.Users = c.Identities.(*memory.Store)
+		c.Provisioner = provisioner
+		c.Attributes.Username = "urn:oid:0.9.2342.19200300.100.1.1"
+	})
+	defer e.Close()
+
+	// No name to provision the user with
+	e.idp.login("1", nil)
+	status, _ := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusBadRequest, status)
+
+	e.idp.login("1", map[string]string{
+		"urn:oid:0.9.2342.19200300.100.1.1": "joe",
+		"mail":                              "joe@example.com",
+		"givenName":                         "Joe",
+		"sn":                                "Doe",
+	})
+	status, body := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+
+	user := provisioner.last
+	assert.Equal("1", user.NameID)
+	assert.Equal("joe", user.GetUsername())
+	assert.Equal("joe@example.com", user.GetEmail())
+	assert.Equal("Joe", user.GetFirstName())
+	assert.Equal("Doe", user.GetLastName())
+	assert.Equal([]string{"Doe"}, user.Attributes["sn"])
+	assert.WithinDuration(time.Now(), user.AuthnInstant, time.Minute)
+
+	// Linked after provisioning
+	username, err := e.users.GetUsernameWithIdentity(testIDPEntityID, "1")
+	assert.Nil(err)
+	assert.Equal("joe", username)
+
+	// Another NameID with the same name isn't linked to the existing user
+	e.idp.login("2", map[string]string{"urn:oid:0.9.2342.19200300.100.1.1": "joe"})
+	status, _ = e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusConflict, status)
+}
+
+func TestFriendlyNames(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := etree.NewDocument()
+	assert.Nil(doc.ReadFromString(`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">
+	<saml:AttributeStatement>
+		<saml:Attribute Name="urn:oid:0.9.2342.19200300.100.1.3" FriendlyName="mail">
+			<saml:AttributeValue>joe@example.com</saml:AttributeValue>
+			<saml:AttributeValue>joe@example.org</saml:AttributeValue>
+		</saml:Attribute>
+		<saml:Attribute Name="uid"><saml:AttributeValue>joe</saml:AttributeValue></saml:Attribute>
+	</saml:AttributeStatement>
+</saml:Assertion>`))
+
+	user := DefaultAttributes.user("id", doc.Root())
+	assert.Equal("joe", user.Username)
+	assert.Equal("joe@example.com", user.Email)
+	assert.Equal([]string{"joe@example.com", "joe@example.org"}, user.Attributes["urn:oid:0.9.2342.19200300.100.1.3"])
+	assert.Equal("", user.FirstName)
+}
+
+func setAttr(path, key, value string) func(response *etree.Element) {
+	return func(response *etree.Element) {
+		response.FindElement(path).CreateAttr(key, value)
+	}
+}
+
+func setText(path, text string) func(response *etree.Element) {
+	return func(response *etree.Element) {
+		response.FindElement(path).SetText(text)
+	}
+}
+
+func TestBadResponse(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, nil)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	assert.Nil(e.users.LinkIdentity("joe", testIDPEntityID, "idp-joe"))
+	e.idp.login("idp-joe", nil)
+
+	past := time.Now().Add(-time.Hour).UTC().Format(timeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(timeFormat)
+
+	status, body := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+
+	tampered := []func(response *etree.Element){
+		setText("./saml:Assertion/saml:Conditions/saml:AudienceRestriction/saml:Audience", "https://other.example.com"),
+		setAttr("./saml:Assertion/saml:Conditions", "NotOnOrAfter", past),
+		setAttr("./saml:Assertion/saml:Conditions", "NotBefore", future),
+		setAttr("./saml:Assertion/saml:Conditions", "NotBefore", "yesterday"),
+		setAttr("./saml:Assertion/saml:Subject/saml:SubjectConfirmation/saml:SubjectConfirmationData", "NotOnOrAfter", past),
+		setAttr("./saml:Assertion/saml:Subject/saml:SubjectConfirmation/saml:SubjectConfirmationData", "Recipient", "https://other.example.com/"),
+		setAttr("./saml:Assertion/saml:Subject/saml:SubjectConfirmation/saml:SubjectConfirmationData", "InResponseTo", "_other"),
+		setAttr("./saml:Assertion/saml:Subject/saml:SubjectConfirmation", "Method", "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"),
+		setAttr(".", "InResponseTo", "_other"),
+		setAttr(".", "Destination", "https://other.example.com/"),
+		setText("./saml:Issuer", "https://evil.example.com"),
+		setText("./saml:Assertion/saml:Issuer", "https://evil.example.com"),
+		setAttr("./samlp:Status/samlp:StatusCode", "Value", "urn:oasis:names:tc:SAML:2.0:status:Requester"),
+		func(response *etree.Element) {
+			response.FindElement("./saml:Assertion").RemoveChild(response.FindElement("./saml:Assertion/saml:Conditions"))
+		},
+	}
+
+	for _, tamper := range tampered {
+		e.idp.mtx.Lock()
+		e.idp.tamper = tamper
+		e.idp.mtx.Unlock()
+
+		status, _ := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+		assert.Equal(http.StatusUnauthorized, status)
+	}
+
+	forged := []func(response *etree.Element){
+		// Changed after signing
+		setText("./saml:Assertion/saml:Subject/saml:NameID", "idp-admin"),
+
+		// Unsigned assertion next to the signed one
+		func(response *etree.Element) {
+			forgery := response.FindElement("./saml:Assertion").Copy()
+			forgery.RemoveChild(forgery.FindElement("./ds:Signature"))
+			forgery.FindElement("./saml:Subject/saml:NameID").SetText("idp-admin")
+			response.InsertChildAt(0, forgery)
+		},
+
+		// Signed assertion moved away, the unsigned one in its place
+		func(response *etree.Element) {
+			signed := response.FindElement("./saml:Assertion")
+			forgery := signed.Copy()
+			forgery.RemoveChild(forgery.FindElement("./ds:Signature"))
+			forgery.FindElement("./saml:Subject/saml:NameID").SetText("idp-admin")
+			response.InsertChild(signed, forgery)
+			response.RemoveChild(signed)
+			response.FindElement("./samlp:Status").AddChild(signed)
+		},
+	}
+
+	for _, forge := range forged {
+		e.idp.mtx.Lock()
+		e.idp.forge = forge
+		e.idp.mtx.Unlock()
+
+		status, _ := e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+		assert.Equal(http.StatusUnauthorized, status)
+	}
+
+	// Unsigned
+	e.idp.signAssertion = false
+	status, _ = e.login(newBrowser(), e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusUnauthorized, status)
+}
+
+func TestReplay(t *testing.T) {
+	assert := assert.New(t)
+	e := newTestEnv(assert, nil)
+	defer e.Close()
+
+	assert.Nil(e.users.Add("joe", "joe123"))
+	assert.Nil(e.users.LinkIdentity("joe", testIDPEntityID, "idp-joe"))
+	e.idp.login("idp-joe", nil)
+
+	browser := newBrowser()
+	status, form := e.authenticate(browser, e.server.URL+"/?challenge=abc")
+	assert.Equal(http.StatusOK, status)
+
+	status, body := read(browser.PostForm(e.provider.ACSURL, form))
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("user:joe challenge:abc", body)
+
+	status, _ = read(browser.PostForm(e.provider.ACSURL, form))
+	assert.Equal(http.StatusBadRequest, status)
+
+	// Assertions are used once even if the request wasn't
+	e.idp.mtx.Lock()
+	response, err := e.idp.response("_request", e.provider.ACSURL)
+	e.idp.mtx.Unlock()
+	assert.Nil(err)
+
+	user, err := e.provider.parseResponse(response, "_request")
+	assert.Nil(err)
+	assert.Equal("idp-joe", user.NameID)
+
+	_, err = e.provider.parseResponse(response, "_request")
+	assert.Equal(core.ErrorSessionExpired, err)
+
+	// No login was started in this browser
+	status, _ = read(newBrowser().PostForm(e.provider.ACSURL, form))
+	assert.Equal(http.StatusBadRequest, status)
+}
@@ -0,0 +1,116 @@
+package saml
+
+import (
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// AttributeMap names the assertion attributes copied into User.
+// Attributes are matched by their Name or FriendlyName.
+type AttributeMap struct {
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// Names used by LDAP backed identity providers
+var DefaultAttributes = AttributeMap{
+	Username:  "uid",
+	Email:     "mail",
+	FirstName: "givenName",
+	LastName:  "sn",
+}
+
+// User is described by a verified assertion, implements userdb.UserInfo
+type User struct {
+	// Identity provider's name of the user
+	NameID string
+
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+
+	// All attribute values by Name
+	Attributes map[string][]string
+
+	// Time the user authenticated at the identity provider
+	AuthnInstant time.Time
+}
+
+func (u *User) GetUsername() string {
+	return u.Username
+}
+
+// Users authenticate at the identity provider
+func (u *User) GetPassword() string {
+	return ""
+}
+
+func (u *User) GetFirstName() string {
+	return u.FirstName
+}
+
+func (u *User) GetLastName() string {
+	return u.LastName
+}
+
+func (u *User) GetEmail() string {
+	return u.Email
+}
+
+// Identity provider vouches for the user
+func (u *User) GetIsVerified() bool {
+	return true
+}
+
+// Unknown, the identity provider doesn't send it
+func (u *User) GetRegistrationTime() time.Time {
+	return time.Time{}
+}
+
+// Reads the AttributeStatements of the assertion
+func (m *AttributeMap) user(nameID string, assertion *etree.Element) *User {
+	user := &User{
+		NameID:     nameID,
+		Attributes: make(map[string][]string),
+	}
+
+	friendly := make(map[string][]string)
+	for _, statement := range children(assertion, assertionNS, "AttributeStatement") {
+		for _, attribute := range children(statement, assertionNS, "Attribute") {
+			var values []string
+			for _, value := range children(attribute, assertionNS, "AttributeValue") {
+				values = append(values, value.Text())
+			}
+
+			name := attribute.SelectAttrValue("Name", "")
+			user.Attributes[name] = append(user.Attributes[name], values...)
+
+			friendlyName := attribute.SelectAttrValue("FriendlyName", "")
+			if friendlyName != "" {
+				friendly[friendlyName] = append(friendly[friendlyName], values...)
+			}
+		}
+	}
+
+	get := func(name string) string {
+		values, ok := user.Attributes[name]
+		if !ok {
+			values = friendly[name]
+		}
+
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+
+	user.Username = get(m.Username)
+	user.Email = get(m.Email)
+	user.FirstName = get(m.FirstName)
+	user.LastName = get(m.LastName)
+	return user
+}
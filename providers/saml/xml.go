@@ -0,0 +1,94 @@
+package saml
+
+import (
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	protocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	metadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	dsigNS      = "http://www.w3.org/2000/09/xmldsig#"
+
+	RedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	POSTBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	bearerMethod  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	successStatus = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+	// xs:dateTime in UTC, as required by the specification
+	timeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+func is(el *etree.Element, namespace, tag string) bool {
+	return el.Tag == tag && el.NamespaceURI() == namespace
+}
+
+func children(el *etree.Element, namespace, tag string) []*etree.Element {
+	var result []*etree.Element
+	for _, child := range el.ChildElements() {
+		if is(child, namespace, tag) {
+			result = append(result, child)
+		}
+	}
+	return result
+}
+
+// Returns the only child with the tag, nil if there's none or more than one
+func child(el *etree.Element, namespace, tag string) *etree.Element {
+	found := children(el, namespace, tag)
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+func childText(el *etree.Element, namespace, tag string) string {
+	c := child(el, namespace, tag)
+	if c == nil {
+		return ""
+	}
+	return c.Text()
+}
+
+// Copies the element with the namespaces declared by its ancestors,
+// so it can be verified and read on its own
+func detach(el *etree.Element) *etree.Element {
+	declared := make(map[string]bool)
+	for _, attr := range el.Attr {
+		if attr.Space == "xmlns" || (attr.Space == "" && attr.Key == "xmlns") {
+			declared[attr.FullKey()] = true
+		}
+	}
+
+	result := el.Copy()
+	for parent := el.Parent(); parent != nil; parent = parent.Parent() {
+		for _, attr := range parent.Attr {
+			if attr.Space != "xmlns" && (attr.Space != "" || attr.Key != "xmlns") {
+				continue
+			}
+
+			if !declared[attr.FullKey()] {
+				declared[attr.FullKey()] = true
+				result.CreateAttr(attr.FullKey(), attr.Value)
+			}
+		}
+	}
+	return result
+}
+
+// Parses an optional time attribute, ok is false if it's malformed
+func timeAttr(el *etree.Element, key string) (t time.Time, present bool, ok bool) {
+	value := el.SelectAttrValue(key, "")
+	if value == "" {
+		return time.Time{}, false, true
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, true, false
+	}
+	return t, true, true
+}
@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	dbTablename = "throttle"
+
+	// Concurrent updates of one key are retried
+	maxUpdateAttempts = 10
+)
+
+// DBStore keeps entries in an SQL database, so all replicas share the limits.
+// Call DeleteExpired periodically to remove old entries.
+type DBStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewDBStore(driverName, databaseSourceName string) (*DBStore, error) {
+	var s = new(DBStore)
+	s.table = dbTablename
+
+	var err error
+	s.db, err = sql.Open(driverName, databaseSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStmt := `
+		CREATE TABLE IF NOT EXISTS %[1]s (id           VARCHAR(255) NOT NULL PRIMARY KEY,
+					                      failures     INTEGER NOT NULL,
+					                      lockedUntil  DATETIME NOT NULL,
+					                      expires      DATETIME NOT NULL);
+		CREATE INDEX IF NOT EXISTS %[1]s_expires ON %[1]s (expires);`
+
+	_, err = s.db.Exec(fmt.Sprintf(sqlStmt, s.table))
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Returns the row as it's stored, exists is false if there's none
+func (s *DBStore) get(key string) (row Entry, exists bool, err error) {
+	err = s.db.QueryRow(fmt.Sprintf("SELECT failures, lockedUntil, expires FROM %s WHERE id=?", s.table), key).
+		Scan(&row.Failures, &row.LockedUntil, &row.Expires)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	exists = true
+	return
+}
+
+func valid(row Entry) Entry {
+	if row.Expires.Before(time.Now()) {
+		return Entry{}
+	}
+	return row
+}
+
+func (s *DBStore) Get(key string) (Entry, error) {
+	row, _, err := s.get(key)
+	return valid(row), err
+}
+
+// Update uses optimistic locking: the row is changed only if
+// it still has the values the update started with, otherwise it's retried.
+func (s *DBStore) Update(key string, update func(entry *Entry)) (Entry, error) {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		old, exists, err := s.get(key)
+		if err != nil {
+			return old, err
+		}
+
+		entry := valid(old)
+		update(&entry)
+
+		// Times are kept in UTC, so they compare correctly in every database
+		lockedUntil, expires := entry.LockedUntil.UTC(), entry.Expires.UTC()
+
+		var result sql.Result
+		if exists {
+			result, err = s.db.Exec(fmt.Sprintf(`UPDATE %s SET failures=?, lockedUntil=?, expires=?
+				WHERE id=? AND failures=? AND expires=?`, s.table),
+				entry.Failures, lockedUntil, expires, key, old.Failures, old.Expires.UTC())
+		} else {
+			// Fails if another replica inserted the key in the meantime
+			result, err = s.db.Exec(fmt.Sprintf("INSERT INTO %s(id, failures, lockedUntil, expires) values(?, ?, ?, ?)", s.table),
+				key, entry.Failures, lockedUntil, expires)
+		}
+
+		if err != nil {
+			if exists {
+				return old, err
+			}
+			continue
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return old, err
+		}
+
+		if n == 1 {
+			return entry, nil
+		}
+	}
+
+	return Entry{}, core.ErrorInternalError
+}
+
+func (s *DBStore) Delete(key string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=?", s.table), key)
+	return err
+}
+
+// DeleteExpired removes entries that can be forgotten
+func (s *DBStore) DeleteExpired() error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE expires<?", s.table), time.Now().UTC())
+	return err
+}
+
+func (s *DBStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,66 @@
+package throttle
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_throttle_test.db3"
+)
+
+func TestDBStore(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	s, err := NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer s.Close()
+
+	testStore(t, s)
+}
+
+func TestDBStoreReplicas(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	s1, err := NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer s1.Close()
+
+	s2, err := NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer s2.Close()
+
+	t1, err := NewThrottle(Config{Store: s1, FreeFailures: 1, LockoutFailures: 2})
+	assert.Nil(err)
+
+	t2, err := NewThrottle(Config{Store: s2, FreeFailures: 1, LockoutFailures: 2})
+	assert.Nil(err)
+
+	// Failures in both replicas count
+	assert.Nil(t1.Fail("joe"))
+	assert.Nil(t2.Fail("joe"))
+	assert.NotNil(t1.Check("joe"))
+	assert.NotNil(t2.Check("joe"))
+
+	assert.Nil(t1.Unlock("joe"))
+	assert.Nil(t2.Check("joe"))
+
+	// Old entries are removed
+	_, err = s1.Update("bob", func(entry *Entry) {
+		entry.Failures = 1
+		entry.Expires = time.Now().Add(-time.Minute)
+	})
+	assert.Nil(err)
+	assert.Nil(s1.DeleteExpired())
+
+	_, exists, err := s1.get("bob")
+	assert.Nil(err)
+	assert.False(exists)
+}
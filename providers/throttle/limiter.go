@@ -0,0 +1,92 @@
+package throttle
+
+import (
+	"net"
+	"net/http"
+)
+
+const (
+	userPrefix = "user:"
+	ipPrefix   = "ip:"
+)
+
+// Limiter throttles login attempts by username and by client IP.
+// Both throttles can share a Store.
+type Limiter struct {
+	// Guesses of one user's password, nil disables
+	Users *Throttle
+
+	// Guesses from one client, nil disables.
+	// Usually allows more failures than Users, many users can share an IP.
+	IPs *Throttle
+}
+
+// Client IP, behind a proxy it's the proxy's address
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Reserve is called before the credentials are checked.
+// The attempt counts as failed until Succeed is called.
+func (l *Limiter) Reserve(r *http.Request, username string) error {
+	ip := ipPrefix + clientIP(r)
+	if l.IPs != nil {
+		err := l.IPs.Reserve(ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Users != nil && username != "" {
+		err := l.Users.Reserve(userPrefix + username)
+		if err != nil {
+			if l.IPs != nil {
+				// Attempts of a locked user don't count against the client
+				l.IPs.Release(ip)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Succeed is called after the credentials were accepted.
+// The user's failures are forgotten, the client's only lose this attempt,
+// it could try other accounts.
+func (l *Limiter) Succeed(r *http.Request, username string) error {
+	if l.IPs != nil {
+		err := l.IPs.Release(ipPrefix + clientIP(r))
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.Users != nil && username != "" {
+		return l.Users.Succeed(userPrefix + username)
+	}
+
+	return nil
+}
+
+// Unlock lets the user log in again after a lockout
+func (l *Limiter) Unlock(username string) error {
+	if l.Users == nil {
+		return nil
+	}
+
+	return l.Users.Unlock(userPrefix + username)
+}
+
+// UnlockIP lets the client log in again after a lockout
+func (l *Limiter) UnlockIP(ip string) error {
+	if l.IPs == nil {
+		return nil
+	}
+
+	return l.IPs.Unlock(ipPrefix + ip)
+}
@@ -0,0 +1,87 @@
+package throttle
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func request(remoteAddr string) *http.Request {
+	return &http.Request{RemoteAddr: remoteAddr}
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewMemoryStore()
+	assert.Nil(err)
+
+	users, err := NewThrottle(Config{Store: store, FreeFailures: 1, LockoutFailures: 2, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	ips, err := NewThrottle(Config{Store: store, FreeFailures: 3, LockoutFailures: 4, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	l := Limiter{Users: users, IPs: ips}
+
+	// Username is locked regardless of the client
+	assert.Nil(l.Reserve(request("10.0.0.1:1234"), "joe"))
+	assert.Nil(l.Reserve(request("10.0.0.2:1234"), "joe"))
+	assert.Equal(core.ErrorAccountLocked, l.Reserve(request("10.0.0.3:1234"), "joe"))
+	assert.Nil(l.Reserve(request("10.0.0.3:1234"), "bob"))
+	assert.Nil(l.Succeed(request("10.0.0.3:1234"), "bob"))
+
+	assert.Nil(l.Unlock("joe"))
+	assert.Nil(l.Reserve(request("10.0.0.3:1234"), "joe"))
+	assert.Nil(l.Succeed(request("10.0.0.3:1234"), "joe"))
+
+	// Client is locked regardless of the username
+	for _, user := range []string{"a", "b", "c", "d"} {
+		assert.Nil(l.Reserve(request("10.0.0.4:1234"), user))
+	}
+	assert.Equal(core.ErrorAccountLocked, l.Reserve(request("10.0.0.4:5678"), "e"))
+
+	// Success of the user doesn't unlock the client
+	assert.Nil(l.Succeed(request("10.0.0.5:1234"), "a"))
+	assert.Equal(core.ErrorAccountLocked, l.Reserve(request("10.0.0.4:5678"), "a"))
+
+	assert.Nil(l.UnlockIP("10.0.0.4"))
+	assert.Nil(l.Reserve(request("10.0.0.4:5678"), "a"))
+
+	// Disabled
+	l = Limiter{}
+	assert.Nil(l.Reserve(request("10.0.0.4:1234"), "a"))
+	assert.Nil(l.Succeed(request("10.0.0.4:1234"), "a"))
+	assert.Nil(l.Unlock("a"))
+}
+
+func TestLimiterRelease(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewMemoryStore()
+	assert.Nil(err)
+
+	users, err := NewThrottle(Config{Store: store, FreeFailures: 1, LockoutFailures: 2, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	ips, err := NewThrottle(Config{Store: store, FreeFailures: 1, LockoutFailures: 2, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	l := Limiter{Users: users, IPs: ips}
+
+	// Successful logins don't count against the client
+	for _, user := range []string{"a", "b", "c"} {
+		assert.Nil(l.Reserve(request("10.0.0.1:1234"), user))
+		assert.Nil(l.Succeed(request("10.0.0.1:1234"), user))
+	}
+
+	// Neither do the attempts of a locked user
+	assert.Nil(l.Reserve(request("10.0.0.2:1234"), "joe"))
+	assert.Nil(l.Reserve(request("10.0.0.3:1234"), "joe"))
+	assert.Equal(core.ErrorAccountLocked, l.Reserve(request("10.0.0.1:1234"), "joe"))
+	assert.Equal(core.ErrorAccountLocked, l.Reserve(request("10.0.0.1:1234"), "joe"))
+	assert.Nil(l.Reserve(request("10.0.0.1:1234"), "bob"))
+}
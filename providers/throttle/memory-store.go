@@ -0,0 +1,65 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	memoryCleanupInterval = 10 * time.Minute
+)
+
+// MemoryStore keeps entries in memory, each replica throttles separately.
+// Expired entries are removed periodically.
+type MemoryStore struct {
+	cache *cache.Cache
+
+	// Makes updates atomic
+	mtx sync.Mutex
+}
+
+func NewMemoryStore() (*MemoryStore, error) {
+	s := new(MemoryStore)
+	s.cache = cache.New(cache.NoExpiration, memoryCleanupInterval)
+	return s, nil
+}
+
+func (s *MemoryStore) Get(key string) (Entry, error) {
+	entry, ok := s.cache.Get(key)
+	if !ok {
+		return Entry{}, nil
+	}
+
+	return entry.(Entry), nil
+}
+
+func (s *MemoryStore) Update(key string, update func(entry *Entry)) (Entry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entry, err := s.Get(key)
+	if err != nil {
+		return entry, err
+	}
+
+	update(&entry)
+
+	ttl := entry.Expires.Sub(time.Now())
+	if ttl <= 0 {
+		s.cache.Delete(key)
+		return entry, nil
+	}
+
+	s.cache.Set(key, entry, ttl)
+	return entry, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.cache.Delete(key)
+	return nil
+}
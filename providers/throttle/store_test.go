@@ -0,0 +1,80 @@
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks the behavior shared by all Store implementations
+func testStore(t *testing.T, s Store) {
+	assert := assert.New(t)
+
+	entry, err := s.Get("joe")
+	assert.Nil(err)
+	assert.Equal(0, entry.Failures)
+
+	lockedUntil := time.Now().Add(time.Minute)
+	fail := func(entry *Entry) {
+		entry.Failures++
+		entry.LockedUntil = lockedUntil
+		entry.Expires = time.Now().Add(time.Hour)
+	}
+
+	entry, err = s.Update("joe", fail)
+	assert.Nil(err)
+	assert.Equal(1, entry.Failures)
+
+	entry, err = s.Get("joe")
+	assert.Nil(err)
+	assert.Equal(1, entry.Failures)
+	assert.True(entry.LockedUntil.Equal(lockedUntil))
+
+	// Concurrent updates aren't lost
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Update("joe", fail)
+			assert.Nil(err)
+		}()
+	}
+	wg.Wait()
+
+	entry, err = s.Get("joe")
+	assert.Nil(err)
+	assert.Equal(6, entry.Failures)
+
+	assert.Nil(s.Delete("joe"))
+	entry, err = s.Get("joe")
+	assert.Nil(err)
+	assert.Equal(0, entry.Failures)
+
+	// Expired entries are ignored
+	_, err = s.Update("bob", func(entry *Entry) {
+		entry.Failures = 5
+		entry.Expires = time.Now().Add(50 * time.Millisecond)
+	})
+	assert.Nil(err)
+	time.Sleep(100 * time.Millisecond)
+
+	entry, err = s.Get("bob")
+	assert.Nil(err)
+	assert.Equal(0, entry.Failures)
+
+	entry, err = s.Update("bob", fail)
+	assert.Nil(err)
+	assert.Equal(1, entry.Failures)
+}
+
+func TestMemoryStore(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemoryStore()
+	assert.Nil(err)
+
+	testStore(t, s)
+}
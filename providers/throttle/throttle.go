@@ -0,0 +1,215 @@
+package throttle
+
+import (
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	defaultFreeFailures    = 3
+	defaultBaseDelay       = time.Second
+	defaultMaxDelay        = 5 * time.Minute
+	defaultLockoutFailures = 10
+	defaultLockoutDuration = 15 * time.Minute
+	defaultResetAfter      = 24 * time.Hour
+)
+
+// Entry holds failed attempts for one key, e.g. a username or a client IP
+type Entry struct {
+	Failures    int
+	LockedUntil time.Time
+
+	// Entry can be forgotten after this time
+	Expires time.Time
+}
+
+// Store keeps the entries. Use a shared store (e.g. DBStore) to throttle across replicas.
+type Store interface {
+	// Get returns a zero Entry if there's none or it expired
+	Get(key string) (Entry, error)
+
+	// Update modifies the entry atomically and returns the result.
+	// update gets a zero Entry if there's none or it expired.
+	Update(key string, update func(entry *Entry)) (Entry, error)
+
+	Delete(key string) error
+}
+
+type Config struct {
+	Store Store
+
+	// Failures that don't delay the next attempt
+	FreeFailures int
+
+	// Delay after the first failure above FreeFailures, doubled after each next one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// After this many failures the key is locked for LockoutDuration
+	LockoutFailures int
+	LockoutDuration time.Duration
+
+	// Failures are forgotten after this time without a failure
+	ResetAfter time.Duration
+}
+
+// Throttle slows down guessing passwords with exponential backoff
+// and locks the key after too many failures.
+type Throttle struct {
+	Config
+}
+
+func NewThrottle(c Config) (*Throttle, error) {
+	if c.Store == nil {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.FreeFailures < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.FreeFailures == 0 {
+		c.FreeFailures = defaultFreeFailures
+	}
+
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = defaultBaseDelay
+	}
+
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultMaxDelay
+	}
+
+	if c.LockoutFailures <= 0 {
+		c.LockoutFailures = defaultLockoutFailures
+	}
+
+	if c.LockoutDuration <= 0 {
+		c.LockoutDuration = defaultLockoutDuration
+	}
+
+	if c.ResetAfter <= 0 {
+		c.ResetAfter = defaultResetAfter
+	}
+
+	return &Throttle{Config: c}, nil
+}
+
+// How long the key waits after the given number of failures
+func (t *Throttle) delay(failures int) time.Duration {
+	if failures >= t.LockoutFailures {
+		return t.LockoutDuration
+	}
+
+	if failures <= t.FreeFailures {
+		return 0
+	}
+
+	delay := t.BaseDelay
+	for i := t.FreeFailures + 1; i < failures && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+
+	return delay
+}
+
+// Error of a key that waits until the time it's locked until
+func (t *Throttle) lockedError(entry *Entry, now time.Time) error {
+	if entry.Failures >= t.LockoutFailures {
+		return core.ErrorAccountLocked
+	}
+
+	return &core.ErrorRetryLater{RetryAfter: entry.LockedUntil.Sub(now)}
+}
+
+// Records one more failure in the entry
+func (t *Throttle) fail(entry *Entry, now time.Time) {
+	entry.Failures++
+	entry.LockedUntil = now.Add(t.delay(entry.Failures))
+	entry.Expires = now.Add(t.ResetAfter)
+	if entry.Expires.Before(entry.LockedUntil) {
+		entry.Expires = entry.LockedUntil
+	}
+}
+
+// Check returns core.ErrorAccountLocked if the key is locked
+// or core.ErrorRetryLater if it has to wait before the next attempt.
+// Parallel attempts can all pass Check before any of them fails, use Reserve.
+func (t *Throttle) Check(key string) error {
+	entry, err := t.Store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !now.Before(entry.LockedUntil) {
+		return nil
+	}
+
+	return t.lockedError(&entry, now)
+}
+
+// Reserve counts the attempt as a failure before the credentials are checked,
+// in one Store.Update, so a burst of parallel guesses can't pass the check together.
+// It fails like Check, without counting the attempt. After a successful attempt
+// call Succeed or Release, a failed one is already counted.
+func (t *Throttle) Reserve(key string) error {
+	var result error
+	_, err := t.Store.Update(key, func(entry *Entry) {
+		// Store can call update again, e.g. after a conflict
+		result = nil
+
+		now := time.Now()
+		if now.Before(entry.LockedUntil) {
+			result = t.lockedError(entry, now)
+			return
+		}
+
+		t.fail(entry, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	return result
+}
+
+// Release takes back the failure counted by Reserve, the other failures are kept
+func (t *Throttle) Release(key string) error {
+	_, err := t.Store.Update(key, func(entry *Entry) {
+		if entry.Failures == 0 {
+			return
+		}
+
+		now := time.Now()
+		entry.Failures--
+		entry.LockedUntil = now.Add(t.delay(entry.Failures))
+		if entry.Failures == 0 {
+			entry.LockedUntil = time.Time{}
+		}
+	})
+	return err
+}
+
+// Fail records a failed attempt that wasn't reserved
+func (t *Throttle) Fail(key string) error {
+	_, err := t.Store.Update(key, func(entry *Entry) {
+		t.fail(entry, time.Now())
+	})
+	return err
+}
+
+// Succeed forgets the failures after a successful attempt
+func (t *Throttle) Succeed(key string) error {
+	return t.Store.Delete(key)
+}
+
+// Unlock forgets the failures, e.g. when an admin unlocks the account
+func (t *Throttle) Unlock(key string) error {
+	return t.Store.Delete(key)
+}
@@ -0,0 +1,160 @@
+package throttle
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestThrottle(assert *assert.Assertions, c Config) *Throttle {
+	store, err := NewMemoryStore()
+	assert.Nil(err)
+
+	c.Store = store
+	t, err := NewThrottle(c)
+	assert.Nil(err)
+	return t
+}
+
+func TestNewThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewThrottle(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	throttle := newTestThrottle(assert, Config{})
+	assert.Equal(defaultFreeFailures, throttle.FreeFailures)
+	assert.Equal(defaultLockoutFailures, throttle.LockoutFailures)
+}
+
+func TestDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	throttle := newTestThrottle(assert, Config{
+		FreeFailures:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutFailures: 10,
+		LockoutDuration: time.Hour,
+	})
+
+	expected := []time.Duration{
+		0, 0, 0,
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+		time.Hour,
+		time.Hour,
+	}
+
+	for failures, delay := range expected {
+		assert.Equal(delay, throttle.delay(failures), "failures: %d", failures)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	throttle := newTestThrottle(assert, Config{
+		FreeFailures:    1,
+		BaseDelay:       100 * time.Millisecond,
+		LockoutFailures: 3,
+		LockoutDuration: time.Hour,
+	})
+
+	assert.Nil(throttle.Check("joe"))
+
+	// Free
+	assert.Nil(throttle.Fail("joe"))
+	assert.Nil(throttle.Check("joe"))
+
+	// Delayed
+	assert.Nil(throttle.Fail("joe"))
+	err := throttle.Check("joe")
+	assert.IsType(&core.ErrorRetryLater{}, err)
+	assert.True(err.(*core.ErrorRetryLater).RetryAfter <= 100*time.Millisecond)
+
+	// Other keys aren't affected
+	assert.Nil(throttle.Check("bob"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(throttle.Check("joe"))
+
+	// Locked
+	assert.Nil(throttle.Fail("joe"))
+	assert.Equal(core.ErrorAccountLocked, throttle.Check("joe"))
+
+	// Admin unlocks
+	assert.Nil(throttle.Unlock("joe"))
+	assert.Nil(throttle.Check("joe"))
+}
+
+func TestResetAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	throttle := newTestThrottle(assert, Config{
+		FreeFailures: 1,
+		ResetAfter:   50 * time.Millisecond,
+	})
+
+	assert.Nil(throttle.Fail("joe"))
+	time.Sleep(100 * time.Millisecond)
+
+	// First failure was forgotten
+	assert.Nil(throttle.Fail("joe"))
+	assert.Nil(throttle.Check("joe"))
+
+	entry, err := throttle.Store.Get("joe")
+	assert.Nil(err)
+	assert.Equal(1, entry.Failures)
+
+	// Success forgets too
+	assert.Nil(throttle.Succeed("joe"))
+	entry, err = throttle.Store.Get("joe")
+	assert.Nil(err)
+	assert.Equal(0, entry.Failures)
+}
+
+func TestReserve(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := NewMemoryStore()
+	assert.Nil(err)
+
+	th, err := NewThrottle(Config{Store: store, FreeFailures: 2, LockoutFailures: 3, LockoutDuration: time.Hour})
+	assert.Nil(err)
+
+	// Parallel reservations are counted before any of them fails
+	var wg sync.WaitGroup
+	var passed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if th.Reserve("key") == nil {
+				atomic.AddInt32(&passed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(3), passed)
+
+	entry, err := store.Get("key")
+	assert.Nil(err)
+	assert.Equal(3, entry.Failures)
+	assert.Equal(core.ErrorAccountLocked, th.Check("key"))
+
+	// Releasing the last reservation lifts the lock it caused
+	assert.Nil(th.Release("key"))
+	assert.Nil(th.Check("key"))
+	assert.Nil(th.Reserve("key"))
+	assert.Equal(core.ErrorAccountLocked, th.Reserve("key"))
+}
@@ -0,0 +1,136 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Parameters supported by all authenticator apps (RFC 6238 defaults)
+const (
+	Digits     = 6
+	Period     = 30 * time.Second
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 encoded key
+func GenerateSecret() (string, error) {
+	key := make([]byte, secretSize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(key), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, core.ErrorBadRequest
+	}
+	return key, nil
+}
+
+// Step returns the time step the code for t is generated from
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// HOTP code, RFC 4226
+func hotp(key []byte, counter int64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// Code returns the code valid at time t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, Step(t), Digits), nil
+}
+
+// Validate checks the code against steps around t, skew is the number
+// of steps accepted before and after the current one to allow clock drift.
+// Steps up to lastStep were already used and are rejected.
+// Returns the matching step.
+func Validate(secret, code string, t time.Time, skew int, lastStep int64) (step int64, err error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, core.ErrorBadSecondFactor
+	}
+
+	current := Step(t)
+	for i := current - int64(skew); i <= current+int64(skew); i++ {
+		if i <= lastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hotp(key, i, Digits)), []byte(code)) == 1 {
+			return i, nil
+		}
+	}
+
+	return 0, core.ErrorBadSecondFactor
+}
+
+// URI returns the otpauth:// URI that authenticator apps import, usually from a QR code
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	if issuer != "" {
+		query.Set("issuer", issuer)
+	}
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// QRCode encodes the URI as a PNG image with the given width and height in pixels
+func QRCode(uri string, size int) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, size)
+}
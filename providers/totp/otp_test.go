@@ -0,0 +1,120 @@
+package totp
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Key from the RFC 4226 and RFC 6238 test vectors
+const rfcKey = "12345678901234567890"
+
+func TestHOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 4226, Appendix D
+	expected := []string{"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range expected {
+		assert.Equal(code, hotp([]byte(rfcKey), int64(counter), 6))
+	}
+}
+
+func TestTOTPVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 6238, Appendix B, SHA1
+	expected := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+
+	for unix, code := range expected {
+		assert.Equal(code, hotp([]byte(rfcKey), Step(time.Unix(unix, 0)), 8))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	secret, err := GenerateSecret()
+	assert.Nil(err)
+	assert.Len(secret, 32)
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	assert.Nil(err)
+	assert.Len(code, Digits)
+
+	step, err := Validate(secret, code, now, 1, 0)
+	assert.Nil(err)
+	assert.Equal(Step(now), step)
+
+	// Clock drift
+	step, err = Validate(secret, code, now.Add(Period), 1, 0)
+	assert.Nil(err)
+	assert.Equal(Step(now), step)
+
+	_, err = Validate(secret, code, now.Add(3*Period), 1, 0)
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	// Replay
+	_, err = Validate(secret, code, now, 1, Step(now))
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	_, err = Validate(secret, "12345", now, 1, 0)
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	_, err = Validate("not base32!", code, now, 1, 0)
+	assert.Equal(core.ErrorBadRequest, err)
+}
+
+func TestURI(t *testing.T) {
+	assert := assert.New(t)
+
+	uri := URI("Example IdP", "joe@example.com", "JBSWY3DPEHPK3PXP")
+
+	u, err := url.Parse(uri)
+	assert.Nil(err)
+	assert.Equal("otpauth", u.Scheme)
+	assert.Equal("totp", u.Host)
+	assert.Equal("/Example IdP:joe@example.com", u.Path)
+
+	query := u.Query()
+	assert.Equal("JBSWY3DPEHPK3PXP", query.Get("secret"))
+	assert.Equal("Example IdP", query.Get("issuer"))
+	assert.Equal("6", query.Get("digits"))
+	assert.Equal("30", query.Get("period"))
+
+	png, err := QRCode(uri, 256)
+	assert.Nil(err)
+	assert.True(bytes.HasPrefix(png, []byte("\x89PNG")))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	assert := assert.New(t)
+
+	codes, hashes, err := GenerateRecoveryCodes(5)
+	assert.Nil(err)
+	assert.Len(codes, 5)
+	assert.Len(hashes, 5)
+
+	for i, code := range codes {
+		assert.Len(code, recoveryLength+1)
+		assert.NotEqual(code, hashes[i])
+		assert.Equal(i, findRecoveryCode(hashes, code))
+	}
+
+	// Typed by hand
+	assert.Equal(2, findRecoveryCode(hashes, " "+codes[2][:5]+codes[2][6:]))
+	assert.Equal(-1, findRecoveryCode(hashes, "aaaaa-aaaaa"))
+}
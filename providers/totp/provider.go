@@ -0,0 +1,232 @@
+package totp
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/providers/throttle"
+)
+
+const (
+	pendingSessionName = "totp"
+	defaultCodeField   = "code"
+	defaultMaxAge      = 5 * time.Minute
+)
+
+type CodeFormContext struct {
+	Msg       string
+	SubmitURI string
+	CodeField string
+}
+
+type ProviderConfig struct {
+	// Checks the first factor, e.g. form.FormAuth
+	First core.Provider
+
+	TOTP *TOTP
+
+	// Keeps users who passed the first factor until they enter the code
+	Sessions sessions.Store
+
+	// Template of the form asking for the code, gets a CodeFormContext
+	CodeForm  string
+	CodeField string
+
+	// Time to enter the code after the first factor
+	MaxAge time.Duration
+
+	// Optional. Throttles guessing codes.
+	Limiter *throttle.Limiter
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Provider completes the login only after both the first factor
+// and the code from the authenticator app are checked.
+// Users without an enabled factor log in with the first factor only.
+type Provider struct {
+	ProviderConfig
+}
+
+// First factor was accepted, the code form is shown by WriteError
+type pendingError struct {
+	user string
+	uses int64
+}
+
+func (e *pendingError) Error() string {
+	return core.ErrorSecondFactorRequired.Error()
+}
+
+func NewProvider(c ProviderConfig) (*Provider, error) {
+	if c.First == nil || c.TOTP == nil || c.Sessions == nil || c.CodeForm == "" || c.MaxAge < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.CodeField == "" {
+		c.CodeField = defaultCodeField
+	}
+
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultMaxAge
+	}
+
+	return &Provider{ProviderConfig: c}, nil
+}
+
+// Returns the user waiting for the second factor if the request submits the code form
+func (p *Provider) pending(r *http.Request) (user string, uses int64, ok bool) {
+	if r.FormValue(p.CodeField) == "" {
+		return
+	}
+
+	session, err := p.Sessions.Get(r, pendingSessionName)
+	if err != nil {
+		return
+	}
+
+	user, _ = session.Values["user"].(string)
+	uses, _ = session.Values["uses"].(int64)
+	expires, _ := session.Values["expires"].(int64)
+	if user == "" || time.Now().Unix() > expires {
+		return "", 0, false
+	}
+
+	return user, uses, true
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	user, uses, ok := p.pending(r)
+	if !ok {
+		return p.checkFirst(r)
+	}
+
+	if p.Limiter != nil {
+		err = p.Limiter.Reserve(r, user)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = p.TOTP.VerifyPendingContext(r.Context(), user, r.FormValue(p.CodeField), uses)
+
+	if p.Limiter != nil {
+		// Failed attempts stay reserved, failure to release one isn't fatal
+		if err == nil {
+			p.Limiter.Succeed(r, user)
+		}
+	}
+
+	if err != nil {
+		logging.Info(r.Context(), p.Logger, "second factor rejected", logging.Fields{
+			"user":  user,
+			"error": err,
+		})
+		return "", err
+	}
+
+	return user, nil
+}
+
+func (p *Provider) checkFirst(r *http.Request) (user string, err error) {
+	user, err = p.First.Check(r)
+	if err != nil {
+		return
+	}
+
+	enabled, uses, err := p.TOTP.IsEnabledContext(r.Context(), user)
+	if err != nil {
+		return "", err
+	}
+
+	if enabled {
+		return "", &pendingError{user: user, uses: uses}
+	}
+
+	return
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	return p.First.Register(r)
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	return p.First.Write(w, r)
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	if pending, ok := err.(*pendingError); ok {
+		return p.writePending(w, r, pending)
+	}
+
+	_, _, ok := p.pending(r)
+	if !ok {
+		return p.First.WriteError(w, r, err)
+	}
+
+	context := CodeFormContext{
+		SubmitURI: r.URL.RequestURI(),
+		CodeField: p.CodeField,
+	}
+
+	switch err {
+	case core.ErrorBadSecondFactor:
+		context.Msg = "Invalid code"
+
+	case core.ErrorSessionExpired:
+		context.Msg = "Login expired, start again"
+
+	case core.ErrorAccountLocked:
+		context.Msg = "Account is temporarily locked after too many failed logins"
+
+	default:
+		if _, ok := err.(*core.ErrorRetryLater); ok {
+			context.Msg = err.Error()
+		} else {
+			context.Msg = "An error occurred"
+		}
+	}
+
+	return p.writeCodeForm(w, context)
+}
+
+// Remembers the user and asks for the code
+func (p *Provider) writePending(w http.ResponseWriter, r *http.Request, pending *pendingError) error {
+	session, err := p.Sessions.New(r, pendingSessionName)
+	if err != nil && session == nil {
+		return err
+	}
+
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(p.MaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	session.Values["user"] = pending.user
+	session.Values["uses"] = pending.uses
+	session.Values["expires"] = time.Now().Add(p.MaxAge).Unix()
+
+	err = p.Sessions.Save(r, w, session)
+	if err != nil {
+		return err
+	}
+
+	return p.writeCodeForm(w, CodeFormContext{
+		SubmitURI: r.URL.RequestURI(),
+		CodeField: p.CodeField,
+	})
+}
+
+func (p *Provider) writeCodeForm(w http.ResponseWriter, context CodeFormContext) error {
+	t, err := template.New("tmpl").Parse(p.CodeForm)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, context)
+}
@@ -0,0 +1,151 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	loginForm = `login {{.Msg}}`
+	codeForm  = `code {{.CodeField}} {{.Msg}}`
+)
+
+func createProvider(assert *assert.Assertions) (*Provider, *TOTP) {
+	totp, users := createTOTP(assert)
+
+	first, err := form.NewFormAuth(form.Config{
+		LoginForm:          loginForm,
+		LoginUsernameField: "username",
+		LoginPasswordField: "password",
+		UserStore:          users,
+		Username:           form.Complexity{MinLength: 1, MaxLength: 100},
+		Password:           form.Complexity{MinLength: 1, MaxLength: 100},
+	})
+	assert.Nil(err)
+
+	provider, err := NewProvider(ProviderConfig{
+		First:    first,
+		TOTP:     totp,
+		Sessions: sessions.NewCookieStore([]byte("testsecret")),
+		CodeForm: codeForm,
+	})
+	assert.Nil(err)
+
+	return provider, totp
+}
+
+func post(values url.Values, cookies []*http.Cookie) *http.Request {
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// Checks the request and writes the error like the login handler does
+func login(provider *Provider, r *http.Request) (string, *httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	user, err := provider.Check(r)
+	if err != nil {
+		provider.WriteError(w, r, err)
+	}
+	return user, w, err
+}
+
+func readCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	return (&http.Response{Header: w.Header()}).Cookies()
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(ProviderConfig{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	provider, _ := createProvider(assert)
+	assert.Equal(defaultCodeField, provider.CodeField)
+	assert.Equal(defaultMaxAge, provider.MaxAge)
+}
+
+func TestWithoutFactor(t *testing.T) {
+	assert := assert.New(t)
+	provider, _ := createProvider(assert)
+
+	credentials := url.Values{"username": {testUser}, "password": {testPassword}}
+	user, _, err := login(provider, post(credentials, nil))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	credentials.Set("password", "bad")
+	_, w, err := login(provider, post(credentials, nil))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.Contains(w.Body.String(), "login Authentication failed")
+}
+
+func TestTwoSteps(t *testing.T) {
+	assert := assert.New(t)
+	provider, totp := createProvider(assert)
+
+	secret, _ := enrol(assert, totp)
+
+	// First factor
+	credentials := url.Values{"username": {testUser}, "password": {testPassword}}
+	user, w, err := login(provider, post(credentials, nil))
+	assert.NotNil(err)
+	assert.Equal("", user)
+	assert.Equal("code code ", w.Body.String())
+
+	cookies := readCookies(w)
+	assert.Len(cookies, 1)
+
+	// Code without the first factor
+	code, err := Code(secret, time.Now().Add(Period))
+	assert.Nil(err)
+	_, w, err = login(provider, post(url.Values{"code": {code}}, nil))
+	assert.Equal(core.ErrorBadRequest, err)
+	assert.Contains(w.Body.String(), "login")
+
+	_, w, err = login(provider, post(url.Values{"code": {"000000"}}, cookies))
+	assert.Equal(core.ErrorBadSecondFactor, err)
+	assert.Equal("code code Invalid code", w.Body.String())
+
+	user, _, err = login(provider, post(url.Values{"code": {code}}, cookies))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	// Pending login completes only once
+	code, err = Code(secret, time.Now().Add(2*Period))
+	assert.Nil(err)
+	_, w, err = login(provider, post(url.Values{"code": {code}}, cookies))
+	assert.Equal(core.ErrorSessionExpired, err)
+	assert.Contains(w.Body.String(), "Login expired")
+}
+
+func TestPendingExpired(t *testing.T) {
+	assert := assert.New(t)
+	provider, totp := createProvider(assert)
+	provider.MaxAge = time.Second
+
+	secret, _ := enrol(assert, totp)
+
+	credentials := url.Values{"username": {testUser}, "password": {testPassword}}
+	_, w, _ := login(provider, post(credentials, nil))
+	cookies := readCookies(w)
+
+	time.Sleep(2 * time.Second)
+
+	code, err := Code(secret, time.Now().Add(Period))
+	assert.Nil(err)
+	_, _, err = login(provider, post(url.Values{"code": {code}}, cookies))
+	assert.Equal(core.ErrorBadRequest, err)
+}
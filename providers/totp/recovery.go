@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// Unambiguous characters, codes are typed by hand
+	recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	recoveryLength   = 10
+)
+
+// GenerateRecoveryCodes returns n single use codes and their hashes.
+// Only the hashes are stored, the codes are shown to the user once.
+func GenerateRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		var code []byte
+		code, err = randomCode()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		formatted := string(code[:recoveryLength/2]) + "-" + string(code[recoveryLength/2:])
+		codes = append(codes, formatted)
+		hashes = append(hashes, hashRecoveryCode(formatted))
+	}
+
+	return
+}
+
+func randomCode() ([]byte, error) {
+	// Bytes above the last multiple of the alphabet's length are skipped, so there's no bias
+	limit := 256 - 256%len(recoveryAlphabet)
+
+	code := make([]byte, 0, recoveryLength)
+	random := make([]byte, recoveryLength)
+	for len(code) < recoveryLength {
+		_, err := rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range random {
+			if int(b) < limit && len(code) < recoveryLength {
+				code = append(code, recoveryAlphabet[int(b)%len(recoveryAlphabet)])
+			}
+		}
+	}
+
+	return code, nil
+}
+
+// Codes are random, so a fast hash is enough
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the index of the matching hash or -1
+func findRecoveryCode(hashes []string, code string) int {
+	hash := []byte(hashRecoveryCode(code))
+
+	found := -1
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), hash) == 1 {
+			found = i
+		}
+	}
+	return found
+}
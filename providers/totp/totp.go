@@ -0,0 +1,230 @@
+package totp
+
+import (
+	"context"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+)
+
+const (
+	defaultSkew          = 1
+	defaultRecoveryCodes = 10
+
+	// Pending logins don't check the counter
+	anyUses = -1
+)
+
+type Config struct {
+	// Keeps the factors, e.g. memory.Store or rethinkdb.Store
+	Factors userdb.FactorStore
+
+	// Shown in authenticator apps next to the username
+	Issuer string
+
+	// Number of time steps accepted before and after the current one
+	Skew int
+
+	// Number of generated recovery codes
+	RecoveryCodes int
+}
+
+// Enrolment is shown to the user, who adds the secret to an authenticator app
+type Enrolment struct {
+	Secret string
+	URI    string
+}
+
+// QRCode returns the URI as a PNG image
+func (e *Enrolment) QRCode(size int) ([]byte, error) {
+	return QRCode(e.URI, size)
+}
+
+// TOTP manages users' time-based one-time password factors
+type TOTP struct {
+	Config
+	factors userdb.FactorContextStore
+}
+
+func NewTOTP(c Config) (*TOTP, error) {
+	if c.Factors == nil || c.Skew < 0 || c.RecoveryCodes < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Skew == 0 {
+		c.Skew = defaultSkew
+	}
+
+	if c.RecoveryCodes == 0 {
+		c.RecoveryCodes = defaultRecoveryCodes
+	}
+
+	return &TOTP{Config: c, factors: userdb.FactorsWithContext(c.Factors)}, nil
+}
+
+// Enrol generates a new secret for the user.
+// It isn't used in logins until the user confirms it with Confirm.
+func (t *TOTP) Enrol(username string) (*Enrolment, error) {
+	return t.EnrolContext(context.Background(), username)
+}
+
+func (t *TOTP) EnrolContext(ctx context.Context, username string) (*Enrolment, error) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.factors.UpdateTOTPContext(ctx, username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		if factor != nil && factor.Enabled {
+			return nil, core.ErrorSecondFactorEnabled
+		}
+
+		// Replaces an unconfirmed enrolment
+		return &userdb.TOTPFactor{Secret: secret}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enrolment{
+		Secret: secret,
+		URI:    URI(t.Issuer, username, secret),
+	}, nil
+}
+
+// Confirm enables the enrolled factor if the code is correct
+// and returns the recovery codes
+func (t *TOTP) Confirm(username, code string) (recoveryCodes []string, err error) {
+	return t.ConfirmContext(context.Background(), username, code)
+}
+
+func (t *TOTP) ConfirmContext(ctx context.Context, username, code string) (recoveryCodes []string, err error) {
+	recoveryCodes, hashes, err := GenerateRecoveryCodes(t.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.factors.UpdateTOTPContext(ctx, username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		if factor == nil {
+			return nil, core.ErrorBadRequest
+		}
+
+		if factor.Enabled {
+			return nil, core.ErrorSecondFactorEnabled
+		}
+
+		step, err := Validate(factor.Secret, code, time.Now(), t.Skew, factor.LastStep)
+		if err != nil {
+			return nil, err
+		}
+
+		factor.Enabled = true
+		factor.LastStep = step
+		factor.RecoveryCodes = hashes
+		return factor, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+// IsEnabled returns whether the user logs in with the second factor,
+// uses is passed to VerifyPending.
+func (t *TOTP) IsEnabled(username string) (enabled bool, uses int64, err error) {
+	return t.IsEnabledContext(context.Background(), username)
+}
+
+func (t *TOTP) IsEnabledContext(ctx context.Context, username string) (enabled bool, uses int64, err error) {
+	factor, err := t.factors.GetTOTPContext(ctx, username)
+	if err != nil || factor == nil || !factor.Enabled {
+		return false, 0, err
+	}
+
+	return true, factor.Uses, nil
+}
+
+// Verify accepts a code from the authenticator app or an unused recovery code.
+// Each code is accepted only once.
+func (t *TOTP) Verify(username, code string) error {
+	return t.VerifyContext(context.Background(), username, code)
+}
+
+func (t *TOTP) VerifyContext(ctx context.Context, username, code string) error {
+	return t.verify(ctx, username, code, anyUses)
+}
+
+// VerifyPending is Verify for a login started when the factor had the given uses.
+// Fails with core.ErrorSessionExpired if another code was accepted since then.
+func (t *TOTP) VerifyPending(username, code string, uses int64) error {
+	return t.VerifyPendingContext(context.Background(), username, code, uses)
+}
+
+func (t *TOTP) VerifyPendingContext(ctx context.Context, username, code string, uses int64) error {
+	return t.verify(ctx, username, code, uses)
+}
+
+func (t *TOTP) verify(ctx context.Context, username, code string, uses int64) error {
+	return t.factors.UpdateTOTPContext(ctx, username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		if factor == nil || !factor.Enabled {
+			return nil, core.ErrorBadSecondFactor
+		}
+
+		if uses != anyUses && factor.Uses != uses {
+			return nil, core.ErrorSessionExpired
+		}
+
+		step, err := Validate(factor.Secret, code, time.Now(), t.Skew, factor.LastStep)
+		if err == nil {
+			factor.LastStep = step
+		} else {
+			i := findRecoveryCode(factor.RecoveryCodes, code)
+			if i < 0 {
+				return nil, core.ErrorBadSecondFactor
+			}
+			factor.RecoveryCodes = append(factor.RecoveryCodes[:i], factor.RecoveryCodes[i+1:]...)
+		}
+
+		factor.Uses++
+		return factor, nil
+	})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes
+func (t *TOTP) RegenerateRecoveryCodes(username string) (recoveryCodes []string, err error) {
+	return t.RegenerateRecoveryCodesContext(context.Background(), username)
+}
+
+func (t *TOTP) RegenerateRecoveryCodesContext(ctx context.Context, username string) (recoveryCodes []string, err error) {
+	recoveryCodes, hashes, err := GenerateRecoveryCodes(t.RecoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.factors.UpdateTOTPContext(ctx, username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		if factor == nil || !factor.Enabled {
+			return nil, core.ErrorBadRequest
+		}
+
+		factor.RecoveryCodes = hashes
+		return factor, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+// Disable removes the user's factor
+func (t *TOTP) Disable(username string) error {
+	return t.DisableContext(context.Background(), username)
+}
+
+func (t *TOTP) DisableContext(ctx context.Context, username string) error {
+	return t.factors.UpdateTOTPContext(ctx, username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		return nil, nil
+	})
+}
@@ -0,0 +1,174 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUser     = "joe"
+	testPassword = "joe123"
+)
+
+func createTOTP(assert *assert.Assertions) (*TOTP, *memory.Store) {
+	users, err := memory.NewMemStore()
+	assert.Nil(err)
+
+	err = users.Add(testUser, testPassword)
+	assert.Nil(err)
+
+	totp, err := NewTOTP(Config{
+		Factors: users,
+		Issuer:  "Test",
+	})
+	assert.Nil(err)
+
+	return totp, users
+}
+
+// Enrols the test user, returns the secret and recovery codes
+func enrol(assert *assert.Assertions, totp *TOTP) (string, []string) {
+	enrolment, err := totp.Enrol(testUser)
+	assert.Nil(err)
+
+	code, err := Code(enrolment.Secret, time.Now())
+	assert.Nil(err)
+
+	recoveryCodes, err := totp.Confirm(testUser, code)
+	assert.Nil(err)
+
+	return enrolment.Secret, recoveryCodes
+}
+
+func TestNewTOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewTOTP(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	totp, _ := createTOTP(assert)
+	assert.Equal(defaultSkew, totp.Skew)
+	assert.Equal(defaultRecoveryCodes, totp.RecoveryCodes)
+}
+
+func TestEnrol(t *testing.T) {
+	assert := assert.New(t)
+	totp, users := createTOTP(assert)
+
+	_, err := totp.Enrol("nobody")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	enrolment, err := totp.Enrol(testUser)
+	assert.Nil(err)
+	assert.Contains(enrolment.URI, enrolment.Secret)
+
+	png, err := enrolment.QRCode(128)
+	assert.Nil(err)
+	assert.NotEmpty(png)
+
+	// Not used before confirmed
+	enabled, _, err := totp.IsEnabled(testUser)
+	assert.Nil(err)
+	assert.False(enabled)
+
+	code, err := Code(enrolment.Secret, time.Now())
+	assert.Nil(err)
+	err = totp.Verify(testUser, code)
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	_, err = totp.Confirm(testUser, "000000")
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	recoveryCodes, err := totp.Confirm(testUser, code)
+	assert.Nil(err)
+	assert.Len(recoveryCodes, defaultRecoveryCodes)
+
+	enabled, _, err = totp.IsEnabled(testUser)
+	assert.Nil(err)
+	assert.True(enabled)
+
+	// Only hashes are stored
+	factor, err := users.GetTOTP(testUser)
+	assert.Nil(err)
+	assert.Len(factor.RecoveryCodes, defaultRecoveryCodes)
+	assert.NotContains(factor.RecoveryCodes, recoveryCodes[0])
+
+	_, err = totp.Enrol(testUser)
+	assert.Equal(core.ErrorSecondFactorEnabled, err)
+
+	err = totp.Disable(testUser)
+	assert.Nil(err)
+
+	enabled, _, err = totp.IsEnabled(testUser)
+	assert.Nil(err)
+	assert.False(enabled)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	totp, _ := createTOTP(assert)
+
+	secret, _ := enrol(assert, totp)
+
+	// The confirmation code can't be used again
+	code, err := Code(secret, time.Now())
+	assert.Nil(err)
+	err = totp.Verify(testUser, code)
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	// Next code, allowed by the drift window
+	code, err = Code(secret, time.Now().Add(Period))
+	assert.Nil(err)
+	err = totp.Verify(testUser, code)
+	assert.Nil(err)
+
+	err = totp.Verify(testUser, code)
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	err = totp.Verify(testUser, "000000")
+	assert.Equal(core.ErrorBadSecondFactor, err)
+}
+
+func TestRecoveryCode(t *testing.T) {
+	assert := assert.New(t)
+	totp, _ := createTOTP(assert)
+
+	_, recoveryCodes := enrol(assert, totp)
+
+	err := totp.Verify(testUser, recoveryCodes[3])
+	assert.Nil(err)
+
+	// Single use
+	err = totp.Verify(testUser, recoveryCodes[3])
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	newCodes, err := totp.RegenerateRecoveryCodes(testUser)
+	assert.Nil(err)
+
+	err = totp.Verify(testUser, recoveryCodes[0])
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	err = totp.Verify(testUser, newCodes[0])
+	assert.Nil(err)
+}
+
+func TestVerifyPending(t *testing.T) {
+	assert := assert.New(t)
+	totp, _ := createTOTP(assert)
+
+	_, recoveryCodes := enrol(assert, totp)
+
+	_, uses, err := totp.IsEnabled(testUser)
+	assert.Nil(err)
+
+	err = totp.VerifyPending(testUser, recoveryCodes[0], uses)
+	assert.Nil(err)
+
+	// Login completes only once
+	err = totp.VerifyPending(testUser, recoveryCodes[1], uses)
+	assert.Equal(core.ErrorSessionExpired, err)
+}
@@ -0,0 +1,206 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+)
+
+// CBOR encoder for the software authenticator
+func cborEncodeHead(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= 0xff:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(argument))
+		return b
+	case argument <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(argument))
+		return b
+	}
+	b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], argument)
+	return b
+}
+
+func cborEncode(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		return cborEncode(int64(v))
+	case int64:
+		if v < 0 {
+			return cborEncodeHead(cborNegative, uint64(-1-v))
+		}
+		return cborEncodeHead(cborUnsigned, uint64(v))
+	case []byte:
+		return append(cborEncodeHead(cborBytes, uint64(len(v))), v...)
+	case string:
+		return append(cborEncodeHead(cborText, uint64(len(v))), v...)
+	case []interface{}:
+		result := cborEncodeHead(cborArray, uint64(len(v)))
+		for _, item := range v {
+			result = append(result, cborEncode(item)...)
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := cborEncodeHead(cborMap, uint64(len(v)))
+		for key, item := range v {
+			result = append(result, cborEncode(key)...)
+			result = append(result, cborEncode(item)...)
+		}
+		return result
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("unsupported type")
+}
+
+// Software authenticator, so tests don't need hardware
+type softAuthenticator struct {
+	origin string
+
+	// Holds one credential
+	credentialID []byte
+	userHandle   []byte
+	ecKey        *ecdsa.PrivateKey
+	rsaKey       *rsa.PrivateKey
+	signCount    uint32
+
+	// Increment signCount on every assertion, like most security keys
+	counter bool
+}
+
+func newSoftAuthenticator(origin string, useRSA bool) *softAuthenticator {
+	a := &softAuthenticator{origin: origin, counter: true}
+	a.credentialID = make([]byte, 16)
+	rand.Read(a.credentialID)
+
+	var err error
+	if useRSA {
+		a.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.rsaKey != nil {
+		return cborEncode(map[interface{}]interface{}{
+			coseKeyType:   coseKeyTypeRSA,
+			coseAlgorithm: AlgorithmRS256,
+			coseModulus:   a.rsaKey.N.Bytes(),
+			coseExponent:  big.NewInt(int64(a.rsaKey.E)).Bytes(),
+		})
+	}
+
+	return cborEncode(map[interface{}]interface{}{
+		coseKeyType:   coseKeyTypeEC2,
+		coseAlgorithm: AlgorithmES256,
+		coseCurve:     coseCurveP256,
+		coseX:         a.ecKey.X.Bytes(),
+		coseY:         a.ecKey.Y.Bytes(),
+	})
+}
+
+func (a *softAuthenticator) authenticatorData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+
+	flags := byte(flagUserPresent | flagUserVerified)
+	if attested {
+		flags |= flagAttestedData
+	}
+	data = append(data, flags)
+
+	var counter [4]byte
+	binary.BigEndian.PutUint32(counter[:], a.signCount)
+	data = append(data, counter[:]...)
+
+	if attested {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(a.credentialID)))
+
+		data = append(data, make([]byte, 16)...)
+		data = append(data, length[:]...)
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": Base64(challenge),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+// Like navigator.credentials.create()
+func (a *softAuthenticator) create(options *CreationOptions) *AttestationResponse {
+	a.userHandle = options.User.ID
+
+	response := &AttestationResponse{
+		RawID: a.credentialID,
+		Type:  credentialType,
+	}
+	response.Response.ClientDataJSON = a.clientData(typeCreate, options.Challenge)
+	response.Response.AttestationObject = cborEncode(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authenticatorData(options.RelyingParty.ID, true),
+	})
+	return response
+}
+
+// Like navigator.credentials.get()
+func (a *softAuthenticator) get(options *RequestOptions) *AssertionResponse {
+	if a.counter {
+		a.signCount++
+	}
+
+	response := &AssertionResponse{
+		RawID: a.credentialID,
+		Type:  credentialType,
+	}
+	response.Response.ClientDataJSON = a.clientData(typeGet, options.Challenge)
+	response.Response.AuthenticatorData = a.authenticatorData(options.RelyingPartyID, false)
+	response.Response.UserHandle = a.userHandle
+
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(append([]byte{}, response.Response.AuthenticatorData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	var err error
+	if a.rsaKey != nil {
+		response.Response.Signature, err = rsa.SignPKCS1v15(rand.Reader, a.rsaKey, crypto.SHA256, digest[:])
+	} else {
+		response.Response.Signature, err = a.ecKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return response
+}
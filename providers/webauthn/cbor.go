@@ -0,0 +1,155 @@
+package webauthn
+
+import (
+	"encoding/binary"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Minimal CBOR (RFC 7049) decoder for attestation objects and COSE keys.
+// Authenticators use the canonical encoding, so indefinite lengths,
+// tags and floats aren't supported.
+
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborSimple   = 7
+
+	cborMaxDepth = 16
+)
+
+// Decodes one item and returns the remaining data.
+// Integers are int64, byte strings []byte, text strings string,
+// arrays []interface{} and maps map[interface{}]interface{}.
+func cborDecode(data []byte) (value interface{}, rest []byte, err error) {
+	return cborDecodeItem(data, 0)
+}
+
+func cborHead(data []byte) (major byte, argument uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, nil, core.ErrorBadRequest
+	}
+
+	major = data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+
+	case info == 24 && len(data) >= 1:
+		return major, uint64(data[0]), data[1:], nil
+
+	case info == 25 && len(data) >= 2:
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+
+	case info == 26 && len(data) >= 4:
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+
+	case info == 27 && len(data) >= 8:
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	return 0, 0, nil, core.ErrorBadRequest
+}
+
+func cborDecodeItem(data []byte, depth int) (value interface{}, rest []byte, err error) {
+	if depth > cborMaxDepth {
+		return nil, nil, core.ErrorBadRequest
+	}
+
+	major, argument, rest, err := cborHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		if argument > 1<<63-1 {
+			return nil, nil, core.ErrorBadRequest
+		}
+		return int64(argument), rest, nil
+
+	case cborNegative:
+		if argument > 1<<63-1 {
+			return nil, nil, core.ErrorBadRequest
+		}
+		return -1 - int64(argument), rest, nil
+
+	case cborBytes, cborText:
+		if argument > uint64(len(rest)) {
+			return nil, nil, core.ErrorBadRequest
+		}
+		if major == cborText {
+			return string(rest[:argument]), rest[argument:], nil
+		}
+		return append([]byte{}, rest[:argument]...), rest[argument:], nil
+
+	case cborArray:
+		// Each item takes at least one byte
+		if argument > uint64(len(rest)) {
+			return nil, nil, core.ErrorBadRequest
+		}
+
+		array := make([]interface{}, argument)
+		for i := range array {
+			array[i], rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return array, rest, nil
+
+	case cborMap:
+		if argument > uint64(len(rest)) {
+			return nil, nil, core.ErrorBadRequest
+		}
+
+		m := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key interface{}
+			key, rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, core.ErrorBadRequest
+			}
+
+			if _, exists := m[key]; exists {
+				return nil, nil, core.ErrorBadRequest
+			}
+
+			m[key], rest, err = cborDecodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return m, rest, nil
+
+	case cborSimple:
+		// Floats have the same major type
+		if data[0]&0x1f >= 24 {
+			break
+		}
+
+		switch argument {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+
+	return nil, nil, core.ErrorBadRequest
+}
@@ -0,0 +1,72 @@
+package webauthn
+
+import (
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCBORDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	value := map[interface{}]interface{}{
+		int64(1):  int64(2),
+		int64(-7): int64(-257),
+		"bytes":   []byte{1, 2, 3},
+		"text":    "text",
+		"array":   []interface{}{int64(1000), int64(100000), int64(10000000000), true, false, nil},
+		"map":     map[interface{}]interface{}{},
+	}
+
+	data := append(cborEncode(value), 0xff)
+	decoded, rest, err := cborDecode(data)
+	assert.Nil(err)
+	assert.Equal(value, decoded)
+	assert.Equal([]byte{0xff}, rest)
+
+	// RFC 7049, Appendix A
+	decoded, _, err = cborDecode([]byte{0x3a, 0x00, 0x0f, 0x42, 0x3f})
+	assert.Nil(err)
+	assert.Equal(int64(-1000000), decoded)
+}
+
+func TestCBORMalformed(t *testing.T) {
+	assert := assert.New(t)
+
+	malformed := [][]byte{
+		// Empty
+		{},
+		// Truncated argument
+		{0x19, 0x01},
+		// Truncated byte string
+		{0x45, 0x01, 0x02},
+		// Map with more items than data
+		{0xa2, 0x01, 0x02},
+		// Array key
+		{0xa1, 0x80, 0x01},
+		// Duplicate key
+		{0xa2, 0x01, 0x01, 0x01, 0x02},
+		// Indefinite length
+		{0x5f, 0x41, 0x01, 0xff},
+		// Tag
+		{0xc1, 0x01},
+		// Half precision float
+		{0xf9, 0x00, 0x14},
+		// Unsigned above int64
+		{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	for _, data := range malformed {
+		_, _, err := cborDecode(data)
+		assert.Equal(core.ErrorBadRequest, err, "%x", data)
+	}
+
+	// Too deep
+	deep := make([]byte, 100)
+	for i := range deep {
+		deep[i] = 0x81
+	}
+	_, _, err := cborDecode(append(deep, 0x01))
+	assert.Equal(core.ErrorBadRequest, err)
+}
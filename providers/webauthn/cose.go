@@ -0,0 +1,143 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// COSE (RFC 8152) key parameters and algorithms
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurve      = -1
+	coseCurveP256  = 1
+	coseX          = -2
+	coseY          = -3
+	coseModulus    = -1
+	coseExponent   = -2
+	maxRSAExponent = 1<<31 - 1
+
+	// ECDSA with SHA-256
+	AlgorithmES256 = -7
+
+	// RSASSA-PKCS1-v1_5 with SHA-256
+	AlgorithmRS256 = -257
+)
+
+// Algorithms offered to authenticators, in order of preference
+var SupportedAlgorithms = []int{AlgorithmES256, AlgorithmRS256}
+
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+func mapInt(m map[interface{}]interface{}, key int64) (int64, bool) {
+	value, ok := m[key].(int64)
+	return value, ok
+}
+
+func mapBytes(m map[interface{}]interface{}, key int64) ([]byte, bool) {
+	value, ok := m[key].([]byte)
+	return value, ok && len(value) > 0
+}
+
+// Parses a COSE encoded public key
+func parsePublicKey(data []byte) (*publicKey, error) {
+	value, _, err := cborDecode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, core.ErrorBadRequest
+	}
+
+	keyType, _ := mapInt(m, coseKeyType)
+	algorithm, _ := mapInt(m, coseAlgorithm)
+
+	switch {
+	case keyType == coseKeyTypeEC2 && algorithm == AlgorithmES256:
+		curve, _ := mapInt(m, coseCurve)
+		x, okX := mapBytes(m, coseX)
+		y, okY := mapBytes(m, coseY)
+		if curve != coseCurveP256 || !okX || !okY {
+			return nil, core.ErrorBadRequest
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, core.ErrorBadRequest
+		}
+		return &publicKey{algorithm: algorithm, key: key}, nil
+
+	case keyType == coseKeyTypeRSA && algorithm == AlgorithmRS256:
+		n, okN := mapBytes(m, coseModulus)
+		e, okE := mapBytes(m, coseExponent)
+		if !okN || !okE {
+			return nil, core.ErrorBadRequest
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > maxRSAExponent || exponent.Int64() < 3 {
+			return nil, core.ErrorBadRequest
+		}
+
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return nil, core.ErrorBadRequest
+		}
+		return &publicKey{algorithm: algorithm, key: key}, nil
+	}
+
+	return nil, core.ErrorNotImplemented
+}
+
+// Checks the signature of the data
+func (k *publicKey) verify(data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+			return core.ErrorAuthenticationFailure
+		}
+
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return core.ErrorAuthenticationFailure
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return core.ErrorAuthenticationFailure
+		}
+		return nil
+	}
+
+	return core.ErrorAuthenticationFailure
+}
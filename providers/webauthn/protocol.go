@@ -0,0 +1,204 @@
+package webauthn
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Binary data is sent to the browser base64url encoded
+type Base64 []byte
+
+func (b Base64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	// Some clients keep the padding
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+
+	*b, err = base64.RawURLEncoding.DecodeString(s)
+	return err
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Base64 `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Base64 `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+// CreationOptions are passed to navigator.credentials.create()
+// after decoding the base64url fields
+type CreationOptions struct {
+	Challenge              Base64                 `json:"challenge"`
+	RelyingParty           RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Parameters             []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are passed to navigator.credentials.get()
+// after decoding the base64url fields
+type RequestOptions struct {
+	Challenge        Base64                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RelyingPartyID   string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                 `json:"userVerification,omitempty"`
+}
+
+// AttestationResponse is the PublicKeyCredential returned by navigator.credentials.create(),
+// with binary fields base64url encoded
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    Base64 `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64 `json:"clientDataJSON"`
+		AttestationObject Base64 `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential returned by navigator.credentials.get(),
+// with binary fields base64url encoded
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Base64 `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Base64 `json:"clientDataJSON"`
+		AuthenticatorData Base64 `json:"authenticatorData"`
+		Signature         Base64 `json:"signature"`
+		UserHandle        Base64 `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Collected by the browser and signed by the authenticator
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge Base64 `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedData     = 0x40
+	flagExtensionData    = 0x80
+	authenticatorDataLen = 37
+)
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// Set in registrations
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < authenticatorDataLen {
+		return nil, core.ErrorBadRequest
+	}
+
+	a := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rest := data[authenticatorDataLen:]
+	if a.Flags&flagAttestedData != 0 {
+		// AAGUID and the length of the credential ID
+		if len(rest) < 18 {
+			return nil, core.ErrorBadRequest
+		}
+
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || len(rest) < length {
+			return nil, core.ErrorBadRequest
+		}
+		a.CredentialID = rest[:length]
+		rest = rest[length:]
+
+		// Key's length is known after decoding it
+		_, afterKey, err := cborDecode(rest)
+		if err != nil {
+			return nil, err
+		}
+		a.PublicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if a.Flags&flagExtensionData != 0 {
+		var err error
+		_, rest, err = cborDecode(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rest) != 0 {
+		return nil, core.ErrorBadRequest
+	}
+
+	return a, nil
+}
+
+// Returns the authenticator data from the attestation object.
+// Attestation isn't requested, so the statement isn't verified.
+func parseAttestationObject(data []byte) (*authenticatorData, error) {
+	value, rest, err := cborDecode(data)
+	if err != nil || len(rest) != 0 {
+		return nil, core.ErrorBadRequest
+	}
+
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, core.ErrorBadRequest
+	}
+
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, core.ErrorBadRequest
+	}
+
+	return parseAuthenticatorData(raw)
+}
@@ -0,0 +1,325 @@
+package webauthn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	loginSessionName    = "webauthn"
+	registerSessionName = "webauthn-register"
+	defaultField        = "credential"
+)
+
+// FormContext is passed to the login and registration page templates.
+// The page's script decodes the base64url fields of Options, passes them to
+// navigator.credentials.get() or create() and posts the JSON encoded
+// result with base64url encoded binary fields in Field.
+type FormContext struct {
+	Msg       string
+	SubmitURI string
+	Field     string
+	Options   template.JS
+}
+
+type ProviderConfig struct {
+	// Optional. Checks the first factor, e.g. form.FormAuth.
+	// Without it the logins are passwordless and WebAuthn.RequireUserVerification
+	// has to be set, so the authenticator checks a PIN or biometrics.
+	First core.Provider
+
+	WebAuthn *WebAuthn
+
+	// Keeps the challenges between the steps of a ceremony
+	Sessions sessions.Store
+
+	LoginForm    string
+	RegisterForm string
+	Field        string
+
+	// Optional, nothing is logged without it
+	Logger logging.Logger
+}
+
+// Provider logs users in with WebAuthn authenticators, as a second factor
+// after the First provider or passwordless. In the second factor mode
+// users without registered authenticators log in with the first factor only.
+type Provider struct {
+	ProviderConfig
+
+	// Challenges can't be used twice
+	used *cache.Cache
+}
+
+// Ceremony should be started, the options are written by WriteError
+type pendingError struct {
+	user string
+}
+
+func (e *pendingError) Error() string {
+	return core.ErrorSecondFactorRequired.Error()
+}
+
+func NewProvider(c ProviderConfig) (*Provider, error) {
+	if c.WebAuthn == nil || c.Sessions == nil || c.LoginForm == "" {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	// A stolen authenticator alone shouldn't be enough
+	if c.First == nil && !c.WebAuthn.RequireUserVerification {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.Field == "" {
+		c.Field = defaultField
+	}
+
+	p := &Provider{ProviderConfig: c}
+	p.used = cache.New(c.WebAuthn.Timeout, c.WebAuthn.Timeout)
+	return p, nil
+}
+
+// Ceremony started in an earlier request
+type state struct {
+	user       string
+	userHandle []byte
+	challenge  []byte
+}
+
+func (p *Provider) getState(r *http.Request, name string) (*state, bool) {
+	session, err := p.Sessions.Get(r, name)
+	if err != nil {
+		return nil, false
+	}
+
+	s := new(state)
+	s.user, _ = session.Values["user"].(string)
+	s.userHandle, _ = session.Values["userHandle"].([]byte)
+	s.challenge, _ = session.Values["challenge"].([]byte)
+	expires, _ := session.Values["expires"].(int64)
+	if len(s.challenge) == 0 || time.Now().Unix() > expires {
+		return nil, false
+	}
+
+	return s, true
+}
+
+func (p *Provider) saveState(w http.ResponseWriter, r *http.Request, name string, s *state) error {
+	session, err := p.Sessions.New(r, name)
+	if err != nil && session == nil {
+		return err
+	}
+
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(p.WebAuthn.Timeout / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	session.Values["user"] = s.user
+	session.Values["userHandle"] = s.userHandle
+	session.Values["challenge"] = s.challenge
+	session.Values["expires"] = time.Now().Add(p.WebAuthn.Timeout).Unix()
+
+	return p.Sessions.Save(r, w, session)
+}
+
+// Marks the challenge as used, fails if it already was
+func (p *Provider) useChallenge(challenge []byte) error {
+	err := p.used.Add(base64.RawURLEncoding.EncodeToString(challenge), true, cache.DefaultExpiration)
+	if err != nil {
+		return core.ErrorSessionExpired
+	}
+	return nil
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	response := r.FormValue(p.Field)
+	if response != "" {
+		s, ok := p.getState(r, loginSessionName)
+		if !ok {
+			return "", core.ErrorSessionExpired
+		}
+
+		var assertion AssertionResponse
+		err = json.Unmarshal([]byte(response), &assertion)
+		if err != nil {
+			return "", core.ErrorBadRequest
+		}
+
+		err = p.useChallenge(s.challenge)
+		if err != nil {
+			return "", err
+		}
+
+		user, err = p.WebAuthn.FinishLoginContext(r.Context(), s.user, s.challenge, &assertion)
+		if err != nil {
+			logging.Info(r.Context(), p.Logger, "assertion rejected", logging.Fields{
+				"user":  s.user,
+				"error": err,
+			})
+		}
+		return user, err
+	}
+
+	if p.First == nil {
+		return "", &pendingError{}
+	}
+
+	user, err = p.First.Check(r)
+	if err != nil {
+		return "", err
+	}
+
+	registered, err := p.WebAuthn.HasCredentialsContext(r.Context(), user)
+	if err != nil {
+		return "", err
+	}
+
+	if registered {
+		return "", &pendingError{user: user}
+	}
+
+	return user, nil
+}
+
+// Register finishes the registration of a credential started with BeginRegistration
+// and returns the user who registered it
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	s, ok := p.getState(r, registerSessionName)
+	if !ok {
+		return "", core.ErrorSessionExpired
+	}
+
+	var attestation AttestationResponse
+	err = json.Unmarshal([]byte(r.FormValue(p.Field)), &attestation)
+	if err != nil {
+		return "", core.ErrorBadRequest
+	}
+
+	err = p.useChallenge(s.challenge)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = p.WebAuthn.FinishRegistrationContext(r.Context(), s.user, s.userHandle, s.challenge, &attestation)
+	if err != nil {
+		logging.Info(r.Context(), p.Logger, "registration rejected", logging.Fields{
+			"user":  s.user,
+			"error": err,
+		})
+		return "", err
+	}
+
+	logging.Info(r.Context(), p.Logger, "authenticator registered", logging.Fields{"user": s.user})
+
+	return s.user, nil
+}
+
+// BeginRegistration writes the registration page for the user,
+// who has to be authenticated by the caller
+func (p *Provider) BeginRegistration(w http.ResponseWriter, r *http.Request, username string) error {
+	if p.RegisterForm == "" {
+		return core.ErrorNotImplemented
+	}
+
+	options, err := p.WebAuthn.BeginRegistrationContext(r.Context(), username)
+	if err != nil {
+		return err
+	}
+
+	err = p.saveState(w, r, registerSessionName, &state{
+		user:       username,
+		userHandle: options.User.ID,
+		challenge:  options.Challenge,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.writeForm(w, r, p.RegisterForm, "", options)
+}
+
+func (p *Provider) Write(w http.ResponseWriter, r *http.Request) error {
+	if p.First != nil {
+		return p.First.Write(w, r)
+	}
+	return nil
+}
+
+func (p *Provider) WriteError(w http.ResponseWriter, r *http.Request, err error) error {
+	var user, msg string
+
+	if pending, ok := err.(*pendingError); ok {
+		user = pending.user
+	} else if r.FormValue(p.Field) != "" {
+		// Failed assertion, the user can try again
+		s, ok := p.getState(r, loginSessionName)
+		if ok {
+			user = s.user
+		} else if p.First != nil {
+			return p.First.WriteError(w, r, err)
+		}
+		msg = message(err)
+	} else if p.First != nil {
+		return p.First.WriteError(w, r, err)
+	}
+
+	options, err := p.WebAuthn.BeginLoginContext(r.Context(), user)
+	if err != nil {
+		return err
+	}
+
+	err = p.saveState(w, r, loginSessionName, &state{
+		user:      user,
+		challenge: options.Challenge,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.writeForm(w, r, p.LoginForm, msg, options)
+}
+
+func message(err error) string {
+	switch err {
+	case core.ErrorAuthenticationFailure:
+		return "Authentication failed"
+
+	case core.ErrorSessionExpired:
+		return "Login expired, try again"
+
+	case core.ErrorBadRequest:
+		return "Authenticator returned a bad response"
+	}
+
+	return "An error occurred"
+}
+
+func (p *Provider) writeForm(w http.ResponseWriter, r *http.Request, form, msg string, options interface{}) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	t, err := template.New("tmpl").Parse(form)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, FormContext{
+		Msg:       msg,
+		SubmitURI: r.URL.RequestURI(),
+		Field:     p.Field,
+		// Marshal escapes HTML characters, it's safe in a script
+		Options: template.JS(data),
+	})
+}
@@ -0,0 +1,215 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	loginForm = `login {{.Msg}}`
+
+	// Options are printed where the page's script would use them
+	webauthnForm = `webauthn {{.Field}} <script>var options = {{.Options}};</script> {{.Msg}}`
+)
+
+var optionsRegexp = regexp.MustCompile(`var options = (.*);</script>`)
+
+func createProvider(assert *assert.Assertions, passwordless bool) (*Provider, *WebAuthn) {
+	w, users := createWebAuthn(assert)
+
+	config := ProviderConfig{
+		WebAuthn:     w,
+		Sessions:     sessions.NewCookieStore([]byte("testsecret")),
+		LoginForm:    webauthnForm,
+		RegisterForm: webauthnForm,
+	}
+
+	if !passwordless {
+		var err error
+		config.First, err = form.NewFormAuth(form.Config{
+			LoginForm:          loginForm,
+			LoginUsernameField: "username",
+			LoginPasswordField: "password",
+			UserStore:          users,
+			Username:           form.Complexity{MinLength: 1, MaxLength: 100},
+			Password:           form.Complexity{MinLength: 1, MaxLength: 100},
+		})
+		assert.Nil(err)
+	}
+
+	provider, err := NewProvider(config)
+	assert.Nil(err)
+
+	return provider, w
+}
+
+func post(values url.Values, cookies []*http.Cookie) *http.Request {
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// Checks the request and writes the error like the login handler does
+func login(provider *Provider, r *http.Request) (string, *httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	user, err := provider.Check(r)
+	if err != nil {
+		provider.WriteError(w, r, err)
+	}
+	return user, w, err
+}
+
+func readCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	return (&http.Response{Header: w.Header()}).Cookies()
+}
+
+// Reads the options from the page
+func readOptions(assert *assert.Assertions, w *httptest.ResponseRecorder, options interface{}) {
+	match := optionsRegexp.FindStringSubmatch(w.Body.String())
+	if !assert.Len(match, 2) {
+		return
+	}
+
+	assert.Nil(json.Unmarshal([]byte(match[1]), options))
+}
+
+func assertion(response *AssertionResponse) url.Values {
+	data, _ := json.Marshal(response)
+	return url.Values{defaultField: {string(data)}}
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(ProviderConfig{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	provider, w := createProvider(assert, true)
+	assert.Equal(defaultField, provider.Field)
+
+	// Passwordless needs the user verification
+	w.RequireUserVerification = false
+	_, err = NewProvider(provider.ProviderConfig)
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestProviderRegister(t *testing.T) {
+	assert := assert.New(t)
+	provider, w := createProvider(assert, false)
+
+	// User is authenticated by the caller
+	rw := httptest.NewRecorder()
+	err := provider.BeginRegistration(rw, post(nil, nil), testUser)
+	assert.Nil(err)
+
+	var options CreationOptions
+	readOptions(assert, rw, &options)
+	assert.Equal(testRPID, options.RelyingParty.ID)
+	assert.Equal(testUser, options.User.Name)
+
+	authenticator := newSoftAuthenticator(testOrigin, false)
+	data, _ := json.Marshal(authenticator.create(&options))
+	r := post(url.Values{defaultField: {string(data)}}, readCookies(rw))
+
+	user, err := provider.Register(r)
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	registered, err := w.HasCredentials(testUser)
+	assert.Nil(err)
+	assert.True(registered)
+
+	// Without the session
+	_, err = provider.Register(post(url.Values{defaultField: {string(data)}}, nil))
+	assert.Equal(core.ErrorSessionExpired, err)
+}
+
+func TestSecondFactor(t *testing.T) {
+	assert := assert.New(t)
+	provider, w := createProvider(assert, false)
+
+	credentials := url.Values{"username": {testUser}, "password": {testPassword}}
+
+	// Without an authenticator the first factor is enough
+	user, _, err := login(provider, post(credentials, nil))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	authenticator := register(assert, w, false)
+
+	credentials.Set("password", "bad")
+	_, rw, err := login(provider, post(credentials, nil))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.Equal("login Authentication failed", rw.Body.String())
+
+	credentials.Set("password", testPassword)
+	user, rw, err = login(provider, post(credentials, nil))
+	assert.NotNil(err)
+	assert.Equal("", user)
+	assert.Contains(rw.Body.String(), "webauthn credential")
+
+	var options RequestOptions
+	readOptions(assert, rw, &options)
+	assert.Len(options.AllowCredentials, 1)
+	cookies := readCookies(rw)
+
+	// Assertion without the first factor
+	_, rw, err = login(provider, post(assertion(authenticator.get(&options)), nil))
+	assert.Equal(core.ErrorSessionExpired, err)
+	assert.Contains(rw.Body.String(), "login")
+
+	response := authenticator.get(&options)
+	user, _, err = login(provider, post(assertion(response), cookies))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	// Challenge is used once
+	authenticator.signCount++
+	_, rw, err = login(provider, post(assertion(authenticator.get(&options)), cookies))
+	assert.Equal(core.ErrorSessionExpired, err)
+	assert.Contains(rw.Body.String(), "Login expired, try again")
+}
+
+func TestPasswordlessProvider(t *testing.T) {
+	assert := assert.New(t)
+	provider, w := createProvider(assert, true)
+
+	authenticator := register(assert, w, false)
+
+	// Login page starts the ceremony
+	r, _ := http.NewRequest("GET", "/login", nil)
+	_, rw, err := login(provider, r)
+	assert.NotNil(err)
+
+	var options RequestOptions
+	readOptions(assert, rw, &options)
+	assert.Empty(options.AllowCredentials)
+	cookies := readCookies(rw)
+
+	// Failure shows a new challenge
+	other := newSoftAuthenticator(testOrigin, false)
+	_, rw, err = login(provider, post(assertion(other.get(&options)), cookies))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.Contains(rw.Body.String(), "Authentication failed")
+
+	var retry RequestOptions
+	readOptions(assert, rw, &retry)
+	assert.NotEqual(options.Challenge, retry.Challenge)
+
+	user, _, err := login(provider, post(assertion(authenticator.get(&retry)), readCookies(rw)))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+}
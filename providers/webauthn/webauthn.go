@@ -0,0 +1,415 @@
+package webauthn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+)
+
+const (
+	challengeSize  = 32
+	userHandleSize = 32
+	defaultTimeout = 5 * time.Minute
+
+	credentialType = "public-key"
+	typeCreate     = "webauthn.create"
+	typeGet        = "webauthn.get"
+)
+
+type Config struct {
+	// Keeps the credentials, e.g. memory.Store or rethinkdb.Store
+	Credentials userdb.CredentialStore
+
+	// Relying party ID, the domain of the IdP, e.g. "login.example.com"
+	RPID string
+
+	// Shown by the browser during the registration
+	RPName string
+
+	// Allowed origins of the login pages, e.g. "https://login.example.com"
+	Origins []string
+
+	// Require user verification (PIN, biometrics), needed for passwordless logins
+	RequireUserVerification bool
+
+	// Time the user has to complete a ceremony
+	Timeout time.Duration
+}
+
+// WebAuthn performs the registration and assertion ceremonies.
+// Challenges are kept by the caller, e.g. Provider stores them in a session.
+type WebAuthn struct {
+	Config
+
+	credentials userdb.CredentialContextStore
+	rpIDHash    [32]byte
+}
+
+func NewWebAuthn(c Config) (*WebAuthn, error) {
+	if c.Credentials == nil || c.RPID == "" || len(c.Origins) == 0 || c.Timeout < 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.RPName == "" {
+		c.RPName = c.RPID
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+
+	w := &WebAuthn{Config: c, credentials: userdb.CredentialsWithContext(c.Credentials)}
+	w.rpIDHash = sha256.Sum256([]byte(c.RPID))
+	return w, nil
+}
+
+func (w *WebAuthn) userVerification() string {
+	if w.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+func generateChallenge() ([]byte, error) {
+	challenge := make([]byte, challengeSize)
+	_, err := rand.Read(challenge)
+	return challenge, err
+}
+
+func descriptors(credentials []userdb.WebAuthnCredential) []CredentialDescriptor {
+	var result []CredentialDescriptor
+	for _, credential := range credentials {
+		result = append(result, CredentialDescriptor{Type: credentialType, ID: credential.ID})
+	}
+	return result
+}
+
+// BeginRegistration returns options for creating a new credential for the user
+func (w *WebAuthn) BeginRegistration(username string) (*CreationOptions, error) {
+	return w.BeginRegistrationContext(context.Background(), username)
+}
+
+func (w *WebAuthn) BeginRegistrationContext(ctx context.Context, username string) (*CreationOptions, error) {
+	credentials, err := w.credentials.GetCredentialsContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticators replace credentials with the same handle, so it's kept
+	var userHandle []byte
+	if len(credentials) > 0 {
+		userHandle = credentials[0].UserHandle
+	} else {
+		userHandle = make([]byte, userHandleSize)
+		_, err = rand.Read(userHandle)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	challenge, err := generateChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &CreationOptions{
+		Challenge:    challenge,
+		RelyingParty: RelyingPartyEntity{ID: w.RPID, Name: w.RPName},
+		User: UserEntity{
+			ID:          userHandle,
+			Name:        username,
+			DisplayName: username,
+		},
+		Timeout:            int64(w.Timeout / time.Millisecond),
+		ExcludeCredentials: descriptors(credentials),
+		AuthenticatorSelection: AuthenticatorSelection{
+			// Discoverable credentials allow passwordless logins
+			ResidentKey:      "preferred",
+			UserVerification: w.userVerification(),
+		},
+		Attestation: "none",
+	}
+
+	for _, algorithm := range SupportedAlgorithms {
+		options.Parameters = append(options.Parameters, CredentialParameter{Type: credentialType, Algorithm: algorithm})
+	}
+
+	return options, nil
+}
+
+// Checks the client data signed by the authenticator
+func (w *WebAuthn) verifyClientData(data []byte, ceremony string, challenge []byte) error {
+	var c clientData
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return core.ErrorBadRequest
+	}
+
+	if c.Type != ceremony {
+		return core.ErrorBadRequest
+	}
+
+	if len(challenge) == 0 || subtle.ConstantTimeCompare(c.Challenge, challenge) != 1 {
+		return core.ErrorAuthenticationFailure
+	}
+
+	for _, origin := range w.Origins {
+		if c.Origin == origin {
+			return nil
+		}
+	}
+
+	return core.ErrorAuthenticationFailure
+}
+
+// Checks the authenticator data common to both ceremonies
+func (w *WebAuthn) verifyAuthenticatorData(a *authenticatorData) error {
+	if !bytes.Equal(a.RPIDHash, w.rpIDHash[:]) {
+		return core.ErrorAuthenticationFailure
+	}
+
+	if a.Flags&flagUserPresent == 0 {
+		return core.ErrorAuthenticationFailure
+	}
+
+	if w.RequireUserVerification && a.Flags&flagUserVerified == 0 {
+		return core.ErrorAuthenticationFailure
+	}
+
+	return nil
+}
+
+// FinishRegistration verifies the new credential and adds it to the user's credentials.
+// userHandle and challenge come from the options returned by BeginRegistration.
+func (w *WebAuthn) FinishRegistration(username string, userHandle, challenge []byte, response *AttestationResponse) (*userdb.WebAuthnCredential, error) {
+	return w.FinishRegistrationContext(context.Background(), username, userHandle, challenge, response)
+}
+
+func (w *WebAuthn) FinishRegistrationContext(ctx context.Context, username string, userHandle, challenge []byte, response *AttestationResponse) (*userdb.WebAuthnCredential, error) {
+	if response.Type != credentialType {
+		return nil, core.ErrorBadRequest
+	}
+
+	err := w.verifyClientData(response.Response.ClientDataJSON, typeCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := parseAttestationObject(response.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.verifyAuthenticatorData(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.CredentialID == nil || !bytes.Equal(a.CredentialID, response.RawID) {
+		return nil, core.ErrorBadRequest
+	}
+
+	_, err = parsePublicKey(a.PublicKey)
+	if err != nil {
+		return nil, core.ErrorBadRequest
+	}
+
+	// Credential can't be registered by two users
+	_, err = w.credentials.GetUsernameWithCredentialIDContext(ctx, a.CredentialID)
+	if err == nil {
+		return nil, core.ErrorUserAlreadyExists
+	}
+	if err != core.ErrorNoSuchUser {
+		return nil, err
+	}
+
+	credential := userdb.WebAuthnCredential{
+		ID:         append([]byte{}, a.CredentialID...),
+		PublicKey:  append([]byte{}, a.PublicKey...),
+		SignCount:  a.SignCount,
+		UserHandle: userHandle,
+		Created:    time.Now(),
+	}
+
+	err = w.credentials.UpdateCredentialsContext(ctx, username, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		for _, c := range credentials {
+			if bytes.Equal(c.ID, credential.ID) {
+				return nil, core.ErrorUserAlreadyExists
+			}
+		}
+		return append(credentials, credential), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+// BeginLogin returns options for the assertion.
+// Empty username starts a passwordless login, where the authenticator picks the credential.
+func (w *WebAuthn) BeginLogin(username string) (*RequestOptions, error) {
+	return w.BeginLoginContext(context.Background(), username)
+}
+
+func (w *WebAuthn) BeginLoginContext(ctx context.Context, username string) (*RequestOptions, error) {
+	options := &RequestOptions{
+		Timeout:          int64(w.Timeout / time.Millisecond),
+		RelyingPartyID:   w.RPID,
+		UserVerification: w.userVerification(),
+	}
+
+	if username != "" {
+		credentials, err := w.credentials.GetCredentialsContext(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(credentials) == 0 {
+			return nil, core.ErrorNoSuchUser
+		}
+
+		options.AllowCredentials = descriptors(credentials)
+	}
+
+	var err error
+	options.Challenge, err = generateChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// FinishLogin verifies the assertion and returns the authenticated user.
+// username is empty in passwordless logins, challenge comes from the options returned by BeginLogin.
+func (w *WebAuthn) FinishLogin(username string, challenge []byte, response *AssertionResponse) (user string, err error) {
+	return w.FinishLoginContext(context.Background(), username, challenge, response)
+}
+
+func (w *WebAuthn) FinishLoginContext(ctx context.Context, username string, challenge []byte, response *AssertionResponse) (user string, err error) {
+	if response.Type != credentialType || len(response.RawID) == 0 {
+		return "", core.ErrorBadRequest
+	}
+
+	user = username
+	if user == "" {
+		user, err = w.credentials.GetUsernameWithCredentialIDContext(ctx, response.RawID)
+		if err != nil {
+			return "", core.ErrorAuthenticationFailure
+		}
+	}
+
+	credentials, err := w.credentials.GetCredentialsContext(ctx, user)
+	if err != nil {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	var credential *userdb.WebAuthnCredential
+	for i := range credentials {
+		if bytes.Equal(credentials[i].ID, response.RawID) {
+			credential = &credentials[i]
+		}
+	}
+
+	if credential == nil {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	// Passwordless logins get the handle of the credential's owner
+	userHandle := response.Response.UserHandle
+	if len(userHandle) != 0 && !bytes.Equal(userHandle, credential.UserHandle) {
+		return "", core.ErrorAuthenticationFailure
+	}
+
+	clientDataJSON := response.Response.ClientDataJSON
+	err = w.verifyClientData(clientDataJSON, typeGet, challenge)
+	if err != nil {
+		return "", err
+	}
+
+	authData := response.Response.AuthenticatorData
+	a, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return "", err
+	}
+
+	err = w.verifyAuthenticatorData(a)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	err = key.verify(signed, response.Response.Signature)
+	if err != nil {
+		return "", err
+	}
+
+	err = w.credentials.UpdateCredentialsContext(ctx, user, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		for i := range credentials {
+			if !bytes.Equal(credentials[i].ID, response.RawID) {
+				continue
+			}
+
+			// Authenticators without a counter always report 0,
+			// otherwise it has to grow or the authenticator could be cloned
+			stored := credentials[i].SignCount
+			if (stored != 0 || a.SignCount != 0) && a.SignCount <= stored {
+				return nil, core.ErrorAuthenticationFailure
+			}
+
+			credentials[i].SignCount = a.SignCount
+			return credentials, nil
+		}
+
+		// Removed in the meantime
+		return nil, core.ErrorAuthenticationFailure
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return user, nil
+}
+
+// RemoveCredential deletes one of the user's credentials
+func (w *WebAuthn) RemoveCredential(username string, id []byte) error {
+	return w.RemoveCredentialContext(context.Background(), username, id)
+}
+
+func (w *WebAuthn) RemoveCredentialContext(ctx context.Context, username string, id []byte) error {
+	return w.credentials.UpdateCredentialsContext(ctx, username, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		for i := range credentials {
+			if bytes.Equal(credentials[i].ID, id) {
+				return append(credentials[:i], credentials[i+1:]...), nil
+			}
+		}
+		return nil, core.ErrorBadRequest
+	})
+}
+
+// HasCredentials returns whether the user registered any authenticator
+func (w *WebAuthn) HasCredentials(username string) (bool, error) {
+	return w.HasCredentialsContext(context.Background(), username)
+}
+
+func (w *WebAuthn) HasCredentialsContext(ctx context.Context, username string) (bool, error) {
+	credentials, err := w.credentials.GetCredentialsContext(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return len(credentials) > 0, nil
+}
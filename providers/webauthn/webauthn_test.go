@@ -0,0 +1,217 @@
+package webauthn
+
+import (
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUser     = "joe"
+	testPassword = "joe123"
+	testRPID     = "login.example.com"
+	testOrigin   = "https://login.example.com"
+)
+
+func createWebAuthn(assert *assert.Assertions) (*WebAuthn, *memory.Store) {
+	users, err := memory.NewMemStore()
+	assert.Nil(err)
+
+	err = users.Add(testUser, testPassword)
+	assert.Nil(err)
+
+	w, err := NewWebAuthn(Config{
+		Credentials:             users,
+		RPID:                    testRPID,
+		Origins:                 []string{testOrigin},
+		RequireUserVerification: true,
+	})
+	assert.Nil(err)
+
+	return w, users
+}
+
+// Registers a new software authenticator for the test user
+func register(assert *assert.Assertions, w *WebAuthn, useRSA bool) *softAuthenticator {
+	authenticator := newSoftAuthenticator(testOrigin, useRSA)
+
+	options, err := w.BeginRegistration(testUser)
+	assert.Nil(err)
+
+	_, err = w.FinishRegistration(testUser, options.User.ID, options.Challenge, authenticator.create(options))
+	assert.Nil(err)
+
+	return authenticator
+}
+
+func TestNewWebAuthn(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewWebAuthn(Config{RPID: testRPID})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	w, _ := createWebAuthn(assert)
+	assert.Equal(testRPID, w.RPName)
+	assert.Equal(defaultTimeout, w.Timeout)
+}
+
+func TestRegistration(t *testing.T) {
+	assert := assert.New(t)
+	w, users := createWebAuthn(assert)
+
+	_, err := w.BeginRegistration("nobody")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	first := register(assert, w, false)
+
+	credentials, err := users.GetCredentials(testUser)
+	assert.Nil(err)
+	assert.Len(credentials, 1)
+	assert.Equal(first.credentialID, credentials[0].ID)
+
+	// Second authenticator keeps the user handle and excludes the first one
+	options, err := w.BeginRegistration(testUser)
+	assert.Nil(err)
+	assert.Equal(first.userHandle, []byte(options.User.ID))
+	assert.Len(options.ExcludeCredentials, 1)
+
+	second := newSoftAuthenticator(testOrigin, true)
+	response := second.create(options)
+
+	// Wrong challenge
+	_, err = w.FinishRegistration(testUser, options.User.ID, []byte("other"), response)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	_, err = w.FinishRegistration(testUser, options.User.ID, options.Challenge, response)
+	assert.Nil(err)
+
+	// Already registered
+	options, err = w.BeginRegistration(testUser)
+	assert.Nil(err)
+	_, err = w.FinishRegistration(testUser, options.User.ID, options.Challenge, second.create(options))
+	assert.Equal(core.ErrorUserAlreadyExists, err)
+
+	// Wrong origin
+	options, err = w.BeginRegistration(testUser)
+	assert.Nil(err)
+	phishing := newSoftAuthenticator("https://login.example.com.evil.com", false)
+	_, err = w.FinishRegistration(testUser, options.User.ID, options.Challenge, phishing.create(options))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Wrong relying party
+	options.RelyingParty.ID = "evil.com"
+	other := newSoftAuthenticator(testOrigin, false)
+	_, err = w.FinishRegistration(testUser, options.User.ID, options.Challenge, other.create(options))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	credentials, err = users.GetCredentials(testUser)
+	assert.Nil(err)
+	assert.Len(credentials, 2)
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	w, _ := createWebAuthn(assert)
+
+	_, err := w.BeginLogin(testUser)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	for _, useRSA := range []bool{false, true} {
+		authenticator := register(assert, w, useRSA)
+
+		options, err := w.BeginLogin(testUser)
+		assert.Nil(err)
+		assert.NotEmpty(options.AllowCredentials)
+
+		user, err := w.FinishLogin(testUser, options.Challenge, authenticator.get(options))
+		assert.Nil(err)
+		assert.Equal(testUser, user)
+
+		// Bad signature
+		response := authenticator.get(options)
+		response.Response.Signature[len(response.Response.Signature)-1] ^= 1
+		_, err = w.FinishLogin(testUser, options.Challenge, response)
+		assert.Equal(core.ErrorAuthenticationFailure, err)
+
+		// Type isn't signed, but checked
+		response = authenticator.get(options)
+		response.Type = "password"
+		_, err = w.FinishLogin(testUser, options.Challenge, response)
+		assert.Equal(core.ErrorBadRequest, err)
+	}
+}
+
+func TestPasswordless(t *testing.T) {
+	assert := assert.New(t)
+	w, users := createWebAuthn(assert)
+
+	authenticator := register(assert, w, false)
+
+	err := users.Add("eve", "eve123")
+	assert.Nil(err)
+
+	options, err := w.BeginLogin("")
+	assert.Nil(err)
+	assert.Empty(options.AllowCredentials)
+
+	user, err := w.FinishLogin("", options.Challenge, authenticator.get(options))
+	assert.Nil(err)
+	assert.Equal(testUser, user)
+
+	// Credential of another user
+	options, err = w.BeginLogin("")
+	assert.Nil(err)
+	_, err = w.FinishLogin("eve", options.Challenge, authenticator.get(options))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// User handle of another user
+	response := authenticator.get(options)
+	response.Response.UserHandle = []byte("other")
+	_, err = w.FinishLogin("", options.Challenge, response)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Unknown credential
+	unknown := newSoftAuthenticator(testOrigin, false)
+	_, err = w.FinishLogin("", options.Challenge, unknown.get(options))
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+}
+
+func TestSignCount(t *testing.T) {
+	assert := assert.New(t)
+	w, users := createWebAuthn(assert)
+
+	authenticator := register(assert, w, false)
+
+	options, err := w.BeginLogin(testUser)
+	assert.Nil(err)
+
+	response := authenticator.get(options)
+	_, err = w.FinishLogin(testUser, options.Challenge, response)
+	assert.Nil(err)
+
+	credentials, err := users.GetCredentials(testUser)
+	assert.Nil(err)
+	assert.Equal(authenticator.signCount, credentials[0].SignCount)
+
+	// Counter didn't grow, the authenticator could be cloned
+	_, err = w.FinishLogin(testUser, options.Challenge, response)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Authenticators without counters
+	err = w.RemoveCredential(testUser, authenticator.credentialID)
+	assert.Nil(err)
+
+	authenticator = newSoftAuthenticator(testOrigin, false)
+	authenticator.counter = false
+	options2, err := w.BeginRegistration(testUser)
+	assert.Nil(err)
+	_, err = w.FinishRegistration(testUser, options2.User.ID, options2.Challenge, authenticator.create(options2))
+	assert.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		_, err = w.FinishLogin(testUser, options.Challenge, authenticator.get(options))
+		assert.Nil(err)
+	}
+}
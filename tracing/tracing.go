@@ -0,0 +1,111 @@
+// Package tracing traces the login flow with OpenTelemetry.
+//
+// core.IDP traces the calls to Hydra and NewChallenge itself. Providers and stores
+// are traced by wrapping them, e.g. with Provider and UserStore. Spans are children
+// of the incoming request's span, see Handler.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/janekolszak/idp/core"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultServiceName = "idp"
+)
+
+type Config struct {
+	// Defaults to "idp"
+	ServiceName string
+
+	// Receive the finished spans, e.g. OTLP or stdout exporters.
+	// Spans are batched, except with SyncExport.
+	Exporters  []sdktrace.SpanExporter
+	SyncExport bool
+
+	// Fraction of the traces started here that are recorded, defaults to all.
+	// Traces started by the callers follow their decision.
+	SampleRatio float64
+}
+
+// NewProvider creates a TracerProvider for core.IDPConfig and the wrappers.
+// Shut it down before exiting, so the remaining spans are exported.
+func NewProvider(c Config) (*sdktrace.TracerProvider, error) {
+	if len(c.Exporters) == 0 ||
+		c.SampleRatio < 0 ||
+		c.SampleRatio > 1 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.ServiceName == "" {
+		c.ServiceName = defaultServiceName
+	}
+
+	if c.SampleRatio == 0 {
+		c.SampleRatio = 1
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceNameKey.String(c.ServiceName))),
+	}
+
+	for _, exporter := range c.Exporters {
+		if c.SyncExport {
+			options = append(options, sdktrace.WithSyncer(exporter))
+		} else {
+			options = append(options, sdktrace.WithBatcher(exporter))
+		}
+	}
+
+	return sdktrace.NewTracerProvider(options...), nil
+}
+
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(core.TracerName)
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler starts a span for every request. The trace continues the one
+// from the W3C traceparent header, e.g. set by a proxy or Hydra.
+// Nil tp is the global provider.
+func Handler(h http.Handler, tp trace.TracerProvider) http.Handler {
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		// Paths could contain user data
+		ctx, span := tracer(tp).Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.method", r.Method)))
+		defer span.End()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Starts a span for a call of the wrapped component
+func start(ctx context.Context, tp trace.TracerProvider, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer(tp).Start(ctx, name, trace.WithAttributes(attributes...))
+}
@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/providers/form"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_tracing_test.db3"
+
+	// W3C trace context of the caller
+	testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+)
+
+func newTestProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp, err := NewProvider(Config{Exporters: []sdktrace.SpanExporter{exporter}, SyncExport: true})
+	assert.Nil(t, err)
+	return tp, exporter
+}
+
+// Spans by name
+func spans(exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		byName[span.Name] = span
+	}
+	return byName
+}
+
+func TestNewProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewProvider(Config{Exporters: []sdktrace.SpanExporter{tracetest.NewInMemoryExporter()}, SampleRatio: 2})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	tp, err := NewProvider(Config{Exporters: []sdktrace.SpanExporter{tracetest.NewInMemoryExporter()}})
+	assert.Nil(err)
+	assert.Nil(tp.Shutdown(context.Background()))
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	tp, exporter := newTestProvider(t)
+
+	users, err := memory.NewMemStore()
+	assert.Nil(err)
+	assert.Nil(users.Add("bob", "bob123"))
+
+	f, err := form.NewFormAuth(form.Config{
+		LoginForm:          "{{.Msg}}",
+		LoginUsernameField: "username",
+		LoginPasswordField: "password",
+		UserStore:          &UserStore{Store: users, Name: "memory", TracerProvider: tp},
+		Username:           form.Complexity{MinLength: 1, MaxLength: 100},
+		Password:           form.Complexity{MinLength: 1, MaxLength: 100},
+	})
+	assert.Nil(err)
+
+	provider := &Provider{Provider: f, Name: "form", TracerProvider: tp}
+	var challenge string
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := provider.Check(r)
+		assert.Nil(err)
+
+		// Form is still available to the handler
+		challenge = r.FormValue("challenge")
+	}), tp)
+
+	data := url.Values{"username": {"bob"}, "password": {"bob123"}, "challenge": {"abc"}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("traceparent", testTraceParent)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal("abc", challenge)
+
+	byName := spans(exporter)
+	assert.Len(byName, 3)
+
+	server := byName["HTTP POST"]
+	check := byName["provider.Check"]
+	store := byName["userdb.Check"]
+
+	// Continues the caller's trace
+	assert.Equal(testTraceID, server.SpanContext.TraceID().String())
+	assert.Equal(server.SpanContext.SpanID(), check.Parent.SpanID())
+	assert.Equal(check.SpanContext.SpanID(), store.Parent.SpanID())
+	assert.Equal(testTraceID, store.SpanContext.TraceID().String())
+	assert.Equal(codes.Unset, check.Status.Code)
+
+	// Failed login
+	exporter.Reset()
+	data.Set("password", "wrong")
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = provider.Check(r)
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	byName = spans(exporter)
+	assert.Equal(codes.Error, byName["provider.Check"].Status.Code)
+	assert.Equal(codes.Error, byName["userdb.Check"].Status.Code)
+	for _, span := range byName {
+		for _, attribute := range span.Attributes {
+			assert.NotEqual("wrong", attribute.Value.AsString())
+		}
+	}
+}
+
+func TestCookieStore(t *testing.T) {
+	assert := assert.New(t)
+	tp, exporter := newTestProvider(t)
+	os.Remove(testFileName)
+
+	db, err := cookie.NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+	defer db.Close()
+
+	var store cookie.ContextStore = &CookieStore{Store: db, Name: "remember_me", TracerProvider: tp}
+	_, _, _, err = store.GetContext(context.Background(), "unknown")
+	assert.NotNil(err)
+
+	byName := spans(exporter)
+	assert.Equal(codes.Error, byName["cookie.Get"].Status.Code)
+	assert.Equal("remember_me", byName["cookie.Get"].Attributes[0].Value.AsString())
+}
+
+func TestIDP(t *testing.T) {
+	assert := assert.New(t)
+	tp, exporter := newTestProvider(t)
+
+	idp := core.NewIDP(&core.IDPConfig{TracerProvider: tp})
+	defer idp.Close()
+
+	_, err := idp.NewChallenge(httptest.NewRequest("GET", "/", nil), "joe")
+	assert.Equal(core.ErrorBadRequest, err)
+
+	span := spans(exporter)["idp.NewChallenge"]
+	assert.Equal(codes.Error, span.Status.Code)
+}
@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/userdb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Provider traces the wrapped provider's Check and Register.
+// The provider gets the span in the request's context.
+type Provider struct {
+	core.Provider
+
+	// Span attribute, e.g. "form"
+	Name           string
+	TracerProvider trace.TracerProvider
+}
+
+// Copies of the request don't share the parsed form with r, the body could be read only by the copy
+func withContext(ctx context.Context, r *http.Request) *http.Request {
+	r.ParseForm()
+	return r.WithContext(ctx)
+}
+
+func (p *Provider) Check(r *http.Request) (user string, err error) {
+	ctx, span := start(r.Context(), p.TracerProvider, "provider.Check", attribute.String("idp.provider", p.Name))
+	user, err = p.Provider.Check(withContext(ctx, r))
+	end(span, err)
+	return
+}
+
+func (p *Provider) Register(r *http.Request) (user string, err error) {
+	ctx, span := start(r.Context(), p.TracerProvider, "provider.Register", attribute.String("idp.provider", p.Name))
+	user, err = p.Provider.Register(withContext(ctx, r))
+	end(span, err)
+	return
+}
+
+// UserStore traces the calls to the wrapped store, including hashing the passwords
+type UserStore struct {
+	userdb.Store
+
+	// Span attribute, e.g. "rethinkdb"
+	Name           string
+	TracerProvider trace.TracerProvider
+}
+
+func (s *UserStore) Check(username, password string) error {
+	return s.CheckContext(context.Background(), username, password)
+}
+
+func (s *UserStore) Add(username, password string) error {
+	return s.AddContext(context.Background(), username, password)
+}
+
+func (s *UserStore) CheckContext(ctx context.Context, username, password string) (err error) {
+	ctx, span := start(ctx, s.TracerProvider, "userdb.Check", attribute.String("idp.store", s.Name))
+	err = userdb.WithContext(s.Store).CheckContext(ctx, username, password)
+	end(span, err)
+	return
+}
+
+func (s *UserStore) AddContext(ctx context.Context, username, password string) (err error) {
+	ctx, span := start(ctx, s.TracerProvider, "userdb.Add", attribute.String("idp.store", s.Name))
+	err = userdb.WithContext(s.Store).AddContext(ctx, username, password)
+	end(span, err)
+	return
+}
+
+// CookieStore traces the calls to the wrapped store
+type CookieStore struct {
+	cookie.Store
+
+	// Span attribute, e.g. "remember_me"
+	Name           string
+	TracerProvider trace.TracerProvider
+}
+
+func (s *CookieStore) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return start(ctx, s.TracerProvider, "cookie."+operation, attribute.String("idp.store", s.Name))
+}
+
+func (s *CookieStore) Get(selector string) (user string, hash string, expiration time.Time, err error) {
+	return s.GetContext(context.Background(), selector)
+}
+
+func (s *CookieStore) Insert(user, hash string, expiration time.Time) (selector string, err error) {
+	return s.InsertContext(context.Background(), user, hash, expiration)
+}
+
+func (s *CookieStore) Update(selector, user, hash string, expiration time.Time) (err error) {
+	return s.UpdateContext(context.Background(), selector, user, hash, expiration)
+}
+
+func (s *CookieStore) DeleteSelector(selector string) (err error) {
+	return s.DeleteSelectorContext(context.Background(), selector)
+}
+
+func (s *CookieStore) DeleteUser(user string) (err error) {
+	return s.DeleteUserContext(context.Background(), user)
+}
+
+func (s *CookieStore) GetContext(ctx context.Context, selector string) (user string, hash string, expiration time.Time, err error) {
+	ctx, span := s.start(ctx, "Get")
+	user, hash, expiration, err = cookie.WithContext(s.Store).GetContext(ctx, selector)
+	end(span, err)
+	return
+}
+
+func (s *CookieStore) InsertContext(ctx context.Context, user, hash string, expiration time.Time) (selector string, err error) {
+	ctx, span := s.start(ctx, "Insert")
+	selector, err = cookie.WithContext(s.Store).InsertContext(ctx, user, hash, expiration)
+	end(span, err)
+	return
+}
+
+func (s *CookieStore) UpdateContext(ctx context.Context, selector, user, hash string, expiration time.Time) (err error) {
+	ctx, span := s.start(ctx, "Update")
+	err = cookie.WithContext(s.Store).UpdateContext(ctx, selector, user, hash, expiration)
+	end(span, err)
+	return
+}
+
+func (s *CookieStore) DeleteSelectorContext(ctx context.Context, selector string) (err error) {
+	ctx, span := s.start(ctx, "DeleteSelector")
+	err = cookie.WithContext(s.Store).DeleteSelectorContext(ctx, selector)
+	end(span, err)
+	return
+}
+
+// ConsumeSelectorContext fails with core.ErrorNotImplemented if the wrapped store isn't a cookie.Consumer
+func (s *CookieStore) ConsumeSelectorContext(ctx context.Context, selector string) (err error) {
+	ctx, span := s.start(ctx, "ConsumeSelector")
+	if consumer, ok := s.Store.(cookie.Consumer); ok {
+		err = consumer.ConsumeSelectorContext(ctx, selector)
+	} else {
+		err = core.ErrorNotImplemented
+	}
+	end(span, err)
+	return
+}
+
+func (s *CookieStore) DeleteUserContext(ctx context.Context, user string) (err error) {
+	ctx, span := s.start(ctx, "DeleteUser")
+	err = cookie.WithContext(s.Store).DeleteUserContext(ctx, user)
+	end(span, err)
+	return
+}
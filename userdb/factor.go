@@ -0,0 +1,144 @@
+package userdb
+
+import (
+	"context"
+	"time"
+)
+
+// TOTPFactor is the user's time-based one-time password second factor
+type TOTPFactor struct {
+	// Base32 encoded shared key
+	Secret string `json:"secret" gorethink:"secret"`
+
+	// Set after the user confirmed the enrolment with a valid code
+	Enabled bool `json:"enabled" gorethink:"enabled"`
+
+	// Last accepted time step. Codes from it and earlier steps are rejected.
+	LastStep int64 `json:"lastStep" gorethink:"lastStep"`
+
+	// Hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recoveryCodes" gorethink:"recoveryCodes"`
+
+	// Counts accepted codes. Logins waiting for the second factor
+	// are bound to it, so each of them completes only once.
+	Uses int64 `json:"uses" gorethink:"uses"`
+}
+
+// Copy returns a deep copy of the factor
+func (f *TOTPFactor) Copy() *TOTPFactor {
+	if f == nil {
+		return nil
+	}
+
+	result := *f
+	if f.RecoveryCodes != nil {
+		result.RecoveryCodes = append([]string{}, f.RecoveryCodes...)
+	}
+	return &result
+}
+
+// FactorStore keeps users' second factors
+type FactorStore interface {
+	// GetTOTP returns nil if the user has no factor
+	GetTOTP(username string) (*TOTPFactor, error)
+
+	// UpdateTOTP modifies the factor atomically.
+	// update gets nil if there's no factor and returns the new one, nil removes the factor.
+	// An error returned by update aborts the change and is passed to the caller.
+	UpdateTOTP(username string, update func(factor *TOTPFactor) (*TOTPFactor, error)) error
+}
+
+// FactorContextStore is a FactorStore whose calls to the database are canceled with the context
+type FactorContextStore interface {
+	GetTOTPContext(ctx context.Context, username string) (*TOTPFactor, error)
+	UpdateTOTPContext(ctx context.Context, username string, update func(factor *TOTPFactor) (*TOTPFactor, error)) error
+}
+
+// FactorsWithContext returns the store itself if it's a FactorContextStore.
+// Other stores are adapted, they ignore the context.
+func FactorsWithContext(s FactorStore) FactorContextStore {
+	if cs, ok := s.(FactorContextStore); ok {
+		return cs
+	}
+	return factorAdapter{s}
+}
+
+type factorAdapter struct {
+	FactorStore
+}
+
+func (a factorAdapter) GetTOTPContext(ctx context.Context, username string) (*TOTPFactor, error) {
+	return a.GetTOTP(username)
+}
+
+func (a factorAdapter) UpdateTOTPContext(ctx context.Context, username string, update func(factor *TOTPFactor) (*TOTPFactor, error)) error {
+	return a.UpdateTOTP(username, update)
+}
+
+// WebAuthnCredential is a public key credential created by the user's authenticator
+type WebAuthnCredential struct {
+	ID []byte `json:"id" gorethink:"id"`
+
+	// COSE encoded key
+	PublicKey []byte `json:"publicKey" gorethink:"publicKey"`
+
+	// Last counter reported by the authenticator, detects cloned authenticators
+	SignCount uint32 `json:"signCount" gorethink:"signCount"`
+
+	// Identifies the user in authenticators, same for all the user's credentials
+	UserHandle []byte `json:"userHandle" gorethink:"userHandle"`
+
+	Created time.Time `json:"created" gorethink:"created"`
+}
+
+// CredentialStore keeps users' WebAuthn credentials
+type CredentialStore interface {
+	GetCredentials(username string) ([]WebAuthnCredential, error)
+
+	// GetUsernameWithCredentialID returns core.ErrorNoSuchUser if no user has the credential
+	GetUsernameWithCredentialID(id []byte) (string, error)
+
+	// UpdateCredentials modifies the user's credentials atomically.
+	// An error returned by update aborts the change and is passed to the caller.
+	UpdateCredentials(username string, update func(credentials []WebAuthnCredential) ([]WebAuthnCredential, error)) error
+}
+
+// CredentialContextStore is a CredentialStore whose calls to the database are canceled with the context
+type CredentialContextStore interface {
+	GetCredentialsContext(ctx context.Context, username string) ([]WebAuthnCredential, error)
+	GetUsernameWithCredentialIDContext(ctx context.Context, id []byte) (string, error)
+	UpdateCredentialsContext(ctx context.Context, username string, update func(credentials []WebAuthnCredential) ([]WebAuthnCredential, error)) error
+}
+
+// CredentialsWithContext returns the store itself if it's a CredentialContextStore.
+// Other stores are adapted, they ignore the context.
+func CredentialsWithContext(s CredentialStore) CredentialContextStore {
+	if cs, ok := s.(CredentialContextStore); ok {
+		return cs
+	}
+	return credentialAdapter{s}
+}
+
+type credentialAdapter struct {
+	CredentialStore
+}
+
+func (a credentialAdapter) GetCredentialsContext(ctx context.Context, username string) ([]WebAuthnCredential, error) {
+	return a.GetCredentials(username)
+}
+
+func (a credentialAdapter) GetUsernameWithCredentialIDContext(ctx context.Context, id []byte) (string, error) {
+	return a.GetUsernameWithCredentialID(id)
+}
+
+func (a credentialAdapter) UpdateCredentialsContext(ctx context.Context, username string, update func(credentials []WebAuthnCredential) ([]WebAuthnCredential, error)) error {
+	return a.UpdateCredentials(username, update)
+}
+
+// CopyCredentials returns a copy of the slice, so it can be modified
+func CopyCredentials(credentials []WebAuthnCredential) []WebAuthnCredential {
+	if credentials == nil {
+		return nil
+	}
+	return append([]WebAuthnCredential{}, credentials...)
+}
@@ -0,0 +1,113 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/janekolszak/idp/core"
+	"golang.org/x/crypto/argon2"
+)
+
+// Largest memory accepted in hashes, 4 GiB
+const maxArgon2Memory = 4 * 1024 * 1024
+
+// Argon2id uses the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$salt$hash
+type Argon2id struct {
+	// Number of passes, defaults to 3
+	Time uint32
+
+	// Memory in KiB, defaults to 64 MiB
+	Memory uint32
+
+	// Degree of parallelism, defaults to 2
+	Threads uint8
+
+	// Defaults to 16 bytes
+	SaltLength int
+
+	// Defaults to 32 bytes
+	KeyLength uint32
+}
+
+func (a *Argon2id) params() (time, memory uint32, threads uint8, saltLength int, keyLength uint32) {
+	time, memory, threads, saltLength, keyLength = a.Time, a.Memory, a.Threads, a.SaltLength, a.KeyLength
+	if time == 0 {
+		time = 3
+	}
+	if memory == 0 {
+		memory = 64 * 1024
+	}
+	if threads == 0 {
+		threads = 2
+	}
+	if saltLength == 0 {
+		saltLength = 16
+	}
+	if keyLength == 0 {
+		keyLength = 32
+	}
+	return
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	time, memory, threads, saltLength, keyLength := a.params()
+
+	salt, err := newSalt(saltLength)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, keyLength)
+
+	return encodePHC("argon2id", []string{
+		fmt.Sprintf("v=%d", argon2.Version),
+		fmt.Sprintf("m=%d,t=%d,p=%d", memory, time, threads),
+	}, salt, key), nil
+}
+
+func (a *Argon2id) Verify(hash, password string) (needsRehash bool, err error) {
+	p, err := decodePHC("argon2id", hash)
+	if err != nil {
+		return
+	}
+
+	if p.Params["v"] != fmt.Sprint(argon2.Version) {
+		err = core.ErrorUnknownHashFormat
+		return
+	}
+
+	memory, err := p.uint("m", 32)
+	if err != nil {
+		return
+	}
+
+	time, err := p.uint("t", 32)
+	if err != nil {
+		return
+	}
+
+	threads, err := p.uint("p", 8)
+	if err != nil {
+		return
+	}
+
+	// Hashes from the database could make every login slow or crash the server
+	if time < 1 || threads < 1 || memory < 8*threads || memory > maxArgon2Memory {
+		err = core.ErrorUnknownHashFormat
+		return
+	}
+
+	key := argon2.IDKey([]byte(password), p.Salt, uint32(time), uint32(memory), uint8(threads), uint32(len(p.Hash)))
+	if subtle.ConstantTimeCompare(key, p.Hash) != 1 {
+		err = core.ErrorAuthenticationFailure
+		return
+	}
+
+	wantTime, wantMemory, wantThreads, wantSaltLength, wantKeyLength := a.params()
+	needsRehash = uint32(time) != wantTime ||
+		uint32(memory) != wantMemory ||
+		uint8(threads) != wantThreads ||
+		len(p.Salt) != wantSaltLength ||
+		uint32(len(p.Hash)) != wantKeyLength
+	return
+}
@@ -0,0 +1,52 @@
+package hasher
+
+import (
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt uses the modular crypt format: $2a$cost$saltandhash
+type Bcrypt struct {
+	// Defaults to bcrypt.DefaultCost
+	Cost int
+}
+
+func (b *Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *Bcrypt) Verify(hash, password string) (needsRehash bool, err error) {
+	if !strings.HasPrefix(hash, "$2a$") &&
+		!strings.HasPrefix(hash, "$2b$") &&
+		!strings.HasPrefix(hash, "$2y$") {
+		err = core.ErrorUnknownHashFormat
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		err = core.ErrorAuthenticationFailure
+		return
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return
+	}
+
+	needsRehash = cost != b.cost()
+	return
+}
@@ -0,0 +1,41 @@
+package hasher
+
+import (
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+)
+
+// Chain hashes new passwords with the first hasher and verifies hashes
+// created by any of them. A hash verified by other than the first hasher
+// is reported as needing a rehash, so stored hashes migrate on login.
+type Chain []userdb.PasswordHasher
+
+// NewDefault hashes with bcrypt and still verifies argon2id and scrypt hashes
+func NewDefault() Chain {
+	return Chain{&Bcrypt{}, &Argon2id{}, &Scrypt{}}
+}
+
+func (c Chain) Hash(password string) (string, error) {
+	if len(c) == 0 {
+		return "", core.ErrorInvalidConfig
+	}
+
+	return c[0].Hash(password)
+}
+
+func (c Chain) Verify(hash, password string) (needsRehash bool, err error) {
+	for i, h := range c {
+		needsRehash, err = h.Verify(hash, password)
+		if err == core.ErrorUnknownHashFormat {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return needsRehash || i != 0, nil
+	}
+
+	return false, core.ErrorUnknownHashFormat
+}
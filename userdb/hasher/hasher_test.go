@@ -0,0 +1,176 @@
+package hasher
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Cheap parameters to keep tests fast
+func testHashers() map[string]userdb.PasswordHasher {
+	return map[string]userdb.PasswordHasher{
+		"$2a$":       &Bcrypt{Cost: 4},
+		"$argon2id$": &Argon2id{Time: 1, Memory: 64, Threads: 1},
+		"$scrypt$":   &Scrypt{LogN: 4},
+	}
+}
+
+func TestHashVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	for prefix, h := range testHashers() {
+		hash, err := h.Hash("password")
+		assert.Nil(err)
+		assert.True(strings.HasPrefix(hash, prefix), hash)
+
+		// Salted
+		other, err := h.Hash("password")
+		assert.Nil(err)
+		assert.NotEqual(hash, other)
+
+		needsRehash, err := h.Verify(hash, "password")
+		assert.Nil(err, prefix)
+		assert.False(needsRehash, prefix)
+
+		_, err = h.Verify(hash, "badpassword")
+		assert.Equal(core.ErrorAuthenticationFailure, err, prefix)
+
+		_, err = h.Verify("hash", "password")
+		assert.Equal(core.ErrorUnknownHashFormat, err, prefix)
+	}
+}
+
+func TestOtherFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	hashers := testHashers()
+	for prefix, h := range hashers {
+		hash, err := h.Hash("password")
+		assert.Nil(err)
+
+		for otherPrefix, other := range hashers {
+			if otherPrefix == prefix {
+				continue
+			}
+			_, err = other.Verify(hash, "password")
+			assert.Equal(core.ErrorUnknownHashFormat, err, otherPrefix+" verifying "+prefix)
+		}
+	}
+}
+
+func TestKnownHashes(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reference value from Python's hashlib.scrypt
+	needsRehash, err := (&Scrypt{LogN: 4, R: 8, P: 1, SaltLength: 8, KeyLength: 32}).Verify(
+		"$scrypt$ln=4,r=8,p=1$c29tZXNhbHQ$7xe5L3Roj67jYaBKf3ePT2Y6rVHHGUWO44Z8iz+O6PQ", "password")
+	assert.Nil(err)
+	assert.False(needsRehash)
+}
+
+func TestBadParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		hasher userdb.PasswordHasher
+		hash   string
+	}{
+		{&Argon2id{}, "$argon2id$v=19$m=64,t=0,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Argon2id{}, "$argon2id$v=19$m=64,t=1,p=0$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Argon2id{}, "$argon2id$v=19$m=7,t=1,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Argon2id{}, "$argon2id$v=19$m=64,t=1,p=9$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Argon2id{}, "$argon2id$v=19$m=4194305,t=1,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Argon2id{}, "$argon2id$v=19$m=4294967295,t=1,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Scrypt{}, "$scrypt$ln=0,r=8,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Scrypt{}, "$scrypt$ln=21,r=8,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+		{&Scrypt{}, "$scrypt$ln=63,r=8,p=1$c29tZXNhbHQ$c29tZWhhc2g"},
+	}
+
+	for _, test := range tests {
+		_, err := test.hasher.Verify(test.hash, "password")
+		assert.Equal(core.ErrorUnknownHashFormat, err, test.hash)
+	}
+}
+
+func TestOutdatedParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	old := map[userdb.PasswordHasher]userdb.PasswordHasher{
+		&Bcrypt{Cost: 4}: &Bcrypt{Cost: 5},
+		&Argon2id{Time: 1, Memory: 64, Threads: 1}: &Argon2id{Time: 2, Memory: 64, Threads: 1},
+		&Scrypt{LogN: 4}: &Scrypt{LogN: 5},
+		&Argon2id{Time: 1, Memory: 64, Threads: 1, KeyLength: 16}: &Argon2id{Time: 1, Memory: 64, Threads: 1},
+	}
+
+	for oldHasher, newHasher := range old {
+		hash, err := oldHasher.Hash("password")
+		assert.Nil(err)
+
+		needsRehash, err := newHasher.Verify(hash, "password")
+		assert.Nil(err)
+		assert.True(needsRehash, hash)
+	}
+}
+
+func TestChain(t *testing.T) {
+	assert := assert.New(t)
+
+	bcrypt := &Bcrypt{Cost: 4}
+	argon := &Argon2id{Time: 1, Memory: 64, Threads: 1}
+	chain := Chain{argon, bcrypt}
+
+	hash, err := chain.Hash("password")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(hash, "$argon2id$"))
+
+	needsRehash, err := chain.Verify(hash, "password")
+	assert.Nil(err)
+	assert.False(needsRehash)
+
+	// Old algorithm gets migrated
+	hash, err = bcrypt.Hash("password")
+	assert.Nil(err)
+
+	needsRehash, err = chain.Verify(hash, "password")
+	assert.Nil(err)
+	assert.True(needsRehash)
+
+	needsRehash, err = chain.Verify(hash, "badpassword")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.False(needsRehash)
+
+	_, err = chain.Verify("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password")
+	assert.Equal(core.ErrorUnknownHashFormat, err)
+
+	_, err = Chain{}.Hash("password")
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+// Remembers the verified hashes
+type recordingHasher struct {
+	*Bcrypt
+	verified []string
+}
+
+func (h *recordingHasher) Verify(hash, password string) (bool, error) {
+	h.verified = append(h.verified, hash)
+	return h.Bcrypt.Verify(hash, password)
+}
+
+func TestDummy(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &recordingHasher{Bcrypt: &Bcrypt{Cost: 4}}
+
+	var d Dummy
+	d.Verify(h, "password")
+	d.Verify(h, "other")
+
+	// A real hash of the hasher, created once
+	assert.Len(h.verified, 2)
+	assert.True(strings.HasPrefix(h.verified[0], "$2a$04$"), h.verified[0])
+	assert.Equal(h.verified[0], h.verified[1])
+}
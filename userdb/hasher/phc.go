@@ -0,0 +1,87 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Decoded PHC string: $id$param=value,...$salt$hash
+type phc struct {
+	ID     string
+	Params map[string]string
+	Salt   []byte
+	Hash   []byte
+}
+
+// Encodes the hash in the PHC string format, params are kept in the given order
+func encodePHC(id string, params []string, salt, hash []byte) string {
+	return "$" + id +
+		"$" + strings.Join(params, ",") +
+		"$" + base64.RawStdEncoding.EncodeToString(salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(hash)
+}
+
+func decodePHC(id, encoded string) (*phc, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 5 || parts[0] != "" || parts[1] != id {
+		return nil, core.ErrorUnknownHashFormat
+	}
+
+	p := &phc{
+		ID:     parts[1],
+		Params: make(map[string]string),
+	}
+
+	// Optional version field, e.g. $argon2id$v=19$m=...
+	fields := parts[2:]
+	if len(fields) == 4 {
+		p.Params["v"] = strings.TrimPrefix(fields[0], "v=")
+		fields = fields[1:]
+	}
+
+	if len(fields) != 3 {
+		return nil, core.ErrorUnknownHashFormat
+	}
+
+	for _, param := range strings.Split(fields[0], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, core.ErrorUnknownHashFormat
+		}
+		p.Params[kv[0]] = kv[1]
+	}
+
+	var err error
+	p.Salt, err = base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, core.ErrorUnknownHashFormat
+	}
+
+	p.Hash, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(p.Hash) == 0 {
+		return nil, core.ErrorUnknownHashFormat
+	}
+
+	return p, nil
+}
+
+func (p *phc) uint(name string, bitSize int) (uint64, error) {
+	value, err := strconv.ParseUint(p.Params[name], 10, bitSize)
+	if err != nil {
+		return 0, core.ErrorUnknownHashFormat
+	}
+	return value, nil
+}
+
+func newSalt(length int) ([]byte, error) {
+	salt := make([]byte, length)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
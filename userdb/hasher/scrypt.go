@@ -0,0 +1,114 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/janekolszak/idp/core"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Largest cost accepted in hashes, 2^20 takes 1 GiB with r=8
+const maxScryptLogN = 20
+
+// Scrypt uses the PHC string format: $scrypt$ln=15,r=8,p=1$salt$hash
+type Scrypt struct {
+	// CPU/memory cost is 2^LogN, defaults to 15
+	LogN uint8
+
+	// Block size, defaults to 8
+	R int
+
+	// Parallelization, defaults to 1
+	P int
+
+	// Defaults to 16 bytes
+	SaltLength int
+
+	// Defaults to 32 bytes
+	KeyLength int
+}
+
+func (s *Scrypt) params() (logN uint8, r, p, saltLength, keyLength int) {
+	logN, r, p, saltLength, keyLength = s.LogN, s.R, s.P, s.SaltLength, s.KeyLength
+	if logN == 0 {
+		logN = 15
+	}
+	if r == 0 {
+		r = 8
+	}
+	if p == 0 {
+		p = 1
+	}
+	if saltLength == 0 {
+		saltLength = 16
+	}
+	if keyLength == 0 {
+		keyLength = 32
+	}
+	return
+}
+
+func (s *Scrypt) Hash(password string) (string, error) {
+	logN, r, p, saltLength, keyLength := s.params()
+
+	salt, err := newSalt(saltLength)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, keyLength)
+	if err != nil {
+		return "", err
+	}
+
+	return encodePHC("scrypt", []string{
+		fmt.Sprintf("ln=%d,r=%d,p=%d", logN, r, p),
+	}, salt, key), nil
+}
+
+func (s *Scrypt) Verify(hash, password string) (needsRehash bool, err error) {
+	p, err := decodePHC("scrypt", hash)
+	if err != nil {
+		return
+	}
+
+	logN, err := p.uint("ln", 6)
+	if err != nil {
+		return
+	}
+
+	r, err := p.uint("r", 31)
+	if err != nil {
+		return
+	}
+
+	parallel, err := p.uint("p", 31)
+	if err != nil {
+		return
+	}
+
+	// Cost comes from the stored hash, a huge one would exhaust the memory
+	if logN < 1 || logN > maxScryptLogN {
+		err = core.ErrorUnknownHashFormat
+		return
+	}
+
+	key, err := scrypt.Key([]byte(password), p.Salt, 1<<logN, int(r), int(parallel), len(p.Hash))
+	if err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare(key, p.Hash) != 1 {
+		err = core.ErrorAuthenticationFailure
+		return
+	}
+
+	wantLogN, wantR, wantP, wantSaltLength, wantKeyLength := s.params()
+	needsRehash = uint8(logN) != wantLogN ||
+		int(r) != wantR ||
+		int(parallel) != wantP ||
+		len(p.Salt) != wantSaltLength ||
+		len(p.Hash) != wantKeyLength
+	return
+}
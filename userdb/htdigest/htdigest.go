@@ -0,0 +1,265 @@
+package htdigest
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+)
+
+// Digest algorithms, as named in RFC 7616
+const (
+	MD5    = "MD5"
+	SHA256 = "SHA-256"
+)
+
+// NewHash returns the hash function of the algorithm, nil if it's unknown
+func NewHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case MD5:
+		return md5.New()
+	case SHA256:
+		return sha256.New()
+	default:
+		return nil
+	}
+}
+
+// H is the hex encoded hash of the data, empty for unknown algorithms
+func H(algorithm, data string) string {
+	h := NewHash(algorithm)
+	if h == nil {
+		return ""
+	}
+
+	io.WriteString(h, data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HA1 is the hash stored in the file
+func HA1(algorithm, user, realm, password string) string {
+	return H(algorithm, user+":"+realm+":"+password)
+}
+
+// Entry identifies a hash in the file
+type Entry struct {
+	User      string
+	Realm     string
+	Algorithm string
+}
+
+// Parse reads entries in the "user:realm:hash" format. Lines starting with # are comments.
+// The hash is HA1 of the user's password, its length tells the algorithm.
+// The htdigest tool writes MD5 hashes, a user can have a SHA-256 one in another line.
+func Parse(reader io.Reader) (map[Entry]string, error) {
+	r := csv.NewReader(bufio.NewReader(reader))
+	r.Comment = '#'
+	r.Comma = ':'
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = 3
+
+	hashes := make(map[Entry]string)
+	for {
+		fields, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return hashes, nil
+			}
+
+			return nil, err
+		}
+
+		_, err = hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, err
+		}
+
+		e := Entry{User: fields[0], Realm: fields[1]}
+		switch len(fields[2]) {
+		case 2 * md5.Size:
+			e.Algorithm = MD5
+		case 2 * sha256.Size:
+			e.Algorithm = SHA256
+		default:
+			return nil, core.ErrorInvalidConfig
+		}
+
+		hashes[e] = strings.ToLower(fields[2])
+	}
+}
+
+// Htdigest holds credentials loaded from an htdigest file.
+// The data is swapped atomically when the file is reloaded,
+// so lookups never see a partially loaded file.
+type Htdigest struct {
+	// map[Entry]string
+	hashes atomic.Value
+
+	// Optional, reports files that couldn't be reloaded
+	Logger logging.Logger
+
+	mtx      sync.Mutex
+	filename string
+	modTime  time.Time
+	size     int64
+
+	stop      chan bool
+	waitGroup sync.WaitGroup
+}
+
+func (h *Htdigest) Load(filename string) error {
+	return h.load(filename, true)
+}
+
+// The watcher doesn't accept an empty file, it's most likely being written
+func (h *Htdigest) load(filename string, allowEmpty bool) error {
+	f, err := os.OpenFile(filename, os.O_RDONLY, os.ModeExclusive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := Parse(f)
+	if err != nil {
+		return err
+	}
+
+	if len(hashes) == 0 && !allowEmpty {
+		return io.ErrUnexpectedEOF
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.filename = filename
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.hashes.Store(hashes)
+
+	return nil
+}
+
+// Get returns the user's HA1 hash computed with the algorithm
+func (h *Htdigest) Get(user, realm, algorithm string) (string, error) {
+	hashes, _ := h.hashes.Load().(map[Entry]string)
+
+	hash, ok := hashes[Entry{User: user, Realm: realm, Algorithm: algorithm}]
+	if !ok {
+		return "", core.ErrorNoSuchUser
+	}
+
+	return hash, nil
+}
+
+// Watch checks the loaded file every interval and reloads it when it changes.
+// The file is reloaded once it stays the same for a whole interval, so a file
+// that is being written isn't loaded. An empty file is never loaded.
+// If the new content can't be loaded the previous one is kept.
+func (h *Htdigest) Watch(interval time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.stop != nil {
+		// Already watching
+		return
+	}
+
+	h.stop = make(chan bool)
+	h.waitGroup.Add(1)
+	go h.watch(interval, h.stop)
+}
+
+// Close stops watching the file
+func (h *Htdigest) Close() {
+	h.mtx.Lock()
+	stop := h.stop
+	h.stop = nil
+	h.mtx.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	h.waitGroup.Wait()
+}
+
+func (h *Htdigest) watch(interval time.Duration, stop chan bool) {
+	defer h.waitGroup.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Change seen in the previous tick
+	var pending os.FileInfo
+	for {
+		select {
+		case <-ticker.C:
+			info := h.changed()
+			if info == nil {
+				pending = nil
+				continue
+			}
+
+			if pending == nil || !info.ModTime().Equal(pending.ModTime()) || info.Size() != pending.Size() {
+				// Still being written, or just changed
+				pending = info
+				continue
+			}
+			pending = nil
+
+			h.mtx.Lock()
+			filename := h.filename
+			h.mtx.Unlock()
+
+			// The previous content is kept, the file will be checked again in the next tick
+			err := h.load(filename, false)
+			if err != nil {
+				logging.Warn(context.Background(), h.Logger, "reloading the htdigest file failed", logging.Fields{
+					"file":  filename,
+					"error": err,
+				})
+			} else {
+				logging.Info(context.Background(), h.Logger, "htdigest file reloaded", logging.Fields{"file": filename})
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Returns the file's info if it differs from the loaded one
+func (h *Htdigest) changed() os.FileInfo {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		// File is being replaced
+		return nil
+	}
+
+	if info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+
+	return info
+}
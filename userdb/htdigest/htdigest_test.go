@@ -0,0 +1,133 @@
+package htdigest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	htdigestTestFileName = "/tmp/idp_htdigest_test"
+
+	htdigestFileContents = `# Comment
+	                user1:realm:9c5ac8a0b4bc96da8a0c61a4bab5d8ec
+	                user1:realm:4e4e9cd2f52e1d78be7bc5c5c31aa7b0c5e8a0e25e7da3ea2e3f2f74b9ae1b4c
+	                user2:realm:8D0C3F5B2A6AE46A5CC2B8EDF7C58B4A
+	                user2:other:8d0c3f5b2a6ae46a5cc2b8edf7c58b4a`
+)
+
+func TestH(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 7616, 3.9.1
+	assert.Equal("7987c64c30e25f1b74be53f966b49b90f2808aa92faf9a00262392d7b4794232",
+		HA1(SHA256, "Mufasa", "http-auth@example.org", "Circle of Life"))
+	assert.Equal("3d78807defe7de2157e2b0b6573a855f",
+		HA1(MD5, "Mufasa", "http-auth@example.org", "Circle of Life"))
+
+	assert.Equal("", H("SHA-512-256", "data"))
+}
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	hashes, err := Parse(strings.NewReader(htdigestFileContents))
+	assert.Nil(err)
+	assert.Len(hashes, 4)
+	assert.Equal("8d0c3f5b2a6ae46a5cc2b8edf7c58b4a", hashes[Entry{User: "user2", Realm: "realm", Algorithm: MD5}])
+
+	_, err = Parse(strings.NewReader("user1:realm:hash"))
+	assert.NotNil(err)
+
+	_, err = Parse(strings.NewReader("user1:realm:abcd"))
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = Parse(strings.NewReader("user1:hash"))
+	assert.NotNil(err)
+}
+
+func TestHtdigest(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(htdigestTestFileName, []byte(htdigestFileContents), 0644)
+	assert.Nil(err)
+
+	var h Htdigest
+
+	_, err = h.Get("user1", "realm", MD5)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = h.Load(htdigestTestFileName)
+	assert.Nil(err)
+
+	hash, err := h.Get("user1", "realm", MD5)
+	assert.Nil(err)
+	assert.Equal("9c5ac8a0b4bc96da8a0c61a4bab5d8ec", hash)
+
+	hash, err = h.Get("user1", "realm", SHA256)
+	assert.Nil(err)
+	assert.Len(hash, 64)
+
+	_, err = h.Get("user2", "realm", SHA256)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	_, err = h.Get("user1", "other", MD5)
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestHtdigestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(htdigestTestFileName, []byte(htdigestFileContents), 0644)
+	assert.Nil(err)
+
+	var h Htdigest
+	err = h.Load(htdigestTestFileName)
+	assert.Nil(err)
+
+	h.Watch(10 * time.Millisecond)
+	defer h.Close()
+
+	// Replace the file
+	tmpFileName := htdigestTestFileName + ".new"
+	err = ioutil.WriteFile(tmpFileName, []byte("user3:realm:"+HA1(MD5, "user3", "realm", "password")), 0644)
+	assert.Nil(err)
+	err = os.Rename(tmpFileName, htdigestTestFileName)
+	assert.Nil(err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = h.Get("user3", "realm", MD5); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(err)
+
+	_, err = h.Get("user1", "realm", MD5)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// Broken file doesn't replace the loaded data
+	err = ioutil.WriteFile(tmpFileName, []byte("user1:hash"), 0644)
+	assert.Nil(err)
+	err = os.Rename(tmpFileName, htdigestTestFileName)
+	assert.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = h.Get("user3", "realm", MD5)
+	assert.Nil(err)
+
+	// Neither does a file truncated by a writer
+	err = ioutil.WriteFile(htdigestTestFileName, nil, 0644)
+	assert.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = h.Get("user3", "realm", MD5)
+	assert.Nil(err)
+
+	// Stopping twice is fine
+	h.Close()
+}
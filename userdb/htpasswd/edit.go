@@ -0,0 +1,130 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const lockSuffix = ".lock"
+
+// ValidUser checks that the name can be written to the file
+func ValidUser(user string) bool {
+	return user != "" &&
+		!strings.HasPrefix(user, "#") &&
+		!strings.ContainsAny(user, ": \t\r\n\"")
+}
+
+// Returns the user of the entry, "" for comments and empty lines
+func lineUser(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return ""
+	}
+	return line[:i]
+}
+
+// Edit replaces the user's hash with the one returned by edit, which gets
+// the current hash or "" if the user has no entry. Returning "" removes the entry.
+// The file is created if it doesn't exist. It's replaced atomically,
+// so Watch never loads it partially written, and other lines, including comments, are kept.
+// Concurrent edits, also by other processes, wait for each other on the filename.lock file.
+func Edit(filename, user string, edit func(hash string) (string, error)) error {
+	if !ValidUser(user) {
+		return core.ErrorBadRequest
+	}
+
+	unlock, err := lock(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	info, err := os.Stat(filename)
+	if err == nil {
+		mode = info.Mode()
+	}
+
+	hashes, err := Parse(strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+
+	hash, err := edit(hashes[user])
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		if lineUser(line) != user {
+			lines = append(lines, line)
+			continue
+		}
+
+		if hash != "" && !found {
+			lines = append(lines, user+":"+hash)
+		}
+		found = true
+	}
+
+	// Split leaves an empty string after the last newline
+	if len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if hash != "" && !found {
+		lines = append(lines, user+":"+hash)
+	}
+
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+
+	return writeFile(filename, []byte(content), mode)
+}
+
+// Writes a temporary file in the same directory and renames it
+func writeFile(filename string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), filename)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
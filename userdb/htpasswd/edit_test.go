@@ -0,0 +1,91 @@
+package htpasswd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+const editTestFileName = "/tmp/idp_htpasswd_edit_test"
+
+func set(hash string) func(string) (string, error) {
+	return func(string) (string, error) { return hash, nil }
+}
+
+func TestEdit(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(editTestFileName)
+
+	// Created
+	assert.Nil(Edit(editTestFileName, "user1", set("hash1")))
+	assert.Nil(Edit(editTestFileName, "user2", set("hash2")))
+
+	info, err := os.Stat(editTestFileName)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode())
+
+	// Comments, the order and the mode are kept
+	os.Remove(editTestFileName)
+	err = ioutil.WriteFile(editTestFileName, []byte("# Comment\nuser1:hash1\n  user2:hash2\nuser3:hash3"), 0644)
+	assert.Nil(err)
+
+	var current string
+	err = Edit(editTestFileName, "user2", func(hash string) (string, error) {
+		current = hash
+		return "new", nil
+	})
+	assert.Nil(err)
+	assert.Equal("hash2", current)
+
+	assert.Nil(Edit(editTestFileName, "user1", set("")))
+	assert.Nil(Edit(editTestFileName, "user4", set("hash4")))
+
+	data, err := ioutil.ReadFile(editTestFileName)
+	assert.Nil(err)
+	assert.Equal("# Comment\nuser2:new\nuser3:hash3\nuser4:hash4\n", string(data))
+
+	info, err = os.Stat(editTestFileName)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0644), info.Mode())
+
+	// Nothing is written
+	failed := errors.New("failed")
+	assert.Equal(failed, Edit(editTestFileName, "user3", func(string) (string, error) { return "", failed }))
+	assert.Equal(core.ErrorBadRequest, Edit(editTestFileName, "user:5", set("hash")))
+	assert.Equal(core.ErrorBadRequest, Edit(editTestFileName, "#user", set("hash")))
+
+	var h Htpasswd
+	assert.Nil(h.Load(editTestFileName))
+	hash, err := h.Get("user3")
+	assert.Nil(err)
+	assert.Equal("hash3", hash)
+}
+
+func TestEditConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(editTestFileName)
+
+	// Each edit opens the lock file, like another process would
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(Edit(editTestFileName, fmt.Sprintf("user%d", i), set("hash")))
+		}(i)
+	}
+	wg.Wait()
+
+	var h Htpasswd
+	assert.Nil(h.Load(editTestFileName))
+	for i := 0; i < 20; i++ {
+		_, err := h.Get(fmt.Sprintf("user%d", i))
+		assert.Nil(err)
+	}
+}
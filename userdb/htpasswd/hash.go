@@ -0,0 +1,110 @@
+package htpasswd
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/janekolszak/idp/core"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hash formats produced by the htpasswd tool
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatBcrypt
+	FormatAPR1
+	FormatMD5Crypt
+	FormatSHA1
+	FormatCrypt
+)
+
+// Used for comparison when there's no such user, "password" hashed with cost 5
+const dummyHash = "$2y$05$oHxU0ruGKexixZrm6uDFMOtSFKQIpesi.iW/K6CY/2fcwwZ7F13TK"
+
+func (f Format) String() string {
+	switch f {
+	case FormatBcrypt:
+		return "bcrypt"
+	case FormatAPR1:
+		return "apr1"
+	case FormatMD5Crypt:
+		return "md5-crypt"
+	case FormatSHA1:
+		return "sha1"
+	case FormatCrypt:
+		return "crypt"
+	default:
+		return "unknown"
+	}
+}
+
+// IsWeak is true for formats that are cheap to brute force
+func (f Format) IsWeak() bool {
+	return f != FormatBcrypt
+}
+
+// Identify recognizes the format of the hash
+func Identify(hash string) Format {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"),
+		strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"):
+		return FormatBcrypt
+
+	case strings.HasPrefix(hash, apr1Magic):
+		return FormatAPR1
+
+	case strings.HasPrefix(hash, md5CryptMagic):
+		return FormatMD5Crypt
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		return FormatSHA1
+
+	case len(hash) == 13 && isCryptSalt(hash[:2]):
+		return FormatCrypt
+
+	default:
+		return FormatUnknown
+	}
+}
+
+// Compare checks if the password matches the hash in any of the supported formats
+func Compare(hash, password string) error {
+	var computed string
+
+	switch Identify(hash) {
+	case FormatBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			return core.ErrorAuthenticationFailure
+		}
+		return nil
+
+	case FormatAPR1:
+		computed = md5Crypt(password, hash, apr1Magic)
+
+	case FormatMD5Crypt:
+		computed = md5Crypt(password, hash, md5CryptMagic)
+
+	case FormatSHA1:
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+
+	case FormatCrypt:
+		computed = desCrypt(password, hash[:2])
+
+	default:
+		return core.ErrorAuthenticationFailure
+	}
+
+	// Prevents timing atack
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return core.ErrorAuthenticationFailure
+	}
+
+	return nil
+}
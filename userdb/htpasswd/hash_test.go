@@ -0,0 +1,53 @@
+package htpasswd
+
+import (
+	"testing"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+var hashTests = []struct {
+	password string
+	hash     string
+	format   Format
+}{
+	{"password", "$2y$05$oHxU0ruGKexixZrm6uDFMOtSFKQIpesi.iW/K6CY/2fcwwZ7F13TK", FormatBcrypt},
+	{"password", "$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1", FormatAPR1},
+	{"secret", "$apr1$xy12$630IYUQy/qI1epIqojrUp0", FormatAPR1},
+	{"password", "$1$abcdefgh$G//4keteveJp0qb8z2DxG/", FormatMD5Crypt},
+	{"averylongpasswordthatexceedssixteenbytes", "$1$saltstri$vm6tZGzoSiXl34oXNoTd/1", FormatMD5Crypt},
+	{"password", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", FormatSHA1},
+	{"password", "abJnggxhB/yWI", FormatCrypt},
+	{"secret12345", "ZzJEIbCXrxYKA", FormatCrypt},
+	{"a", "./xT2u5QYaHcU", FormatCrypt},
+}
+
+func TestIdentify(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range hashTests {
+		assert.Equal(test.format, Identify(test.hash), test.hash)
+	}
+
+	assert.Equal(FormatUnknown, Identify("hash"))
+	assert.Equal(FormatUnknown, Identify("!plaintext123"))
+
+	assert.False(FormatBcrypt.IsWeak())
+	assert.True(FormatCrypt.IsWeak())
+}
+
+func TestCompare(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range hashTests {
+		assert.Nil(Compare(test.hash, test.password), test.hash)
+		assert.Equal(core.ErrorAuthenticationFailure, Compare(test.hash, "x"+test.password), test.hash)
+	}
+
+	// Only 8 characters are significant in crypt
+	assert.Nil(Compare("ZzJEIbCXrxYKA", "secret12"))
+
+	assert.Equal(core.ErrorAuthenticationFailure, Compare("hash", "hash"))
+	assert.Equal(core.ErrorAuthenticationFailure, Compare("", ""))
+}
@@ -0,0 +1,219 @@
+package htpasswd
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+)
+
+// Parse reads entries in the "user:hash" format. Lines starting with # are comments.
+func Parse(reader io.Reader) (map[string]string, error) {
+	r := csv.NewReader(bufio.NewReader(reader))
+	r.Comment = '#'
+	r.Comma = ':'
+	r.TrimLeadingSpace = true
+	r.FieldsPerRecord = 2
+
+	hashes := make(map[string]string)
+	for {
+		fields, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return hashes, nil
+			}
+
+			return nil, err
+		}
+
+		hashes[fields[0]] = fields[1]
+	}
+}
+
+// Htpasswd holds credentials loaded from an htpasswd file.
+// The data is swapped atomically when the file is reloaded,
+// so checks never see a partially loaded file.
+type Htpasswd struct {
+	// Fail checks of entries hashed with SHA1, MD5 or crypt
+	RejectWeak bool
+
+	// map[string]string
+	hashes atomic.Value
+
+	// Optional, reports files that couldn't be reloaded
+	Logger logging.Logger
+
+	mtx      sync.Mutex
+	filename string
+	modTime  time.Time
+	size     int64
+
+	stop      chan bool
+	waitGroup sync.WaitGroup
+}
+
+func (h *Htpasswd) Load(filename string) error {
+	return h.load(filename, true)
+}
+
+// The watcher doesn't accept an empty file, it's most likely being written
+func (h *Htpasswd) load(filename string, allowEmpty bool) error {
+	f, err := os.OpenFile(filename, os.O_RDONLY, os.ModeExclusive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := Parse(f)
+	if err != nil {
+		return err
+	}
+
+	if len(hashes) == 0 && !allowEmpty {
+		return io.ErrUnexpectedEOF
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.filename = filename
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.hashes.Store(hashes)
+
+	return nil
+}
+
+func (h *Htpasswd) Get(user string) (string, error) {
+	hashes, _ := h.hashes.Load().(map[string]string)
+
+	hash, ok := hashes[user]
+	if !ok {
+		return "", core.ErrorNoSuchUser
+	}
+
+	return hash, nil
+}
+
+func (h *Htpasswd) Check(user, password string) error {
+	hash, err := h.Get(user)
+	if err != nil {
+		// Prevent timing attack
+		Compare(dummyHash, password)
+		return err
+	}
+
+	if h.RejectWeak && Identify(hash).IsWeak() {
+		return core.ErrorAuthenticationFailure
+	}
+
+	return Compare(hash, password)
+}
+
+// Watch checks the loaded file every interval and reloads it when it changes.
+// The file is reloaded once it stays the same for a whole interval, so a file
+// that is being written isn't loaded. An empty file is never loaded.
+// If the new content can't be loaded the previous one is kept.
+func (h *Htpasswd) Watch(interval time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.stop != nil {
+		// Already watching
+		return
+	}
+
+	h.stop = make(chan bool)
+	h.waitGroup.Add(1)
+	go h.watch(interval, h.stop)
+}
+
+// Close stops watching the file
+func (h *Htpasswd) Close() {
+	h.mtx.Lock()
+	stop := h.stop
+	h.stop = nil
+	h.mtx.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	h.waitGroup.Wait()
+}
+
+func (h *Htpasswd) watch(interval time.Duration, stop chan bool) {
+	defer h.waitGroup.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Change seen in the previous tick
+	var pending os.FileInfo
+	for {
+		select {
+		case <-ticker.C:
+			info := h.changed()
+			if info == nil {
+				pending = nil
+				continue
+			}
+
+			if pending == nil || !info.ModTime().Equal(pending.ModTime()) || info.Size() != pending.Size() {
+				// Still being written, or just changed
+				pending = info
+				continue
+			}
+			pending = nil
+
+			h.mtx.Lock()
+			filename := h.filename
+			h.mtx.Unlock()
+
+			// The previous content is kept, the file will be checked again in the next tick
+			err := h.load(filename, false)
+			if err != nil {
+				logging.Warn(context.Background(), h.Logger, "reloading the htpasswd file failed", logging.Fields{
+					"file":  filename,
+					"error": err,
+				})
+			} else {
+				logging.Info(context.Background(), h.Logger, "htpasswd file reloaded", logging.Fields{"file": filename})
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Returns the file's info if it differs from the loaded one
+func (h *Htpasswd) changed() os.FileInfo {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		// File is being replaced
+		return nil
+	}
+
+	if info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+
+	return info
+}
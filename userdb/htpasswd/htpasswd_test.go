@@ -0,0 +1,161 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	htpasswdTestFileName = "/tmp/idp_htpasswd_test"
+	htpasswdFileContents = `# Comment
+							user1:hash
+							user2:hash
+							user3:hash
+							user4:hash`
+
+	htpasswdFormatsFileName     = "/tmp/idp_htpasswd_formats_test"
+	htpasswdFormatsFileContents = `# All formats, every password is "password"
+	                bcrypt:$2y$05$oHxU0ruGKexixZrm6uDFMOtSFKQIpesi.iW/K6CY/2fcwwZ7F13TK
+	                apr1:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1
+	                md5:$1$abcdefgh$G//4keteveJp0qb8z2DxG/
+	                sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+	                crypt:abJnggxhB/yWI`
+)
+
+var htpasswdUsers = []string{"user1", "user2", "user3", "user4"}
+
+var formatUsers = []string{"bcrypt", "apr1", "md5", "sha", "crypt"}
+
+func TestHtpasswd(t *testing.T) {
+	assert := assert.New(t)
+
+	// Prepare file
+	err := ioutil.WriteFile(htpasswdTestFileName, []byte(htpasswdFileContents), 0644)
+	assert.Nil(err)
+
+	// Load passwords
+	var h Htpasswd
+
+	err = h.Load(htpasswdTestFileName)
+	assert.Nil(err)
+
+	for _, user := range htpasswdUsers {
+		hash, err := h.Get(user)
+		assert.Nil(err)
+		assert.Equal(hash, "hash", "Bad password")
+	}
+
+	_, err = h.Get("user5")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestHtpasswdEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	var h Htpasswd
+
+	_, err := h.Get("user1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = h.Check("user1", "password")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestHtpasswdCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(htpasswdFormatsFileName, []byte(htpasswdFormatsFileContents), 0644)
+	assert.Nil(err)
+
+	var h Htpasswd
+	err = h.Load(htpasswdFormatsFileName)
+	assert.Nil(err)
+
+	for _, user := range formatUsers {
+		assert.Nil(h.Check(user, "password"), user)
+		assert.Equal(core.ErrorAuthenticationFailure, h.Check(user, "badpassword"), user)
+	}
+
+	// Only bcrypt is accepted
+	h.RejectWeak = true
+	assert.Nil(h.Check("bcrypt", "password"))
+	for _, user := range formatUsers[1:] {
+		assert.Equal(core.ErrorAuthenticationFailure, h.Check(user, "password"), user)
+	}
+}
+
+func TestHtpasswdWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(htpasswdTestFileName, []byte(htpasswdFileContents), 0644)
+	assert.Nil(err)
+
+	var mtx sync.Mutex
+	var warnings []logging.Fields
+
+	var h Htpasswd
+	h.Logger = logging.LoggerFunc(func(level logging.Level, msg string, fields logging.Fields) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if level == logging.LevelWarn {
+			warnings = append(warnings, fields)
+		}
+	})
+	err = h.Load(htpasswdTestFileName)
+	assert.Nil(err)
+
+	h.Watch(10 * time.Millisecond)
+	defer h.Close()
+
+	// Replace the file
+	tmpFileName := htpasswdTestFileName + ".new"
+	err = ioutil.WriteFile(tmpFileName, []byte(htpasswdFormatsFileContents), 0644)
+	assert.Nil(err)
+	err = os.Rename(tmpFileName, htpasswdTestFileName)
+	assert.Nil(err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = h.Get("bcrypt"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(h.Check("bcrypt", "password"))
+
+	_, err = h.Get("user1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// Broken file doesn't replace the loaded data
+	err = ioutil.WriteFile(tmpFileName, []byte("user1:hash:extra"), 0644)
+	assert.Nil(err)
+	err = os.Rename(tmpFileName, htpasswdTestFileName)
+	assert.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(h.Check("bcrypt", "password"))
+
+	// The failure is logged
+	mtx.Lock()
+	assert.NotEmpty(warnings)
+	if len(warnings) > 0 {
+		assert.Equal(htpasswdTestFileName, warnings[0]["file"])
+	}
+	mtx.Unlock()
+
+	// Neither does a file truncated by a writer
+	err = ioutil.WriteFile(htpasswdTestFileName, nil, 0644)
+	assert.Nil(err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(h.Check("bcrypt", "password"))
+
+	// Stopping twice is fine
+	h.Close()
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package htpasswd
+
+import (
+	"os"
+	"syscall"
+)
+
+// Locks the file next to filename. The htpasswd file itself can't be locked,
+// it's replaced by a rename and the lock would stay with the old file.
+// The lock is released if the process dies, the lock file is kept.
+func lock(filename string) (unlock func() error, err error) {
+	f, err := os.OpenFile(filename+lockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f.Close, nil
+}
@@ -0,0 +1,109 @@
+package htpasswd
+
+import (
+	"crypto/md5"
+	"strings"
+)
+
+const (
+	apr1Magic     = "$apr1$"
+	md5CryptMagic = "$1$"
+
+	// Alphabet used by all the crypt(3) variants
+	itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Extracts the salt from a "$magic$salt$hash" string
+func md5CryptSalt(hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	return salt
+}
+
+// Poul-Henning Kamp's MD5 based crypt. Apache's $apr1$ differs only in the magic string.
+// The salt is taken from the hash that's being compared.
+func md5Crypt(password, hash, magic string) string {
+	pw := []byte(password)
+	salt := []byte(md5CryptSalt(hash, magic))
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write(salt)
+	alternate.Write(pw)
+	mixin := alternate.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write(salt)
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+
+	final := d.Sum(nil)
+
+	// Slow down brute force
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+
+		if i%3 != 0 {
+			round.Write(salt)
+		}
+
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+
+		final = round.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			encoded = append(encoded, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+
+	return magic + string(salt) + "$" + string(encoded)
+}
@@ -0,0 +1,52 @@
+package userdb
+
+import "context"
+
+// Identity is the user's account at an upstream identity provider
+type Identity struct {
+	Issuer  string `json:"issuer" gorethink:"issuer"`
+	Subject string `json:"subject" gorethink:"subject"`
+}
+
+// IdentityStore links upstream accounts to local users
+type IdentityStore interface {
+	// GetUsernameWithIdentity returns core.ErrorNoSuchUser if the identity isn't linked
+	GetUsernameWithIdentity(issuer, subject string) (string, error)
+
+	// LinkIdentity fails with core.ErrorUserAlreadyExists if the identity is linked to another user
+	LinkIdentity(username, issuer, subject string) error
+
+	UnlinkIdentity(username, issuer, subject string) error
+}
+
+// IdentityContextStore is an IdentityStore whose calls to the database are canceled with the context
+type IdentityContextStore interface {
+	GetUsernameWithIdentityContext(ctx context.Context, issuer, subject string) (string, error)
+	LinkIdentityContext(ctx context.Context, username, issuer, subject string) error
+	UnlinkIdentityContext(ctx context.Context, username, issuer, subject string) error
+}
+
+// IdentitiesWithContext returns the store itself if it's an IdentityContextStore.
+// Other stores are adapted, they ignore the context.
+func IdentitiesWithContext(s IdentityStore) IdentityContextStore {
+	if cs, ok := s.(IdentityContextStore); ok {
+		return cs
+	}
+	return identityAdapter{s}
+}
+
+type identityAdapter struct {
+	IdentityStore
+}
+
+func (a identityAdapter) GetUsernameWithIdentityContext(ctx context.Context, issuer, subject string) (string, error) {
+	return a.GetUsernameWithIdentity(issuer, subject)
+}
+
+func (a identityAdapter) LinkIdentityContext(ctx context.Context, username, issuer, subject string) error {
+	return a.LinkIdentity(username, issuer, subject)
+}
+
+func (a identityAdapter) UnlinkIdentityContext(ctx context.Context, username, issuer, subject string) error {
+	return a.UnlinkIdentity(username, issuer, subject)
+}
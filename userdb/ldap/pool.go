@@ -0,0 +1,72 @@
+package ldap
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/ldap.v2"
+)
+
+var errPoolClosed = errors.New("ldap connection pool is closed")
+
+// Pool of connections bound with the service account.
+// Connections are created lazily, at most size of them are kept idle.
+type pool struct {
+	conns chan *ldap.Conn
+	dial  func() (*ldap.Conn, error)
+
+	mtx    sync.Mutex
+	closed bool
+}
+
+func newPool(size int, dial func() (*ldap.Conn, error)) *pool {
+	return &pool{
+		conns: make(chan *ldap.Conn, size),
+		dial:  dial,
+	}
+}
+
+// Returns an idle connection or dials a new one
+func (p *pool) get() (*ldap.Conn, error) {
+	select {
+	case conn, ok := <-p.conns:
+		if !ok {
+			return nil, errPoolClosed
+		}
+		return conn, nil
+	default:
+		return p.dial()
+	}
+}
+
+// Returns the connection to the pool, closes it if the pool is full or closed
+func (p *pool) put(conn *ldap.Conn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		conn.Close()
+		return
+	}
+
+	select {
+	case p.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *pool) close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	close(p.conns)
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,360 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+type testEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Minimal in-process LDAP server. Handles simple binds, searches with
+// and/or/equality/present filters and the StartTLS extended operation.
+type testServer struct {
+	Address   string
+	TLSConfig *tls.Config
+
+	// Reject binds on connections that weren't upgraded with StartTLS
+	RequireTLS bool
+
+	listener net.Listener
+	entries  []testEntry
+
+	mtx         sync.Mutex
+	connections int
+	binds       int
+
+	// Searches are answered after the delay
+	searchDelay time.Duration
+}
+
+func newTestServer(entries []testEntry) (*testServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	serverConfig, clientConfig, err := newTestTLSConfigs()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &testServer{
+		Address:   listener.Addr().String(),
+		TLSConfig: clientConfig,
+		listener:  listener,
+		entries:   entries,
+	}
+
+	go s.serve(serverConfig)
+	return s, nil
+}
+
+// Self signed certificate for 127.0.0.1
+func newTestTLSConfigs() (server *tls.Config, client *tls.Config, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{
+		RootCAs:    roots,
+		ServerName: "127.0.0.1",
+	}
+	return
+}
+
+func (s *testServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *testServer) Connections() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.connections
+}
+
+func (s *testServer) SetSearchDelay(delay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.searchDelay = delay
+}
+
+func (s *testServer) SearchDelay() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.searchDelay
+}
+
+func (s *testServer) serve(tlsConfig *tls.Config) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		s.connections++
+		s.mtx.Unlock()
+
+		go s.handle(conn, tlsConfig)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn, tlsConfig *tls.Config) {
+	defer func() { conn.Close() }()
+
+	isTLS := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		if len(packet.Children) < 2 {
+			return
+		}
+
+		id, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			code := s.bind(request, isTLS)
+			_, err = conn.Write(testResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			time.Sleep(s.SearchDelay())
+			for _, entry := range s.search(request) {
+				_, err = conn.Write(testSearchEntry(id, entry).Bytes())
+				if err != nil {
+					return
+				}
+			}
+			_, err = conn.Write(testResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationExtendedRequest:
+			if isTLS || len(request.Children) == 0 || request.Children[0].Data.String() != startTLSOID {
+				_, err = conn.Write(testResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError).Bytes())
+				break
+			}
+
+			_, err = conn.Write(testResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			if err != nil {
+				return
+			}
+
+			tlsConn := tls.Server(conn, tlsConfig)
+			err = tlsConn.Handshake()
+			conn = tlsConn
+			isTLS = true
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			_, err = conn.Write(testResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform).Bytes())
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *testServer) bind(request *ber.Packet, isTLS bool) int {
+	if len(request.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+
+	if s.RequireTLS && !isTLS {
+		return ldap.LDAPResultConfidentialityRequired
+	}
+
+	s.mtx.Lock()
+	s.binds++
+	s.mtx.Unlock()
+
+	dn, _ := request.Children[1].Value.(string)
+	password := request.Children[2].Data.String()
+
+	if dn == "" && password == "" {
+		// Anonymous
+		return ldap.LDAPResultSuccess
+	}
+
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) && entry.Password != "" && entry.Password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (s *testServer) search(request *ber.Packet) (found []testEntry) {
+	if len(request.Children) < 7 {
+		return
+	}
+
+	base, _ := request.Children[0].Value.(string)
+	for _, entry := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(entry.DN), strings.ToLower(base)) {
+			continue
+		}
+
+		if testMatch(request.Children[6], entry) {
+			found = append(found, entry)
+		}
+	}
+	return
+}
+
+func testMatch(filter *ber.Packet, entry testEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !testMatch(child, entry) {
+				return false
+			}
+		}
+		return true
+
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if testMatch(child, entry) {
+				return true
+			}
+		}
+		return false
+
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !testMatch(filter.Children[0], entry)
+
+	case ldap.FilterPresent:
+		return len(testValues(entry, filter.Data.String())) != 0
+
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		name, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+		for _, v := range testValues(entry, name) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+
+	default:
+		return false
+	}
+}
+
+func testValues(entry testEntry, name string) []string {
+	if strings.EqualFold(name, "objectClass") {
+		return []string{"person"}
+	}
+
+	for attribute, values := range entry.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func testEnvelope(id int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	return packet
+}
+
+func testResult(id int64, tag int, code int) *ber.Packet {
+	packet := testEnvelope(id)
+
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(tag), nil, "Response")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	packet.AppendChild(response)
+
+	return packet
+}
+
+func testSearchEntry(id int64, entry testEntry) *ber.Packet {
+	packet := testEnvelope(id)
+
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "objectName"))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range entry.Attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	response.AppendChild(attributes)
+	packet.AppendChild(response)
+
+	return packet
+}
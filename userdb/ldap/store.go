@@ -0,0 +1,349 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"gopkg.in/ldap.v2"
+)
+
+// Names of the directory attributes mapped into User
+type Attributes struct {
+	Username  string
+	FirstName string
+	LastName  string
+	Email     string
+}
+
+type Config struct {
+	// Address of the directory server, host:port
+	Address string
+
+	// Connect with ldaps://
+	UseTLS bool
+
+	// Upgrade the plain connection with the StartTLS extended operation
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// Service account used for searching users. Anonymous if empty.
+	BindDN       string
+	BindPassword string
+
+	// Users are searched in the whole subtree of BaseDN
+	BaseDN string
+
+	// Filter with one %s verb that gets the escaped username,
+	// e.g. "(uid=%s)" for OpenLDAP or "(sAMAccountName=%s)" for Active Directory
+	UserFilter string
+
+	Attributes Attributes
+
+	// Maximal number of idle connections kept open
+	PoolSize int
+
+	// Timeout of a single request
+	Timeout time.Duration
+
+	// Optional, gets the errors of the directory server
+	Logger logging.Logger
+}
+
+// Store authenticates users by searching their DN with the service account
+// and binding as the found entry with the given password.
+type Store struct {
+	Config
+
+	pool *pool
+}
+
+func NewStore(c Config) (*Store, error) {
+	if c.Address == "" || c.BaseDN == "" {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.UseTLS && c.StartTLS {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+
+	if c.Attributes.Username == "" {
+		c.Attributes.Username = "uid"
+	}
+
+	if c.Attributes.FirstName == "" {
+		c.Attributes.FirstName = "givenName"
+	}
+
+	if c.Attributes.LastName == "" {
+		c.Attributes.LastName = "sn"
+	}
+
+	if c.Attributes.Email == "" {
+		c.Attributes.Email = "mail"
+	}
+
+	if c.PoolSize <= 0 {
+		c.PoolSize = 5
+	}
+
+	s := &Store{Config: c}
+	s.pool = newPool(c.PoolSize, s.dial)
+
+	// Check the configuration by opening the first connection
+	conn, err := s.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	s.pool.put(conn)
+
+	return s, nil
+}
+
+func (s *Store) dial() (conn *ldap.Conn, err error) {
+	if s.UseTLS {
+		conn, err = ldap.DialTLS("tcp", s.Address, s.TLSConfig)
+	} else {
+		conn, err = ldap.Dial("tcp", s.Address)
+	}
+	if err != nil {
+		return
+	}
+
+	if s.Timeout > 0 {
+		conn.SetTimeout(s.Timeout)
+	}
+
+	if s.StartTLS {
+		err = conn.StartTLS(s.TLSConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	err = s.bindService(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// Binds the connection back to the service account
+func (s *Store) bindService(conn *ldap.Conn) error {
+	if s.BindDN == "" {
+		return nil
+	}
+
+	return conn.Bind(s.BindDN, s.BindPassword)
+}
+
+// Reverts the connection to the service account after binding as a user
+func (s *Store) rebind(conn *ldap.Conn) {
+	if s.BindDN == "" {
+		// There's no way back to the anonymous state, don't reuse it
+		conn.Close()
+		return
+	}
+
+	s.release(conn, conn.Bind(s.BindDN, s.BindPassword))
+}
+
+// Returns a healthy connection to the pool, drops the broken one
+func (s *Store) release(conn *ldap.Conn, err error) {
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s.pool.put(conn)
+}
+
+// Filters out errors that leave the connection usable
+func connError(err error) error {
+	if err == core.ErrorNoSuchUser || err == core.ErrorAuthenticationFailure {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) search(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		s.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0, // size limit
+		int(s.Timeout.Seconds()),
+		false, // types only
+		fmt.Sprintf(s.UserFilter, ldap.EscapeFilter(username)),
+		[]string{
+			s.Attributes.Username,
+			s.Attributes.FirstName,
+			s.Attributes.LastName,
+			s.Attributes.Email,
+		},
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, core.ErrorNoSuchUser
+	case 1:
+		return result.Entries[0], nil
+	default:
+		// Filter is too wide, don't guess which entry is the right one
+		return nil, core.ErrorAuthenticationFailure
+	}
+}
+
+// PingContext connects and binds as the service account, without the pool.
+// LDAP operations can't be cancelled, they're limited by Timeout.
+func (s *Store) PingContext(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+
+	conn.Close()
+	return nil
+}
+
+func (s *Store) Check(username, password string) error {
+	return s.CheckContext(context.Background(), username, password)
+}
+
+// CheckContext closes the connection when the context is done, which aborts
+// the search and the bind. Dialing a new connection is limited by Timeout.
+func (s *Store) CheckContext(ctx context.Context, username, password string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	// Bind with an empty password is an "unauthenticated bind" and succeeds
+	if username == "" || password == "" {
+		return core.ErrorAuthenticationFailure
+	}
+
+	conn, err := s.pool.get()
+	if err != nil {
+		logging.Error(ctx, s.Logger, "connecting to the directory failed", logging.Fields{"address": s.Address, "error": err})
+		return err
+	}
+
+	stop := closeOnDone(ctx, conn)
+	bound, err := s.authenticate(conn, username, password)
+	if stop() {
+		return ctx.Err()
+	}
+
+	if bound {
+		s.rebind(conn)
+	} else {
+		if connError(err) != nil {
+			logging.Error(ctx, s.Logger, "checking the user in the directory failed", logging.Fields{"user": username, "error": err})
+		}
+		s.release(conn, connError(err))
+	}
+	return err
+}
+
+// Searches the user and binds as the found entry.
+// bound is true if the connection has to be bound back to the service account.
+func (s *Store) authenticate(conn *ldap.Conn, username, password string) (bound bool, err error) {
+	entry, err := s.search(conn, username)
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, err
+		}
+		return true, core.ErrorAuthenticationFailure
+	}
+
+	return true, nil
+}
+
+// Closes the connection if the context is done before stop is called,
+// its pending operations fail. stop reports whether the connection was closed.
+func closeOnDone(ctx context.Context, conn *ldap.Conn) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	done := make(chan bool)
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return <-closed
+	}
+}
+
+// Users are managed in the directory
+func (s *Store) Add(username, password string) error {
+	return core.ErrorNotImplemented
+}
+
+func (s *Store) AddContext(ctx context.Context, username, password string) error {
+	return core.ErrorNotImplemented
+}
+
+func (s *Store) Get(username string) (user *User, err error) {
+	conn, err := s.pool.get()
+	if err != nil {
+		return
+	}
+
+	entry, err := s.search(conn, username)
+	if err != nil {
+		s.release(conn, connError(err))
+		return
+	}
+	s.release(conn, nil)
+
+	user = &User{
+		DN:        entry.DN,
+		Username:  entry.GetAttributeValue(s.Attributes.Username),
+		FirstName: entry.GetAttributeValue(s.Attributes.FirstName),
+		LastName:  entry.GetAttributeValue(s.Attributes.LastName),
+		Email:     entry.GetAttributeValue(s.Attributes.Email),
+	}
+	return
+}
+
+func (s *Store) Close() error {
+	s.pool.close()
+	return nil
+}
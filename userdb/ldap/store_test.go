@@ -0,0 +1,242 @@
+package ldap
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_BASE_DN       = "ou=people,dc=example,dc=com"
+	TEST_BIND_DN       = "cn=idp,dc=example,dc=com"
+	TEST_BIND_PASSWORD = "servicePassword"
+)
+
+var (
+	server *testServer
+
+	testUserPassword = "testPassword"
+	testEntries      = []testEntry{
+		{
+			DN:       TEST_BIND_DN,
+			Password: TEST_BIND_PASSWORD,
+		},
+		{
+			DN:       "uid=joe," + TEST_BASE_DN,
+			Password: testUserPassword,
+			Attributes: map[string][]string{
+				"uid":       {"joe"},
+				"givenName": {"Joe"},
+				"sn":        {"Doe"},
+				"mail":      {"joe@example.com"},
+			},
+		},
+		{
+			DN:       "uid=ann," + TEST_BASE_DN,
+			Password: "annPassword",
+			Attributes: map[string][]string{
+				"uid":  {"ann"},
+				"mail": {"ann@example.com"},
+			},
+		},
+	}
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	server, err = newTestServer(testEntries)
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+
+	os.Exit(m.Run())
+}
+
+func newTestStore(assert *assert.Assertions, c Config) *Store {
+	c.Address = server.Address
+	c.BaseDN = TEST_BASE_DN
+	c.BindDN = TEST_BIND_DN
+	c.BindPassword = TEST_BIND_PASSWORD
+
+	store, err := NewStore(c)
+	assert.Nil(err)
+	assert.NotNil(store)
+	return store
+}
+
+func TestNewStore(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewStore(Config{BaseDN: TEST_BASE_DN})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewStore(Config{Address: server.Address})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	_, err = NewStore(Config{
+		Address:  server.Address,
+		BaseDN:   TEST_BASE_DN,
+		UseTLS:   true,
+		StartTLS: true,
+	})
+	assert.Equal(core.ErrorInvalidConfig, err)
+
+	// Bad service account
+	_, err = NewStore(Config{
+		Address:      server.Address,
+		BaseDN:       TEST_BASE_DN,
+		BindDN:       TEST_BIND_DN,
+		BindPassword: "bad",
+	})
+	assert.NotNil(err)
+
+	store := newTestStore(assert, Config{})
+	assert.Nil(store.Close())
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newTestStore(assert, Config{})
+	defer store.Close()
+
+	// Good password
+	err := store.Check("joe", testUserPassword)
+	assert.Nil(err)
+
+	// Bad password
+	err = store.Check("joe", testUserPassword+"stuff")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Empty password would be an unauthenticated bind
+	err = store.Check("joe", "")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// No user
+	err = store.Check("bob", testUserPassword)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// Filter injection
+	err = store.Check("*", testUserPassword)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// The connection is usable after the user's bind
+	err = store.Check("ann", "annPassword")
+	assert.Nil(err)
+}
+
+func TestAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newTestStore(assert, Config{})
+	defer store.Close()
+
+	err := store.Add("bob", "bob123")
+	assert.Equal(core.ErrorNotImplemented, err)
+}
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newTestStore(assert, Config{})
+	defer store.Close()
+
+	user, err := store.Get("joe")
+	assert.Nil(err)
+	assert.NotNil(user)
+	assert.Equal("uid=joe,"+TEST_BASE_DN, user.DN)
+	assert.Equal("joe", user.GetUsername())
+	assert.Equal("Joe", user.GetFirstName())
+	assert.Equal("Doe", user.GetLastName())
+	assert.Equal("joe@example.com", user.GetEmail())
+	assert.Equal("", user.GetPassword())
+
+	_, err = store.Get("bob")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestAttributes(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newTestStore(assert, Config{
+		UserFilter: "(mail=%s)",
+		Attributes: Attributes{
+			Username: "mail",
+		},
+	})
+	defer store.Close()
+
+	err := store.Check("ann@example.com", "annPassword")
+	assert.Nil(err)
+
+	user, err := store.Get("ann@example.com")
+	assert.Nil(err)
+	assert.Equal("ann@example.com", user.GetUsername())
+	assert.Equal("", user.GetFirstName())
+}
+
+func TestCheckCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newTestStore(assert, Config{PoolSize: 1})
+	defer store.Close()
+
+	server.SetSearchDelay(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := store.CheckContext(ctx, "joe", testUserPassword)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 500*time.Millisecond)
+
+	// The aborted connection isn't reused
+	server.SetSearchDelay(0)
+	assert.Nil(store.Check("joe", testUserPassword))
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+
+	before := server.Connections()
+
+	store := newTestStore(assert, Config{PoolSize: 1})
+	defer store.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(store.Check("joe", testUserPassword))
+		assert.Equal(core.ErrorAuthenticationFailure, store.Check("joe", "bad"))
+	}
+
+	// Every request reused the first connection
+	assert.Equal(before+1, server.Connections())
+}
+
+func TestStartTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	server.RequireTLS = true
+	defer func() { server.RequireTLS = false }()
+
+	_, err := NewStore(Config{
+		Address:      server.Address,
+		BaseDN:       TEST_BASE_DN,
+		BindDN:       TEST_BIND_DN,
+		BindPassword: TEST_BIND_PASSWORD,
+	})
+	assert.NotNil(err)
+
+	store := newTestStore(assert, Config{
+		StartTLS:  true,
+		TLSConfig: server.TLSConfig,
+	})
+	defer store.Close()
+
+	err = store.Check("joe", testUserPassword)
+	assert.Nil(err)
+}
@@ -0,0 +1,42 @@
+package ldap
+
+import "time"
+
+// User is a directory entry mapped onto the fields used by the IdP.
+// Passwords never leave the directory, so GetPassword always returns "".
+type User struct {
+	DN        string
+	Username  string
+	FirstName string
+	LastName  string
+	Email     string
+}
+
+func (u *User) GetUsername() string {
+	return u.Username
+}
+
+func (u *User) GetPassword() string {
+	return ""
+}
+
+func (u *User) GetFirstName() string {
+	return u.FirstName
+}
+
+func (u *User) GetLastName() string {
+	return u.LastName
+}
+
+func (u *User) GetEmail() string {
+	return u.Email
+}
+
+// Accounts are managed by the directory administrators, so they're trusted
+func (u *User) GetIsVerified() bool {
+	return true
+}
+
+func (u *User) GetRegistrationTime() time.Time {
+	return time.Time{}
+}
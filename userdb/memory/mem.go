@@ -1,19 +1,32 @@
 package memory
 
 import (
-	"bufio"
-	"encoding/csv"
-	"io"
+	"bytes"
+	"context"
 	"os"
 	"sync"
 
 	"github.com/janekolszak/idp/core"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/hasher"
+	"github.com/janekolszak/idp/userdb/htpasswd"
 )
 
 type Store struct {
-	hashes map[string]string
-	mtx    sync.RWMutex
+	// Hashes added passwords. Outdated hashes are replaced after a successful check.
+	Hasher userdb.PasswordHasher
+
+	// Fail checks of htpasswd entries hashed with SHA1, MD5 or crypt
+	RejectWeak bool
+
+	hashes      map[string]string
+	factors     map[string]*userdb.TOTPFactor
+	credentials map[string][]userdb.WebAuthnCredential
+	identities  map[userdb.Identity]string
+	emails      map[string]string
+	verified    map[string]bool
+	mtx         sync.RWMutex
+	dummy       hasher.Dummy
 }
 
 func NewMemStore() (*Store, error) {
@@ -23,6 +36,12 @@ func NewMemStore() (*Store, error) {
 	defer s.mtx.Unlock()
 
 	s.hashes = make(map[string]string)
+	s.factors = make(map[string]*userdb.TOTPFactor)
+	s.credentials = make(map[string][]userdb.WebAuthnCredential)
+	s.identities = make(map[userdb.Identity]string)
+	s.emails = make(map[string]string)
+	s.verified = make(map[string]bool)
+	s.Hasher = hasher.NewDefault()
 
 	return &s, nil
 }
@@ -35,51 +54,83 @@ func (s *Store) LoadHtpasswd(filename string) error {
 	}
 	defer f.Close()
 
-	r := csv.NewReader(bufio.NewReader(f))
-	r.Comment = '#'
-	r.Comma = ':'
-	r.TrimLeadingSpace = true
-	r.FieldsPerRecord = 2
+	hashes, err := htpasswd.Parse(f)
+	if err != nil {
+		return err
+	}
 
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	s.hashes = make(map[string]string)
-	for {
-		fields, err := r.Read()
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-
-			return err
-		}
-
-		s.hashes[fields[0]] = fields[1]
-	}
+	s.hashes = hashes
+	return nil
 }
 
 func (s *Store) Check(username, password string) error {
+	return s.CheckContext(context.Background(), username, password)
+}
 
+// CheckContext doesn't block, there's nothing to cancel
+func (s *Store) CheckContext(ctx context.Context, username, password string) error {
 	s.mtx.RLock()
-	defer s.mtx.RUnlock()
-
 	hash, exists := s.hashes[username]
-	// possibly compare against zero hash to prevent timing attack
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	s.mtx.RUnlock()
+
 	if !exists {
+		// Prevent timing attack
+		s.dummy.Verify(s.Hasher, password)
 		return core.ErrorNoSuchUser
 	}
 
+	needsRehash, err := s.verify(hash, password)
 	if err != nil {
 		return core.ErrorAuthenticationFailure
 	}
 
+	if needsRehash {
+		s.rehash(username, hash, password)
+	}
+
 	return nil
 }
 
+func (s *Store) verify(hash, password string) (needsRehash bool, err error) {
+	needsRehash, err = s.Hasher.Verify(hash, password)
+	if err != core.ErrorUnknownHashFormat {
+		return
+	}
+
+	// Entries loaded from htpasswd
+	if s.RejectWeak && htpasswd.Identify(hash).IsWeak() {
+		return false, core.ErrorAuthenticationFailure
+	}
+
+	err = htpasswd.Compare(hash, password)
+	return err == nil, err
+}
+
+// Replaces the hash, unless it was changed in the meantime.
+// Failure isn't fatal, the old hash still works.
+func (s *Store) rehash(username, oldHash, password string) {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.hashes[username] == oldHash {
+		s.hashes[username] = hash
+	}
+}
+
 // TODO: add complexity requirements
 func (s *Store) Add(username, password string) error {
+	return s.AddContext(context.Background(), username, password)
+}
+
+func (s *Store) AddContext(ctx context.Context, username, password string) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -87,10 +138,218 @@ func (s *Store) Add(username, password string) error {
 	if exists {
 		return core.ErrorUserAlreadyExists
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	s.hashes[username] = hash
+	return nil
+}
+
+func (s *Store) SetPassword(username, password string) error {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+	s.hashes[username] = hash
+	return nil
+}
+
+// ChangePassword replaces the password if the old one is correct
+func (s *Store) ChangePassword(username, oldPassword, newPassword string) error {
+	err := s.Check(username, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	return s.SetPassword(username, newPassword)
+}
+
+func (s *Store) GetTOTP(username string) (*userdb.TOTPFactor, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return nil, core.ErrorNoSuchUser
+	}
+
+	return s.factors[username].Copy(), nil
+}
+
+func (s *Store) UpdateTOTP(username string, update func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error)) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+
+	factor, err := update(s.factors[username].Copy())
+	if err != nil {
+		return err
+	}
+
+	if factor == nil {
+		delete(s.factors, username)
+		return nil
+	}
+
+	s.factors[username] = factor.Copy()
+	return nil
+}
+
+func (s *Store) GetCredentials(username string) ([]userdb.WebAuthnCredential, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return nil, core.ErrorNoSuchUser
+	}
+
+	return userdb.CopyCredentials(s.credentials[username]), nil
+}
+
+func (s *Store) GetUsernameWithCredentialID(id []byte) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for username, credentials := range s.credentials {
+		for _, credential := range credentials {
+			if bytes.Equal(credential.ID, id) {
+				return username, nil
+			}
+		}
+	}
+
+	return "", core.ErrorNoSuchUser
+}
+
+func (s *Store) UpdateCredentials(username string, update func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error)) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+
+	credentials, err := update(userdb.CopyCredentials(s.credentials[username]))
 	if err != nil {
 		return err
 	}
-	s.hashes[username] = string(hash)
+
+	if len(credentials) == 0 {
+		delete(s.credentials, username)
+		return nil
+	}
+
+	s.credentials[username] = userdb.CopyCredentials(credentials)
+	return nil
+}
+
+func (s *Store) GetUsernameWithIdentity(issuer, subject string) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	username, exists := s.identities[userdb.Identity{Issuer: issuer, Subject: subject}]
+	if !exists {
+		return "", core.ErrorNoSuchUser
+	}
+
+	return username, nil
+}
+
+func (s *Store) LinkIdentity(username, issuer, subject string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+
+	identity := userdb.Identity{Issuer: issuer, Subject: subject}
+	linked, exists := s.identities[identity]
+	if exists && linked != username {
+		return core.ErrorUserAlreadyExists
+	}
+
+	s.identities[identity] = username
+	return nil
+}
+
+func (s *Store) UnlinkIdentity(username, issuer, subject string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	identity := userdb.Identity{Issuer: issuer, Subject: subject}
+	if s.identities[identity] == username {
+		delete(s.identities, identity)
+	}
+	return nil
+}
+
+// SetEmail changes the user's address, it isn't verified until SetIsVerifiedWithID
+func (s *Store) SetEmail(username, email string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+
+	s.emails[username] = email
+	delete(s.verified, username)
+	return nil
+}
+
+// Usernames are the IDs in this store, e.g. for the verifier.Verifier
+
+func (s *Store) GetIDWithUsernameContext(ctx context.Context, username string) (string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	_, exists := s.hashes[username]
+	if !exists {
+		return "", core.ErrorNoSuchUser
+	}
+
+	return username, nil
+}
+
+func (s *Store) GetEmailWithIDContext(ctx context.Context, id string) (email string, isVerified bool, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	_, exists := s.hashes[id]
+	if !exists {
+		return "", false, core.ErrorNoSuchUser
+	}
+
+	return s.emails[id], s.verified[id], nil
+}
+
+func (s *Store) SetIsVerifiedWithIDContext(ctx context.Context, id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, exists := s.hashes[id]
+	if !exists {
+		return core.ErrorNoSuchUser
+	}
+
+	s.verified[id] = true
 	return nil
 }
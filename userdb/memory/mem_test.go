@@ -1,10 +1,15 @@
 package memory
 
 import (
+	"context"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/hasher"
+	"github.com/janekolszak/idp/userdb/verifier"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,3 +61,263 @@ func TestHtpasswd(t *testing.T) {
 		assert.Equal("hash", s.hashes[user])
 	}
 }
+
+func TestHtpasswdFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ioutil.WriteFile(htpasswdTestFileName, []byte(`bcrypt:$2y$05$oHxU0ruGKexixZrm6uDFMOtSFKQIpesi.iW/K6CY/2fcwwZ7F13TK
+	                                                       apr1:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1`), 0644)
+	assert.Nil(err)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	err = s.LoadHtpasswd(htpasswdTestFileName)
+	assert.Nil(err)
+
+	assert.Nil(s.Check("bcrypt", "password"))
+	assert.Nil(s.Check("apr1", "password"))
+	assert.Equal(core.ErrorAuthenticationFailure, s.Check("apr1", "bad"))
+
+	// Reload, successful checks upgraded the hashes
+	err = s.LoadHtpasswd(htpasswdTestFileName)
+	assert.Nil(err)
+
+	s.RejectWeak = true
+	assert.Nil(s.Check("bcrypt", "password"))
+	assert.Equal(core.ErrorAuthenticationFailure, s.Check("apr1", "password"))
+}
+
+func TestRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	s.Hasher = &hasher.Bcrypt{Cost: 4}
+	err = s.Add("bob", "bob123")
+	assert.Nil(err)
+	oldHash := s.hashes["bob"]
+
+	// Parameters change, the hash is replaced on the next successful check
+	s.Hasher = hasher.Chain{&hasher.Scrypt{LogN: 4}, &hasher.Bcrypt{Cost: 4}}
+
+	err = s.Check("bob", "bad")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+	assert.Equal(oldHash, s.hashes["bob"])
+
+	err = s.Check("bob", "bob123")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(s.hashes["bob"], "$scrypt$"))
+
+	err = s.Check("bob", "bob123")
+	assert.Nil(err)
+
+	// Htpasswd entries get upgraded too
+	err = ioutil.WriteFile(htpasswdTestFileName, []byte(`apr1:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1`), 0644)
+	assert.Nil(err)
+	err = s.LoadHtpasswd(htpasswdTestFileName)
+	assert.Nil(err)
+
+	err = s.Check("apr1", "password")
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(s.hashes["apr1"], "$scrypt$"))
+}
+
+func TestChangePassword(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+	s.Hasher = &hasher.Bcrypt{Cost: 4}
+
+	err = s.SetPassword("bob", "bob123")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = s.Add("bob", "bob123")
+	assert.Nil(err)
+
+	// Wrong old password
+	err = s.ChangePassword("bob", "bob", "bob456")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	err = s.ChangePassword("bob", "bob123", "bob456")
+	assert.Nil(err)
+
+	err = s.Check("bob", "bob123")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	err = s.Check("bob", "bob456")
+	assert.Nil(err)
+
+	err = s.SetPassword("bob", "bob789")
+	assert.Nil(err)
+
+	err = s.Check("bob", "bob789")
+	assert.Nil(err)
+}
+
+func TestTOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	_, err = s.GetTOTP("bob")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = s.Add("bob", "bob123")
+	assert.Nil(err)
+
+	factor, err := s.GetTOTP("bob")
+	assert.Nil(err)
+	assert.Nil(factor)
+
+	err = s.UpdateTOTP("bob", func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		assert.Nil(factor)
+		return &userdb.TOTPFactor{Secret: "secret", RecoveryCodes: []string{"a", "b"}}, nil
+	})
+	assert.Nil(err)
+
+	// Aborted update
+	err = s.UpdateTOTP("bob", func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		factor.RecoveryCodes[0] = "changed"
+		return nil, core.ErrorBadSecondFactor
+	})
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	factor, err = s.GetTOTP("bob")
+	assert.Nil(err)
+	assert.Equal("secret", factor.Secret)
+	assert.Equal([]string{"a", "b"}, factor.RecoveryCodes)
+
+	// Removed
+	err = s.UpdateTOTP("bob", func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		return nil, nil
+	})
+	assert.Nil(err)
+
+	factor, err = s.GetTOTP("bob")
+	assert.Nil(err)
+	assert.Nil(factor)
+}
+
+func TestCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	err = s.Add("bob", "bob123")
+	assert.Nil(err)
+
+	_, err = s.GetUsernameWithCredentialID([]byte("id"))
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = s.UpdateCredentials("bob", func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		assert.Len(credentials, 0)
+		return append(credentials, userdb.WebAuthnCredential{ID: []byte("id"), SignCount: 1}), nil
+	})
+	assert.Nil(err)
+
+	username, err := s.GetUsernameWithCredentialID([]byte("id"))
+	assert.Nil(err)
+	assert.Equal("bob", username)
+
+	// Aborted update
+	err = s.UpdateCredentials("bob", func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		credentials[0].SignCount = 2
+		return nil, core.ErrorAuthenticationFailure
+	})
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	credentials, err := s.GetCredentials("bob")
+	assert.Nil(err)
+	assert.Len(credentials, 1)
+	assert.Equal(uint32(1), credentials[0].SignCount)
+
+	err = s.UpdateCredentials("bob", func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		return nil, nil
+	})
+	assert.Nil(err)
+
+	_, err = s.GetUsernameWithCredentialID([]byte("id"))
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestIdentities(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	err = s.LinkIdentity("bob", "https://issuer", "1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	assert.Nil(s.Add("bob", "bob123"))
+	assert.Nil(s.Add("eve", "eve123"))
+
+	err = s.LinkIdentity("bob", "https://issuer", "1")
+	assert.Nil(err)
+
+	// Linked twice
+	err = s.LinkIdentity("bob", "https://issuer", "1")
+	assert.Nil(err)
+
+	err = s.LinkIdentity("eve", "https://issuer", "1")
+	assert.Equal(core.ErrorUserAlreadyExists, err)
+
+	username, err := s.GetUsernameWithIdentity("https://issuer", "1")
+	assert.Nil(err)
+	assert.Equal("bob", username)
+
+	_, err = s.GetUsernameWithIdentity("https://other", "1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = s.UnlinkIdentity("bob", "https://issuer", "1")
+	assert.Nil(err)
+
+	_, err = s.GetUsernameWithIdentity("https://issuer", "1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+var _ verifier.UserStore = (*Store)(nil)
+
+func TestVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewMemStore()
+	assert.Nil(err)
+
+	_, err = s.GetIDWithUsernameContext(context.Background(), "bob")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	assert.Equal(core.ErrorNoSuchUser, s.SetEmail("bob", "bob@example.com"))
+
+	assert.Nil(s.Add("bob", "bob123"))
+	assert.Nil(s.SetEmail("bob", "bob@example.com"))
+
+	id, err := s.GetIDWithUsernameContext(context.Background(), "bob")
+	assert.Nil(err)
+
+	email, isVerified, err := s.GetEmailWithIDContext(context.Background(), id)
+	assert.Nil(err)
+	assert.Equal("bob@example.com", email)
+	assert.False(isVerified)
+
+	assert.Nil(s.SetIsVerifiedWithIDContext(context.Background(), id))
+
+	_, isVerified, err = s.GetEmailWithIDContext(context.Background(), id)
+	assert.Nil(err)
+	assert.True(isVerified)
+
+	// New address has to be verified again
+	assert.Nil(s.SetEmail("bob", "robert@example.com"))
+
+	email, isVerified, err = s.GetEmailWithIDContext(context.Background(), id)
+	assert.Nil(err)
+	assert.Equal("robert@example.com", email)
+	assert.False(isVerified)
+
+	assert.Equal(core.ErrorNoSuchUser, s.SetIsVerifiedWithIDContext(context.Background(), "eve"))
+}
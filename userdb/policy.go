@@ -0,0 +1,36 @@
+package userdb
+
+import (
+	"time"
+
+	"github.com/janekolszak/idp/core"
+)
+
+// Account is the part of the user's data consulted by login policies
+type Account interface {
+	GetIsVerified() bool
+	GetRegistrationTime() time.Time
+}
+
+// LoginPolicy decides whether a user with correct credentials may log in
+type LoginPolicy interface {
+	Allow(account Account) error
+}
+
+// RequireVerified rejects users who haven't verified their email address.
+// Unverified users can log in during the GracePeriod after registration.
+type RequireVerified struct {
+	GracePeriod time.Duration
+}
+
+func (p *RequireVerified) Allow(account Account) error {
+	if account.GetIsVerified() {
+		return nil
+	}
+
+	if time.Since(account.GetRegistrationTime()) < p.GracePeriod {
+		return nil
+	}
+
+	return core.ErrorNotVerified
+}
@@ -0,0 +1,35 @@
+package userdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAccount struct {
+	isVerified       bool
+	registrationTime time.Time
+}
+
+func (a *testAccount) GetIsVerified() bool {
+	return a.isVerified
+}
+
+func (a *testAccount) GetRegistrationTime() time.Time {
+	return a.registrationTime
+}
+
+func TestRequireVerified(t *testing.T) {
+	assert := assert.New(t)
+
+	p := RequireVerified{}
+	assert.Nil(p.Allow(&testAccount{isVerified: true}))
+	assert.Equal(core.ErrorNotVerified, p.Allow(&testAccount{registrationTime: time.Now()}))
+
+	p = RequireVerified{GracePeriod: time.Hour}
+	assert.Nil(p.Allow(&testAccount{isVerified: true, registrationTime: time.Now().Add(-2 * time.Hour)}))
+	assert.Nil(p.Allow(&testAccount{registrationTime: time.Now().Add(-time.Minute)}))
+	assert.Equal(core.ErrorNotVerified, p.Allow(&testAccount{registrationTime: time.Now().Add(-2 * time.Hour)}))
+}
@@ -0,0 +1,228 @@
+package reset
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/helpers"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/userdb"
+)
+
+const (
+	defaultSubject  = "Reset your password"
+	defaultTemplate = `Hello {{.Username}},
+
+Someone requested a password reset for your account.
+To choose a new password open the link below:
+
+{{.URL}}
+
+The link expires in {{.MaxAge}}. If you didn't request the reset, ignore this email.
+`
+)
+
+type Config struct {
+	// Keeps selectors and hashed validators of the reset tokens.
+	// Use a separate table from the remember me cookies.
+	// The store has to be a cookie.Consumer, so a token can't be used twice.
+	Tokens cookie.Store
+
+	// Users whose passwords are reset
+	Users userdb.PasswordStore
+
+	// Remember me cookies of the user are revoked after the reset. Optional.
+	Cookies cookie.Store
+
+	// Delivers the reset links
+	Mailer mail.Mailer
+
+	// Page with the new password form,
+	// selector and validator are added as query parameters
+	URL string
+
+	// Email's subject and text/template of the body.
+	// Template gets .Username, .URL and .MaxAge
+	Subject  string
+	Template string
+
+	// How long the token is valid
+	MaxAge time.Duration
+}
+
+// Resetter sends password reset links and sets the new passwords.
+// Tokens use the same selector/validator scheme as the remember me cookies,
+// only the hash of the validator is stored.
+type Resetter struct {
+	Config
+	consumer cookie.Consumer
+	template *template.Template
+}
+
+func NewResetter(config Config) (*Resetter, error) {
+	if config.Tokens == nil ||
+		config.Users == nil ||
+		config.Mailer == nil ||
+		config.URL == "" ||
+		config.MaxAge <= 0 {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	consumer, ok := config.Tokens.(cookie.Consumer)
+	if !ok {
+		return nil, core.ErrorInvalidConfig
+	}
+
+	if config.Subject == "" {
+		config.Subject = defaultSubject
+	}
+
+	if config.Template == "" {
+		config.Template = defaultTemplate
+	}
+
+	t, err := template.New("reset").Parse(config.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := Resetter{
+		Config:   config,
+		consumer: consumer,
+		template: t,
+	}
+
+	return &rs, nil
+}
+
+func (rs *Resetter) link(selector, validator string) (string, error) {
+	u, err := url.Parse(rs.URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("selector", selector)
+	q.Set("validator", validator)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Request sends a reset link to the user's email.
+// Caller finds the user, to avoid account enumeration
+// it shouldn't tell whether the user exists.
+func (rs *Resetter) Request(username, email string) error {
+	return rs.RequestContext(context.Background(), username, email)
+}
+
+func (rs *Resetter) RequestContext(ctx context.Context, username, email string) error {
+	token := helpers.LoginCookie{}
+	hash, err := token.GenerateValidator()
+	if err != nil {
+		return err
+	}
+
+	selector, err := cookie.WithContext(rs.Tokens).InsertContext(ctx, username, hash, time.Now().Add(rs.MaxAge))
+	if err != nil {
+		return err
+	}
+
+	link, err := rs.link(selector, token.Validator)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	err = rs.template.Execute(&body, map[string]interface{}{
+		"Username": username,
+		"URL":      link,
+		"MaxAge":   rs.MaxAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	return rs.Mailer.Send(&mail.Message{
+		To:      email,
+		Subject: rs.Subject,
+		Body:    body.String(),
+	})
+}
+
+// Check validates the token without using it,
+// e.g. before displaying the new password form.
+func (rs *Resetter) Check(selector, validator string) (username string, err error) {
+	return rs.CheckContext(context.Background(), selector, validator)
+}
+
+func (rs *Resetter) CheckContext(ctx context.Context, selector, validator string) (username string, err error) {
+	if selector == "" || validator == "" {
+		err = core.ErrorBadRequest
+		return
+	}
+
+	username, hash, expiration, err := cookie.WithContext(rs.Tokens).GetContext(ctx, selector)
+	if err != nil {
+		return
+	}
+
+	if expiration.Before(time.Now()) {
+		cookie.WithContext(rs.Tokens).DeleteSelectorContext(ctx, selector)
+		err = core.ErrorTokenExpired
+		return
+	}
+
+	token := helpers.LoginCookie{
+		Selector:  selector,
+		Validator: validator,
+	}
+
+	if !token.Check(hash) {
+		err = core.ErrorBadRequest
+		return
+	}
+
+	return
+}
+
+// Complete sets the new password and revokes all the user's
+// reset tokens and remember me cookies.
+func (rs *Resetter) Complete(selector, validator, password string) (username string, err error) {
+	return rs.CompleteContext(context.Background(), selector, validator, password)
+}
+
+func (rs *Resetter) CompleteContext(ctx context.Context, selector, validator, password string) (username string, err error) {
+	username, err = rs.CheckContext(ctx, selector, validator)
+	if err != nil {
+		return
+	}
+
+	// Of concurrent completions with the same token only one gets past this
+	err = rs.consumer.ConsumeSelectorContext(ctx, selector)
+	if err != nil {
+		return
+	}
+
+	// Links sent earlier stop working too
+	err = cookie.WithContext(rs.Tokens).DeleteUserContext(ctx, username)
+	if err != nil {
+		return
+	}
+
+	err = userdb.PasswordsWithContext(rs.Users).SetPasswordContext(ctx, username, password)
+	if err != nil {
+		return
+	}
+
+	if rs.Cookies != nil {
+		err = cookie.WithContext(rs.Cookies).DeleteUserContext(ctx, username)
+	}
+
+	return
+}
@@ -0,0 +1,220 @@
+package reset
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/mail"
+	"github.com/janekolszak/idp/providers/cookie"
+	"github.com/janekolszak/idp/userdb/hasher"
+	"github.com/janekolszak/idp/userdb/memory"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testFileName = "/tmp/idp_reset_test.db3"
+	testUsername = "joe"
+	testEmail    = "joe@example.com"
+	testPassword = "testPassword"
+	testURL      = "https://example.com/reset?lang=en"
+)
+
+var linkRegexp = regexp.MustCompile(`https://\S+`)
+
+type testMailer struct {
+	messages []*mail.Message
+}
+
+func (m *testMailer) Send(message *mail.Message) error {
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// Returns the selector and validator from the last sent link
+func (m *testMailer) token() (selector, validator string) {
+	message := m.messages[len(m.messages)-1]
+	u, err := url.Parse(linkRegexp.FindString(message.Body))
+	if err != nil {
+		return
+	}
+
+	return u.Query().Get("selector"), u.Query().Get("validator")
+}
+
+func setup(t *testing.T, maxAge time.Duration) (*Resetter, *testMailer, *memory.Store, *cookie.DBStore) {
+	assert := assert.New(t)
+	os.Remove(testFileName)
+
+	tokens, err := cookie.NewDBStoreWithTable("sqlite3", testFileName, "passwordreset")
+	assert.Nil(err)
+
+	cookies, err := cookie.NewDBStore("sqlite3", testFileName)
+	assert.Nil(err)
+
+	users, err := memory.NewMemStore()
+	assert.Nil(err)
+	users.Hasher = &hasher.Bcrypt{Cost: 4}
+	assert.Nil(users.Add(testUsername, testPassword))
+
+	mailer := &testMailer{}
+	rs, err := NewResetter(Config{
+		Tokens:  tokens,
+		Users:   users,
+		Cookies: cookies,
+		Mailer:  mailer,
+		URL:     testURL,
+		MaxAge:  maxAge,
+	})
+	assert.Nil(err)
+
+	return rs, mailer, users, cookies
+}
+
+func TestNewResetter(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewResetter(Config{})
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+	rs, mailer, users, cookies := setup(t, time.Hour)
+
+	// Remember me cookie that should be revoked
+	cookieSelector, err := cookies.Insert(testUsername, "hash", time.Now().Add(time.Hour))
+	assert.Nil(err)
+
+	err = rs.Request(testUsername, testEmail)
+	assert.Nil(err)
+	assert.Len(mailer.messages, 1)
+	assert.Equal(testEmail, mailer.messages[0].To)
+	assert.Equal(defaultSubject, mailer.messages[0].Subject)
+	assert.Contains(mailer.messages[0].Body, "https://example.com/reset?")
+	assert.Contains(mailer.messages[0].Body, "lang=en")
+
+	selector, validator := mailer.token()
+	assert.NotEqual("", selector)
+	assert.NotEqual("", validator)
+
+	// Only the hash is stored
+	_, hash, _, err := rs.Tokens.Get(selector)
+	assert.Nil(err)
+	assert.NotEqual(validator, hash)
+
+	// Bad validator
+	_, err = rs.Check(selector, validator+"x")
+	assert.Equal(core.ErrorBadRequest, err)
+
+	_, err = rs.Complete(selector, "", "newPassword")
+	assert.Equal(core.ErrorBadRequest, err)
+
+	username, err := rs.Check(selector, validator)
+	assert.Nil(err)
+	assert.Equal(testUsername, username)
+
+	username, err = rs.Complete(selector, validator, "newPassword")
+	assert.Nil(err)
+	assert.Equal(testUsername, username)
+
+	assert.Equal(core.ErrorAuthenticationFailure, users.Check(testUsername, testPassword))
+	assert.Nil(users.Check(testUsername, "newPassword"))
+
+	// Cookies revoked
+	_, _, _, err = cookies.Get(cookieSelector)
+	assert.NotNil(err)
+
+	// Single use
+	_, err = rs.Complete(selector, validator, "otherPassword")
+	assert.NotNil(err)
+	assert.Nil(users.Check(testUsername, "newPassword"))
+}
+
+func TestResetInvalidatesOlderTokens(t *testing.T) {
+	assert := assert.New(t)
+	rs, mailer, users, _ := setup(t, time.Hour)
+
+	assert.Nil(rs.Request(testUsername, testEmail))
+	oldSelector, oldValidator := mailer.token()
+
+	assert.Nil(rs.Request(testUsername, testEmail))
+	selector, validator := mailer.token()
+	assert.NotEqual(oldSelector, selector)
+
+	_, err := rs.Complete(selector, validator, "newPassword")
+	assert.Nil(err)
+
+	_, err = rs.Complete(oldSelector, oldValidator, "otherPassword")
+	assert.NotNil(err)
+	assert.Nil(users.Check(testUsername, "newPassword"))
+}
+
+func TestResetExpired(t *testing.T) {
+	assert := assert.New(t)
+	rs, mailer, users, _ := setup(t, time.Millisecond)
+
+	assert.Nil(rs.Request(testUsername, testEmail))
+	selector, validator := mailer.token()
+
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := rs.Complete(selector, validator, "newPassword")
+	assert.Equal(core.ErrorTokenExpired, err)
+	assert.Nil(users.Check(testUsername, testPassword))
+
+	// Expired token is removed
+	_, _, _, err = rs.Tokens.Get(selector)
+	assert.NotNil(err)
+}
+
+func TestResetNoSuchUser(t *testing.T) {
+	assert := assert.New(t)
+	rs, mailer, _, _ := setup(t, time.Hour)
+
+	assert.Nil(rs.Request("bob", "bob@example.com"))
+	selector, validator := mailer.token()
+
+	_, err := rs.Complete(selector, validator, "newPassword")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestResetTokenUsedOnce(t *testing.T) {
+	assert := assert.New(t)
+	rs, mailer, users, _ := setup(t, time.Hour)
+
+	assert.Nil(rs.Request(testUsername, testEmail))
+	selector, validator := mailer.token()
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rs.Complete(selector, validator, "newPassword")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	completed := 0
+	for err := range results {
+		if err == nil {
+			completed++
+		}
+	}
+	assert.Equal(1, completed)
+	assert.Nil(users.Check(testUsername, "newPassword"))
+
+	_, err := rs.Complete(selector, validator, "otherPassword")
+	assert.NotNil(err)
+	assert.Nil(users.Check(testUsername, "newPassword"))
+}
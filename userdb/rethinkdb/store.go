@@ -1,24 +1,44 @@
 package rethinkdb
 
 import (
+	"context"
+	"reflect"
+
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/hasher"
 
-	"golang.org/x/crypto/bcrypt"
-	r "gopkg.in/dancannon/gorethink.v2"
+	r "gopkg.in/gorethink/gorethink.v3"
 	"time"
 )
 
 type Store struct {
+	// Hashes passwords. Outdated hashes are replaced after a successful check.
+	Hasher userdb.PasswordHasher
+
+	// Optional. Consulted after the password is checked,
+	// e.g. userdb.RequireVerified rejects unverified users.
+	Policy userdb.LoginPolicy
+
+	// Optional, gets the database errors
+	Logger logging.Logger
+
 	session *r.Session
+	dummy   hasher.Dummy
 }
 
 const (
 	table = "users"
+
+	// Concurrent updates of one user's factor are retried
+	maxUpdateAttempts = 10
 )
 
 func NewStore(session *r.Session) (*Store, error) {
 	store := new(Store)
 	store.session = session
+	store.Hasher = hasher.NewDefault()
 
 	// Discard error (database exists)
 	db := session.Database()
@@ -29,13 +49,34 @@ func NewStore(session *r.Session) (*Store, error) {
 	r.Table(table).IndexCreate("username").Exec(session)
 	r.Table(table).IndexCreate("email").Exec(session)
 
+	// Index for passwordless logins, where the user is found by the credential
+	r.Table(table).IndexCreateFunc("credentialID", func(user r.Term) interface{} {
+		return user.Field("webauthn").Field("id").Default([]interface{}{})
+	}, r.IndexCreateOpts{Multi: true}).Exec(session)
+
+	// Index for logins through upstream identity providers
+	r.Table(table).IndexCreateFunc("identity", func(user r.Term) interface{} {
+		return user.Field("identities").Default([]interface{}{}).Map(func(identity r.Term) interface{} {
+			return []interface{}{identity.Field("issuer"), identity.Field("subject")}
+		})
+	}, r.IndexCreateOpts{Multi: true}).Exec(session)
+
 	r.Table(table).IndexWait().RunWrite(session)
 
 	return store, nil
 }
 
+// PingContext checks the connection and that the table exists
+func (s *Store) PingContext(ctx context.Context) error {
+	return r.Table(table).Info().Exec(s.session, r.ExecOpts{Context: ctx})
+}
+
 func (s *Store) GetWithID(id string) (user *User, err error) {
-	cursor, err := r.Table(table).Get(id).Run(s.session)
+	return s.GetWithIDContext(context.Background(), id)
+}
+
+func (s *Store) GetWithIDContext(ctx context.Context, id string) (user *User, err error) {
+	cursor, err := r.Table(table).Get(id).Run(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
 		return
 	}
@@ -52,7 +93,11 @@ func (s *Store) GetWithID(id string) (user *User, err error) {
 }
 
 func (s *Store) GetWithUsername(username string) (user *User, err error) {
-	cursor, err := r.Table(table).GetAllByIndex("username", username).Run(s.session)
+	return s.GetWithUsernameContext(context.Background(), username)
+}
+
+func (s *Store) GetWithUsernameContext(ctx context.Context, username string) (user *User, err error) {
+	cursor, err := r.Table(table).GetAllByIndex("username", username).Run(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
 		return
 	}
@@ -68,32 +113,112 @@ func (s *Store) GetWithUsername(username string) (user *User, err error) {
 	return
 }
 
+// GetUsernameWithEmail is used by passwordless logins, e.g. magiclink.Provider
+func (s *Store) GetUsernameWithEmail(email string) (string, error) {
+	return s.GetUsernameWithEmailContext(context.Background(), email)
+}
+
+func (s *Store) GetUsernameWithEmailContext(ctx context.Context, email string) (string, error) {
+	cursor, err := r.Table(table).GetAllByIndex("email", email).Pluck("username").Run(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return "", core.ErrorNoSuchUser
+	}
+
+	var user User
+	err = cursor.One(&user)
+	if err != nil {
+		return "", err
+	}
+
+	return user.Username, nil
+}
+
+func (s *Store) GetIDWithUsername(username string) (string, error) {
+	return s.GetIDWithUsernameContext(context.Background(), username)
+}
+
+func (s *Store) GetIDWithUsernameContext(ctx context.Context, username string) (string, error) {
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return "", err
+	}
+
+	return user.ID, nil
+}
+
 func (s *Store) Check(username, password string) error {
-	cursor, err := r.Table(table).GetAllByIndex("username", username).Pluck("password").Run(s.session)
+	return s.CheckContext(context.Background(), username, password)
+}
+
+func (s *Store) CheckContext(ctx context.Context, username, password string) error {
+	user, err := s.checkPassword(ctx, username, password)
 	if err != nil {
-		bcrypt.CompareHashAndPassword([]byte(""), []byte(password))
 		return err
 	}
+
+	if s.Policy != nil {
+		return s.Policy.Allow(user)
+	}
+
+	return nil
+}
+
+func (s *Store) checkPassword(ctx context.Context, username, password string) (*User, error) {
+	cursor, err := r.Table(table).GetAllByIndex("username", username).Pluck("id", "password", "isVerified", "registrationTime").Run(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		logging.Error(ctx, s.Logger, "getting the user failed", logging.Fields{"user": username, "error": err})
+		s.dummy.Verify(s.Hasher, password)
+		return nil, err
+	}
 	defer cursor.Close()
 
-	var data map[string][]byte
+	var data User
 	err = cursor.One(&data)
 	if err != nil {
 		// No such user, prevent timing atack
-		bcrypt.CompareHashAndPassword([]byte(""), []byte(password))
-		return core.ErrorAuthenticationFailure
+		s.dummy.Verify(s.Hasher, password)
+		return nil, core.ErrorAuthenticationFailure
 	}
 
-	err = bcrypt.CompareHashAndPassword(data["password"], []byte(password))
+	needsRehash, err := s.Hasher.Verify(string(data.Password), password)
 	if err != nil {
-		return core.ErrorAuthenticationFailure
+		return nil, core.ErrorAuthenticationFailure
 	}
 
-	return nil
+	if needsRehash {
+		// Failure isn't fatal, the old hash still works
+		err = s.setPasswordHash(ctx, data.ID, string(data.Password), password)
+		if err != nil {
+			logging.Warn(ctx, s.Logger, "replacing the outdated password hash failed", logging.Fields{"user": username, "error": err})
+		}
+	}
+
+	return &data, nil
+}
+
+// Replaces the hash, unless it was changed in the meantime
+func (s *Store) setPasswordHash(ctx context.Context, id, oldHash, password string) error {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	return r.Table(table).Get(id).Update(func(user r.Term) interface{} {
+		return r.Branch(
+			user.Field("password").Eq([]byte(oldHash)),
+			map[string]interface{}{"password": []byte(hash)},
+			map[string]interface{}{},
+		)
+	}).Exec(s.session, r.ExecOpts{Context: ctx})
 }
 
-func (s *Store) count(indexName, value string) (uint, error) {
-	cursor, err := r.Table(table).GetAllByIndex(indexName, value).Count().Run(s.session)
+func (s *Store) count(ctx context.Context, indexName, value string) (uint, error) {
+	cursor, err := r.Table(table).GetAllByIndex(indexName, value).Count().Run(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
 		return 0, err
 	}
@@ -113,10 +238,14 @@ func (s *Store) count(indexName, value string) (uint, error) {
 }
 
 func (s *Store) UserExists(username, email string) error {
+	return s.UserExistsContext(context.Background(), username, email)
+}
+
+func (s *Store) UserExistsContext(ctx context.Context, username, email string) error {
 	// RethinkDB doesn't support unique secondary indexes, so this ugly code is needed
 	// TODO: Rewrite when RethinkDB supports unique secondary indexes
 
-	count, err := s.count("username", username)
+	count, err := s.count(ctx, "username", username)
 	if err != nil {
 		return err
 	}
@@ -125,7 +254,12 @@ func (s *Store) UserExists(username, email string) error {
 		return core.ErrorUserAlreadyExists
 	}
 
-	count, err = s.count("email", email)
+	// Users added without an address
+	if email == "" {
+		return nil
+	}
+
+	count, err = s.count(ctx, "email", email)
 	if err != nil {
 		return err
 	}
@@ -138,20 +272,24 @@ func (s *Store) UserExists(username, email string) error {
 }
 
 func (s *Store) Insert(user *User, password string) (id string, err error) {
-	err = s.UserExists(user.Username, user.Email)
+	return s.InsertContext(context.Background(), user, password)
+}
+
+func (s *Store) InsertContext(ctx context.Context, user *User, password string) (id string, err error) {
+	err = s.UserExistsContext(ctx, user.Username, user.Email)
 	if err != nil {
 		return
 	}
 
-	// TODO: Change the cost
-	user.Password, err = bcrypt.GenerateFromPassword([]byte(password), 0 /*cost*/)
+	hash, err := s.Hasher.Hash(password)
 	if err != nil {
 		return
 	}
+	user.Password = []byte(hash)
 
 	user.RegistrationTime = time.Now()
 	user.IsVerified = false
-	result, err := r.Table(table).Insert(user).RunWrite(s.session)
+	result, err := r.Table(table).Insert(user).RunWrite(s.session, r.RunOpts{Context: ctx})
 	if err != nil {
 		return
 	}
@@ -161,22 +299,316 @@ func (s *Store) Insert(user *User, password string) (id string, err error) {
 	return
 }
 
+// Add inserts a user with just the username, e.g. registered with the form provider
+func (s *Store) Add(username, password string) error {
+	return s.AddContext(context.Background(), username, password)
+}
+
+func (s *Store) AddContext(ctx context.Context, username, password string) error {
+	_, err := s.InsertContext(ctx, &User{Username: username}, password)
+	return err
+}
+
 func (s *Store) SetPasswordWithID(id, password string) error {
-	// TODO: Implement.
+	return s.SetPasswordWithIDContext(context.Background(), id, password)
+}
+
+func (s *Store) SetPasswordWithIDContext(ctx context.Context, id, password string) error {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	var data = map[string]interface{}{
+		"password": []byte(hash),
+	}
+	result, err := r.Table(table).Get(id).Update(data).RunWrite(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return err
+	}
+
+	if result.Skipped != 0 {
+		return core.ErrorNoSuchUser
+	}
+
 	return nil
 }
 
+func (s *Store) SetPassword(username, password string) error {
+	return s.SetPasswordContext(context.Background(), username, password)
+}
+
+func (s *Store) SetPasswordContext(ctx context.Context, username, password string) error {
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	return s.SetPasswordWithIDContext(ctx, user.ID, password)
+}
+
+// ChangePassword replaces the password if the old one is correct.
+// The login policy isn't consulted.
+func (s *Store) ChangePassword(username, oldPassword, newPassword string) error {
+	return s.ChangePasswordContext(context.Background(), username, oldPassword, newPassword)
+}
+
+func (s *Store) ChangePasswordContext(ctx context.Context, username, oldPassword, newPassword string) error {
+	_, err := s.checkPassword(ctx, username, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	return s.SetPasswordContext(ctx, username, newPassword)
+}
+
 func (s *Store) Update(user *User) error {
-	return r.Table(table).Get(user.ID).Update(user).Exec(s.session)
+	return s.UpdateContext(context.Background(), user)
+}
+
+func (s *Store) UpdateContext(ctx context.Context, user *User) error {
+	return r.Table(table).Get(user.ID).Update(user).Exec(s.session, r.ExecOpts{Context: ctx})
 }
 
 func (s *Store) DeleteWithID(id string) error {
-	return r.Table(table).Get(id).Delete().Exec(s.session)
+	return s.DeleteWithIDContext(context.Background(), id)
+}
+
+func (s *Store) DeleteWithIDContext(ctx context.Context, id string) error {
+	return r.Table(table).Get(id).Delete().Exec(s.session, r.ExecOpts{Context: ctx})
 }
 
 func (s *Store) SetIsVerifiedWithID(id string) error {
+	return s.SetIsVerifiedWithIDContext(context.Background(), id)
+}
+
+func (s *Store) SetIsVerifiedWithIDContext(ctx context.Context, id string) error {
 	var data = map[string]interface{}{
 		"isVerified": true,
 	}
-	return r.Table(table).Get(id).Update(data).Exec(s.session)
+	return r.Table(table).Get(id).Update(data).Exec(s.session, r.ExecOpts{Context: ctx})
+}
+
+// GetEmailWithIDContext is used by the verifier.Verifier to replace expired verifications
+func (s *Store) GetEmailWithIDContext(ctx context.Context, id string) (email string, isVerified bool, err error) {
+	user, err := s.GetWithIDContext(ctx, id)
+	if err != nil {
+		return
+	}
+
+	return user.Email, user.IsVerified, nil
+}
+
+func (s *Store) GetTOTP(username string) (*userdb.TOTPFactor, error) {
+	return s.GetTOTPContext(context.Background(), username)
+}
+
+func (s *Store) GetTOTPContext(ctx context.Context, username string) (*userdb.TOTPFactor, error) {
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.TOTP, nil
+}
+
+// UpdateTOTP uses optimistic locking: the factor is replaced only if
+// it wasn't changed since it was read, otherwise the update is retried.
+func (s *Store) UpdateTOTP(username string, update func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error)) error {
+	return s.UpdateTOTPContext(context.Background(), username, update)
+}
+
+func (s *Store) UpdateTOTPContext(ctx context.Context, username string, update func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error)) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		user, err := s.GetWithUsernameContext(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		factor, err := update(user.TOTP.Copy())
+		if err != nil {
+			return err
+		}
+
+		if reflect.DeepEqual(factor, user.TOTP) {
+			return nil
+		}
+
+		result, err := r.Table(table).Get(user.ID).Update(func(row r.Term) interface{} {
+			return r.Branch(
+				row.Field("totp").Default(nil).Eq(user.TOTP),
+				map[string]interface{}{"totp": factor},
+				map[string]interface{}{},
+			)
+		}).RunWrite(s.session, r.RunOpts{Context: ctx})
+		if err != nil {
+			return err
+		}
+
+		if result.Replaced == 1 {
+			return nil
+		}
+	}
+
+	return core.ErrorInternalError
+}
+
+func (s *Store) GetCredentials(username string) ([]userdb.WebAuthnCredential, error) {
+	return s.GetCredentialsContext(context.Background(), username)
+}
+
+func (s *Store) GetCredentialsContext(ctx context.Context, username string) ([]userdb.WebAuthnCredential, error) {
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.WebAuthn, nil
+}
+
+func (s *Store) GetUsernameWithCredentialID(id []byte) (string, error) {
+	return s.GetUsernameWithCredentialIDContext(context.Background(), id)
+}
+
+func (s *Store) GetUsernameWithCredentialIDContext(ctx context.Context, id []byte) (string, error) {
+	cursor, err := r.Table(table).GetAllByIndex("credentialID", id).Pluck("username").Run(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return "", core.ErrorNoSuchUser
+	}
+
+	var user User
+	err = cursor.One(&user)
+	if err != nil {
+		return "", err
+	}
+
+	return user.Username, nil
+}
+
+// UpdateCredentials uses optimistic locking like UpdateTOTP
+func (s *Store) UpdateCredentials(username string, update func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error)) error {
+	return s.UpdateCredentialsContext(context.Background(), username, update)
+}
+
+func (s *Store) UpdateCredentialsContext(ctx context.Context, username string, update func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error)) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		user, err := s.GetWithUsernameContext(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		credentials, err := update(userdb.CopyCredentials(user.WebAuthn))
+		if err != nil {
+			return err
+		}
+
+		if len(credentials) == 0 && len(user.WebAuthn) == 0 ||
+			reflect.DeepEqual(credentials, user.WebAuthn) {
+			return nil
+		}
+
+		if credentials == nil {
+			credentials = []userdb.WebAuthnCredential{}
+		}
+
+		old := user.WebAuthn
+		if old == nil {
+			old = []userdb.WebAuthnCredential{}
+		}
+
+		result, err := r.Table(table).Get(user.ID).Update(func(row r.Term) interface{} {
+			return r.Branch(
+				row.Field("webauthn").Default([]interface{}{}).Eq(old),
+				map[string]interface{}{"webauthn": credentials},
+				map[string]interface{}{},
+			)
+		}).RunWrite(s.session, r.RunOpts{Context: ctx})
+		if err != nil {
+			return err
+		}
+
+		if result.Replaced == 1 {
+			return nil
+		}
+	}
+
+	return core.ErrorInternalError
+}
+
+func (s *Store) GetUsernameWithIdentity(issuer, subject string) (string, error) {
+	return s.GetUsernameWithIdentityContext(context.Background(), issuer, subject)
+}
+
+func (s *Store) GetUsernameWithIdentityContext(ctx context.Context, issuer, subject string) (string, error) {
+	cursor, err := r.Table(table).GetAllByIndex("identity", []interface{}{issuer, subject}).Pluck("username").Run(s.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return "", err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return "", core.ErrorNoSuchUser
+	}
+
+	var user User
+	err = cursor.One(&user)
+	if err != nil {
+		return "", err
+	}
+
+	return user.Username, nil
+}
+
+func (s *Store) LinkIdentity(username, issuer, subject string) error {
+	return s.LinkIdentityContext(context.Background(), username, issuer, subject)
+}
+
+func (s *Store) LinkIdentityContext(ctx context.Context, username, issuer, subject string) error {
+	// Same race as in UserExists, RethinkDB has no unique secondary indexes
+	linked, err := s.GetUsernameWithIdentityContext(ctx, issuer, subject)
+	if err == nil {
+		if linked != username {
+			return core.ErrorUserAlreadyExists
+		}
+		return nil
+	}
+	if err != core.ErrorNoSuchUser {
+		return err
+	}
+
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	identity := userdb.Identity{Issuer: issuer, Subject: subject}
+	return r.Table(table).Get(user.ID).Update(func(row r.Term) interface{} {
+		return map[string]interface{}{
+			"identities": row.Field("identities").Default([]interface{}{}).Append(identity),
+		}
+	}).Exec(s.session, r.ExecOpts{Context: ctx})
+}
+
+func (s *Store) UnlinkIdentity(username, issuer, subject string) error {
+	return s.UnlinkIdentityContext(context.Background(), username, issuer, subject)
+}
+
+func (s *Store) UnlinkIdentityContext(ctx context.Context, username, issuer, subject string) error {
+	user, err := s.GetWithUsernameContext(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	return r.Table(table).Get(user.ID).Update(func(row r.Term) interface{} {
+		return map[string]interface{}{
+			"identities": row.Field("identities").Default([]interface{}{}).Filter(func(identity r.Term) interface{} {
+				return identity.Field("issuer").Ne(issuer).Or(identity.Field("subject").Ne(subject))
+			}),
+		}
+	}).Exec(s.session, r.ExecOpts{Context: ctx})
 }
@@ -2,11 +2,15 @@ package rethinkdb
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/userdb"
+	"github.com/janekolszak/idp/userdb/hasher"
 	"github.com/stretchr/testify/assert"
-	r "gopkg.in/dancannon/gorethink.v2"
+	r "gopkg.in/gorethink/gorethink.v3"
 )
 
 const (
@@ -70,6 +74,41 @@ func TestInsert(t *testing.T) {
 	assert.NotNil(err)
 }
 
+func TestAdd(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	// Users without addresses don't collide
+	assert.Nil(store.Add("joe", testUserPassword))
+	assert.Nil(store.Add("ann", testUserPassword))
+	assert.Equal(core.ErrorUserAlreadyExists, store.Add("joe", testUserPassword))
+
+	assert.Nil(store.Check("joe", testUserPassword))
+}
+
+func TestUserExists(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	_, err = store.Insert(&User{Username: "joe", Email: "joe@example.com"}, testUserPassword)
+	assert.Nil(err)
+	_, err = store.Insert(&User{Username: "bob"}, testUserPassword)
+	assert.Nil(err)
+
+	assert.Equal(core.ErrorUserAlreadyExists, store.UserExists("joe", ""))
+	assert.Equal(core.ErrorUserAlreadyExists, store.UserExists("ann", "joe@example.com"))
+
+	// Empty address isn't compared with bob's
+	assert.Nil(store.UserExists("ann", ""))
+	assert.Nil(store.UserExists("ann", "ann@example.com"))
+}
+
 func TestGetWithUsername(t *testing.T) {
 	assert := assert.New(t)
 	assert.Nil(Cleanup())
@@ -91,6 +130,24 @@ func TestGetWithUsername(t *testing.T) {
 	assert.Equal(user.Email, testUser.Email)
 }
 
+func TestGetUsernameWithEmail(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	_, err = store.GetUsernameWithEmail(testUser.Email)
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	_, err = store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	username, err := store.GetUsernameWithEmail(testUser.Email)
+	assert.Nil(err)
+	assert.Equal(testUser.Username, username)
+}
+
 func TestGetWithID(t *testing.T) {
 	assert := assert.New(t)
 	assert.Nil(Cleanup())
@@ -214,3 +271,242 @@ func TestCheck(t *testing.T) {
 	err = store.Check(testUser.Username, testUserPassword+"stuff")
 	assert.Equal(err, core.ErrorAuthenticationFailure)
 }
+
+func TestRehash(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+	assert.NotNil(store)
+
+	store.Hasher = &hasher.Bcrypt{Cost: 4}
+	id, err := store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	// Parameters change, the hash is replaced on the next successful check
+	store.Hasher = hasher.Chain{&hasher.Scrypt{LogN: 4}, &hasher.Bcrypt{Cost: 4}}
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Nil(err)
+
+	user, err := store.GetWithID(id)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(string(user.Password), "$scrypt$"))
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Nil(err)
+}
+
+func TestSetPasswordWithID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+	assert.NotNil(store)
+
+	id, err := store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	err = store.SetPasswordWithID(id, "newPassword")
+	assert.Nil(err)
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Equal(err, core.ErrorAuthenticationFailure)
+
+	err = store.Check(testUser.Username, "newPassword")
+	assert.Nil(err)
+
+	err = store.SetPasswordWithID("nonexistent", "newPassword")
+	assert.Equal(err, core.ErrorNoSuchUser)
+}
+
+func TestChangePassword(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+	assert.NotNil(store)
+
+	_, err = store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	// Wrong old password
+	err = store.ChangePassword(testUser.Username, "badPassword", "newPassword")
+	assert.Equal(err, core.ErrorAuthenticationFailure)
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Nil(err)
+
+	err = store.ChangePassword(testUser.Username, testUserPassword, "newPassword")
+	assert.Nil(err)
+
+	err = store.Check(testUser.Username, "newPassword")
+	assert.Nil(err)
+}
+
+func TestCheckPolicy(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+	store.Policy = &userdb.RequireVerified{}
+
+	id, err := store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Equal(core.ErrorNotVerified, err)
+
+	// Bad password is reported first
+	err = store.Check(testUser.Username, "badPassword")
+	assert.Equal(core.ErrorAuthenticationFailure, err)
+
+	// Grace period after the registration
+	store.Policy = &userdb.RequireVerified{GracePeriod: time.Hour}
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Nil(err)
+
+	store.Policy = &userdb.RequireVerified{}
+	err = store.SetIsVerifiedWithID(id)
+	assert.Nil(err)
+
+	err = store.Check(testUser.Username, testUserPassword)
+	assert.Nil(err)
+}
+
+func TestUpdateTOTP(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	_, err = store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	factor, err := store.GetTOTP(testUser.Username)
+	assert.Nil(err)
+	assert.Nil(factor)
+
+	err = store.UpdateTOTP(testUser.Username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		assert.Nil(factor)
+		return &userdb.TOTPFactor{Secret: "secret", RecoveryCodes: []string{"a", "b"}}, nil
+	})
+	assert.Nil(err)
+
+	err = store.UpdateTOTP(testUser.Username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		factor.Enabled = true
+		factor.LastStep = 10
+		return factor, nil
+	})
+	assert.Nil(err)
+
+	factor, err = store.GetTOTP(testUser.Username)
+	assert.Nil(err)
+	assert.Equal("secret", factor.Secret)
+	assert.True(factor.Enabled)
+	assert.Equal(int64(10), factor.LastStep)
+	assert.Equal([]string{"a", "b"}, factor.RecoveryCodes)
+
+	// Aborted update
+	err = store.UpdateTOTP(testUser.Username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		return nil, core.ErrorBadSecondFactor
+	})
+	assert.Equal(core.ErrorBadSecondFactor, err)
+
+	// Removed
+	err = store.UpdateTOTP(testUser.Username, func(factor *userdb.TOTPFactor) (*userdb.TOTPFactor, error) {
+		return nil, nil
+	})
+	assert.Nil(err)
+
+	factor, err = store.GetTOTP(testUser.Username)
+	assert.Nil(err)
+	assert.Nil(factor)
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	_, err = store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	_, err = store.GetUsernameWithCredentialID([]byte("id"))
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = store.UpdateCredentials(testUser.Username, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		assert.Len(credentials, 0)
+		return append(credentials, userdb.WebAuthnCredential{ID: []byte("id"), SignCount: 1}), nil
+	})
+	assert.Nil(err)
+
+	username, err := store.GetUsernameWithCredentialID([]byte("id"))
+	assert.Nil(err)
+	assert.Equal(testUser.Username, username)
+
+	err = store.UpdateCredentials(testUser.Username, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		credentials[0].SignCount = 2
+		return credentials, nil
+	})
+	assert.Nil(err)
+
+	credentials, err := store.GetCredentials(testUser.Username)
+	assert.Nil(err)
+	assert.Len(credentials, 1)
+	assert.Equal(uint32(2), credentials[0].SignCount)
+
+	err = store.UpdateCredentials(testUser.Username, func(credentials []userdb.WebAuthnCredential) ([]userdb.WebAuthnCredential, error) {
+		return nil, nil
+	})
+	assert.Nil(err)
+
+	_, err = store.GetUsernameWithCredentialID([]byte("id"))
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+func TestIdentities(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Cleanup())
+
+	store, err := NewStore(session)
+	assert.Nil(err)
+
+	_, err = store.Insert(testUser, testUserPassword)
+	assert.Nil(err)
+
+	_, err = store.GetUsernameWithIdentity("https://issuer", "1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	err = store.LinkIdentity(testUser.Username, "https://issuer", "1")
+	assert.Nil(err)
+
+	username, err := store.GetUsernameWithIdentity("https://issuer", "1")
+	assert.Nil(err)
+	assert.Equal(testUser.Username, username)
+
+	err = store.LinkIdentity("other", "https://issuer", "1")
+	assert.Equal(core.ErrorUserAlreadyExists, err)
+
+	err = store.UnlinkIdentity(testUser.Username, "https://issuer", "1")
+	assert.Nil(err)
+
+	_, err = store.GetUsernameWithIdentity("https://issuer", "1")
+	assert.Equal(core.ErrorNoSuchUser, err)
+}
+
+// Providers pass the request's context to the store
+var (
+	_ userdb.ContextStore           = (*Store)(nil)
+	_ userdb.PasswordContextStore   = (*Store)(nil)
+	_ userdb.FactorContextStore     = (*Store)(nil)
+	_ userdb.CredentialContextStore = (*Store)(nil)
+	_ userdb.IdentityContextStore   = (*Store)(nil)
+)
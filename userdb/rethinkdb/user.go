@@ -1,6 +1,10 @@
 package rethinkdb
 
-import "time"
+import (
+	"time"
+
+	"github.com/janekolszak/idp/userdb"
+)
 
 type User struct {
 	ID               string    `json:"id,omitempty" gorethink:"id,omitempty"`
@@ -11,6 +15,16 @@ type User struct {
 	Email            string    `json:"email" gorethink:"email"`
 	IsVerified       bool      `json:"isVerified" gorethink:"isVerified"`
 	RegistrationTime time.Time `json:"registrationTime" gorethink:"registrationTime"`
+
+	// Second factor, nil if the user has none.
+	// Not in JSON, the secret shouldn't leave the database.
+	TOTP *userdb.TOTPFactor `json:"-" gorethink:"totp,omitempty"`
+
+	// Authenticators registered with WebAuthn
+	WebAuthn []userdb.WebAuthnCredential `json:"webauthn,omitempty" gorethink:"webauthn,omitempty"`
+
+	// Linked accounts at upstream identity providers
+	Identities []userdb.Identity `json:"identities,omitempty" gorethink:"identities,omitempty"`
 }
 
 func (u *User) GetUsername() string {
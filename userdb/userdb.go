@@ -1,12 +1,89 @@
 package userdb
 
-import "time"
+import (
+	"context"
+	"time"
+)
+
+// PasswordHasher creates and verifies password hashes
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+
+	// Verify checks the password against the encoded hash.
+	// needsRehash is true when the hash was created with outdated parameters
+	// and should be replaced with a new one while the password is known.
+	Verify(hash, password string) (needsRehash bool, err error)
+}
 
 type Store interface {
 	Check(username, password string) error
 	Add(username, password string) error
 }
 
+// ContextStore is a Store whose calls to the database are canceled with the context,
+// e.g. when the browser disconnects. Implemented by the stores in this repository.
+type ContextStore interface {
+	CheckContext(ctx context.Context, username, password string) error
+	AddContext(ctx context.Context, username, password string) error
+}
+
+// WithContext returns the store itself if it's a ContextStore.
+// Other stores are adapted, they ignore the context.
+func WithContext(s Store) ContextStore {
+	if cs, ok := s.(ContextStore); ok {
+		return cs
+	}
+	return contextAdapter{s}
+}
+
+type contextAdapter struct {
+	Store
+}
+
+func (a contextAdapter) CheckContext(ctx context.Context, username, password string) error {
+	return a.Check(username, password)
+}
+
+func (a contextAdapter) AddContext(ctx context.Context, username, password string) error {
+	return a.Add(username, password)
+}
+
+// PasswordStore replaces passwords of existing users
+type PasswordStore interface {
+	SetPassword(username, password string) error
+
+	// ChangePassword replaces the password if the old one is correct
+	ChangePassword(username, oldPassword, newPassword string) error
+}
+
+// PasswordContextStore is a PasswordStore whose calls to the database are canceled with the context
+type PasswordContextStore interface {
+	SetPasswordContext(ctx context.Context, username, password string) error
+	ChangePasswordContext(ctx context.Context, username, oldPassword, newPassword string) error
+}
+
+// PasswordsWithContext returns the store itself if it's a PasswordContextStore.
+// Other stores are adapted, they ignore the context.
+func PasswordsWithContext(s PasswordStore) PasswordContextStore {
+	if cs, ok := s.(PasswordContextStore); ok {
+		return cs
+	}
+	return passwordAdapter{s}
+}
+
+type passwordAdapter struct {
+	PasswordStore
+}
+
+func (a passwordAdapter) SetPasswordContext(ctx context.Context, username, password string) error {
+	return a.SetPassword(username, password)
+}
+
+func (a passwordAdapter) ChangePasswordContext(ctx context.Context, username, oldPassword, newPassword string) error {
+	return a.ChangePassword(username, oldPassword, newPassword)
+}
+
 type UserInfo interface {
 	GetUsername() string
 	GetPassword() string
@@ -0,0 +1,306 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	dbTablename         = "verifyemails"
+	defaultPollInterval = 5 * time.Second
+)
+
+// DBQueue keeps verifications in an SQL database, SQLite ("sqlite3" driver)
+// or PostgreSQL ("postgres" and "pgx" drivers).
+// The Worker polls for unsent verifications. Each one is claimed with a conditional
+// UPDATE that locks the row, so workers in many processes never send the same email.
+type DBQueue struct {
+	// How often the database is checked for unsent verifications
+	PollInterval time.Duration
+
+	// Claimed verifications aren't handed to other workers for this long.
+	// If the email wasn't sent, it's retried after that.
+	RetryInterval time.Duration
+
+	db    *sql.DB
+	table string
+
+	// PostgreSQL uses $1, $2... instead of ? placeholders
+	numbered bool
+}
+
+var numberedDrivers = map[string]bool{
+	"postgres": true,
+	"pgx":      true,
+}
+
+func NewDBQueue(driverName, databaseSourceName string) (*DBQueue, error) {
+	var q = new(DBQueue)
+	q.table = dbTablename
+	q.PollInterval = defaultPollInterval
+	q.RetryInterval = defaultRetryInterval
+	q.numbered = numberedDrivers[driverName]
+
+	var err error
+	q.db, err = sql.Open(driverName, databaseSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	// Some drivers execute only the first statement, so they're separate
+	sqlStmts := []string{`
+		CREATE TABLE IF NOT EXISTS %[1]s (code           VARCHAR(36) NOT NULL PRIMARY KEY,
+					                      userID         VARCHAR(255) NOT NULL,
+					                      email          TEXT NOT NULL,
+					                      sentCount      INTEGER NOT NULL,
+					                      lastSentTime   TIMESTAMP,
+					                      creationTime   TIMESTAMP NOT NULL,
+					                      claimedUntil   TIMESTAMP)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_creationTime ON %[1]s (creationTime)`,
+		`CREATE INDEX IF NOT EXISTS %[1]s_userID ON %[1]s (userID)`,
+	}
+
+	for _, sqlStmt := range sqlStmts {
+		_, err = q.db.Exec(fmt.Sprintf(sqlStmt, q.table))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// Returns the query with the table name and the driver's placeholders
+func (q *DBQueue) query(format string) string {
+	query := fmt.Sprintf(format, q.table)
+	if !q.numbered {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+
+		n++
+		fmt.Fprintf(&b, "$%d", n)
+	}
+
+	return b.String()
+}
+
+// Times are kept in UTC, so they compare correctly in every database
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+func (q *DBQueue) scan(row *sql.Row) (*Verification, error) {
+	var v Verification
+	var lastSentTime *time.Time
+	err := row.Scan(&v.ID, &v.UserID, &v.Email, &v.SentCount, &lastSentTime, &v.CreationTime)
+	if err == sql.ErrNoRows {
+		return nil, core.ErrorBadRequest
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if lastSentTime != nil {
+		v.LastSentTime = *lastSentTime
+	}
+
+	return &v, nil
+}
+
+func (q *DBQueue) Push(verification *Verification) (code string, err error) {
+	return q.PushContext(context.Background(), verification)
+}
+
+func (q *DBQueue) PushContext(ctx context.Context, verification *Verification) (code string, err error) {
+	code = uuid.NewV4().String()
+
+	_, err = q.db.ExecContext(ctx, q.query("INSERT INTO %s(code, userID, email, sentCount, creationTime) values(?, ?, ?, ?, ?)"),
+		code, verification.UserID, verification.Email, verification.SentCount, utcNow())
+	if err != nil {
+		code = ""
+	}
+
+	return
+}
+
+func (q *DBQueue) GetWithUserID(userID string) (*Verification, error) {
+	return q.GetWithUserIDContext(context.Background(), userID)
+}
+
+func (q *DBQueue) GetWithUserIDContext(ctx context.Context, userID string) (*Verification, error) {
+	row := q.db.QueryRowContext(ctx, q.query("SELECT code, userID, email, sentCount, lastSentTime, creationTime FROM %s WHERE userID=? LIMIT 1"), userID)
+	return q.scan(row)
+}
+
+func (q *DBQueue) Take(code string) (v *Verification, err error) {
+	return q.TakeContext(context.Background(), code)
+}
+
+func (q *DBQueue) TakeContext(ctx context.Context, code string) (v *Verification, err error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	v, err = q.scan(tx.QueryRowContext(ctx, q.query("SELECT code, userID, email, sentCount, lastSentTime, creationTime FROM %s WHERE code=?"), code))
+	if err != nil {
+		return
+	}
+
+	result, err := tx.ExecContext(ctx, q.query("DELETE FROM %s WHERE code=?"), code)
+	if err != nil {
+		return
+	}
+
+	// Taken concurrently
+	n, err := result.RowsAffected()
+	if err == nil && n != 1 {
+		err = core.ErrorBadRequest
+	}
+
+	return
+}
+
+func (q *DBQueue) MarkSent(code string, sentCount int) (ok bool, err error) {
+	return q.MarkSentContext(context.Background(), code, sentCount)
+}
+
+func (q *DBQueue) MarkSentContext(ctx context.Context, code string, sentCount int) (ok bool, err error) {
+	result, err := q.db.ExecContext(ctx, q.query("UPDATE %s SET sentCount=sentCount+1, lastSentTime=?, claimedUntil=NULL WHERE code=? AND sentCount=?"),
+		utcNow(), code, sentCount)
+	if err != nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	ok = n == 1
+	return
+}
+
+// Claims one unsent verification, returns nil if there's none
+func (q *DBQueue) claim(ctx context.Context) (v *Verification, err error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	t := utcNow()
+	v, err = q.scan(tx.QueryRowContext(ctx, q.query(`SELECT code, userID, email, sentCount, lastSentTime, creationTime FROM %s
+		WHERE sentCount=0 AND (claimedUntil IS NULL OR claimedUntil<?) LIMIT 1`), t))
+	if err == core.ErrorBadRequest {
+		// Nothing to send
+		v, err = nil, nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Same condition, so only one of the concurrent transactions claims the row
+	result, err := tx.ExecContext(ctx, q.query(`UPDATE %s SET claimedUntil=?
+		WHERE code=? AND sentCount=0 AND (claimedUntil IS NULL OR claimedUntil<?)`),
+		t.Add(q.RetryInterval), v.ID, t)
+	if err != nil {
+		return
+	}
+
+	n, err := result.RowsAffected()
+	if err == nil && n != 1 {
+		v = nil
+	}
+
+	return
+}
+
+func (q *DBQueue) Pending(stop <-chan bool) (<-chan *Verification, error) {
+	out := make(chan *Verification)
+
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(q.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			for {
+				// Errors are retried in the next tick
+				v, err := q.claim(context.Background())
+				if err != nil || v == nil {
+					break
+				}
+
+				select {
+				case out <- v:
+				case <-stop:
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (q *DBQueue) DeleteExpired(deadline time.Time) error {
+	return q.DeleteExpiredContext(context.Background(), deadline)
+}
+
+func (q *DBQueue) DeleteExpiredContext(ctx context.Context, deadline time.Time) error {
+	_, err := q.db.ExecContext(ctx, q.query("DELETE FROM %s WHERE creationTime<?"), deadline.UTC())
+	return err
+}
+
+func (q *DBQueue) Count() (uint, error) {
+	return q.CountContext(context.Background())
+}
+
+func (q *DBQueue) CountContext(ctx context.Context) (uint, error) {
+	var count uint
+	err := q.db.QueryRowContext(ctx, q.query("SELECT COUNT(*) FROM %s")).Scan(&count)
+	return count, err
+}
+
+func (q *DBQueue) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,80 @@
+package verifier
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testDBFileName = "/tmp/idp_verifier_test.db3"
+)
+
+func TestDBQueue(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testDBFileName)
+
+	q, err := NewDBQueue("sqlite3", testDBFileName)
+	assert.Nil(err)
+	defer q.Close()
+	q.PollInterval = 10 * time.Millisecond
+
+	testQueue(t, q)
+}
+
+func TestDBQueueClaim(t *testing.T) {
+	assert := assert.New(t)
+	os.Remove(testDBFileName)
+
+	q, err := NewDBQueue("sqlite3", testDBFileName)
+	assert.Nil(err)
+	defer q.Close()
+	q.RetryInterval = 100 * time.Millisecond
+
+	code, err := q.Push(&Verification{UserID: TEST_USER_ID, Email: TEST_EMAIL})
+	assert.Nil(err)
+
+	v, err := q.claim(context.Background())
+	assert.Nil(err)
+	assert.Equal(code, v.ID)
+
+	// Claimed by another worker
+	other, err := NewDBQueue("sqlite3", testDBFileName)
+	assert.Nil(err)
+	defer other.Close()
+
+	v, err = other.claim(context.Background())
+	assert.Nil(err)
+	assert.Nil(v)
+
+	// Email wasn't sent, retried after the claim expires
+	time.Sleep(150 * time.Millisecond)
+	v, err = other.claim(context.Background())
+	assert.Nil(err)
+	assert.Equal(code, v.ID)
+
+	// Sent
+	ok, err := other.MarkSent(code, 0)
+	assert.Nil(err)
+	assert.True(ok)
+
+	time.Sleep(150 * time.Millisecond)
+	v, err = q.claim(context.Background())
+	assert.Nil(err)
+	assert.Nil(v)
+}
+
+func TestDBQueuePlaceholders(t *testing.T) {
+	assert := assert.New(t)
+
+	q := &DBQueue{table: "verifications"}
+	assert.Equal("UPDATE verifications SET sentCount=? WHERE code=?", q.query("UPDATE %s SET sentCount=? WHERE code=?"))
+
+	q.numbered = true
+	assert.Equal("UPDATE verifications SET sentCount=$1 WHERE code=$2", q.query("UPDATE %s SET sentCount=? WHERE code=?"))
+}
@@ -0,0 +1,74 @@
+package verifier
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/janekolszak/idp/core"
+)
+
+const (
+	CodeParam     = "code"
+	UsernameField = "username"
+)
+
+// VerifyHandler handles the links from the emails, the code is the "code" query parameter.
+// Responds with a plain text message.
+func (v *Verifier) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := v.VerifyContext(r.Context(), r.URL.Query().Get(CodeParam))
+	switch err {
+	case nil:
+		http.Error(w, "Your email address is verified", http.StatusOK)
+
+	case core.ErrorBadRequest:
+		http.Error(w, "Verification link is invalid or was already used", http.StatusBadRequest)
+
+	case core.ErrorTokenExpired:
+		http.Error(w, "Verification link expired, request a new one", http.StatusBadRequest)
+
+	default:
+		writeError(w, err)
+	}
+}
+
+// ResendHandler sends the verification email again, the user is identified by the
+// "username" form field of a POST request. Responds with a plain text message,
+// e.g. "too many requests, try again in 5 minutes".
+func (v *Verifier) ResendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PostFormValue(UsernameField)
+	if username == "" {
+		http.Error(w, "Enter your username", http.StatusBadRequest)
+		return
+	}
+
+	// Unknown and verified users get the same response, it doesn't reveal who has an account
+	err := v.ResendWithUsernameContext(r.Context(), username)
+	switch err {
+	case nil, core.ErrorNoSuchUser, core.ErrorBadRequest:
+		http.Error(w, "If the account needs verification, an email was sent", http.StatusOK)
+
+	default:
+		writeError(w, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*core.ErrorRetryLater); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter.Seconds()+1)))
+		http.Error(w, e.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	if err == core.ErrorTooManyRequests {
+		http.Error(w, "Too many verification emails were sent, try again when the link expires", http.StatusTooManyRequests)
+		return
+	}
+
+	http.Error(w, "An error occurred", http.StatusInternalServerError)
+}
@@ -0,0 +1,86 @@
+package verifier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resend(v *Verifier, username string) *httptest.ResponseRecorder {
+	form := url.Values{UsernameField: {username}}
+	r := httptest.NewRequest(http.MethodPost, "/resend", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	v.ResendHandler(w, r)
+	return w
+}
+
+func verify(v *Verifier, code string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	v.VerifyHandler(w, httptest.NewRequest(http.MethodGet, "/verify?code="+url.QueryEscape(code), nil))
+	return w
+}
+
+const resendSent = "If the account needs verification, an email was sent\n"
+
+func TestHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.ResendInterval = time.Hour
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+
+	w := httptest.NewRecorder()
+	verifier.ResendHandler(w, httptest.NewRequest(http.MethodGet, "/resend", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+
+	w = resend(verifier, "")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	// Unknown users look like the others
+	w = resend(verifier, "bob")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(resendSent, w.Body.String())
+
+	code, err := verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+
+	_, err = config.Queue.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+
+	w = resend(verifier, TEST_USERNAME)
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(w.Header().Get("Retry-After"))
+	assert.Contains(w.Body.String(), "too many requests, try again in 60 minutes")
+
+	w = verify(verifier, "nonexistent")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "invalid or was already used")
+
+	w = verify(verifier, code)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.True(verifier.Users.(*testUsers).isVerified(TEST_USER_ID))
+
+	w = resend(verifier, TEST_USERNAME)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(resendSent, w.Body.String())
+}
+
+func TestResendHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	verifier, err := NewVerifier(testConfig(t))
+	assert.Nil(err)
+
+	w := resend(verifier, TEST_USERNAME)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(resendSent, w.Body.String())
+}
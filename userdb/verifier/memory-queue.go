@@ -0,0 +1,190 @@
+package verifier
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	defaultRetryInterval = time.Minute
+)
+
+// MemoryQueue keeps verifications in memory, they're lost on restart.
+type MemoryQueue struct {
+	// Verifications handed to the Worker aren't handed again for this long.
+	// If the email wasn't sent, it's retried after that.
+	RetryInterval time.Duration
+
+	mtx           sync.Mutex
+	verifications map[string]*Verification
+	claims        map[string]time.Time
+	pushed        chan bool
+}
+
+func NewMemoryQueue() (*MemoryQueue, error) {
+	q := new(MemoryQueue)
+	q.RetryInterval = defaultRetryInterval
+	q.verifications = make(map[string]*Verification)
+	q.claims = make(map[string]time.Time)
+	q.pushed = make(chan bool, 1)
+
+	return q, nil
+}
+
+func (q *MemoryQueue) Push(verification *Verification) (code string, err error) {
+	return q.PushContext(context.Background(), verification)
+}
+
+func (q *MemoryQueue) PushContext(ctx context.Context, verification *Verification) (code string, err error) {
+	v := *verification
+	v.ID = uuid.NewV4().String()
+	v.CreationTime = time.Now()
+
+	q.mtx.Lock()
+	q.verifications[v.ID] = &v
+	q.mtx.Unlock()
+
+	// Wake up Pending
+	select {
+	case q.pushed <- true:
+	default:
+	}
+
+	return v.ID, nil
+}
+
+func (q *MemoryQueue) GetWithUserID(userID string) (*Verification, error) {
+	return q.GetWithUserIDContext(context.Background(), userID)
+}
+
+func (q *MemoryQueue) GetWithUserIDContext(ctx context.Context, userID string) (*Verification, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for _, v := range q.verifications {
+		if v.UserID == userID {
+			result := *v
+			return &result, nil
+		}
+	}
+
+	return nil, core.ErrorBadRequest
+}
+
+func (q *MemoryQueue) Take(code string) (*Verification, error) {
+	return q.TakeContext(context.Background(), code)
+}
+
+func (q *MemoryQueue) TakeContext(ctx context.Context, code string) (*Verification, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	v, ok := q.verifications[code]
+	if !ok {
+		return nil, core.ErrorBadRequest
+	}
+
+	delete(q.verifications, code)
+	delete(q.claims, code)
+	return v, nil
+}
+
+func (q *MemoryQueue) MarkSent(code string, sentCount int) (ok bool, err error) {
+	return q.MarkSentContext(context.Background(), code, sentCount)
+}
+
+func (q *MemoryQueue) MarkSentContext(ctx context.Context, code string, sentCount int) (ok bool, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	v, exists := q.verifications[code]
+	if !exists || v.SentCount != sentCount {
+		return false, nil
+	}
+
+	v.SentCount++
+	v.LastSentTime = time.Now()
+	delete(q.claims, code)
+	return true, nil
+}
+
+// Returns a copy of an unsent verification that isn't handed to the Worker already
+func (q *MemoryQueue) claim(now time.Time) *Verification {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for code, v := range q.verifications {
+		if v.SentCount != 0 || now.Before(q.claims[code]) {
+			continue
+		}
+
+		q.claims[code] = now.Add(q.RetryInterval)
+		result := *v
+		return &result
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Pending(stop <-chan bool) (<-chan *Verification, error) {
+	out := make(chan *Verification)
+
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(q.RetryInterval)
+		defer ticker.Stop()
+
+		for {
+			for v := q.claim(time.Now()); v != nil; v = q.claim(time.Now()) {
+				select {
+				case out <- v:
+				case <-stop:
+					return
+				}
+			}
+
+			select {
+			case <-q.pushed:
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (q *MemoryQueue) DeleteExpired(deadline time.Time) error {
+	return q.DeleteExpiredContext(context.Background(), deadline)
+}
+
+func (q *MemoryQueue) DeleteExpiredContext(ctx context.Context, deadline time.Time) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for code, v := range q.verifications {
+		if v.CreationTime.Before(deadline) {
+			delete(q.verifications, code)
+			delete(q.claims, code)
+		}
+	}
+
+	return nil
+}
+
+func (q *MemoryQueue) Count() (uint, error) {
+	return q.CountContext(context.Background())
+}
+
+func (q *MemoryQueue) CountContext(ctx context.Context) (uint, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return uint(len(q.verifications)), nil
+}
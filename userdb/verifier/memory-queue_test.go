@@ -0,0 +1,16 @@
+package verifier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	q, err := NewMemoryQueue()
+	assert.Nil(err)
+
+	testQueue(t, q)
+}
@@ -0,0 +1,105 @@
+package verifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks the behavior shared by all Queue implementations
+func testQueue(t *testing.T, q Queue) {
+	assert := assert.New(t)
+
+	_, err := q.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	_, err = q.TakeContext(context.Background(), "nonexistent")
+	assert.Equal(core.ErrorBadRequest, err)
+
+	code, err := q.PushContext(context.Background(), &Verification{UserID: TEST_USER_ID, Email: TEST_EMAIL})
+	assert.Nil(err)
+	assert.NotEqual("", code)
+
+	count, err := q.CountContext(context.Background())
+	assert.Nil(err)
+	assert.Equal(1, int(count))
+
+	v, err := q.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Nil(err)
+	assert.Equal(code, v.ID)
+	assert.Equal(TEST_EMAIL, v.Email)
+	assert.Equal(0, v.SentCount)
+	assert.True(v.LastSentTime.IsZero())
+	assert.False(v.CreationTime.IsZero())
+
+	// Delivered as pending
+	stop := make(chan bool)
+	pending, err := q.Pending(stop)
+	assert.Nil(err)
+
+	select {
+	case v = <-pending:
+		assert.Equal(code, v.ID)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Verification not delivered")
+	}
+
+	ok, err := q.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+	assert.True(ok)
+
+	// Counter changed in the meantime
+	ok, err = q.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+	assert.False(ok)
+
+	close(stop)
+	for range pending {
+	}
+
+	v, err = q.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Nil(err)
+	assert.Equal(1, v.SentCount)
+	assert.False(v.LastSentTime.IsZero())
+
+	// Not expired yet
+	err = q.DeleteExpiredContext(context.Background(), time.Now().Add(-time.Hour))
+	assert.Nil(err)
+
+	v, err = q.TakeContext(context.Background(), code)
+	assert.Nil(err)
+	assert.Equal(TEST_USER_ID, v.UserID)
+	assert.Equal(1, v.SentCount)
+
+	// Single use
+	_, err = q.TakeContext(context.Background(), code)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	// Expired
+	code, err = q.PushContext(context.Background(), &Verification{UserID: TEST_USER_ID, Email: TEST_EMAIL})
+	assert.Nil(err)
+
+	unsent, err := q.PushContext(context.Background(), &Verification{UserID: "otherUserID", Email: TEST_EMAIL})
+	assert.Nil(err)
+
+	ok, err = q.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+	assert.True(ok)
+
+	err = q.DeleteExpiredContext(context.Background(), time.Now().Add(time.Hour))
+	assert.Nil(err)
+
+	_, err = q.TakeContext(context.Background(), code)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	// Unsent verifications expire too
+	_, err = q.TakeContext(context.Background(), unsent)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	count, err = q.CountContext(context.Background())
+	assert.Nil(err)
+	assert.Equal(0, int(count))
+}
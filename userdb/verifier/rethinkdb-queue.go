@@ -0,0 +1,233 @@
+package verifier
+
+import (
+	"context"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	r "gopkg.in/gorethink/gorethink.v3"
+)
+
+const (
+	tablename = "verifyEmails"
+)
+
+// Data received from RethinkDB in the Change feed
+type VerificationChange struct {
+	Old *Verification `gorethink:"old_val"`
+	New *Verification `gorethink:"new_val"`
+}
+
+// RethinkDBQueue keeps verifications in RethinkDB.
+// Unsent verifications are delivered by a changefeed, so there's no polling,
+// but an email that failed to send is retried only after the Worker restarts.
+type RethinkDBQueue struct {
+	session *r.Session
+	table   string
+}
+
+func NewRethinkDBQueue(session *r.Session) (*RethinkDBQueue, error) {
+	q := new(RethinkDBQueue)
+	q.session = session
+	q.table = tablename
+
+	// Discard error (database exists)
+	db := session.Database()
+	r.DBCreate(db).RunWrite(session)
+	r.DB(db).TableCreate(q.table).RunWrite(session)
+
+	// Index for removing expired verifications
+	r.Table(q.table).IndexCreate("creationTime").Exec(session)
+
+	// Index for resending emails to the user
+	r.Table(q.table).IndexCreate("userID").Exec(session)
+
+	r.Table(q.table).IndexWait().RunWrite(session)
+
+	return q, nil
+}
+
+func (q *RethinkDBQueue) Push(verification *Verification) (code string, err error) {
+	return q.PushContext(context.Background(), verification)
+}
+
+func (q *RethinkDBQueue) PushContext(ctx context.Context, verification *Verification) (code string, err error) {
+	v := *verification
+	v.ID = ""
+	v.CreationTime = time.Now()
+
+	resp, err := r.Table(q.table).Insert(v).RunWrite(q.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return
+	}
+
+	if len(resp.GeneratedKeys) != 1 {
+		err = core.ErrorInternalError
+		return
+	}
+
+	code = resp.GeneratedKeys[0]
+	return
+}
+
+func (q *RethinkDBQueue) GetWithUserID(userID string) (*Verification, error) {
+	return q.GetWithUserIDContext(context.Background(), userID)
+}
+
+func (q *RethinkDBQueue) GetWithUserIDContext(ctx context.Context, userID string) (*Verification, error) {
+	cursor, err := r.Table(q.table).GetAllByIndex("userID", userID).Run(q.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, core.ErrorBadRequest
+	}
+
+	v := new(Verification)
+	err = cursor.One(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (q *RethinkDBQueue) Take(code string) (*Verification, error) {
+	return q.TakeContext(context.Background(), code)
+}
+
+func (q *RethinkDBQueue) TakeContext(ctx context.Context, code string) (*Verification, error) {
+	resp, err := r.Table(q.table).Get(code).Delete(r.DeleteOpts{ReturnChanges: true}).RunWrite(q.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Changes) != 1 {
+		// No such code, e.g. already used
+		return nil, core.ErrorBadRequest
+	}
+
+	old, ok := resp.Changes[0].OldValue.(map[string]interface{})
+	if !ok {
+		return nil, core.ErrorInternalError
+	}
+
+	v := Verification{ID: code}
+	v.UserID, _ = old["userID"].(string)
+	v.Email, _ = old["email"].(string)
+	v.LastSentTime, _ = old["lastSentTime"].(time.Time)
+	v.CreationTime, _ = old["creationTime"].(time.Time)
+	if sentCount, ok := old["sentCount"].(float64); ok {
+		v.SentCount = int(sentCount)
+	}
+
+	if v.UserID == "" {
+		return nil, core.ErrorInternalError
+	}
+
+	return &v, nil
+}
+
+func (q *RethinkDBQueue) MarkSent(code string, sentCount int) (ok bool, err error) {
+	return q.MarkSentContext(context.Background(), code, sentCount)
+}
+
+func (q *RethinkDBQueue) MarkSentContext(ctx context.Context, code string, sentCount int) (ok bool, err error) {
+	resp, err := r.Table(q.table).Get(code).Update(func(row r.Term) interface{} {
+		return r.Branch(
+			row.Field("sentCount").Eq(sentCount),
+			map[string]interface{}{
+				"sentCount":    row.Field("sentCount").Add(1),
+				"lastSentTime": r.Now(),
+			},
+			map[string]interface{}{},
+		)
+	}).RunWrite(q.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return
+	}
+
+	ok = resp.Replaced == 1
+	return
+}
+
+func (q *RethinkDBQueue) Pending(stop <-chan bool) (<-chan *Verification, error) {
+	// Includes verifications pushed while nobody was listening
+	cursor, err := r.Table(q.table).Filter(map[string]interface{}{"sentCount": 0}).Changes(r.ChangesOpts{IncludeInitial: true}).Run(q.session)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan VerificationChange)
+	cursor.Listen(ch)
+
+	out := make(chan *Verification)
+	go func() {
+		defer close(out)
+		defer cursor.Close()
+
+		for {
+			select {
+			case c, ok := <-ch:
+				if !ok {
+					// For example database closing
+					return
+				}
+
+				if c.New == nil {
+					// Sent or verified, left the feed
+					continue
+				}
+
+				select {
+				case out <- c.New:
+				case <-stop:
+					return
+				}
+
+			case <-stop:
+				// Stopping
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (q *RethinkDBQueue) DeleteExpired(deadline time.Time) error {
+	return q.DeleteExpiredContext(context.Background(), deadline)
+}
+
+func (q *RethinkDBQueue) DeleteExpiredContext(ctx context.Context, deadline time.Time) error {
+	return r.Table(q.table).
+		Between(r.MinVal, deadline, r.BetweenOpts{Index: "creationTime"}).
+		Delete().
+		Exec(q.session, r.ExecOpts{Context: ctx})
+}
+
+func (q *RethinkDBQueue) Count() (uint, error) {
+	return q.CountContext(context.Background())
+}
+
+func (q *RethinkDBQueue) CountContext(ctx context.Context) (uint, error) {
+	cursor, err := r.Table(q.table).Count().Run(q.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return 0, err
+	}
+
+	var result interface{}
+	err = cursor.One(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	count, ok := result.(float64)
+	if !ok {
+		return 0, core.ErrorInternalError
+	}
+
+	return uint(count), nil
+}
@@ -0,0 +1,33 @@
+package verifier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	r "gopkg.in/gorethink/gorethink.v3"
+)
+
+const (
+	RETHINKDB_ADDRESS = "localhost:28015"
+	TEST_DATABASE     = "verifyuserstest"
+)
+
+func TestRethinkDBQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	session, err := r.Connect(r.ConnectOpts{
+		Address:  RETHINKDB_ADDRESS,
+		Database: TEST_DATABASE,
+	})
+	if !assert.Nil(err) {
+		return
+	}
+	defer session.Close()
+
+	r.DB(TEST_DATABASE).TableDrop(tablename).Exec(session)
+
+	q, err := NewRethinkDBQueue(session)
+	assert.Nil(err)
+
+	testQueue(t, q)
+}
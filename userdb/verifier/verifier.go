@@ -0,0 +1,381 @@
+package verifier
+
+import (
+	"context"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/mail"
+
+	"time"
+)
+
+const (
+	defaultSubject  = "Verify your email address"
+	defaultTemplate = `Hello,
+
+Please confirm your email address {{.Email}} by opening the link below:
+
+{{.URL}}
+`
+
+	defaultResendInterval = 5 * time.Minute
+	defaultMaxSendCount   = 5
+	defaultTTL            = 72 * time.Hour
+	defaultSweepInterval  = time.Hour
+)
+
+type Verification struct {
+	// ID is a random UUIDv4. We will use it as the "selector code"
+	ID string `json:"id,omitempty" gorethink:"id,omitempty"`
+
+	// User whose email we validate
+	UserID string `json:"userID" gorethink:"userID"`
+
+	Email string `json:"email" gorethink:"email"`
+	// This field holds how many times the verification email was resent
+	SentCount int `json:"sentCount" gorethink:"sentCount"`
+
+	// Time of sending the last email
+	LastSentTime time.Time `json:"lastSentTime,omitempty" gorethink:"lastSentTime,omitempty"`
+
+	// Set by the Queue, the code expires TTL after this
+	CreationTime time.Time `json:"creationTime,omitempty" gorethink:"creationTime,omitempty"`
+}
+
+// Queue keeps the verifications until the user comes back with the code.
+// Implementations: MemoryQueue, DBQueue and RethinkDBQueue. They also have
+// the methods without the context.
+type Queue interface {
+	// PushContext stores a new verification with CreationTime set to now,
+	// the returned ID is the code sent to the user
+	PushContext(ctx context.Context, verification *Verification) (code string, err error)
+
+	// GetWithUserIDContext returns the user's verification
+	GetWithUserIDContext(ctx context.Context, userID string) (*Verification, error)
+
+	// TakeContext removes the verification and returns it, so each code can be used once
+	TakeContext(ctx context.Context, code string) (*Verification, error)
+
+	// MarkSentContext increments SentCount and sets LastSentTime to now,
+	// only if SentCount still equals sentCount. ok is false otherwise.
+	MarkSentContext(ctx context.Context, code string, sentCount int) (ok bool, err error)
+
+	// Pending delivers verifications whose email wasn't sent yet,
+	// including the ones pushed later. The channel is closed after stop is closed.
+	Pending(stop <-chan bool) (<-chan *Verification, error)
+
+	// DeleteExpiredContext removes verifications created before the deadline, sent or not
+	DeleteExpiredContext(ctx context.Context, deadline time.Time) error
+
+	CountContext(ctx context.Context) (uint, error)
+}
+
+// Users whose email addresses are verified, e.g. rethinkdb.Store
+type UserStore interface {
+	SetIsVerifiedWithIDContext(ctx context.Context, id string) error
+
+	// Used when the user asks for another email in the login form
+	GetIDWithUsernameContext(ctx context.Context, username string) (string, error)
+
+	// Used when the verification expired and a new one is sent
+	GetEmailWithIDContext(ctx context.Context, id string) (email string, isVerified bool, err error)
+}
+
+type Config struct {
+	// Stores the verifications
+	Queue Queue
+
+	// Users are marked as verified in this store
+	Users UserStore
+
+	// Sends the verification emails
+	Mailer mail.Mailer
+
+	// Verification page, the code is added as the "code" query parameter
+	URL string
+
+	// Email's subject and text/template of the body.
+	// Template gets .Email, .Code and .URL
+	Subject  string
+	Template string
+
+	// Minimal time between sending two emails with the same code
+	ResendInterval time.Duration
+
+	// Maximal number of emails sent with the same code
+	MaxSendCount int
+
+	// Codes expire this long after the verification was created,
+	// Resend replaces expired verifications with new ones
+	TTL time.Duration
+
+	// How often the Worker removes expired verifications
+	SweepInterval time.Duration
+
+	// Optional, the Worker logs emails it failed to send
+	Logger logging.Logger
+
+	// Optional, gets verified addresses and failed verifications
+	Auditor core.Auditor
+}
+
+func (c *Config) validate() error {
+	if c.Queue == nil ||
+		c.Users == nil ||
+		c.Mailer == nil ||
+		c.URL == "" {
+		return core.ErrorInvalidConfig
+	}
+
+	if c.Subject == "" {
+		c.Subject = defaultSubject
+	}
+
+	if c.Template == "" {
+		c.Template = defaultTemplate
+	}
+
+	if c.ResendInterval <= 0 {
+		c.ResendInterval = defaultResendInterval
+	}
+
+	if c.MaxSendCount <= 0 {
+		c.MaxSendCount = defaultMaxSendCount
+	}
+
+	if c.TTL <= 0 {
+		c.TTL = defaultTTL
+	}
+
+	if c.SweepInterval <= 0 {
+		c.SweepInterval = defaultSweepInterval
+	}
+
+	return nil
+}
+
+// Verifier sends user a verification email with a random code.
+// (UUID v4 according to https://www.rethinkdb.com/api/javascript/uuid/ )
+// When user returns with this particular code he's considered to be verified.
+type Verifier struct {
+	Config
+	worker *Worker
+}
+
+func NewVerifier(config Config) (*Verifier, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(Verifier)
+	v.Config = config
+
+	v.worker, err = newWorker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Pushes the verification to the queue.
+// Later a Verify Worker will pop the verification and send the email.
+func (v *Verifier) PushVerification(userID string, email string) (code string, err error) {
+	return v.PushVerificationContext(context.Background(), userID, email)
+}
+
+func (v *Verifier) PushVerificationContext(ctx context.Context, userID string, email string) (code string, err error) {
+	verification := Verification{
+		UserID:    userID,
+		Email:     email,
+		SentCount: 0,
+	}
+
+	return v.Queue.PushContext(ctx, &verification)
+}
+
+// Called from the http handler when the verification code is received.
+// Gets the user id assigned to the code, removes the underlying Verification from the queue
+// and marks the user as verified.
+func (v *Verifier) Verify(code string) (userID string, err error) {
+	return v.VerifyContext(context.Background(), code)
+}
+
+func (v *Verifier) VerifyContext(ctx context.Context, code string) (userID string, err error) {
+	userID, err = v.verify(ctx, code)
+
+	var e *core.AuditEvent
+	if err != nil {
+		e = core.NewAuditEvent(nil, core.AuditVerificationFailed, "verifier", userID, err)
+	} else {
+		e = core.NewAuditEvent(nil, core.AuditEmailVerified, "verifier", userID, nil)
+	}
+	e.RequestID = logging.RequestID(ctx)
+	core.Audit(v.Auditor, e)
+	return
+}
+
+func (v *Verifier) verify(ctx context.Context, code string) (userID string, err error) {
+	if code == "" {
+		err = core.ErrorBadRequest
+		return
+	}
+
+	verification, err := v.Queue.TakeContext(ctx, code)
+	if err != nil {
+		return
+	}
+
+	// Expired verifications are removed by the Worker, but it runs periodically
+	if v.expired(verification, time.Now()) {
+		err = core.ErrorTokenExpired
+		return
+	}
+
+	userID = verification.UserID
+	err = v.Users.SetIsVerifiedWithIDContext(ctx, userID)
+	return
+}
+
+func (v *Verifier) expired(verification *Verification, now time.Time) bool {
+	if verification.CreationTime.IsZero() {
+		// Pushed before the codes expired, the Worker sweeps them neither
+		return false
+	}
+
+	return verification.CreationTime.Add(v.TTL).Before(now)
+}
+
+// Checks if another email can be sent now
+func (v *Verifier) checkResend(verification *Verification, now time.Time) error {
+	if verification.SentCount >= v.MaxSendCount {
+		return core.ErrorTooManyRequests
+	}
+
+	next := verification.LastSentTime.Add(v.ResendInterval)
+	if now.Before(next) {
+		return &core.ErrorRetryLater{RetryAfter: next.Sub(now)}
+	}
+
+	return nil
+}
+
+// Resend sends the verification email to the user again.
+// If the verification expired, it's replaced by a new one and the Worker sends its email.
+// Fails with core.ErrorBadRequest if the user is already verified.
+// Errors are meant to be displayed to the user, e.g.
+// "too many requests, try again in 5 minutes".
+func (v *Verifier) Resend(userID string) error {
+	return v.ResendContext(context.Background(), userID)
+}
+
+func (v *Verifier) ResendContext(ctx context.Context, userID string) error {
+	verification, err := v.Queue.GetWithUserIDContext(ctx, userID)
+	if err == core.ErrorBadRequest {
+		// Already verified or the expired verification was swept
+		return v.renew(ctx, userID, nil)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if v.expired(verification, now) {
+		return v.renew(ctx, userID, verification)
+	}
+
+	if verification.SentCount == 0 {
+		// Worker didn't send the first email yet
+		return nil
+	}
+
+	err = v.checkResend(verification, now)
+	if err != nil {
+		return err
+	}
+
+	// Concurrent requests could pass the check above, only one of them updates the counter
+	ok, err := v.Queue.MarkSentContext(ctx, verification.ID, verification.SentCount)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return &core.ErrorRetryLater{RetryAfter: v.ResendInterval}
+	}
+
+	return v.worker.send(verification)
+}
+
+// Replaces the expired verification, if there's any, with a new one
+func (v *Verifier) renew(ctx context.Context, userID string, expired *Verification) error {
+	email, isVerified, err := v.Users.GetEmailWithIDContext(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if isVerified {
+		return core.ErrorBadRequest
+	}
+
+	if expired != nil {
+		// Only one of the concurrent requests takes it and pushes the new verification
+		_, err = v.Queue.TakeContext(ctx, expired.ID)
+		if err == core.ErrorBadRequest {
+			return &core.ErrorRetryLater{RetryAfter: v.ResendInterval}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = v.PushVerificationContext(ctx, userID, email)
+	return err
+}
+
+// ResendWithUsername is Resend for users identified by the username, e.g. in the login form
+func (v *Verifier) ResendWithUsername(username string) error {
+	return v.ResendWithUsernameContext(context.Background(), username)
+}
+
+func (v *Verifier) ResendWithUsernameContext(ctx context.Context, username string) error {
+	userID, err := v.Users.GetIDWithUsernameContext(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	return v.ResendContext(ctx, userID)
+}
+
+func (v *Verifier) Count() (uint, error) {
+	return v.CountContext(context.Background())
+}
+
+func (v *Verifier) CountContext(ctx context.Context) (uint, error) {
+	return v.Queue.CountContext(ctx)
+}
+
+// Start the Verify Worker that sends the verification emails.
+// VW will block waiting for new Verifications.
+func (v *Verifier) Start() {
+	v.worker.Start()
+}
+
+// Stops the Verify Worker
+func (v *Verifier) Stop() {
+	v.worker.Stop()
+}
+
+// Runs the Verify Worker in the current goroutine, until Stop is called
+func (v *Verifier) Run() {
+	v.worker.Run()
+}
+
+// Ready fails with core.ErrorNotRunning if the Verify Worker doesn't send emails
+func (v *Verifier) Ready(ctx context.Context) error {
+	return v.worker.Ready(ctx)
+}
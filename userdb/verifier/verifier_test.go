@@ -0,0 +1,302 @@
+package verifier
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	TEST_USER_ID  = "testUserID"
+	TEST_USERNAME = "joe"
+	TEST_EMAIL    = "joe@example.com"
+	TEST_URL      = "https://example.com/verify"
+)
+
+type testUsers struct {
+	mtx      sync.Mutex
+	verified map[string]bool
+}
+
+func (u *testUsers) SetIsVerifiedWithIDContext(ctx context.Context, id string) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	if u.verified == nil {
+		u.verified = make(map[string]bool)
+	}
+	u.verified[id] = true
+	return nil
+}
+
+func (u *testUsers) GetIDWithUsernameContext(ctx context.Context, username string) (string, error) {
+	if username != TEST_USERNAME {
+		return "", core.ErrorNoSuchUser
+	}
+	return TEST_USER_ID, nil
+}
+
+func (u *testUsers) GetEmailWithIDContext(ctx context.Context, id string) (string, bool, error) {
+	if id != TEST_USER_ID {
+		return "", false, core.ErrorNoSuchUser
+	}
+	return TEST_EMAIL, u.isVerified(id), nil
+}
+
+func (u *testUsers) isVerified(id string) bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	return u.verified[id]
+}
+
+// Records the messages, fails if err is set
+type testMailer struct {
+	mtx      sync.Mutex
+	messages []*mail.Message
+	sent     chan *mail.Message
+	err      error
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{sent: make(chan *mail.Message, 10)}
+}
+
+func (m *testMailer) Send(message *mail.Message) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.messages = append(m.messages, message)
+	m.sent <- message
+	return nil
+}
+
+func (m *testMailer) count() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return len(m.messages)
+}
+
+func testConfig(t *testing.T) Config {
+	queue, err := NewMemoryQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Config{
+		Queue:  queue,
+		Users:  &testUsers{},
+		Mailer: newTestMailer(),
+		URL:    TEST_URL,
+	}
+}
+
+func TestNewVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	verifier, err := NewVerifier(testConfig(t))
+	assert.Nil(err)
+	assert.NotNil(verifier)
+
+	_, err = NewVerifier(Config{URL: TEST_URL})
+	assert.Equal(core.ErrorInvalidConfig, err)
+}
+
+func TestVerifierPush(t *testing.T) {
+	assert := assert.New(t)
+
+	verifier, err := NewVerifier(testConfig(t))
+	assert.Nil(err)
+	assert.NotNil(verifier)
+
+	id, err := verifier.PushVerification("userID", TEST_EMAIL)
+	assert.Nil(err)
+	assert.NotEqual(id, "")
+
+	count, err := verifier.Count()
+	assert.Nil(err)
+	assert.Equal(int(count), 1, "Should be equal")
+}
+
+type testAuditor []*core.AuditEvent
+
+func (a *testAuditor) Audit(e *core.AuditEvent) {
+	*a = append(*a, e)
+}
+
+func TestVerifierVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	auditor := &testAuditor{}
+	config := testConfig(t)
+	config.Auditor = auditor
+
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+	assert.NotNil(verifier)
+
+	code, err := verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+	assert.NotEqual(code, "")
+
+	count, err := verifier.Count()
+	assert.Nil(err)
+	assert.Equal(int(count), 1, "Should be equal")
+
+	userID, err := verifier.Verify(code)
+	assert.Nil(err)
+	assert.Equal(userID, TEST_USER_ID)
+
+	count, err = verifier.Count()
+	assert.Nil(err)
+	assert.Equal(int(count), 0, "Should be equal")
+
+	assert.True(verifier.Users.(*testUsers).isVerified(TEST_USER_ID))
+
+	// Code can be used only once
+	_, err = verifier.Verify(code)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	_, err = verifier.Verify("")
+	assert.Equal(core.ErrorBadRequest, err)
+
+	assert.Len(*auditor, 3)
+	assert.Equal(core.AuditEmailVerified, (*auditor)[0].Type)
+	assert.Equal(TEST_USER_ID, (*auditor)[0].User)
+	assert.Equal(core.AuditVerificationFailed, (*auditor)[1].Type)
+	assert.Equal(core.ErrorBadRequest.Error(), (*auditor)[1].Error)
+}
+
+func TestVerifierCheckResend(t *testing.T) {
+	assert := assert.New(t)
+
+	verifier, err := NewVerifier(testConfig(t))
+	assert.Nil(err)
+
+	now := time.Now()
+	v := Verification{SentCount: 1, LastSentTime: now.Add(-time.Minute)}
+
+	err = verifier.checkResend(&v, now)
+	assert.IsType(&core.ErrorRetryLater{}, err)
+	assert.Equal("too many requests, try again in 4 minutes", err.Error())
+
+	v.LastSentTime = now.Add(-defaultResendInterval)
+	assert.Nil(verifier.checkResend(&v, now))
+
+	v.SentCount = defaultMaxSendCount
+	assert.Equal(core.ErrorTooManyRequests, verifier.checkResend(&v, now))
+}
+
+func TestVerifierResend(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.ResendInterval = 100 * time.Millisecond
+	config.MaxSendCount = 2
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+	mailer := config.Mailer.(*testMailer)
+
+	// No verification, e.g. swept after it expired, a new one is pushed
+	err = verifier.Resend(TEST_USER_ID)
+	assert.Nil(err)
+
+	v, err := config.Queue.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Nil(err)
+	assert.Equal(TEST_EMAIL, v.Email)
+	code := v.ID
+
+	// Worker didn't send it yet
+	err = verifier.Resend(TEST_USER_ID)
+	assert.Nil(err)
+	assert.Equal(0, mailer.count())
+
+	// Sent for the first time
+	ok, err := config.Queue.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+	assert.True(ok)
+
+	// Too early
+	err = verifier.Resend(TEST_USER_ID)
+	assert.IsType(&core.ErrorRetryLater{}, err)
+
+	time.Sleep(100 * time.Millisecond)
+	err = verifier.ResendWithUsername(TEST_USERNAME)
+	assert.Nil(err)
+	assert.Equal(1, mailer.count())
+	assert.Contains(mailer.messages[0].Body, TEST_URL+"?code="+code)
+
+	// Limit reached
+	time.Sleep(100 * time.Millisecond)
+	err = verifier.Resend(TEST_USER_ID)
+	assert.Equal(core.ErrorTooManyRequests, err)
+
+	v, err = config.Queue.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Nil(err)
+	assert.Equal(2, v.SentCount)
+
+	err = verifier.ResendWithUsername("bob")
+	assert.Equal(core.ErrorNoSuchUser, err)
+
+	// Nothing to resend
+	_, err = verifier.Verify(code)
+	assert.Nil(err)
+
+	err = verifier.Resend(TEST_USER_ID)
+	assert.Equal(core.ErrorBadRequest, err)
+}
+
+func TestVerifierExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.TTL = 100 * time.Millisecond
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+
+	code, err := verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+
+	_, err = config.Queue.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = verifier.Verify(code)
+	assert.Equal(core.ErrorTokenExpired, err)
+	assert.False(verifier.Users.(*testUsers).isVerified(TEST_USER_ID))
+
+	// Replaced with a new verification, even though it was sent already
+	code, err = verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+
+	_, err = config.Queue.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	err = verifier.Resend(TEST_USER_ID)
+	assert.Nil(err)
+
+	_, err = verifier.Verify(code)
+	assert.Equal(core.ErrorBadRequest, err)
+
+	v, err := config.Queue.GetWithUserIDContext(context.Background(), TEST_USER_ID)
+	assert.Nil(err)
+	assert.NotEqual(code, v.ID)
+	assert.Equal(0, v.SentCount)
+
+	_, err = verifier.Verify(v.ID)
+	assert.Nil(err)
+	assert.True(verifier.Users.(*testUsers).isVerified(TEST_USER_ID))
+}
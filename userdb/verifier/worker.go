@@ -0,0 +1,246 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/janekolszak/idp/logging"
+	"github.com/janekolszak/idp/mail"
+)
+
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+var errPendingClosed = errors.New("pending verifications channel was closed")
+
+// Gets Verifications and sends emails.
+// Should be spawned only in one instance.
+type Worker struct {
+	Config
+	template  *template.Template
+	waitGroup sync.WaitGroup
+
+	// Guards stop, it's nil while the Worker isn't started
+	mutex sync.Mutex
+	stop  chan bool
+
+	// 1 while the goroutine sending emails works
+	running int32
+
+	// First delay after the queue fails, doubled up to maxRetryDelay
+	retryDelay time.Duration
+}
+
+func NewWorker(config Config) (*Worker, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWorker(config)
+}
+
+func newWorker(config Config) (*Worker, error) {
+	t, err := template.New("verification").Parse(config.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	w := new(Worker)
+	w.Config = config
+	w.template = t
+	w.retryDelay = minRetryDelay
+
+	return w, nil
+}
+
+// Start the Worker that sends the verification emails.
+// VW will block waiting for new Verifications. Starting a started Worker does nothing.
+func (w *Worker) Start() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stop != nil {
+		return
+	}
+
+	w.stop = make(chan bool)
+	w.waitGroup.Add(2)
+	atomic.StoreInt32(&w.running, 1)
+	go w.run(w.stop)
+	go w.sweep(w.stop)
+}
+
+// Stops the Worker goroutine. Stopping a Worker that isn't started does nothing.
+func (w *Worker) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stop == nil {
+		return
+	}
+
+	close(w.stop)
+	w.stop = nil
+	w.waitGroup.Wait()
+}
+
+// Runs the Worker in the current goroutine, until Stop is called
+func (w *Worker) Run() {
+	w.Start()
+	w.waitGroup.Wait()
+}
+
+// Ready fails with core.ErrorNotRunning if emails aren't being sent,
+// e.g. the Worker wasn't started or the queue failed. For the readiness probe.
+func (w *Worker) Ready(ctx context.Context) error {
+	if atomic.LoadInt32(&w.running) == 0 {
+		return core.ErrorNotRunning
+	}
+	return nil
+}
+
+func (w *Worker) run(stop chan bool) {
+	defer w.waitGroup.Done()
+	defer atomic.StoreInt32(&w.running, 0)
+
+	delay := w.retryDelay
+	for {
+		// Verifications that weren't sent yet, including those pushed while the worker was stopped
+		pending, err := w.Queue.Pending(stop)
+		if err == nil {
+			atomic.StoreInt32(&w.running, 1)
+			delay = w.retryDelay
+			w.deliver(pending)
+			err = errPendingClosed
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		// The queue failed or the feed was closed, e.g. the database restarted.
+		// Not ready until the queue works again.
+		atomic.StoreInt32(&w.running, 0)
+		logging.Error(context.Background(), w.Logger, "getting pending verifications failed", logging.Fields{
+			"error":       err,
+			"retry_after": delay.String(),
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// Sends emails of the pending verifications until the channel is closed
+func (w *Worker) deliver(pending <-chan *Verification) {
+	for v := range pending {
+		// Not marked as sent on failure, the queue decides when it's retried
+		err := w.process(v)
+		if err != nil {
+			// The ID is the code from the link
+			logging.Warn(context.Background(), w.Logger, "sending the verification email failed", logging.Fields{
+				"user_id": v.UserID,
+				"error":   err,
+			})
+		}
+	}
+}
+
+func (w *Worker) sweep(stop chan bool) {
+	defer w.waitGroup.Done()
+
+	ticker := time.NewTicker(w.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Failure isn't fatal, it's retried in the next tick
+			err := w.Sweep()
+			if err != nil {
+				logging.Warn(context.Background(), w.Logger, "removing expired verifications failed", logging.Fields{"error": err})
+			}
+
+		case <-stop:
+			// Stopping
+			return
+		}
+	}
+}
+
+// Sweep removes verifications that expired
+func (w *Worker) Sweep() error {
+	return w.SweepContext(context.Background())
+}
+
+func (w *Worker) SweepContext(ctx context.Context) error {
+	return w.Queue.DeleteExpiredContext(ctx, time.Now().Add(-w.TTL))
+}
+
+// Sends the email and marks the verification as sent
+func (w *Worker) process(v *Verification) error {
+	err := w.send(v)
+	if err != nil {
+		return err
+	}
+
+	// Not tied to any request
+	_, err = w.Queue.MarkSentContext(context.Background(), v.ID, 0)
+	return err
+}
+
+func (w *Worker) link(code string) (string, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("code", code)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (w *Worker) send(v *Verification) error {
+	link, err := w.link(v.ID)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	err = w.template.Execute(&body, map[string]interface{}{
+		"Email": v.Email,
+		"Code":  v.ID,
+		"URL":   link,
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Mailer.Send(&mail.Message{
+		To:      v.Email,
+		Subject: w.Subject,
+		Body:    body.String(),
+	})
+}
@@ -0,0 +1,209 @@
+package verifier
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janekolszak/idp/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewWorker(t *testing.T) {
+	assert := assert.New(t)
+
+	w, err := NewWorker(testConfig(t))
+	assert.Nil(err)
+	assert.NotNil(w)
+}
+
+func TestWorkerSimple(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+	assert.NotNil(verifier)
+
+	w, err := NewWorker(config)
+	assert.Nil(err)
+	assert.NotNil(w)
+
+	assert.Equal(core.ErrorNotRunning, w.Ready(context.Background()))
+
+	w.Start()
+	assert.Nil(w.Ready(context.Background()))
+	verifier.PushVerification("userID", "email")
+	w.Stop()
+
+	assert.Equal(core.ErrorNotRunning, w.Ready(context.Background()))
+}
+
+func TestWorkerStop(t *testing.T) {
+	assert := assert.New(t)
+
+	w, err := NewWorker(testConfig(t))
+	assert.Nil(err)
+
+	// Not started
+	assert.NotPanics(w.Stop)
+
+	w.Start()
+	w.Start()
+	assert.Nil(w.Ready(context.Background()))
+
+	assert.NotPanics(w.Stop)
+	assert.NotPanics(w.Stop)
+	assert.Equal(core.ErrorNotRunning, w.Ready(context.Background()))
+
+	// Can be started again
+	w.Start()
+	assert.Nil(w.Ready(context.Background()))
+	w.Stop()
+}
+
+func TestWorkerSend(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+	mailer := config.Mailer.(*testMailer)
+
+	// Pushed before start, sent anyway
+	code, err := verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+
+	verifier.Start()
+	defer verifier.Stop()
+
+	select {
+	case message := <-mailer.sent:
+		assert.Equal(TEST_EMAIL, message.To)
+		assert.Equal(defaultSubject, message.Subject)
+		assert.Contains(message.Body, TEST_URL+"?code="+code)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Email not sent")
+	}
+
+	// Pushed after start
+	code, err = verifier.PushVerification("otherUserID", "bob@example.com")
+	assert.Nil(err)
+
+	select {
+	case message := <-mailer.sent:
+		assert.Equal("bob@example.com", message.To)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Email not sent")
+	}
+
+	// Marked as sent
+	v, err := config.Queue.GetWithUserIDContext(context.Background(), "otherUserID")
+	assert.Nil(err)
+	for i := 0; i < 50 && v.SentCount == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		v, err = config.Queue.GetWithUserIDContext(context.Background(), "otherUserID")
+		assert.Nil(err)
+	}
+	assert.Equal(1, v.SentCount)
+	assert.False(v.LastSentTime.IsZero())
+}
+
+func TestWorkerRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.Queue.(*MemoryQueue).RetryInterval = 50 * time.Millisecond
+	verifier, err := NewVerifier(config)
+	assert.Nil(err)
+	mailer := config.Mailer.(*testMailer)
+	mailer.err = errors.New("mail server down")
+
+	_, err = verifier.PushVerification(TEST_USER_ID, TEST_EMAIL)
+	assert.Nil(err)
+
+	verifier.Start()
+	defer verifier.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	mailer.mtx.Lock()
+	mailer.err = nil
+	mailer.mtx.Unlock()
+
+	select {
+	case message := <-mailer.sent:
+		assert.Equal(TEST_EMAIL, message.To)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Email not retried")
+	}
+}
+
+func TestWorkerSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.TTL = 50 * time.Millisecond
+	config.SweepInterval = 10 * time.Millisecond
+	w, err := NewWorker(config)
+	assert.Nil(err)
+
+	code, err := config.Queue.PushContext(context.Background(), &Verification{UserID: TEST_USER_ID, Email: TEST_EMAIL})
+	assert.Nil(err)
+	_, err = config.Queue.MarkSentContext(context.Background(), code, 0)
+	assert.Nil(err)
+
+	w.Start()
+	defer w.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	count, err := config.Queue.CountContext(context.Background())
+	assert.Nil(err)
+	assert.Equal(0, int(count))
+}
+
+// Pending fails the given number of times
+type failingQueue struct {
+	Queue
+	failures int32
+}
+
+func (q *failingQueue) Pending(stop <-chan bool) (<-chan *Verification, error) {
+	if atomic.AddInt32(&q.failures, -1) >= 0 {
+		return nil, errors.New("queue failed")
+	}
+	return q.Queue.Pending(stop)
+}
+
+func TestWorkerRetryPending(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testConfig(t)
+	config.Queue = &failingQueue{Queue: config.Queue, failures: 2}
+	mailer := config.Mailer.(*testMailer)
+
+	w, err := NewWorker(config)
+	assert.Nil(err)
+	w.retryDelay = 50 * time.Millisecond
+
+	_, err = config.Queue.PushContext(context.Background(), &Verification{UserID: TEST_USER_ID, Email: TEST_EMAIL})
+	assert.Nil(err)
+
+	w.Start()
+	defer w.Stop()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(core.ErrorNotRunning, w.Ready(context.Background()))
+
+	// Retried after 50ms and 100ms
+	select {
+	case message := <-mailer.sent:
+		assert.Equal(TEST_EMAIL, message.To)
+	case <-time.After(time.Second):
+		assert.Fail("Pending not retried")
+	}
+
+	assert.Nil(w.Ready(context.Background()))
+}